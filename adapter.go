@@ -0,0 +1,548 @@
+package formula
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Decompress returns a reader that yields the decompressed contents
+// of r if r holds gzip or zstd compressed data, and the contents of r
+// unchanged otherwise.  The compression format is detected from the
+// leading bytes of the stream.
+func Decompress(r io.Reader) (io.ReadCloser, error) {
+
+	br := bufio.NewReader(r)
+	head, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(head, zstdMagic):
+		dec, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	default:
+		return ioutil.NopCloser(br), nil
+	}
+}
+
+// CSVOptions controls how CSV files are read.
+type CSVOptions struct {
+
+	// Comma is the field delimiter, defaults to ','.
+	Comma rune
+
+	// Workers is the number of goroutines that parse the records.
+	// If it is greater than one, the data are read into memory and
+	// split into byte ranges at record boundaries, which are
+	// parsed in parallel.  Otherwise the records are parsed
+	// sequentially as they are read.
+	Workers int
+
+	// Precision determines how a column of numbers is handled if
+	// some of its values have more significant digits than a
+	// float64 can hold, e.g. long identifiers.
+	Precision PrecisionPolicy
+}
+
+// PrecisionPolicy determines how a column of a text dataset is handled
+// if it holds numbers that can not be represented exactly as float64
+// values.  A value such as 0.1 is exact in this sense, since it is
+// the shortest decimal that converts to its float64 value.
+type PrecisionPolicy int
+
+const (
+	// PrecisionError returns an error naming the column and the
+	// row of the first value that can not be represented exactly.
+	// This is the default, so that the type of a column is never
+	// changed silently.
+	PrecisionError PrecisionPolicy = iota
+
+	// PrecisionText returns the column as []string, so that the
+	// values, e.g. identifiers, are not changed.
+	PrecisionText
+
+	// PrecisionLossy returns the column as []float64, rounding the
+	// values to the nearest float64.
+	PrecisionLossy
+)
+
+// ReadCSV reads CSV data with a header row from r, which may be gzip
+// or zstd compressed.  A column whose values can all be parsed as
+// numbers is returned as []float64, with empty fields becoming NaN,
+// any other column is returned as []string.  Columns holding numbers
+// that a float64 can not represent exactly are handled according to
+// opts.Precision.  opts may be nil.
+func ReadCSV(r io.Reader, opts *CSVOptions) (DataSource, error) {
+	tab := newRawTable(opts)
+	if err := tab.readCSV(r, opts); err != nil {
+		return nil, err
+	}
+	return tab.source()
+}
+
+// OpenCSV reads and concatenates the rows of all CSV files matching
+// the glob pattern, in lexical order of the file names.  Each file
+// may be compressed and must have the same header.
+func OpenCSV(pattern string, opts *CSVOptions) (DataSource, error) {
+	tab := newRawTable(opts)
+	err := eachFile(pattern, func(r io.Reader) error {
+		return tab.readCSV(r, opts)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tab.source()
+}
+
+// ReadJSONL reads newline-delimited JSON from r, which may be gzip or
+// zstd compressed.  Each line must hold an object mapping variable
+// names to numbers, strings or nulls.  The variables are ordered by
+// first appearance.  A variable that is absent or null in a record is
+// missing, which is NaN for numeric variables and "" for string
+// variables.  Variables holding numbers that a float64 can not
+// represent exactly are returned as strings, as with PrecisionText.
+func ReadJSONL(r io.Reader) (DataSource, error) {
+	tab := &rawTable{precision: PrecisionText}
+	if err := tab.readJSONL(r); err != nil {
+		return nil, err
+	}
+	return tab.source()
+}
+
+// OpenJSONL reads and concatenates the records of all JSONL files
+// matching the glob pattern, in lexical order of the file names.
+// Each file may be compressed.  The data are handled as described
+// for ReadJSONL.
+func OpenJSONL(pattern string) (DataSource, error) {
+	tab := &rawTable{precision: PrecisionText}
+	if err := eachFile(pattern, tab.readJSONL); err != nil {
+		return nil, err
+	}
+	return tab.source()
+}
+
+// eachFile calls f with the contents of each file matching pattern.
+func eachFile(pattern string, f func(io.Reader) error) error {
+
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no files match '%s'", pattern)
+	}
+	sort.Strings(files)
+
+	for _, fn := range files {
+		fid, err := os.Open(fn)
+		if err != nil {
+			return err
+		}
+		err = f(fid)
+		fid.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", fn, err)
+		}
+	}
+
+	return nil
+}
+
+// rawTable accumulates the values of a text dataset before the
+// column types are determined.
+type rawTable struct {
+	names []string
+	colix map[string]int
+
+	// The values of each column, as text
+	cols [][]string
+
+	// Indicates which values were given as quoted strings in
+	// JSON input, which forces the column to be textual
+	quoted [][]bool
+
+	nrow int
+
+	// How numbers that can not be represented exactly are handled
+	precision PrecisionPolicy
+}
+
+// newRawTable returns an empty table for reading CSV data using the
+// given options, which may be nil.
+func newRawTable(opts *CSVOptions) *rawTable {
+	tab := new(rawTable)
+	if opts != nil {
+		tab.precision = opts.Precision
+	}
+	return tab
+}
+
+// column returns the position of the named column, creating it if
+// it does not yet exist.
+func (tab *rawTable) column(na string) int {
+
+	if tab.colix == nil {
+		tab.colix = make(map[string]int)
+	}
+
+	j, ok := tab.colix[na]
+	if !ok {
+		j = len(tab.names)
+		tab.colix[na] = j
+		tab.names = append(tab.names, na)
+		tab.cols = append(tab.cols, make([]string, tab.nrow))
+		tab.quoted = append(tab.quoted, make([]bool, tab.nrow))
+	}
+
+	return j
+}
+
+func (tab *rawTable) readCSV(r io.Reader, opts *CSVOptions) error {
+
+	rdr, err := Decompress(r)
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+
+	if opts != nil && opts.Workers > 1 {
+		return tab.readCSVParallel(rdr, opts)
+	}
+
+	crdr := newCSVReader(rdr, opts)
+	head, err := crdr.Read()
+	if err != nil {
+		return err
+	}
+	if err := tab.setHeader(head); err != nil {
+		return err
+	}
+
+	for {
+		rec, err := crdr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		for j, v := range rec {
+			tab.cols[j] = append(tab.cols[j], v)
+			tab.quoted[j] = append(tab.quoted[j], false)
+		}
+		tab.nrow++
+	}
+
+	return nil
+}
+
+// newCSVReader returns a CSV reader for r configured by opts, which
+// may be nil.
+func newCSVReader(r io.Reader, opts *CSVOptions) *csv.Reader {
+	crdr := csv.NewReader(r)
+	if opts != nil && opts.Comma != 0 {
+		crdr.Comma = opts.Comma
+	}
+	return crdr
+}
+
+// setHeader creates the columns named in the header of a CSV file,
+// or checks that the header matches the columns of a previous file.
+func (tab *rawTable) setHeader(head []string) error {
+
+	if tab.names != nil {
+		if len(head) != len(tab.names) {
+			return fmt.Errorf("header has %d columns, expected %d", len(head), len(tab.names))
+		}
+		for j, na := range head {
+			if na != tab.names[j] {
+				return fmt.Errorf("header column %d is '%s', expected '%s'", j, na, tab.names[j])
+			}
+		}
+	} else {
+		for _, na := range head {
+			tab.column(na)
+		}
+	}
+
+	return nil
+}
+
+// readCSVParallel reads all the data from r, and parses the records
+// in byte ranges by opts.Workers goroutines.
+func (tab *rawTable) readCSVParallel(r io.Reader, opts *CSVOptions) error {
+
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	// The header is the first record
+	bounds, lines := recordBounds(buf, opts.Workers)
+	crdr := newCSVReader(bytes.NewReader(buf[0:bounds[0]]), opts)
+	head, err := crdr.Read()
+	if err != nil {
+		return err
+	}
+	if err := tab.setHeader(head); err != nil {
+		return err
+	}
+
+	// Each worker parses the records in one byte range into
+	// columns
+	type part struct {
+		cols [][]string
+		err  error
+	}
+	parts := make([]part, len(bounds)-1)
+	var wg sync.WaitGroup
+	for k := range parts {
+		wg.Add(1)
+		go func(k int) {
+			defer wg.Done()
+			crdr := newCSVReader(bytes.NewReader(buf[bounds[k]:bounds[k+1]]), opts)
+			crdr.FieldsPerRecord = len(head)
+			cols := make([][]string, len(head))
+			for {
+				rec, err := crdr.Read()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					// Report the line in the file
+					if pe, ok := err.(*csv.ParseError); ok {
+						pe.StartLine += lines[k]
+						pe.Line += lines[k]
+					}
+					parts[k].err = err
+					return
+				}
+				for j, v := range rec {
+					cols[j] = append(cols[j], v)
+				}
+			}
+			parts[k].cols = cols
+		}(k)
+	}
+	wg.Wait()
+
+	for _, p := range parts {
+		if p.err != nil {
+			return p.err
+		}
+	}
+	for _, p := range parts {
+		for j, col := range p.cols {
+			tab.cols[j] = append(tab.cols[j], col...)
+			tab.quoted[j] = append(tab.quoted[j], make([]bool, len(col))...)
+		}
+		if len(p.cols) > 0 {
+			tab.nrow += len(p.cols[0])
+		}
+	}
+
+	return nil
+}
+
+// recordBounds splits CSV data into about n byte ranges of similar
+// size that start at record boundaries, following the header record.
+// The ranges are from bounds[k] to bounds[k+1], and bounds[0] is the
+// end of the header.  lines[k] is the number of lines before range
+// k.  A newline is a record boundary unless it is in a quoted field,
+// and the fields are quoted if the number of quotes before them is
+// odd, since an escaped quote is written as two quotes.
+func recordBounds(buf []byte, n int) ([]int, []int) {
+
+	var bounds, lines []int
+	target := 0
+	inQuote := false
+	nl := 0
+	for i, c := range buf {
+		switch c {
+		case '"':
+			inQuote = !inQuote
+		case '\n':
+			nl++
+			if inQuote || i+1 < target {
+				continue
+			}
+			bounds = append(bounds, i+1)
+			lines = append(lines, nl)
+			if len(bounds) == 1 {
+				// The end of the header
+				target = i + 1 + (len(buf)-i-1)/n
+			} else {
+				target = bounds[len(bounds)-1] + (len(buf)-bounds[0])/n
+			}
+		}
+	}
+	if len(bounds) == 0 || bounds[len(bounds)-1] < len(buf) {
+		bounds = append(bounds, len(buf))
+		lines = append(lines, nl)
+	}
+
+	return bounds, lines
+}
+
+func (tab *rawTable) readJSONL(r io.Reader) error {
+
+	rdr, err := Decompress(r)
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+
+	dec := json.NewDecoder(rdr)
+	dec.UseNumber()
+	for {
+		var rec map[string]interface{}
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		// Visit the keys in sorted order, so that new
+		// variables in a record are added in a well-defined
+		// order.
+		keys := make([]string, 0, len(rec))
+		for k := range rec {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			tab.column(k)
+		}
+
+		for j, na := range tab.names {
+			switch v := rec[na].(type) {
+			case nil:
+				tab.cols[j] = append(tab.cols[j], "")
+				tab.quoted[j] = append(tab.quoted[j], false)
+			case json.Number:
+				tab.cols[j] = append(tab.cols[j], v.String())
+				tab.quoted[j] = append(tab.quoted[j], false)
+			case string:
+				tab.cols[j] = append(tab.cols[j], v)
+				tab.quoted[j] = append(tab.quoted[j], true)
+			default:
+				return fmt.Errorf("variable '%s' in record %d has unsupported type %T", na, tab.nrow+1, v)
+			}
+		}
+		tab.nrow++
+	}
+
+	return nil
+}
+
+// source determines the type of each column and returns the table
+// as a DataSource.
+func (tab *rawTable) source() (DataSource, error) {
+
+	data := make([]interface{}, len(tab.names))
+	for j, col := range tab.cols {
+		x, inexact, ok := tab.numeric(j)
+		switch {
+		case !ok:
+			data[j] = col
+		case inexact == -1 || tab.precision == PrecisionLossy:
+			data[j] = x
+		case tab.precision == PrecisionError:
+			return nil, fmt.Errorf("value '%s' in row %d of column '%s' can not be represented exactly as a number",
+				col[inexact], inexact+1, tab.names[j])
+		default:
+			data[j] = col
+		}
+	}
+
+	src, err := NewSource(data, tab.names)
+	if err != nil {
+		return nil, err
+	}
+
+	return src, nil
+}
+
+// numeric attempts to convert column j to numbers, returning false if
+// this is not possible.  The position of the first value that can not
+// be represented exactly is also returned, or -1 if all values are
+// exact.
+func (tab *rawTable) numeric(j int) ([]float64, int, bool) {
+
+	for _, q := range tab.quoted[j] {
+		if q {
+			return nil, -1, false
+		}
+	}
+
+	col := tab.cols[j]
+	x := make([]float64, len(col))
+	inexact := -1
+	for i, s := range col {
+		if s == "" {
+			x[i] = math.NaN()
+			continue
+		}
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, -1, false
+		}
+		x[i] = v
+		if inexact == -1 && !isExact(s, v) {
+			inexact = i
+		}
+	}
+
+	return x, inexact, true
+}
+
+// isExact returns true if the decimal number s is the float64 value
+// v, i.e. s has the same significant digits as the shortest decimal
+// representation of v.  Infinities, NaN and hexadecimal numbers are
+// exact.
+func isExact(s string, v float64) bool {
+	if math.IsInf(v, 0) || math.IsNaN(v) || strings.ContainsAny(s, "xX") {
+		return true
+	}
+	return sigDigits(s) == sigDigits(strconv.FormatFloat(v, 'e', -1, 64))
+}
+
+// sigDigits returns the significant digits of a decimal number,
+// without leading and trailing zeros.
+func sigDigits(s string) string {
+	if k := strings.IndexAny(s, "eE"); k != -1 {
+		s = s[0:k]
+	}
+	var b strings.Builder
+	for _, c := range s {
+		if c >= '0' && c <= '9' {
+			b.WriteRune(c)
+		}
+	}
+	return strings.Trim(b.String(), "0")
+}
@@ -0,0 +1,229 @@
+package formula
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"gonum.org/v1/gonum/floats"
+)
+
+func gzipBytes(s string) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(s))
+	w.Close()
+	return buf.Bytes()
+}
+
+func zstdBytes(s string) []byte {
+	var buf bytes.Buffer
+	w, _ := zstd.NewWriter(&buf)
+	w.Write([]byte(s))
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestReadCSV(t *testing.T) {
+
+	txt := "x1,x2,x3\n1,a,2\n2,b,\n3,c,4\n"
+
+	for _, b := range [][]byte{[]byte(txt), gzipBytes(txt), zstdBytes(txt)} {
+		src, err := ReadCSV(bytes.NewReader(b), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(src.Names(), []string{"x1", "x2", "x3"}) {
+			t.Fail()
+		}
+		if !reflect.DeepEqual(src.Get("x1"), []float64{1, 2, 3}) {
+			t.Fail()
+		}
+		if !reflect.DeepEqual(src.Get("x2"), []string{"a", "b", "c"}) {
+			t.Fail()
+		}
+		x3 := src.Get("x3").([]float64)
+		if x3[0] != 2 || !math.IsNaN(x3[1]) || x3[2] != 4 {
+			t.Fail()
+		}
+	}
+}
+
+func TestReadCSVParallel(t *testing.T) {
+
+	// Quoted fields with newlines, commas and quotes, and a
+	// header in quotes
+	var buf strings.Builder
+	buf.WriteString("x1,\"x\n2\"\r\n")
+	for i := 0; i < 100; i++ {
+		switch i % 4 {
+		case 0:
+			fmt.Fprintf(&buf, "%d,\"a\nb\"\n", i)
+		case 1:
+			fmt.Fprintf(&buf, "%d,\"c,\"\"d\"\"\"\r\n", i)
+		case 2:
+			fmt.Fprintf(&buf, ",\"\"\"\n\n\"\n")
+		default:
+			fmt.Fprintf(&buf, "%d,e\n", i)
+		}
+	}
+	txt := buf.String()
+
+	exp, err := ReadCSV(strings.NewReader(txt), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, workers := range []int{2, 3, 7, 500} {
+		src, err := ReadCSV(strings.NewReader(txt), &CSVOptions{Workers: workers})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(src.Names(), exp.Names()) || !reflect.DeepEqual(src.Get("x\n2"), exp.Get("x\n2")) {
+			t.Errorf("%d workers: unexpected data", workers)
+		}
+		x1, ex1 := src.Get("x1").([]float64), exp.Get("x1").([]float64)
+		if len(x1) != 100 || !floats.Same(x1, ex1) {
+			t.Errorf("%d workers: unexpected data", workers)
+		}
+	}
+
+	// The line of an error is reported in the file
+	txt = "x1,x2\n1,2\n3,4\n5\n6,7\n"
+	_, err = ReadCSV(strings.NewReader(txt), &CSVOptions{Workers: 3})
+	if pe, ok := err.(*csv.ParseError); !ok || pe.Line != 4 {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestReadCSVPrecision(t *testing.T) {
+
+	txt := "id,x\n12345678901234567890,0.1\n7,-2.50e-3\n"
+
+	// By default a value that is not exact is an error
+	_, err := ReadCSV(strings.NewReader(txt), nil)
+	if err == nil || !strings.Contains(err.Error(), "row 1 of column 'id'") {
+		t.Errorf("Unexpected error %v", err)
+	}
+	_, err = ReadCSV(strings.NewReader("x\n0.5\n0.10000000000000001\n"), nil)
+	if err == nil || !strings.Contains(err.Error(), "row 2 of column 'x'") {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	src, err := ReadCSV(strings.NewReader(txt), &CSVOptions{Precision: PrecisionText})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, ok := src.Get("id").([]string); !ok || id[0] != "12345678901234567890" {
+		t.Errorf("Unexpected id: %v", src.Get("id"))
+	}
+	if x, ok := src.Get("x").([]float64); !ok || !floats.Same(x, []float64{0.1, -0.0025}) {
+		t.Errorf("Unexpected x: %v", src.Get("x"))
+	}
+
+	src, err = ReadCSV(strings.NewReader(txt), &CSVOptions{Precision: PrecisionLossy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, ok := src.Get("id").([]float64); !ok || id[1] != 7 {
+		t.Errorf("Unexpected id: %v", src.Get("id"))
+	}
+
+	_, err = ReadCSV(strings.NewReader(txt), &CSVOptions{Precision: PrecisionError})
+	if err == nil || !strings.Contains(err.Error(), "column 'id'") {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestReadJSONL(t *testing.T) {
+
+	txt := `{"x1": 1, "x2": "a"}
+{"x2": "b", "x1": null}
+{"x1": 3, "x3": "7"}
+`
+	src, err := ReadJSONL(strings.NewReader(txt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(src.Names(), []string{"x1", "x2", "x3"}) {
+		t.Fail()
+	}
+	x1 := src.Get("x1").([]float64)
+	if x1[0] != 1 || !math.IsNaN(x1[1]) || x1[2] != 3 {
+		t.Fail()
+	}
+	if !reflect.DeepEqual(src.Get("x2"), []string{"a", "b", ""}) {
+		t.Fail()
+	}
+	if !reflect.DeepEqual(src.Get("x3"), []string{"", "", "7"}) {
+		t.Fail()
+	}
+
+	// Ids that a float64 can not represent exactly are strings
+	txt = `{"id": 12345678901234567890, "x": 1.5}
+{"id": 2, "x": 2}
+`
+	src, err = ReadJSONL(strings.NewReader(txt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(src.Get("id"), []string{"12345678901234567890", "2"}) {
+		t.Errorf("Unexpected id %v", src.Get("id"))
+	}
+	if !reflect.DeepEqual(src.Get("x"), []float64{1.5, 2}) {
+		t.Errorf("Unexpected x %v", src.Get("x"))
+	}
+}
+
+func TestOpenGlob(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "formula")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string][]byte{
+		"part1.csv.gz":   gzipBytes("x,y\n1,a\n2,b\n"),
+		"part2.csv.zst":  zstdBytes("x,y\n3,c\n"),
+		"part3.csv":      []byte("x,y\n4,d\n"),
+		"part1.jsonl.gz": gzipBytes(`{"x": 1}` + "\n"),
+		"part2.jsonl":    []byte(`{"x": 2}` + "\n"),
+	}
+	for fn, b := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, fn), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	src, err := OpenCSV(filepath.Join(dir, "*.csv*"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(src.Get("x"), []float64{1, 2, 3, 4}) {
+		t.Fail()
+	}
+	if !reflect.DeepEqual(src.Get("y"), []string{"a", "b", "c", "d"}) {
+		t.Fail()
+	}
+
+	src, err = OpenJSONL(filepath.Join(dir, "*.jsonl*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(src.Get("x"), []float64{1, 2}) {
+		t.Fail()
+	}
+
+	if _, err := OpenCSV(filepath.Join(dir, "*.txt"), nil); err == nil {
+		t.Fail()
+	}
+}
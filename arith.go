@@ -0,0 +1,213 @@
+package formula
+
+import (
+	"strings"
+)
+
+// Precedence of the arithmetic operators inside I(); lower number is
+// higher precedence.
+var arithPrecedence = map[tokType]int{times: 0, nest: 0, plus: 1, minus: 1}
+
+// lexArith replaces each I(...) construct in the token sequence with a
+// single arith token holding the parsed arithmetic expression.  Inside
+// I(), the operators +, -, * and / denote elementwise arithmetic on
+// numeric variables and constants rather than formula operations,
+// e.g. I(x1/100) or I(2*x1 + 1).
+func lexArith(input []*token) ([]*token, error) {
+
+	var output []*token
+	for i := 0; i < len(input); i++ {
+		tok := input[i]
+		if !(tok.symbol == vname && tok.name == "I" && i+1 < len(input) && input[i+1].symbol == leftp) {
+			output = append(output, tok)
+			continue
+		}
+
+		// Find the matching right parenthesis
+		depth := 0
+		j := i + 1
+		for ; j < len(input); j++ {
+			switch input[j].symbol {
+			case leftp:
+				depth++
+			case rightp:
+				depth--
+			}
+			if depth == 0 {
+				break
+			}
+		}
+		if j == len(input) {
+			return nil, syntaxError("", tok.pos, "unbalanced parentheses in I()")
+		}
+
+		inner := input[i+2 : j]
+		if len(inner) == 0 {
+			return nil, syntaxError("", tok.pos, "empty I() expression")
+		}
+		expr, err := parseArith(inner)
+		if err != nil {
+			return nil, err
+		}
+
+		name := "I(" + renderArith(inner) + ")"
+		output = append(output, &token{symbol: arith, name: name, expr: expr, pos: tok.pos})
+		i = j
+	}
+
+	return output, nil
+}
+
+// renderArith returns the text of an arithmetic expression.
+func renderArith(tokens []*token) string {
+
+	var parts []string
+	for _, tok := range tokens {
+		switch tok.symbol {
+		case vname, number:
+			parts = append(parts, argText(tok))
+		case icept:
+			parts = append(parts, "1")
+		case noicept:
+			parts = append(parts, "0")
+		case leftp:
+			parts = append(parts, "(")
+		case rightp:
+			parts = append(parts, ")")
+		case plus:
+			parts = append(parts, "+")
+		case minus:
+			parts = append(parts, "-")
+		case times:
+			parts = append(parts, "*")
+		case nest:
+			parts = append(parts, "/")
+		}
+	}
+
+	return strings.Join(parts, "")
+}
+
+// parseArith converts a non-empty arithmetic expression to RPN.
+func parseArith(input []*token) ([]*token, error) {
+
+	var stack, output []*token
+	var last *token
+	expectOperand := true
+
+	for _, tok := range input {
+
+		// In I(), 1 and 0 are numbers
+		switch tok.symbol {
+		case icept:
+			tok = &token{symbol: number, name: "1", value: 1, pos: tok.pos}
+		case noicept:
+			tok = &token{symbol: number, name: "0", value: 0, pos: tok.pos}
+		}
+
+		switch tok.symbol {
+		case vname, number:
+			if !expectOperand {
+				return nil, syntaxError("", tok.pos, "missing operator before '%s' in I()", tok.name)
+			}
+			output = append(output, tok)
+			expectOperand = false
+		case plus, minus, times, nest:
+			if expectOperand {
+				return nil, syntaxError("", tok.pos, "unexpected '%s' in I()", tokText(tok))
+			}
+			for {
+				last = peek(stack)
+				if last == nil || last.symbol == leftp {
+					break
+				}
+				if arithPrecedence[tok.symbol] >= arithPrecedence[last.symbol] {
+					stack, last = pop(stack)
+					output = append(output, last)
+				} else {
+					break
+				}
+			}
+			stack = push(stack, tok)
+			expectOperand = true
+		case leftp:
+			stack = push(stack, tok)
+		case rightp:
+			for {
+				stack, last = pop(stack)
+				if last == nil {
+					return nil, syntaxError("", tok.pos, "unbalanced parentheses in I()")
+				}
+				if last.symbol == leftp {
+					break
+				}
+				output = append(output, last)
+			}
+		default:
+			return nil, syntaxError("", tok.pos, "unexpected '%s' in I(), only numeric variables, numbers and +, -, *, / are allowed", tokText(tok))
+		}
+	}
+
+	if expectOperand {
+		tok := input[len(input)-1]
+		return nil, syntaxError("", tok.pos, "missing operand after '%s' in I()", tokText(tok))
+	}
+
+	for {
+		stack, last = pop(stack)
+		if last == nil {
+			break
+		}
+		if last.symbol == leftp {
+			return nil, syntaxError("", last.pos, "unbalanced parentheses in I()")
+		}
+		output = append(output, last)
+	}
+
+	return output, nil
+}
+
+// evalArith evaluates an arithmetic expression in RPN form, returning
+// the resulting column.
+func (fp *Parser) evalArith(expr []*token) ([]float64, error) {
+
+	var stack [][]float64
+	for _, tok := range expr {
+		switch tok.symbol {
+		case vname:
+			x, err := fp.numeric(tok.name)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, x)
+			continue
+		case number:
+			x := make([]float64, numRows(fp.RawData))
+			for i := range x {
+				x[i] = tok.value
+			}
+			stack = append(stack, x)
+			continue
+		}
+
+		n := len(stack)
+		a, b := stack[n-2], stack[n-1]
+		stack = stack[0 : n-2]
+		y := make([]float64, len(a))
+		for i := range y {
+			switch tok.symbol {
+			case plus:
+				y[i] = a[i] + b[i]
+			case minus:
+				y[i] = a[i] - b[i]
+			case times:
+				y[i] = a[i] * b[i]
+			case nest:
+				y[i] = a[i] / b[i]
+			}
+		}
+		stack = append(stack, y)
+	}
+
+	return stack[0], nil
+}
@@ -0,0 +1,345 @@
+package formula
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// NodeKind identifies the kind of a node in the syntax tree of a
+// formula.
+type NodeKind int
+
+const (
+	// VarNode is a variable; Name is the variable name.
+	VarNode NodeKind = iota
+
+	// InterceptNode is the intercept, written 1.
+	InterceptNode
+
+	// NoInterceptNode suppresses the intercept, written 0.
+	NoInterceptNode
+
+	// DotNode stands for all the variables, written ".".
+	DotNode
+
+	// NumberNode is a numeric literal; Name is its text and Value
+	// its value.
+	NumberNode
+
+	// StringNode is a quoted string literal; Name is its value.
+	StringNode
+
+	// CallNode is a function call; Name is the function name and
+	// Args are the arguments.
+	CallNode
+
+	// ArithNode is an I() expression; Args holds the arithmetic
+	// expression, in which the operators denote elementwise
+	// arithmetic.
+	ArithNode
+
+	// OpNode is a binary operator; Name is the operator symbol and
+	// Args holds the two operands.
+	OpNode
+
+	// LabelNode is a labeled term, e.g. trt_eff = x1:x2; Name is
+	// the label and Args holds the term.
+	LabelNode
+)
+
+// Node is a node in the syntax tree of a formula.
+type Node struct {
+	Kind  NodeKind
+	Name  string
+	Value float64
+	Args  []*Node
+
+	// The precedence of an operator that is not built in
+	prec int
+}
+
+// Formula is the syntax tree of a formula.
+type Formula struct {
+
+	// Response is the left-hand side of the formula, or nil if
+	// the formula has no left-hand side.
+	Response *Node
+
+	// Terms is the right-hand side of the formula.
+	Terms *Node
+}
+
+// ParseFormula returns the syntax tree of a formula, which can be
+// inspected, rewritten and rendered back to text with String.  The
+// macros and binary operators in config, which may be nil, are
+// used.  The tree is built in the same way as when the formula is
+// parsed by New, except that no intercept is added for
+// Config.AutoIntercept.  A response given as cbind(y1, y2) has the
+// tree of y1 + y2.
+func ParseFormula(fml string, config *Config) (*Formula, error) {
+
+	fp := &Parser{Formulas: []string{fml}}
+	fp.configure(config)
+	fp.autoIcept = false
+	if err := fp.compile(); err != nil {
+		return nil, err
+	}
+
+	f := new(Formula)
+	var err error
+	f.Terms, err = treeRPN(fp.rpn[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(fp.rpn) == 2 {
+		f.Response, err = treeRPN(fp.rpn[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+// String returns the text of the formula.
+func (f *Formula) String() string {
+	if f.Response == nil {
+		return f.Terms.String()
+	}
+	return f.Response.String() + " ~ " + f.Terms.String()
+}
+
+// treeRPN returns the syntax tree of an expression in RPN form.
+func treeRPN(rpn []*token) (*Node, error) {
+
+	var stack []*Node
+	for _, tok := range rpn {
+		if isOperator(tok) {
+			n := len(stack)
+			if n < 2 {
+				return nil, fmt.Errorf("not enough arguments")
+			}
+			node := &Node{Kind: OpNode, Name: opSymbol(tok), Args: []*Node{stack[n-2], stack[n-1]}, prec: tok.prec}
+			stack = append(stack[0:n-2], node)
+			continue
+		}
+
+		node, err := treeToken(tok)
+		if err != nil {
+			return nil, err
+		}
+		stack = append(stack, node)
+	}
+
+	if len(stack) != 1 {
+		return nil, fmt.Errorf("invalid formula")
+	}
+
+	return stack[0], nil
+}
+
+// opSymbol returns the symbol of an operator token.
+func opSymbol(tok *token) string {
+	if tok.symbol == binop {
+		return tok.name
+	}
+	return opNames[tok.symbol]
+}
+
+// treeToken returns the syntax tree of a token that is not an
+// operator.
+func treeToken(tok *token) (*Node, error) {
+
+	switch tok.symbol {
+	case vname:
+		return &Node{Kind: VarNode, Name: tok.name}, nil
+	case icept:
+		return &Node{Kind: InterceptNode, Name: "1"}, nil
+	case noicept:
+		return &Node{Kind: NoInterceptNode, Name: "0"}, nil
+	case dot:
+		return &Node{Kind: DotNode, Name: "."}, nil
+	case number:
+		return &Node{Kind: NumberNode, Name: tok.name, Value: tok.value}, nil
+	case str:
+		return &Node{Kind: StringNode, Name: tok.name}, nil
+	case subexpr:
+		return treeRPN(tok.expr)
+	case arith:
+		expr, err := treeRPN(tok.expr)
+		if err != nil {
+			return nil, err
+		}
+		return &Node{Kind: ArithNode, Name: "I", Args: []*Node{expr}}, nil
+	case labeled:
+		term, err := treeRPN(tok.expr)
+		if err != nil {
+			return nil, err
+		}
+		return &Node{Kind: LabelNode, Name: tok.funcn, Args: []*Node{term}}, nil
+	case funct:
+		node := &Node{Kind: CallNode, Name: tok.funcn}
+		for _, arg := range tok.args {
+			a, err := treeToken(arg)
+			if err != nil {
+				return nil, err
+			}
+			node.Args = append(node.Args, a)
+		}
+		return node, nil
+	default:
+		return nil, fmt.Errorf("unexpected token in formula")
+	}
+}
+
+// builtinOp returns the token type of a built-in operator symbol.
+func builtinOp(sym string) (tokType, bool) {
+	for tt, s := range opNames {
+		if s == sym {
+			return tt, true
+		}
+	}
+	return 0, false
+}
+
+// precedence returns the precedence of an operator node, or -1 if the
+// node is not an operator.  A labeled term extends to the next + or -,
+// so it has the precedence of +.
+func (n *Node) precedence() int {
+
+	if n.Kind == LabelNode {
+		return precedence[plus]
+	}
+	if n.Kind != OpNode {
+		return -1
+	}
+	if tt, ok := builtinOp(n.Name); ok {
+		return precedence[tt]
+	}
+
+	return n.prec
+}
+
+// String returns the text of the expression rooted at the node.
+// Operands are parenthesized as needed for the text to be parsed into
+// the same tree.
+func (n *Node) String() string {
+
+	switch n.Kind {
+	case VarNode:
+		return argText(&token{symbol: vname, name: n.Name})
+	case InterceptNode:
+		return "1"
+	case NoInterceptNode:
+		return "0"
+	case DotNode:
+		return "."
+	case NumberNode:
+		if n.Name != "" {
+			return n.Name
+		}
+		return strconv.FormatFloat(n.Value, 'f', -1, 64)
+	case StringNode:
+		return Str(n.Name).String()
+	case LabelNode:
+		if len(n.Args) != 1 {
+			return "<invalid>"
+		}
+		term := n.Args[0].String()
+		if n.Args[0].precedence() >= precedence[plus] {
+			term = "(" + term + ")"
+		}
+		return argText(&token{symbol: vname, name: n.Name}) + " = " + term
+	case CallNode, ArithNode:
+		args := make([]string, len(n.Args))
+		for i, a := range n.Args {
+			args[i] = a.String()
+		}
+		return n.Name + "(" + strings.Join(args, ", ") + ")"
+	case OpNode:
+		if len(n.Args) != 2 {
+			return "<invalid>"
+		}
+		prec := n.precedence()
+		left, right := n.Args[0].String(), n.Args[1].String()
+		if n.Args[0].precedence() > prec {
+			left = "(" + left + ")"
+		}
+		// A labeled term extends to the right, so it needs no
+		// parentheses as a right operand
+		if n.Args[1].precedence() >= prec && n.Args[1].Kind != LabelNode {
+			right = "(" + right + ")"
+		}
+		sym := n.Name
+		if tt, ok := builtinOp(sym); !ok || tt == plus || tt == minus {
+			sym = " " + sym + " "
+		}
+		return left + sym + right
+	default:
+		return "<invalid>"
+	}
+}
+
+// Canonical returns a normalized text of the formula, which is the
+// same for formulas that differ only in the order of their terms,
+// repeated terms, parentheses, whitespace or the use of macros.  This
+// can be used to detect duplicate formulas, or as a key for caching
+// designs.  The terms of each sum are sorted, except in the arguments
+// of function calls, whose text is part of the names of the columns.
+func (f *Formula) Canonical() string {
+
+	g := &Formula{Terms: canonical(f.Terms)}
+	if f.Response != nil {
+		g.Response = canonical(f.Response)
+	}
+
+	return g.String()
+}
+
+// canonical returns a copy of the tree rooted at n in which the terms
+// of each sum are sorted and unique.
+func canonical(n *Node) *Node {
+
+	if n.Kind != OpNode {
+		return n
+	}
+
+	if n.Name != "+" {
+		c := *n
+		c.Args = []*Node{canonical(n.Args[0]), canonical(n.Args[1])}
+		return &c
+	}
+
+	// Collect the terms of the sum
+	var terms []*Node
+	var collect func(*Node)
+	collect = func(n *Node) {
+		if n.Kind == OpNode && n.Name == "+" {
+			collect(n.Args[0])
+			collect(n.Args[1])
+			return
+		}
+		terms = append(terms, canonical(n))
+	}
+	collect(n)
+
+	texts := make(map[string]*Node)
+	var keys []string
+	for _, t := range terms {
+		s := t.String()
+		if _, ok := texts[s]; !ok {
+			texts[s] = t
+			keys = append(keys, s)
+		}
+	}
+	sort.Strings(keys)
+
+	rslt := texts[keys[0]]
+	for _, s := range keys[1:] {
+		rslt = &Node{Kind: OpNode, Name: "+", Args: []*Node{rslt, texts[s]}}
+	}
+
+	return rslt
+}
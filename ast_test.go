@@ -0,0 +1,88 @@
+package formula
+
+import (
+	"testing"
+)
+
+func TestParseFormula(t *testing.T) {
+
+	config := &Config{
+		Macros:    map[string]string{"demog": "x1 + x3"},
+		BinaryOps: map[string]BinaryOp{"%max%": {Precedence: 1, Func: func(a, b *ColSet) (*ColSet, error) { return a, nil }}},
+	}
+
+	for _, tc := range []struct {
+		fml  string
+		text string
+	}{
+		{"y ~ x1 + x2*x3", "y ~ x1 + x2*x3"},
+		{"(x1+x2)*x3 - 1", "(x1 + x2)*x3 - 1"},
+		{"x1 - (x2 - x3)", "x1 - (x2 - x3)"},
+		{"0 + (x1 + x2 + x3)^2", "0 + (x1 + x2 + x3)^2"},
+		{"log(x1) + cut(x2, -0.5, \"a\") + I(2*(x1 + x4))", "log(x1) + cut(x2, -0.5, \"a\") + I(2*(x1 + x4))"},
+		{"square(x1 + x4):x3 + .", "square(x1 + x4):x3 + ."},
+		{"demog/x2", "(x1 + x3)/x2"},
+		{"x1 %max% x2 + `a b`", "x1 %max% x2 + `a b`"},
+		{"cbind(y1, y2) ~ x1", "y1 + y2 ~ x1"},
+		{"x4 + eff=x1:x3 + z = (x1 + x2) + (w = x1)*x2", "x4 + eff = x1:x3 + z = (x1 + x2) + (w = x1)*x2"},
+	} {
+		f, err := ParseFormula(tc.fml, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.String() != tc.text {
+			t.Errorf("Expected '%s', observed '%s'", tc.text, f.String())
+		}
+
+		// Rendering is stable
+		g, err := ParseFormula(f.String(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if g.String() != f.String() {
+			t.Errorf("'%s' is not stable", f.String())
+		}
+	}
+
+	// Rewrite x2 to log(x2)
+	f, err := ParseFormula("x1 + x2:x3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Terms.Kind != OpNode || f.Terms.Name != "+" {
+		t.Fatalf("Unexpected tree")
+	}
+	x2 := f.Terms.Args[1].Args[0]
+	*x2 = Node{Kind: CallNode, Name: "log", Args: []*Node{{Kind: VarNode, Name: "x2"}}}
+	if f.String() != "x1 + log(x2):x3" {
+		t.Errorf("Unexpected rewritten formula '%s'", f.String())
+	}
+
+	if _, err := ParseFormula("x1 + ", nil); err == nil {
+		t.Errorf("Expected an error")
+	}
+}
+
+func TestCanonical(t *testing.T) {
+
+	config := &Config{Macros: map[string]string{"demog": "x1 + x3"}}
+
+	for _, tc := range [][]string{
+		{"x3 + x1 + x1 + (x2:x4)", "x2:x4 + x1 + x3", "x1 + x2:x4 + x3"},
+		{"y ~ demog*(x4 + x2)", "y ~ (x3 + x1)*(x2 + x4)", "y ~ (x1 + x3)*(x2 + x4)"},
+		{"f(x4 + x1) + 1", "1 + f(x4 + x1)", "1 + f(x4 + x1)"},
+		{"x1 + x2 - x3", "(x2 + x1) - x3", "x1 + x2 - x3"},
+	} {
+		var texts []string
+		for _, fml := range tc[0:2] {
+			f, err := ParseFormula(fml, config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			texts = append(texts, f.Canonical())
+		}
+		if texts[0] != tc[2] || texts[1] != tc[2] {
+			t.Errorf("Expected '%s', observed %v", tc[2], texts)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package formula
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// BinaryOp is a binary operator that can be used in formulas in
+// addition to the built-in operators.  The operators are registered
+// in Config.BinaryOps under their symbols, e.g. "%max%" or "&", or see
+// RegisterOperator.  A symbol is either a name between percent signs,
+// as in R, or consists of punctuation characters.  Symbols can not
+// contain spaces, quotes or parentheses, and can not begin with a
+// character that has a meaning in formulas, such as + or (.
+type BinaryOp struct {
+
+	// Precedence determines how tightly the operator binds; lower
+	// numbers bind more tightly.  The built-in operators have
+	// precedence 0 (^), 1 (:), 2 (* and /) and 3 (+ and -).  All
+	// operators are left associative.
+	Precedence int
+
+	// Func combines the columns of the two operands into the
+	// columns of the result.
+	Func func(a, b *ColSet) (*ColSet, error)
+}
+
+// The operators registered with RegisterOperator
+var registry = struct {
+	sync.Mutex
+	ops map[string]BinaryOp
+}{ops: make(map[string]BinaryOp)}
+
+// RegisterOperator makes a binary operator available to all parsers
+// created afterwards, so that a package embedding this package can
+// define operators without changing the Config of each parser.  An
+// operator in Config.BinaryOps takes precedence over a registered
+// operator with the same symbol.  An error is returned if the symbol
+// is invalid or already registered.
+func RegisterOperator(sym string, op BinaryOp) error {
+
+	if err := checkOpSymbol(sym); err != nil {
+		return fmt.Errorf("RegisterOperator: %v", err)
+	}
+	if op.Func == nil {
+		return fmt.Errorf("RegisterOperator: operator '%s' is nil", sym)
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.ops[sym]; ok {
+		return fmt.Errorf("RegisterOperator: operator '%s' is already registered", sym)
+	}
+	registry.ops[sym] = op
+
+	return nil
+}
+
+// UnregisterOperator removes a binary operator registered with
+// RegisterOperator.
+func UnregisterOperator(sym string) {
+	registry.Lock()
+	defer registry.Unlock()
+	delete(registry.ops, sym)
+}
+
+// binaryOps returns the registered binary operators along with those
+// in ops, which take precedence.
+func binaryOps(ops map[string]BinaryOp) map[string]BinaryOp {
+
+	registry.Lock()
+	defer registry.Unlock()
+	if len(registry.ops) == 0 {
+		return ops
+	}
+
+	all := make(map[string]BinaryOp)
+	for sym, op := range registry.ops {
+		all[sym] = op
+	}
+	for sym, op := range ops {
+		all[sym] = op
+	}
+
+	return all
+}
+
+// checkOpSymbol returns an error if sym can not be used as the symbol
+// of a BinaryOp.
+func checkOpSymbol(sym string) error {
+
+	if sym == "" {
+		return fmt.Errorf("the symbol of a binary operator is empty")
+	}
+	if strings.ContainsAny(sym[0:1], "()+-*:^/~.,'\"`_#") {
+		return fmt.Errorf("the symbol '%s' begins with a reserved character", sym)
+	}
+	pct := len(sym) > 2 && sym[0] == '%' && sym[len(sym)-1] == '%'
+	for i, r := range sym {
+		// Whether r is part of a name between percent signs
+		name := pct && i > 0 && i < len(sym)-1
+		alnum := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if unicode.IsSpace(r) || strings.ContainsRune("()'\"`", r) || (name && r == '%') || (!name && alnum) {
+			return fmt.Errorf("the symbol '%s' contains an invalid character", sym)
+		}
+	}
+
+	return nil
+}
+
+// scanOp returns the token for the registered binary operator whose
+// symbol starts at position pos of the input, advancing the reader
+// past it.  The longest matching symbol is used.  The token is nil if
+// no symbol matches.
+func scanOp(input string, pos int, rdr *strings.Reader, ops map[string]BinaryOp) *token {
+
+	var syms []string
+	for sym := range ops {
+		if checkOpSymbol(sym) == nil && strings.HasPrefix(input[pos:], sym) {
+			syms = append(syms, sym)
+		}
+	}
+	if len(syms) == 0 {
+		return nil
+	}
+	sort.Slice(syms, func(i, j int) bool { return len(syms[i]) > len(syms[j]) })
+
+	sym := syms[0]
+	if _, err := rdr.Seek(int64(pos+len(sym)), io.SeekStart); err != nil {
+		panic(err)
+	}
+
+	return &token{symbol: binop, name: sym, prec: ops[sym].Precedence}
+}
+
+// doBinaryOp applies a registered binary operator to the columns
+// named a and b.
+func (fp *Parser) doBinaryOp(tok *token, a, b string) (*ColSet, error) {
+
+	op, ok := fp.binaryOps[tok.name]
+	if !ok || op.Func == nil {
+		return nil, fmt.Errorf("Operator '%s' not found", tok.name)
+	}
+
+	rslt, err := op.Func(fp.workData[a], fp.workData[b])
+	if err != nil {
+		return nil, fmt.Errorf("%s %s %s: %v", a, tok.name, b, err)
+	}
+	if rslt == nil || len(rslt.names) != len(rslt.data) {
+		return nil, fmt.Errorf("%s %s %s: invalid result", a, tok.name, b)
+	}
+
+	return rslt, nil
+}
@@ -0,0 +1,126 @@
+package formula
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestBinaryOps(t *testing.T) {
+
+	// Elementwise maximum of two single columns
+	pmax := func(a, b *ColSet) (*ColSet, error) {
+		if len(a.Names()) != 1 || len(b.Names()) != 1 {
+			return nil, fmt.Errorf("the operands must have one column")
+		}
+		x, y := a.Data()[0], b.Data()[0]
+		z := make([]float64, len(x))
+		for i := range z {
+			z[i] = math.Max(x[i], y[i])
+		}
+		na := fmt.Sprintf("max(%s, %s)", a.Names()[0], b.Names()[0])
+		return NewColSet([]string{na}, [][]float64{z}), nil
+	}
+	config := &Config{
+		BinaryOps: map[string]BinaryOp{
+			"%max%": {Precedence: 1, Func: pmax},
+			"&":     {Precedence: 3, Func: func(a, b *ColSet) (*ColSet, error) { return b, nil }},
+		},
+	}
+
+	fp, err := New("x2 + x1 %max% x4 + (x1 & x4)", simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &ColSet{
+		names: []string{"x2[0]", "x2[1]", "max(x1, x4)", "x4"},
+		data: [][]float64{
+			{1, 1, 1, 0, 0},
+			{0, 0, 0, 1, 1},
+			{0, 1, 2, 3, 4},
+			{-1, 0, 1, 0, -1},
+		},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+
+	// The operator fails with a categorical operand
+	fp, err = New("x3 %max% x1", simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.Parse(); err == nil {
+		t.Errorf("Expected an error")
+	}
+
+	for _, sym := range []string{"", "+%", "%a b%", "%a%b%", "&a"} {
+		config := &Config{BinaryOps: map[string]BinaryOp{sym: {Func: pmax}}}
+		if _, err := New("x1", simpleData(), config); err == nil {
+			t.Errorf("Symbol '%s' should fail", sym)
+		}
+	}
+}
+
+func TestRegisterOperator(t *testing.T) {
+
+	// x %in% y keeps the columns of x that are also in y
+	in := BinaryOp{
+		Precedence: 3,
+		Func: func(a, b *ColSet) (*ColSet, error) {
+			var names []string
+			var data [][]float64
+			for j, na := range a.Names() {
+				for _, nb := range b.Names() {
+					if na == nb {
+						names = append(names, na)
+						data = append(data, a.Data()[j])
+					}
+				}
+			}
+			return NewColSet(names, data), nil
+		},
+	}
+	if err := RegisterOperator("%in%", in); err != nil {
+		t.Fatal(err)
+	}
+	defer UnregisterOperator("%in%")
+
+	if err := RegisterOperator("%in%", in); err == nil {
+		t.Errorf("Registering an operator twice should fail")
+	}
+	if err := RegisterOperator("+%", in); err == nil {
+		t.Errorf("An invalid symbol should fail")
+	}
+
+	fp, err := New("(x1 + x2 + x4) %in% (x4 + x3 + x1)", simpleData(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(cols.Names()) != "[x1 x4]" {
+		t.Errorf("Unexpected names %v", cols.Names())
+	}
+
+	// The Config takes precedence
+	config := &Config{BinaryOps: map[string]BinaryOp{"%in%": {Precedence: 3, Func: func(a, b *ColSet) (*ColSet, error) { return b, nil }}}}
+	fp, err = New("x1 %in% x4", simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err = fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(cols.Names()) != "[x4]" {
+		t.Errorf("Unexpected names %v", cols.Names())
+	}
+}
@@ -0,0 +1,120 @@
+package formula
+
+import (
+	"math"
+)
+
+// BlockScaling determines how the blocks of columns produced by a
+// function call, e.g. a spline or polynomial basis, are rescaled to
+// improve the conditioning of the design matrix.  Only function calls
+// producing more than one column are rescaled.  The constants are
+// learned from the parser's own data when it is created, and are
+// reused by Parse and by the parsers returned by WithData, so that new
+// data are transformed in the same way.
+type BlockScaling int
+
+const (
+	// NoBlockScaling leaves the blocks unscaled.  This is the
+	// default.
+	NoBlockScaling BlockScaling = iota
+
+	// BlockUnitNorm divides each column of a block by its
+	// Euclidean norm.
+	BlockUnitNorm
+
+	// BlockUnitRange maps each column of a block linearly onto
+	// [0, 1], from its minimum and maximum values.
+	BlockUnitRange
+)
+
+// scaleBlock returns the columns of cs rescaled according to the
+// block scaling of the parser.  Until the constants have been fitted,
+// see fitBlockScales, the constants of columns that have not been
+// seen before are learned from cs.
+func (fp *Parser) scaleBlock(cs *ColSet) *ColSet {
+
+	if fp.blockScaling == NoBlockScaling || len(cs.data) < 2 {
+		return cs
+	}
+
+	rslt := &ColSet{names: cs.names, terms: cs.terms, origins: cs.origins, meta: cs.meta}
+	for j, x := range cs.data {
+		na := cs.names[j]
+		c, ok := fp.blockScales[na]
+		if !ok {
+			if fp.blockFitted {
+				// Not seen in the data that the constants
+				// were fitted to
+				rslt.data = append(rslt.data, x)
+				continue
+			}
+			c = blockConstants(x, fp.blockScaling)
+			fp.blockScales[na] = c
+		}
+		y := make([]float64, len(x))
+		for i, v := range x {
+			y[i] = (v - c[0]) / c[1]
+		}
+		rslt.data = append(rslt.data, y)
+	}
+
+	return rslt
+}
+
+// blockConstants returns the offset and scale that rescale x, ignoring
+// missing values.  The scale is one if x is constant or zero.
+func blockConstants(x []float64, scaling BlockScaling) [2]float64 {
+
+	switch scaling {
+	case BlockUnitNorm:
+		var ss float64
+		for _, v := range x {
+			if !math.IsNaN(v) {
+				ss += v * v
+			}
+		}
+		if ss == 0 {
+			return [2]float64{0, 1}
+		}
+		return [2]float64{0, math.Sqrt(ss)}
+	default:
+		lo, hi := math.Inf(1), math.Inf(-1)
+		for _, v := range x {
+			if !math.IsNaN(v) {
+				lo = math.Min(lo, v)
+				hi = math.Max(hi, v)
+			}
+		}
+		if !(hi > lo) {
+			return [2]float64{0, 1}
+		}
+		return [2]float64{lo, hi - lo}
+	}
+}
+
+// fitBlockScales learns the constants of Config.BlockScaling from the
+// parser's data, unless they have already been learned, e.g. given in
+// Config.Codes.
+func (fp *Parser) fitBlockScales() error {
+
+	if fp.blockScaling == NoBlockScaling || fp.blockFitted {
+		return nil
+	}
+
+	p := fp.WithData(fp.RawData)
+	p.weightScaling = NoWeightScaling
+	if _, err := p.Parse(); err != nil {
+		return err
+	}
+	fp.blockScales = p.blockScales
+	fp.blockFitted = true
+
+	return nil
+}
+
+// BlockScales returns the offset and scale of each column rescaled by
+// Config.BlockScaling, keyed by column name.  A column x is
+// transformed to (x - offset) / scale.
+func (fp *Parser) BlockScales() map[string][2]float64 {
+	return fp.blockScales
+}
@@ -0,0 +1,108 @@
+package formula
+
+import (
+	"math"
+	"testing"
+
+	"gonum.org/v1/gonum/floats"
+)
+
+func TestBlockScaling(t *testing.T) {
+
+	config := &Config{Funcs: makeFuncs(), BlockScaling: BlockUnitRange}
+	fp, err := New("pbase(x1) + square(x1)", simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the block of two columns is rescaled
+	exp := &ColSet{
+		names: []string{"pbase(x1)^2", "pbase(x1)^3", "square(x1)"},
+		data: [][]float64{
+			{0, 1.0 / 16, 4.0 / 16, 9.0 / 16, 1},
+			{0, 1.0 / 64, 8.0 / 64, 27.0 / 64, 1},
+			{0, 1, 4, 9, 16},
+		},
+	}
+	if ok, diff := exp.EqualTol(cols, 1e-12); !ok {
+		t.Errorf("%v", diff)
+	}
+
+	// New data are rescaled with the same constants
+	src := mustSource([]interface{}{[]float64{2, 8}}, []string{"x1"})
+	cols, err = fp.WithData(src).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp = &ColSet{
+		names: []string{"pbase(x1)^2", "pbase(x1)^3", "square(x1)"},
+		data: [][]float64{
+			{4.0 / 16, 4},
+			{8.0 / 64, 8},
+			{4, 64},
+		},
+	}
+	if ok, diff := exp.EqualTol(cols, 1e-12); !ok {
+		t.Errorf("%v", diff)
+	}
+
+	config.BlockScaling = BlockUnitNorm
+	fp, err = New("pbase(x1)", simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err = fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for j, x := range cols.Data() {
+		if math.Abs(floats.Norm(x, 2)-1) > 1e-12 {
+			t.Errorf("column %d has norm %v", j, floats.Norm(x, 2))
+		}
+	}
+	if c := fp.BlockScales()["pbase(x1)^2"]; c != [2]float64{0, math.Sqrt(354)} {
+		t.Errorf("Unexpected constants %v", c)
+	}
+}
+
+func TestBlockScalingFitted(t *testing.T) {
+
+	// The constants are learned from the parser's own data, even
+	// if new data are parsed first
+	config := &Config{Funcs: makeFuncs(), BlockScaling: BlockUnitRange}
+	fp, err := New("pbase(x1)", simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := fp.BlockScales()["pbase(x1)^2"]; c != [2]float64{0, 16} {
+		t.Errorf("Unexpected constants %v", c)
+	}
+
+	src := mustSource([]interface{}{[]float64{2, 8}}, []string{"x1"})
+	cols, err := fp.WithData(src).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := &ColSet{
+		names: []string{"pbase(x1)^2", "pbase(x1)^3"},
+		data: [][]float64{
+			{4.0 / 16, 4},
+			{8.0 / 64, 8},
+		},
+	}
+	if ok, diff := exp.EqualTol(cols, 1e-12); !ok {
+		t.Errorf("%v", diff)
+	}
+
+	cols, err = fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x := cols.Data()[0]; x[0] != 0 || x[4] != 1 {
+		t.Errorf("Unexpected column %v", x)
+	}
+}
@@ -0,0 +1,188 @@
+package formula
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Expr is a formula expression built programmatically, e.g.
+//
+//	Var("x1").Times(Var("x2")).Plus(Apply("log", Var("x3")))
+//
+// The String method returns the text of the expression, which can be
+// passed to New or NewMulti.  Variable names are quoted as needed and
+// operands are parenthesized according to the precedence of the
+// operators, so the expression is parsed exactly as it was built.
+// Parts that cannot be written as formula text, e.g. a variable name
+// containing a backtick, are reported by Err.
+type Expr struct {
+	text string
+
+	// The precedence of the outermost operator, or -1 for a
+	// variable, literal or function call
+	prec int
+
+	// The first part of the expression that cannot be written
+	// as formula text
+	err error
+}
+
+// String returns the formula text of the expression, which is empty
+// if Err is not nil.
+func (e *Expr) String() string {
+	return e.text
+}
+
+// Err returns an error if a part of the expression cannot be written
+// as formula text, and nil otherwise.
+func (e *Expr) Err() error {
+	return e.err
+}
+
+// invalid returns an expression holding the given error.
+func invalid(format string, args ...interface{}) *Expr {
+	return &Expr{prec: -1, err: fmt.Errorf(format, args...)}
+}
+
+// Var returns an expression consisting of the variable with the given
+// name.  Names that are not identifiers are quoted with backticks, and
+// names that are empty or contain a backtick are invalid.
+func Var(na string) *Expr {
+	if na == "" || strings.Contains(na, "`") {
+		return invalid("Var: the variable name %q cannot be quoted", na)
+	}
+	return &Expr{text: argText(&token{symbol: vname, name: na}), prec: -1}
+}
+
+// Intercept returns the expression 1, which denotes the intercept.
+func Intercept() *Expr {
+	return &Expr{text: "1", prec: -1}
+}
+
+// NoIntercept returns the expression 0, which suppresses the
+// intercept.
+func NoIntercept() *Expr {
+	return &Expr{text: "0", prec: -1}
+}
+
+// Num returns a numeric literal, which can be used as a function
+// argument.  Infinite and NaN values are invalid.
+func Num(x float64) *Expr {
+	if math.IsInf(x, 0) || math.IsNaN(x) {
+		return invalid("Num: %v is not a finite number", x)
+	}
+	return &Expr{text: strconv.FormatFloat(x, 'f', -1, 64), prec: -1}
+}
+
+// Str returns a string literal, which can be used as a function
+// argument.  Strings are quoted with double quotes, or with single
+// quotes if they contain a double quote, and strings containing both
+// are invalid.
+func Str(s string) *Expr {
+	if strings.Contains(s, `"`) && strings.Contains(s, "'") {
+		return invalid("Str: the string %q cannot be quoted", s)
+	}
+	if strings.Contains(s, `"`) {
+		return &Expr{text: "'" + s + "'", prec: -1}
+	}
+	return &Expr{text: `"` + s + `"`, prec: -1}
+}
+
+// Apply returns an expression calling the function with the given
+// name on the arguments, e.g. Apply("log", Var("x")).  Function names
+// must be identifiers.
+func Apply(fn string, args ...*Expr) *Expr {
+	if !isIdent(fn) {
+		return invalid("Apply: %q is not a function name", fn)
+	}
+	text := make([]string, len(args))
+	for i, a := range args {
+		if a.err != nil {
+			return a
+		}
+		text[i] = a.text
+	}
+	return &Expr{text: fn + "(" + strings.Join(text, ", ") + ")", prec: -1}
+}
+
+// binary returns the expression combining e and o with an operator
+// of the given symbol and precedence.  All operators are left
+// associative, so a right operand with the same precedence is
+// parenthesized.
+func (e *Expr) binary(sym string, prec int, o *Expr) *Expr {
+
+	if e.err != nil {
+		return e
+	}
+	if o.err != nil {
+		return o
+	}
+
+	left, right := e.text, o.text
+	if e.prec > prec {
+		left = "(" + left + ")"
+	}
+	if o.prec >= prec {
+		right = "(" + right + ")"
+	}
+
+	return &Expr{text: left + sym + right, prec: prec}
+}
+
+// Plus returns e + o.
+func (e *Expr) Plus(o *Expr) *Expr {
+	return e.binary(" + ", precedence[plus], o)
+}
+
+// Minus returns e - o.
+func (e *Expr) Minus(o *Expr) *Expr {
+	return e.binary(" - ", precedence[minus], o)
+}
+
+// Times returns e*o.
+func (e *Expr) Times(o *Expr) *Expr {
+	return e.binary("*", precedence[times], o)
+}
+
+// Interact returns e:o.
+func (e *Expr) Interact(o *Expr) *Expr {
+	return e.binary(":", precedence[colon], o)
+}
+
+// Nest returns e/o.
+func (e *Expr) Nest(o *Expr) *Expr {
+	return e.binary("/", precedence[nest], o)
+}
+
+// Pow returns e^k.
+func (e *Expr) Pow(k int) *Expr {
+	return e.binary("^", precedence[power], &Expr{text: strconv.Itoa(k), prec: -1})
+}
+
+// Label returns the labeled term na = e, whose columns are named
+// after the label.
+func (e *Expr) Label(na string) *Expr {
+	if e.err != nil {
+		return e
+	}
+	label := Var(na)
+	if label.err != nil {
+		return label
+	}
+	term := e.text
+	if e.prec >= precedence[plus] {
+		term = "(" + term + ")"
+	}
+	return &Expr{text: label.text + " = " + term, prec: precedence[plus]}
+}
+
+// Response returns the two-sided formula e ~ rhs, in which e is the
+// response.  The formula is empty if either side is invalid, see Err.
+func (e *Expr) Response(rhs *Expr) string {
+	if e.err != nil || rhs.err != nil {
+		return ""
+	}
+	return e.text + " ~ " + rhs.text
+}
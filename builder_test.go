@@ -0,0 +1,98 @@
+package formula
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBuilder(t *testing.T) {
+
+	for _, tc := range []struct {
+		expr *Expr
+		text string
+	}{
+		{
+			expr: Var("x1").Times(Var("x2")).Plus(Apply("log", Var("x3"))),
+			text: "x1*x2 + log(x3)",
+		},
+		{
+			expr: Var("x1").Plus(Var("x2")).Times(Var("x3")),
+			text: "(x1 + x2)*x3",
+		},
+		{
+			expr: Var("x1").Minus(Var("x2").Minus(Var("x3"))),
+			text: "x1 - (x2 - x3)",
+		},
+		{
+			expr: Intercept().Plus(Var("x1").Plus(Var("x2")).Pow(2)),
+			text: "1 + (x1 + x2)^2",
+		},
+		{
+			expr: Var("blood pressure").Interact(Apply("cut", Var("x1"), Num(-0.5), Str("a\"b"))).Plus(NoIntercept()),
+			text: "`blood pressure`:cut(x1, -0.5, 'a\"b') + 0",
+		},
+		{
+			expr: Var("x1").Nest(Var("x2")),
+			text: "x1/x2",
+		},
+		{
+			expr: Var("x1").Plus(Var("x2")).Label("z").Times(Var("x3")),
+			text: "(z = (x1 + x2))*x3",
+		},
+	} {
+		if tc.expr.String() != tc.text {
+			t.Errorf("Expected '%s', observed '%s'", tc.text, tc.expr.String())
+		}
+	}
+
+	// The built formula is parsed in the same way as the text
+	e := Var("x1").Plus(Var("x4")).Interact(Var("x3"))
+	fp, err := New(Var("x2").Response(e), simpleData(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := &ColSet{
+		names: []string{"x1:x3[a]", "x1:x3[b]", "x4:x3[a]", "x4:x3[b]"},
+		data: [][]float64{
+			{0, 0, 2, 0, 4},
+			{0, 1, 0, 3, 0},
+			{-1, 0, 1, 0, -1},
+			{0, 0, 0, 0, 0},
+		},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+}
+
+func TestBuilderInvalid(t *testing.T) {
+
+	for _, e := range []*Expr{
+		Var("a`b"),
+		Var(""),
+		Var("x1").Plus(Var("a` + `b")),
+		Apply("cut", Var("x1"), Str(`a"b'c`)),
+		Apply("cut", Var("x1"), Num(math.Inf(1))),
+		Apply("log x", Var("x1")),
+		Var("x1").Label("z`"),
+		Var("x1").Pow(2).Minus(Var("`")),
+	} {
+		if e.Err() == nil {
+			t.Errorf("Expected an error for '%s'", e.String())
+		}
+		if e.String() != "" {
+			t.Errorf("Expected no text, observed '%s'", e.String())
+		}
+		if _, err := New(Var("x2").Response(e), simpleData(), nil); err == nil {
+			t.Errorf("Expected New to fail")
+		}
+	}
+
+	if err := Var("x1").Plus(Apply("cut", Var("a b"), Str("it's"))).Err(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
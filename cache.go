@@ -0,0 +1,67 @@
+package formula
+
+// Sub-expressions that appear in several formulas, e.g. log(x1) in
+// "log(x1) + x2" and "log(x1):x3", are evaluated only once per call
+// to Parse.  Each evaluated sub-expression is stored in the parser's
+// cache under a canonical key derived from its syntax tree.
+
+// opNames gives the formula syntax of each binary operator.
+var opNames = map[tokType]string{plus: "+", minus: "-", times: "*", colon: ":", power: "^", nest: "/"}
+
+// exprKey returns the cache key for the result of applying the
+// operator in tok to the sub-expressions with keys k1 and k2.
+func exprKey(tok *token, k1, k2 string) string {
+	op := opNames[tok.symbol]
+	if tok.symbol == binop {
+		op = tok.name
+	}
+	return "(" + k1 + op + k2 + ")"
+}
+
+// varKey returns the cache key for the variable with the given name,
+// which is quoted as in a formula if it is not an identifier, so that
+// it differs from the keys of function calls and expressions.
+func varKey(na string) string {
+	if isIdent(na) {
+		return na
+	}
+	return "`" + na + "`"
+}
+
+// workKey returns the key in workData for a result other than a
+// variable, e.g. the columns of a function call.  The key starts with
+// a backtick, which can not occur in variable names, so that it
+// differs from the names of the variables.
+func workKey(na string) string {
+	return "`" + na
+}
+
+// rawColumn returns the data for a variable in the parser's data, as
+// returned by get.  During Parse, each variable is converted once.
+func (fp *Parser) rawColumn(na string) interface{} {
+
+	if fp.rawCache == nil {
+		return fp.get(fp.RawData, na)
+	}
+
+	v, ok := fp.rawCache[na]
+	if !ok {
+		v = fp.get(fp.RawData, na)
+		fp.rawCache[na] = v
+	}
+
+	return v
+}
+
+// cached returns the cached result of the sub-expression with the
+// given key, if it has already been evaluated.
+func (fp *Parser) cached(key string) (*ColSet, bool) {
+	cs, ok := fp.cache[key]
+	return cs, ok
+}
+
+// store saves the result of evaluating the sub-expression with the
+// given key.
+func (fp *Parser) store(key string, cs *ColSet) {
+	fp.cache[key] = cs
+}
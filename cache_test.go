@@ -0,0 +1,104 @@
+package formula
+
+import (
+	"testing"
+)
+
+func TestCache(t *testing.T) {
+
+	var ncall int
+	funcs := makeFuncs()
+	funcs["count"] = func(na string, x []float64) *ColSet {
+		ncall++
+		return &ColSet{names: []string{na}, data: [][]float64{x}}
+	}
+
+	formulas := []string{"count(x1) + x3*x4", "count(x1):x3", "x2 + x3*x4 + count(x1)"}
+	config := &Config{RefLevels: map[string]string{"x3": "a"}, Funcs: funcs}
+	fp, err := NewMulti(formulas, simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for k := 0; k < 2; k++ {
+		ncall = 0
+		cs, err := fp.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ncall != 1 {
+			t.Errorf("count called %d times, expected 1", ncall)
+		}
+
+		exp := &ColSet{
+			names: []string{"count(x1)", "x3[b]:x4", "count(x1):x3[b]", "x2[0]", "x2[1]"},
+			data: [][]float64{
+				{0, 1, 2, 3, 4},
+				{0, 0, 0, 0, 0},
+				{0, 1, 0, 3, 0},
+				{1, 1, 1, 0, 0},
+				{0, 0, 0, 1, 1},
+			},
+		}
+		if !colSetEq(cs, exp) {
+			t.Errorf("Mismatch:\nExpected: %v\nObserved: %v\n", exp, cs)
+		}
+	}
+
+	if _, ok := fp.cache["(x3*x4)"]; !ok {
+		t.Fail()
+	}
+}
+
+// countSource counts the calls to Get for each variable.
+type countSource struct {
+	DataSource
+	ncall map[string]int
+}
+
+func (src *countSource) Get(na string) interface{} {
+	src.ncall[na]++
+	return src.DataSource.Get(na)
+}
+
+func TestDuplicateVariable(t *testing.T) {
+
+	names := []string{"x1", "log(x1)", "tmp2"}
+	data := []interface{}{
+		[]float64{1, 2, 3},
+		[]float64{7, 8, 9},
+		[]float64{4, 5, 6},
+	}
+	src := &countSource{DataSource: mustSource(data, names), ncall: make(map[string]int)}
+	funcs := makeFuncs()
+	funcs["log"] = funcs["square"]
+
+	fp, err := New("log(x1) + square(x1) + x1 + `log(x1)` + tmp2", src, &Config{Funcs: funcs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.ncall = make(map[string]int)
+	cs, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The variable `log(x1)` has the name of the column of the
+	// call log(x1), so it is skipped as a duplicate
+	exp := &ColSet{
+		names: []string{"log(x1)", "square(x1)", "x1", "tmp2"},
+		data: [][]float64{
+			{1, 4, 9},
+			{1, 4, 9},
+			{1, 2, 3},
+			{4, 5, 6},
+		},
+	}
+	if !colSetEq(cs, exp) {
+		t.Errorf("Mismatch:\nExpected: %v\nObserved: %v\n", exp, cs)
+	}
+
+	if src.ncall["x1"] != 1 {
+		t.Errorf("x1 retrieved %d times, expected 1", src.ncall["x1"])
+	}
+}
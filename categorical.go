@@ -0,0 +1,384 @@
+package formula
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// The built-in function C converts a variable to a categorical
+// variable, so that a numeric variable holding integer codes, e.g. a
+// treatment group, is represented by indicator columns.  The
+// functions in Config.CatFuncs, e.g. a binning function, produce
+// categorical variables in the same way.  The optional second
+// argument of such a call is the reference level, e.g. C(x, 2) or
+// bin(x, "low").  If it is not given, the reference level of the call
+// in Config.RefLevels is used, e.g. RefLevels["bin(x)"], or for C, the
+// reference level of the variable.  The levels are learned from the
+// data along with the levels of the string variables, and the
+// indicator columns are named like C(x)[3].
+//
+// The built-in function relevel is like C, except that the reference
+// level must be given, e.g. relevel(x2, "control"), so that the
+// formula describes the coding of a variable without
+// Config.RefLevels.
+
+// Contrast determines how a categorical variable is coded.
+type Contrast int
+
+const (
+	// TreatmentContrast codes a categorical variable by an
+	// indicator column for each level other than the reference
+	// level.  This is the default.
+	TreatmentContrast Contrast = iota
+
+	// SumContrast codes a categorical variable by a column for
+	// each level other than the reference level, which is 1 for
+	// that level, -1 for the reference level and 0 otherwise, so
+	// that the coefficients are deviations from the mean over the
+	// levels.  A reference level must be given.
+	SumContrast
+
+	// HelmertContrast compares each level to the mean of the
+	// levels before it, where the reference level is first and the
+	// other levels are in the order in which they were first seen.
+	// The column for the k'th level after the reference level is k
+	// for that level, -1 for the levels before it and 0 for the
+	// levels after it, and is named like x[H.b].  A reference level
+	// must be given.
+	HelmertContrast
+
+	// PolyContrast codes an ordered categorical variable, whose
+	// levels are given in Config.Ordered, by orthonormal
+	// polynomials of degrees 1, 2, ... in the position of the
+	// level, for variables whose levels are equally spaced, e.g.
+	// doses.  The columns are named like x[.L], x[.Q], x[.C],
+	// x[^4], ... for the linear, quadratic, cubic and higher
+	// degree polynomials.  Levels that are not in Config.Ordered
+	// are coded as zero.  This is the default for ordered
+	// variables.
+	PolyContrast
+)
+
+// UnknownPolicy determines how the levels of a categorical variable
+// that were not seen when the codes were determined are coded.
+type UnknownPolicy int
+
+const (
+	// UnknownZero codes an unseen level by zeros in all the
+	// columns of the variable.  This is the default.
+	UnknownZero UnknownPolicy = iota
+
+	// UnknownError returns an error if a level was not seen.
+	UnknownError
+
+	// UnknownOther codes an unseen level by an indicator column
+	// named like x[_other_], which every categorical variable
+	// coded by indicators then has, so that designs for different
+	// datasets have the same columns.
+	UnknownOther
+)
+
+// MissingPolicy determines how the values of categorical variables
+// that are in Config.MissingLevels, e.g. "" or "NA", are coded.
+type MissingPolicy int
+
+const (
+	// MissingAsLevel codes a missing value as a level of its own,
+	// e.g. x[NA].  This is the default.
+	MissingAsLevel MissingPolicy = iota
+
+	// MissingDrop codes a missing value as missing (NaN) in all
+	// the columns of the variable, so that the row is removed by
+	// ColSet.DropNA.
+	MissingDrop
+
+	// MissingError returns an error if a value is missing.
+	MissingError
+)
+
+// OtherLevel is the level of the column of a categorical variable that
+// indicates levels that were not seen, see UnknownOther.
+const OtherLevel = "_other_"
+
+// CatFunc is a transformation of a numeric column to a categorical
+// column, e.g. a binning or clustering of the values.  The first
+// argument is the name of the call.
+type CatFunc func(string, []float64) []string
+
+// isCat returns true if tok is a call to the built-in functions C or
+// relevel, or to a CatFunc.
+func (fp *Parser) isCat(tok *token) bool {
+	if tok.symbol != funct {
+		return false
+	}
+	_, ok := fp.catFuncs[tok.funcn]
+	return ok || tok.funcn == "C" || tok.funcn == "relevel"
+}
+
+// checkCat returns an error if the arguments of a call to C or to a
+// CatFunc are not a variable, optionally followed by a reference
+// level.
+func checkCat(tok *token) error {
+
+	if len(tok.args) < 1 || len(tok.args) > 2 || tok.args[0].symbol != vname {
+		return fmt.Errorf("%s: %s takes a variable and an optional reference level", tok.name, tok.funcn)
+	}
+	if len(tok.args) == 2 && tok.args[1].symbol != number && tok.args[1].symbol != str {
+		return fmt.Errorf("%s: the reference level must be a number or a string", tok.name)
+	}
+	if tok.funcn == "relevel" && len(tok.args) != 2 {
+		return fmt.Errorf("%s: relevel takes a variable and a reference level", tok.name)
+	}
+
+	return nil
+}
+
+// catCalls returns the calls to C, relevel and the CatFuncs in the
+// formulas, including those in the arguments of other functions.
+func (fp *Parser) catCalls() []*token {
+
+	var calls []*token
+	var walk func([]*token)
+	walk = func(tokens []*token) {
+		for _, tok := range tokens {
+			switch {
+			case fp.isCat(tok):
+				calls = append(calls, tok)
+			case tok.symbol == funct:
+				walk(tok.args)
+			case tok.symbol == subexpr || tok.symbol == labeled:
+				walk(tok.expr)
+			}
+		}
+	}
+
+	for _, rpn := range fp.rpn {
+		walk(rpn)
+	}
+
+	return calls
+}
+
+// catRef returns the reference level of a call to C or to a CatFunc.
+func (fp *Parser) catRef(tok *token) string {
+
+	if len(tok.args) == 2 {
+		arg := tok.args[1]
+		if arg.symbol == str {
+			return arg.name
+		}
+		return formatLevel(arg.value)
+	}
+
+	if ref, ok := fp.refLevels[tok.name]; ok || tok.funcn != "C" {
+		return ref
+	}
+
+	return fp.refLevels[tok.args[0].name]
+}
+
+// isOneHot returns true if the categorical variable or call with the
+// given name is coded by an indicator for every level.
+func (fp *Parser) isOneHot(na string) bool {
+
+	if fp.contrast(na) != TreatmentContrast {
+		return false
+	}
+	if v, ok := fp.oneHotVars[na]; ok {
+		return v
+	}
+
+	return fp.oneHot
+}
+
+// levelColumn returns the name of the column of a level of a
+// categorical variable, which has the given code.
+func (fp *Parser) levelColumn(na, level string, code int) string {
+	if fp.contrast(na) == HelmertContrast {
+		return fmt.Sprintf("%s[H.%s]", na, level)
+	}
+	return fp.facNames[na][code]
+}
+
+// RefLevels returns the reference level of each categorical variable
+// and call to C or a CatFunc that has one, whether it was given in
+// Config.RefLevels or in the formula, e.g. relevel(x, "b").
+func (fp *Parser) RefLevels() map[string]string {
+
+	refs := make(map[string]string)
+	for na, ref := range fp.refLevels {
+		refs[na] = ref
+	}
+	for _, tok := range fp.catCalls() {
+		if ref := fp.catRef(tok); ref != "" {
+			refs[tok.name] = ref
+		}
+	}
+
+	return refs
+}
+
+// FactorLevels returns the levels of a categorical variable or call
+// to C or a CatFunc that have a column, in column order, or nil if na
+// is not categorical.  The reference level has no column unless the
+// variable is one-hot coded.  Ordered variables with polynomial
+// contrasts have no column for any level, and their levels are those
+// of Config.Ordered.
+func (fp *Parser) FactorLevels(na string) []string {
+
+	if fp.contrast(na) == PolyContrast {
+		return append([]string(nil), fp.ordered[na]...)
+	}
+
+	codes, ok := fp.codes[na]
+	if !ok {
+		return nil
+	}
+
+	return levelsByCode(codes)
+}
+
+// ColumnForLevel returns the name of the column for a level of a
+// categorical variable or call to C or a CatFunc, e.g. x[b] for level
+// b of x.  False is returned if the level has no column, e.g. for the
+// reference level.
+func (fp *Parser) ColumnForLevel(na, level string) (string, bool) {
+
+	if fp.contrast(na) == PolyContrast {
+		return "", false
+	}
+
+	c, ok := fp.codes[na][level]
+	if !ok {
+		return "", false
+	}
+
+	return fp.levelColumn(na, level, c), true
+}
+
+// formatLevel returns the level of a categorical variable
+// corresponding to a numeric value.
+func formatLevel(x float64) string {
+	return strconv.FormatFloat(x, 'g', -1, 64)
+}
+
+// catLevels returns the levels produced by a call to C or to a
+// CatFunc for the data in src, or nil if the variable is not present.
+func (fp *Parser) catLevels(src DataSource, tok *token) ([]string, error) {
+
+	na := tok.args[0].name
+	if cf, ok := fp.catFuncs[tok.funcn]; ok {
+		switch x := fp.get(src, na).(type) {
+		case nil:
+			return nil, nil
+		case []float64:
+			levels := cf(tok.name, x)
+			if len(levels) != len(x) {
+				return nil, fmt.Errorf("%s: the function returned %d values, expected %d", tok.name, len(levels), len(x))
+			}
+			return levels, nil
+		default:
+			return nil, fmt.Errorf("%s: '%s' is not a numeric variable", tok.name, na)
+		}
+	}
+
+	switch x := fp.get(src, na).(type) {
+	case []string:
+		return x, nil
+	case []float64:
+		levels := make([]string, len(x))
+		for i, v := range x {
+			levels[i] = formatLevel(v)
+		}
+		return levels, nil
+	default:
+		return nil, nil
+	}
+}
+
+// updateCatCodes extends the codes of the calls to C and to the
+// CatFuncs with any levels in src that have not been seen before.
+// Calls whose levels can not be determined are skipped, the error is
+// reported when the formulas are parsed.
+func (fp *Parser) updateCatCodes(src DataSource) {
+
+	for _, tok := range fp.catCalls() {
+		if levels, err := fp.catLevels(src, tok); err == nil && levels != nil {
+			fp.updateLevels(tok.name, fp.catRef(tok), levels)
+		}
+	}
+}
+
+// codeCat returns the indicator columns for a call to C or to a
+// CatFunc.
+func (fp *Parser) codeCat(tok *token) (*ColSet, error) {
+
+	na := tok.args[0].name
+	levels, err := fp.catLevels(fp.RawData, tok)
+	if err != nil {
+		return nil, err
+	}
+	if levels == nil {
+		return nil, &missingError{na}
+	}
+	if _, ok := fp.codes[tok.name]; !ok {
+		fp.codes[tok.name] = make(map[string]int)
+	}
+
+	cs, err := fp.codeStrings(tok.name, fp.catRef(tok), levels)
+	if err != nil {
+		return nil, err
+	}
+
+	// The indicators are derived from the variable through the
+	// function
+	v := &origin{op: "function", detail: tok.funcn, name: tok.name, inputs: []*origin{fp.varOrigin(na)}}
+	for _, o := range cs.origins {
+		o.inputs = []*origin{v}
+	}
+
+	return cs, nil
+}
+
+// missingRows returns the rows of s that hold missing values, see
+// Config.MissingLevels, or nil if missing values are coded as levels
+// or there are none.  An error is returned if there are missing values
+// and the policy is MissingError.
+func (fp *Parser) missingRows(na string, s []string) ([]bool, error) {
+
+	if fp.missingPolicy == MissingAsLevel || len(fp.missingLevels) == 0 {
+		return nil, nil
+	}
+
+	var miss []bool
+	for i, x := range s {
+		if !fp.missingLevels[x] {
+			continue
+		}
+		if fp.missingPolicy == MissingError {
+			return nil, fmt.Errorf("variable '%s' has the missing value '%s' in row %d", na, x, i+1)
+		}
+		if miss == nil {
+			miss = make([]bool, len(s))
+		}
+		miss[i] = true
+	}
+
+	return miss, nil
+}
+
+// setMissing sets the rows of the columns of cs that are true in miss
+// to NaN.
+func setMissing(cs *ColSet, miss []bool) *ColSet {
+
+	for _, x := range cs.data {
+		for i, m := range miss {
+			if m {
+				x[i] = math.NaN()
+			}
+		}
+	}
+
+	return cs
+}
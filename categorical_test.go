@@ -0,0 +1,78 @@
+package formula
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMissingLevels(t *testing.T) {
+
+	data := []interface{}{
+		[]string{"a", "", "b", "NA", "a"},
+		[]float64{1, 2, 3, 4, 5},
+	}
+	src, err := NewSource(data, []string{"x", "y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parse := func(policy MissingPolicy) (*ColSet, error) {
+		config := &Config{
+			RefLevels:     map[string]string{"x": "a"},
+			MissingLevels: []string{"", "NA"},
+			MissingPolicy: policy,
+		}
+		fp, err := New("x + y", src, config)
+		if err != nil {
+			return nil, err
+		}
+		return fp.Parse()
+	}
+
+	// Missing values are levels by default
+	cols, err := parse(MissingAsLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := &ColSet{
+		names: []string{"x[]", "x[b]", "x[NA]", "y"},
+		data: [][]float64{
+			{0, 1, 0, 0, 0},
+			{0, 0, 1, 0, 0},
+			{0, 0, 0, 1, 0},
+			{1, 2, 3, 4, 5},
+		},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+
+	cols, err = parse(MissingDrop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cols.Names()[0] != "x[b]" || len(cols.Names()) != 2 {
+		t.Errorf("Expected columns [x[b] y], found %v", cols.Names())
+	}
+	if !math.IsNaN(cols.Data()[0][1]) || !math.IsNaN(cols.Data()[0][3]) {
+		t.Errorf("Expected NaN for missing values, found %v", cols.Data()[0])
+	}
+	exp = &ColSet{
+		names: []string{"x[b]", "y"},
+		data: [][]float64{
+			{0, 1, 0},
+			{1, 3, 5},
+		},
+	}
+	if sub := cols.DropNA(); !colSetEq(exp, sub) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, sub)
+	}
+
+	if _, err := parse(MissingError); err == nil {
+		t.Errorf("Expected an error for missing values")
+	}
+
+	if _, err := parse(MissingPolicy(7)); err == nil {
+		t.Errorf("Expected an error for an unknown missing value policy")
+	}
+}
@@ -0,0 +1,74 @@
+package formula
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Coder codes a categorical variable by arbitrary columns, e.g.
+// ordinal scores or rows of an embedding table, instead of by
+// indicators.  Coders are given per variable in Config.Coders.
+type Coder interface {
+
+	// Encode returns the columns coding the values of the
+	// variable with the given name, with one value per row in
+	// each column.
+	Encode(name string, values []string) *ColSet
+}
+
+// CoderFunc is a function that is used as a Coder.
+type CoderFunc func(name string, values []string) *ColSet
+
+// Encode calls f.
+func (f CoderFunc) Encode(name string, values []string) *ColSet {
+	return f(name, values)
+}
+
+// validateCoders returns the problems with the coders, which must not
+// be nil, and must not code variables that have encoders.
+func (fp *Parser) validateCoders() []string {
+
+	var names []string
+	for na := range fp.coders {
+		names = append(names, na)
+	}
+	sort.Strings(names)
+
+	var problems []string
+	for _, na := range names {
+		switch _, ok := fp.encoders[na]; {
+		case fp.coders[na] == nil:
+			problems = append(problems, fmt.Sprintf("coder for '%s' is nil", na))
+		case ok:
+			problems = append(problems, fmt.Sprintf("'%s' has both a coder and an encoder", na))
+		}
+	}
+
+	return problems
+}
+
+// codeCustom returns the columns of the categorical variable na that
+// are produced by its Coder.
+func (fp *Parser) codeCustom(na string, c Coder, s []string) (*ColSet, error) {
+
+	cs := c.Encode(na, s)
+	switch {
+	case cs == nil || len(cs.data) == 0:
+		return nil, fmt.Errorf("the coder of '%s' returned no columns", na)
+	case len(cs.names) != len(cs.data):
+		return nil, fmt.Errorf("the coder of '%s' returned %d names for %d columns", na, len(cs.names), len(cs.data))
+	}
+	for j, x := range cs.data {
+		if len(x) != len(s) {
+			return nil, fmt.Errorf("the coder of '%s' returned column '%s' of length %d, expected %d", na, cs.names[j], len(x), len(s))
+		}
+	}
+
+	v := &origin{op: "variable", name: na}
+	cs = &ColSet{names: cs.names, data: cs.data}
+	for _, cna := range cs.names {
+		cs.origins = append(cs.origins, &origin{op: "coder", name: cna, inputs: []*origin{v}})
+	}
+
+	return cs.withTerm(na), nil
+}
@@ -0,0 +1,67 @@
+package formula
+
+import (
+	"testing"
+)
+
+func TestCoder(t *testing.T) {
+
+	data := []interface{}{
+		[]string{"low", "high", "mid", "low"},
+		[]float64{1, 2, 3, 4},
+	}
+	src := mustSource(data, []string{"x", "z"})
+
+	// Ordinal scores of the levels
+	scores := map[string]float64{"low": 1, "mid": 2, "high": 3}
+	ordinal := func(na string, values []string) *ColSet {
+		v := make([]float64, len(values))
+		for i, x := range values {
+			v[i] = scores[x]
+		}
+		return NewColSet([]string{na + "[score]"}, [][]float64{v})
+	}
+
+	config := &Config{Coders: map[string]Coder{"x": CoderFunc(ordinal)}}
+	fp, err := New("x + z + x:z", src, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &ColSet{
+		names: []string{"x[score]", "z", "x[score]:z"},
+		data: [][]float64{
+			{1, 3, 2, 1},
+			{1, 2, 3, 4},
+			{1, 6, 6, 4},
+		},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+	if steps := cols.Provenance()[0]; steps[len(steps)-1].Op != "coder" {
+		t.Errorf("Unexpected provenance %v", steps)
+	}
+
+	// A coder that returns columns of the wrong length
+	short := func(na string, values []string) *ColSet {
+		return NewColSet([]string{na}, [][]float64{{1}})
+	}
+	config.Coders["x"] = CoderFunc(short)
+	fp, err = New("x", src, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.Parse(); err == nil {
+		t.Errorf("Expected an error for a column of the wrong length")
+	}
+
+	config.Coders["x"] = nil
+	if _, err := New("x", src, config); err == nil {
+		t.Errorf("Expected an error for a nil coder")
+	}
+}
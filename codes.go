@@ -0,0 +1,335 @@
+package formula
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// Codes holds the parameters that a parser learns from its data: the
+// codes of the levels of the categorical variables and the names of
+// their indicator columns, and the ranges of the numeric variables,
+// among others.  Codes can be serialized as JSON, and given in
+// Config.Codes to another parser, e.g. in a scoring service, so that
+// its designs for new data have the same columns as the designs of
+// the parser that learned the codes.
+type Codes struct {
+
+	// Codes holds the integer code of each level of each
+	// categorical variable, and FacNames the names of the
+	// indicator columns of each variable in code order.
+	Codes    map[string]map[string]int
+	FacNames map[string][]string
+
+	// Ranges holds the minimum and maximum values of the numeric
+	// variables.
+	Ranges map[string][2]float64
+
+	// Variables are the names of the variables in the data, in
+	// order of first appearance.
+	Variables []string
+
+	// RefSeen holds the categorical variables whose reference
+	// levels occur in the data.
+	RefSeen map[string]bool
+
+	// AutoRefs holds the reference levels chosen by
+	// Config.RefPolicy.
+	AutoRefs map[string]string
+
+	// Pooled holds the levels pooled by Config.MinLevelCount.
+	Pooled map[string][]string
+
+	// BlockScales holds the constants of Config.BlockScaling, and
+	// BlockFitted is true if they have been learned.
+	BlockScales map[string][2]float64
+	BlockFitted bool
+
+	// MeanWeight is the mean case weight used by
+	// RelativeWeights.
+	MeanWeight float64
+
+	// Versions holds the versions of the variables, see
+	// VersionedSource.
+	Versions map[string]string
+
+	// Quantiles holds the sketches of the quantiles of the numeric
+	// variables used by ecdf, winsor, cut, and by bs and te with
+	// Config.QuantileKnots.
+	Quantiles map[string]*quantileSketch
+
+	// DateLayouts holds the layout of the dates in each string
+	// variable, or "" if the variable does not hold dates, see
+	// Config.DateLayouts.
+	DateLayouts map[string]string
+
+	// Moments holds the count, mean and sum of squared deviations
+	// from the mean of the numeric variables used by standardize,
+	// see Recipe.
+	Moments map[string][3]float64
+
+	// TopCounts holds the counts of the levels of the categorical
+	// variables in the codes returned by ShardCodes and MergeCodes
+	// if Config.TopLevels is set, so that the most frequent levels
+	// of the merged codes can be selected.
+	TopCounts map[string]map[string][2]int
+}
+
+// Codes returns a copy of the parameters that the parser learned from
+// its data, see Config.Codes.
+func (fp *Parser) Codes() *Codes {
+
+	c := &Codes{
+		Codes:       make(map[string]map[string]int),
+		FacNames:    make(map[string][]string),
+		Ranges:      make(map[string][2]float64),
+		Variables:   append([]string(nil), fp.vars...),
+		RefSeen:     make(map[string]bool),
+		Pooled:      fp.pooledLevels(),
+		BlockFitted: fp.blockFitted,
+		MeanWeight:  fp.meanWeight,
+		Versions:    fp.Versions(),
+		Quantiles:   fp.quantileState(),
+		Moments:     fp.momentState(),
+	}
+	for na, codes := range fp.codes {
+		c.Codes[na] = copyCodes(codes)
+	}
+	for na, fn := range fp.facNames {
+		c.FacNames[na] = append([]string(nil), fn...)
+	}
+	for na, r := range fp.ranges {
+		c.Ranges[na] = r
+	}
+	for na, seen := range fp.refSeen {
+		c.RefSeen[na] = seen
+	}
+	for na, ref := range fp.autoRefs {
+		if c.AutoRefs == nil {
+			c.AutoRefs = make(map[string]string)
+		}
+		c.AutoRefs[na] = ref
+	}
+	for na, sc := range fp.blockScales {
+		if c.BlockScales == nil {
+			c.BlockScales = make(map[string][2]float64)
+		}
+		c.BlockScales[na] = sc
+	}
+	for na, layout := range fp.layouts {
+		if c.DateLayouts == nil {
+			c.DateLayouts = make(map[string]string)
+		}
+		c.DateLayouts[na] = layout
+	}
+
+	return c
+}
+
+// setFitted replaces the parameters learned from the data with those
+// in c.
+func (fp *Parser) setFitted(c *Codes) {
+
+	fp.resetCodes()
+
+	for na, codes := range c.Codes {
+		fp.codes[na] = copyCodes(codes)
+	}
+	for na, fn := range c.FacNames {
+		fp.facNames[na] = append([]string(nil), fn...)
+	}
+	for na, r := range c.Ranges {
+		fp.ranges[na] = r
+	}
+	fp.vars = append([]string(nil), c.Variables...)
+	for na, seen := range c.RefSeen {
+		fp.refSeen[na] = seen
+	}
+	for na, rare := range c.Pooled {
+		fp.setPooled(na, rare)
+	}
+	for na, ref := range c.AutoRefs {
+		fp.setAutoRef(na, ref, levelsByCode(fp.codes[na]))
+	}
+	fp.blockScales = make(map[string][2]float64)
+	for na, sc := range c.BlockScales {
+		fp.blockScales[na] = sc
+	}
+	fp.blockFitted = c.BlockFitted
+	fp.meanWeight = c.MeanWeight
+	for na, v := range c.Versions {
+		fp.versions[na] = v
+	}
+	for na, q := range c.Quantiles {
+		fp.quantiles[na] = q.copy()
+	}
+	for na, layout := range c.DateLayouts {
+		fp.layouts[na] = layout
+	}
+	for na, m := range c.Moments {
+		fp.moments[na] = m
+	}
+}
+
+// ShardCodes learns the codes of the formulas from the chunks of one
+// shard of a distributed dataset, for merging with the codes of the
+// other shards by MergeCodes.  The reference levels are not required
+// to occur in the shard, as they are checked when the merged codes are
+// used in Config.Codes.  Config.RefPolicy and Config.MinLevelCount are
+// not applied to the codes of a shard.
+func ShardCodes(formulas []string, chunks ChunkSource, config *Config) (*Codes, error) {
+
+	fp := &Parser{Formulas: formulas}
+	fp.configure(config)
+	if err := fp.compile(); err != nil {
+		return nil, err
+	}
+	if err := fp.validate(); err != nil {
+		return nil, err
+	}
+	fp.resetCodes()
+
+	for k := 0; ; k++ {
+		chunk, err := chunks.Chunk(k)
+		if err != nil {
+			return nil, err
+		}
+		if chunk == nil {
+			break
+		}
+		fp.updateCodes(chunk)
+	}
+	fp.selectTopLevels()
+	fp.sortLevelCodes()
+
+	c := fp.Codes()
+	c.TopCounts = fp.heavyState()
+
+	return c, nil
+}
+
+// MergeCodes merges codes learned independently from different
+// datasets, e.g. the shards of a distributed dataset that do not share
+// their data, into codes for all the data.  The levels of a keep their
+// codes, and the levels of b that are not in a are coded after them,
+// in the order of their codes in b.  The ranges, quantile sketches and
+// moments of the numeric variables are combined.  The formulas and
+// configuration must be those given to ShardCodes.  With
+// Config.TopLevels, the most frequent levels are selected again from
+// the combined counts of the levels, and with Config.SortLevels the
+// merged levels are sorted.  Reference levels chosen by
+// Config.RefPolicy, pooled levels, block scaling constants, mean
+// weights, versions and date layouts depend on all the data, and must
+// be the same in a and b, so reference levels should be given
+// explicitly when codes are merged.
+func MergeCodes(formulas []string, a, b *Codes, config *Config) (*Codes, error) {
+
+	switch {
+	case !reflect.DeepEqual(a.AutoRefs, b.AutoRefs):
+		return nil, fmt.Errorf("MergeCodes: the reference levels chosen by the reference level policies differ")
+	case !reflect.DeepEqual(a.Pooled, b.Pooled):
+		return nil, fmt.Errorf("MergeCodes: the pooled levels differ")
+	case a.BlockFitted && b.BlockFitted && !reflect.DeepEqual(a.BlockScales, b.BlockScales):
+		return nil, fmt.Errorf("MergeCodes: the block scaling constants differ")
+	case a.MeanWeight != 0 && b.MeanWeight != 0 && a.MeanWeight != b.MeanWeight:
+		return nil, fmt.Errorf("MergeCodes: the mean weights differ")
+	}
+	for na, v := range a.Versions {
+		if w, ok := b.Versions[na]; ok && w != v {
+			return nil, fmt.Errorf("MergeCodes: variable '%s' has versions '%s' and '%s'", na, v, w)
+		}
+	}
+	for na, layout := range a.DateLayouts {
+		if l, ok := b.DateLayouts[na]; ok && l != layout {
+			return nil, fmt.Errorf("MergeCodes: variable '%s' has date layouts '%s' and '%s'", na, layout, l)
+		}
+	}
+
+	// A copy of a
+	fp := &Parser{Formulas: formulas}
+	fp.configure(config)
+	if err := fp.compile(); err != nil {
+		return nil, err
+	}
+	fp.setFitted(a)
+	c := fp.Codes()
+
+	for na, codes := range b.Codes {
+		mc, ok := c.Codes[na]
+		if !ok {
+			mc = make(map[string]int)
+			c.Codes[na] = mc
+		}
+		for _, lev := range levelsByCode(codes) {
+			if _, ok := mc[lev]; !ok {
+				mc[lev] = len(mc)
+				c.FacNames[na] = append(c.FacNames[na], fmt.Sprintf("%s[%s]", na, lev))
+			}
+		}
+	}
+
+	for na, r := range b.Ranges {
+		if q, ok := c.Ranges[na]; ok {
+			r[0] = math.Min(r[0], q[0])
+			r[1] = math.Max(r[1], q[1])
+		}
+		c.Ranges[na] = r
+	}
+
+	for _, na := range b.Variables {
+		if find(c.Variables, na) == -1 {
+			c.Variables = append(c.Variables, na)
+		}
+	}
+
+	for na, seen := range b.RefSeen {
+		c.RefSeen[na] = c.RefSeen[na] || seen
+	}
+
+	if !c.BlockFitted {
+		c.BlockScales = b.BlockScales
+		c.BlockFitted = b.BlockFitted
+	}
+	if c.MeanWeight == 0 {
+		c.MeanWeight = b.MeanWeight
+	}
+
+	for na, v := range b.Versions {
+		c.Versions[na] = v
+	}
+
+	for na, m := range b.Moments {
+		if c.Moments == nil {
+			c.Moments = make(map[string][3]float64)
+		}
+		c.Moments[na] = mergeMoments(c.Moments[na], m)
+	}
+
+	for na, layout := range b.DateLayouts {
+		if c.DateLayouts == nil {
+			c.DateLayouts = make(map[string]string)
+		}
+		c.DateLayouts[na] = layout
+	}
+
+	for na, q := range b.Quantiles {
+		if c.Quantiles == nil {
+			c.Quantiles = make(map[string]*quantileSketch)
+		}
+		if cq, ok := c.Quantiles[na]; ok {
+			cq.merge(q)
+		} else {
+			c.Quantiles[na] = q.copy()
+		}
+	}
+
+	// Select and order the levels of the merged codes as for a
+	// single dataset.
+	fp.setFitted(c)
+	fp.reselectTopLevels(a.TopCounts, b.TopCounts)
+	fp.sortLevelCodes()
+	c = fp.Codes()
+	c.TopCounts = fp.heavyState()
+
+	return c, nil
+}
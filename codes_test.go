@@ -0,0 +1,219 @@
+package formula
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestCodes(t *testing.T) {
+
+	names := []string{"x1", "x3"}
+	train := mustSource([]interface{}{
+		[]float64{1, 2, 3, 4},
+		[]string{"b", "a", "c", "a"},
+	}, names)
+	test := mustSource([]interface{}{
+		[]float64{5, 6},
+		[]string{"c", "d"},
+	}, names)
+
+	config := &Config{RefLevels: map[string]string{"x3": "a"}}
+	fp, err := New("x1 + x3", train, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The codes survive a round trip through JSON
+	b, err := json.Marshal(fp.Codes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var codes Codes
+	if err := json.Unmarshal(b, &codes); err != nil {
+		t.Fatal(err)
+	}
+
+	// A parser given the codes produces the same columns for the
+	// test data as the parser that learned them
+	exp, err := fp.WithData(test).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config2 := &Config{RefLevels: map[string]string{"x3": "a"}, Codes: &codes}
+	fp2, err := New("x1 + x3", test, config2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp2.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+	if cols.names[1] != "x3[b]" || cols.names[2] != "x3[c]" {
+		t.Errorf("Unexpected columns %v", cols.names)
+	}
+
+	// A stream given the codes does not need to learn them
+	s, err := NewStream([]string{"x1 + x3"}, NewChunkSource(test), config2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err = s.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+	if _, err := s.Next(); err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+}
+
+func TestMergeCodes(t *testing.T) {
+
+	names := []string{"x1", "x3"}
+	shard1 := mustSource([]interface{}{
+		[]float64{1, 2, 3},
+		[]string{"b", "a", "c"},
+	}, names)
+	shard2 := mustSource([]interface{}{
+		[]float64{-1, 2},
+		[]string{"d", "b"},
+	}, names)
+
+	config := &Config{RefLevels: map[string]string{"x3": "a"}}
+	var codes []*Codes
+	for _, src := range []DataSource{shard1, shard2} {
+		c, err := ShardCodes([]string{"x1 + x3"}, NewChunkSource(src), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		codes = append(codes, c)
+	}
+
+	c, err := MergeCodes([]string{"x1 + x3"}, codes[0], codes[1], config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Ranges["x1"] != [2]float64{-1, 3} || !c.RefSeen["x3"] {
+		t.Errorf("Unexpected merged codes %+v", c)
+	}
+
+	// Both shards are coded with the same columns
+	config2 := &Config{RefLevels: map[string]string{"x3": "a"}, Codes: c}
+	exp := []string{"x1", "x3[b]", "x3[c]", "x3[d]"}
+	for k, src := range []DataSource{shard1, shard2} {
+		fp, err := New("x1 + x3", src, config2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cols, err := fp.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(cols.Names(), exp) {
+			t.Errorf("Shard %d: expected columns %v, observed %v", k, exp, cols.Names())
+		}
+	}
+
+	// Codes with different automatic reference levels can not be
+	// merged
+	codes[1].AutoRefs = map[string]string{"x3": "b"}
+	if _, err := MergeCodes([]string{"x1 + x3"}, codes[0], codes[1], config); err == nil {
+		t.Errorf("Expected an error for different reference levels")
+	}
+}
+
+func TestMergeCodesLevels(t *testing.T) {
+
+	shard1 := mustSource([]interface{}{
+		[]string{"c", "c", "c", "a", "d"},
+	}, []string{"x"})
+	shard2 := mustSource([]interface{}{
+		[]string{"b", "b", "d", "d", "a"},
+	}, []string{"x"})
+
+	for _, tc := range []struct {
+		config *Config
+		exp    []string
+	}{
+		{
+			// The merged levels are sorted
+			config: &Config{SortLevels: true, OneHot: true},
+			exp:    []string{"a", "b", "c", "d"},
+		},
+		{
+			// c and d are the most frequent levels overall,
+			// although b is more frequent than d in shard 2
+			config: &Config{TopLevels: 2, OneHot: true},
+			exp:    []string{"c", "d"},
+		},
+		{
+			config: &Config{TopLevels: 2, SortLevels: true, OneHot: true},
+			exp:    []string{"c", "d"},
+		},
+		{
+			// The declared level is kept
+			config: &Config{TopLevels: 2, SortLevels: true, OneHot: true,
+				Levels: map[string][]string{"x": {"z"}}},
+			exp: []string{"z", "c", "d"},
+		},
+	} {
+		formulas := []string{"x"}
+		var codes []*Codes
+		for _, src := range []DataSource{shard1, shard2} {
+			c, err := ShardCodes(formulas, NewChunkSource(src), tc.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			codes = append(codes, c)
+		}
+
+		c, err := MergeCodes(formulas, codes[0], codes[1], tc.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if levels := levelsByCode(c.Codes["x"]); !reflect.DeepEqual(levels, tc.exp) {
+			t.Errorf("%+v: expected levels %v, observed %v", tc.config, tc.exp, levels)
+		}
+		if len(c.FacNames["x"]) != len(tc.exp) {
+			t.Errorf("%+v: unexpected names %v", tc.config, c.FacNames["x"])
+		}
+	}
+}
+
+func TestWithDataCopy(t *testing.T) {
+
+	fp, err := New("x3 + C(x2) + ecdf(x1)", simpleData(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	before := fp.Codes()
+
+	// Changing the learned state of the new parser does not change
+	// fp
+	p := fp.WithData(simpleData())
+	p.codes["x3"]["z"] = len(p.codes["x3"])
+	p.facNames["x3"] = append(p.facNames["x3"], "x3[z]")
+	p.refSeen["C(x2)"] = false
+	p.quantiles["x1"].add(100)
+	p.blockScales["x1"] = [2]float64{1, 2}
+	if !reflect.DeepEqual(before, fp.Codes()) {
+		t.Errorf("WithData shares the codes with the original parser")
+	}
+
+	if _, err := p.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(before, fp.Codes()) {
+		t.Errorf("Parsing new data changed the codes of the original parser")
+	}
+}
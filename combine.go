@@ -0,0 +1,179 @@
+package formula
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ConcatRows returns a DataSource containing the rows of each source
+// in turn.  All sources must have the same variables, with the same
+// types.  The variables are ordered as in the first source.  The data
+// are copied.
+func ConcatRows(sources ...DataSource) (DataSource, error) {
+
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("ConcatRows: no sources")
+	}
+
+	names := sources[0].Names()
+	for k, src := range sources[1:] {
+		if len(src.Names()) != len(names) {
+			return nil, fmt.Errorf("ConcatRows: source %d has %d variables, expected %d", k+1, len(src.Names()), len(names))
+		}
+	}
+
+	data := make([]interface{}, len(names))
+	for j, na := range names {
+		for k, src := range sources {
+			x := src.Get(na)
+			if x == nil {
+				return nil, fmt.Errorf("ConcatRows: variable '%s' not found in source %d", na, k)
+			}
+			switch x := x.(type) {
+			case []float64:
+				y, ok := data[j].([]float64)
+				if !ok && data[j] != nil {
+					return nil, fmt.Errorf("ConcatRows: variable '%s' in source %d has type %T", na, k, x)
+				}
+				data[j] = append(y, x...)
+			case []string:
+				y, ok := data[j].([]string)
+				if !ok && data[j] != nil {
+					return nil, fmt.Errorf("ConcatRows: variable '%s' in source %d has type %T", na, k, x)
+				}
+				data[j] = append(y, x...)
+			case []int:
+				y, ok := data[j].([]int)
+				if !ok && data[j] != nil {
+					return nil, fmt.Errorf("ConcatRows: variable '%s' in source %d has type %T", na, k, x)
+				}
+				data[j] = append(y, x...)
+			case []int64:
+				y, ok := data[j].([]int64)
+				if !ok && data[j] != nil {
+					return nil, fmt.Errorf("ConcatRows: variable '%s' in source %d has type %T", na, k, x)
+				}
+				data[j] = append(y, x...)
+			case []bool:
+				y, ok := data[j].([]bool)
+				if !ok && data[j] != nil {
+					return nil, fmt.Errorf("ConcatRows: variable '%s' in source %d has type %T", na, k, x)
+				}
+				data[j] = append(y, x...)
+			default:
+				return nil, fmt.Errorf("ConcatRows: variable '%s' in source %d has unsupported type %T", na, k, x)
+			}
+		}
+	}
+
+	src, err := NewSource(data, append([]string(nil), names...))
+	if err != nil {
+		return nil, err
+	}
+
+	return src, nil
+}
+
+// colView is a DataSource whose variables are taken from other
+// DataSources.
+type colView struct {
+	names []string
+	src   map[string]DataSource
+
+	// The name of each variable in its source
+	orig map[string]string
+}
+
+// Names returns the names of the variables.
+func (v *colView) Names() []string {
+	return v.names
+}
+
+// Get returns the data for one variable.
+func (v *colView) Get(na string) interface{} {
+	src, ok := v.src[na]
+	if !ok {
+		return nil
+	}
+	return src.Get(v.orig[na])
+}
+
+// ConcatCols returns a DataSource containing the variables of all
+// the given sources, in order.  The sources must have the same number
+// of rows and no variable may appear in more than one source.  The
+// data are not copied.
+func ConcatCols(sources ...DataSource) (DataSource, error) {
+
+	v := &colView{
+		src:  make(map[string]DataSource),
+		orig: make(map[string]string),
+	}
+
+	n := -1
+	for k, src := range sources {
+		for _, na := range src.Names() {
+			if _, ok := v.src[na]; ok {
+				return nil, fmt.Errorf("ConcatCols: variable '%s' in source %d is duplicated", na, k)
+			}
+			m, err := columnLength(na, src.Get(na))
+			if err != nil {
+				return nil, fmt.Errorf("ConcatCols: %v", err)
+			}
+			if n == -1 {
+				n = m
+			} else if m != n {
+				return nil, fmt.Errorf("ConcatCols: variable '%s' in source %d has length %d, expected %d", na, k, m, n)
+			}
+			v.names = append(v.names, na)
+			v.src[na] = src
+			v.orig[na] = na
+		}
+	}
+
+	return v, nil
+}
+
+// RenameColumns returns a DataSource that presents the variables of
+// src under new names.  The mapping is from old names to new names,
+// variables not in the mapping keep their names.  The data are not
+// copied.
+func RenameColumns(src DataSource, mapping map[string]string) (DataSource, error) {
+
+	v := &colView{
+		src:  make(map[string]DataSource),
+		orig: make(map[string]string),
+	}
+
+	used := make(map[string]bool)
+	for _, na := range src.Names() {
+		used[na] = true
+	}
+
+	// Check the mapping in sorted order so that the error is
+	// reproducible.
+	var old []string
+	for na := range mapping {
+		old = append(old, na)
+	}
+	sort.Strings(old)
+	for _, na := range old {
+		if !used[na] {
+			return nil, fmt.Errorf("RenameColumns: variable '%s' not found", na)
+		}
+	}
+
+	for _, na := range src.Names() {
+		newna, ok := mapping[na]
+		if !ok {
+			newna = na
+		}
+		if _, ok := v.src[newna]; ok {
+			return nil, fmt.Errorf("RenameColumns: variable name '%s' is duplicated", newna)
+		}
+		v.names = append(v.names, newna)
+		v.src[newna] = src
+		v.orig[newna] = na
+	}
+
+	return v, nil
+}
@@ -0,0 +1,120 @@
+package formula
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConcatRows(t *testing.T) {
+
+	src1 := mustSource([]interface{}{[]float64{1, 2}, []string{"a", "b"}}, []string{"x", "y"})
+	src2 := mustSource([]interface{}{[]string{"c"}, []float64{3}}, []string{"y", "x"})
+
+	src, err := ConcatRows(src1, src2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(src.Names(), []string{"x", "y"}) {
+		t.Fail()
+	}
+	if !reflect.DeepEqual(src.Get("x"), []float64{1, 2, 3}) || !reflect.DeepEqual(src.Get("y"), []string{"a", "b", "c"}) {
+		t.Fail()
+	}
+
+	// The inputs are not modified
+	if !reflect.DeepEqual(src1.Get("x"), []float64{1, 2}) {
+		t.Fail()
+	}
+
+	bad1 := mustSource([]interface{}{[]float64{3}}, []string{"x"})
+	bad2 := mustSource([]interface{}{[]float64{3}, []float64{4}}, []string{"x", "y"})
+	bad3 := mustSource([]interface{}{[]float64{3}, []string{"c"}}, []string{"x", "z"})
+	for _, bad := range []DataSource{bad1, bad2, bad3} {
+		if _, err := ConcatRows(src1, bad); err == nil {
+			t.Fail()
+		}
+	}
+}
+
+func TestConcatRowsIntBool(t *testing.T) {
+
+	names := []string{"n", "m", "b"}
+	src1 := mustSource([]interface{}{[]int{1, 2}, []int64{10, 20}, []bool{true, false}}, names)
+	src2 := mustSource([]interface{}{[]int{3}, []int64{30}, []bool{true}}, names)
+
+	src, err := ConcatRows(src1, src2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(src.Get("n"), []int{1, 2, 3}) || !reflect.DeepEqual(src.Get("m"), []int64{10, 20, 30}) ||
+		!reflect.DeepEqual(src.Get("b"), []bool{true, false, true}) {
+		t.Errorf("Unexpected data %v %v %v", src.Get("n"), src.Get("m"), src.Get("b"))
+	}
+
+	// The integer types are not mixed
+	bad := mustSource([]interface{}{[]int64{3}, []int64{30}, []bool{true}}, names)
+	if _, err := ConcatRows(src1, bad); err == nil {
+		t.Errorf("Expected an error for []int and []int64")
+	}
+}
+
+func TestConcatCols(t *testing.T) {
+
+	src1 := mustSource([]interface{}{[]float64{1, 2}, []string{"a", "b"}}, []string{"x", "y"})
+	src2 := mustSource([]interface{}{[]float64{3, 4}}, []string{"z"})
+
+	src, err := ConcatCols(src1, src2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(src.Names(), []string{"x", "y", "z"}) {
+		t.Fail()
+	}
+	if !reflect.DeepEqual(src.Get("z"), []float64{3, 4}) || src.Get("w") != nil {
+		t.Fail()
+	}
+
+	if _, err := ConcatCols(src1, src1); err == nil {
+		t.Fail()
+	}
+	if _, err := ConcatCols(src1, mustSource([]interface{}{[]float64{3}}, []string{"z"})); err == nil {
+		t.Fail()
+	}
+}
+
+func TestRenameColumns(t *testing.T) {
+
+	src, err := RenameColumns(simpleData(), map[string]string{"x1": "age", "x3": "sex"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(src.Names(), []string{"age", "x2", "sex", "x4"}) {
+		t.Fail()
+	}
+	if src.Get("x1") != nil {
+		t.Fail()
+	}
+
+	fp, err := New("age + sex", src, &Config{RefLevels: map[string]string{"sex": "a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := &ColSet{
+		names: []string{"age", "sex[b]"},
+		data:  [][]float64{{0, 1, 2, 3, 4}, {0, 1, 0, 1, 0}},
+	}
+	if !colSetEq(cs, exp) {
+		t.Fail()
+	}
+
+	if _, err := RenameColumns(simpleData(), map[string]string{"x1": "x2"}); err == nil {
+		t.Fail()
+	}
+	if _, err := RenameColumns(simpleData(), map[string]string{"y": "z"}); err == nil {
+		t.Fail()
+	}
+}
@@ -0,0 +1,93 @@
+package formula
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Compiling a formula, i.e. lexing it and converting it to RPN, only
+// depends on the text of the formula and a few settings in the
+// Config.  The compiled formulas are kept in a package-level cache,
+// so that constructing many Parsers or Streams with the same formulas,
+// e.g. once per request in a service, does not repeat the work.  The
+// cached formulas are never modified, so they can be shared by
+// Parsers in different goroutines.
+
+// compiled holds the RPN of a formula, and of its left-hand side if
+// it has one.
+type compiled struct {
+	rhs []*token
+	lhs []*token
+}
+
+var compileCache = struct {
+	sync.Mutex
+	disabled bool
+	entries  map[string]*compiled
+}{entries: make(map[string]*compiled)}
+
+// SetCompileCache enables or disables the cache of compiled formulas.
+// The cache is enabled by default.  Disabling the cache also clears
+// it.
+func SetCompileCache(enabled bool) {
+	compileCache.Lock()
+	defer compileCache.Unlock()
+	compileCache.disabled = !enabled
+	if !enabled {
+		compileCache.entries = make(map[string]*compiled)
+	}
+}
+
+// ClearCompileCache removes all formulas from the cache of compiled
+// formulas.
+func ClearCompileCache() {
+	compileCache.Lock()
+	defer compileCache.Unlock()
+	compileCache.entries = make(map[string]*compiled)
+}
+
+// compileKey returns the cache key of a formula, which includes the
+// settings that affect how it is compiled.
+func (fp *Parser) compileKey(fml string) string {
+
+	var parts []string
+	for na, body := range fp.macros {
+		parts = append(parts, "macro "+na+"="+body)
+	}
+	for sym, op := range fp.binaryOps {
+		parts = append(parts, fmt.Sprintf("op %s %d", sym, op.Precedence))
+	}
+	sort.Strings(parts)
+	parts = append(parts, fmt.Sprintf("icept %t", fp.autoIcept), fml)
+
+	return strings.Join(parts, "\x00")
+}
+
+// compileCached returns the compiled formula from the cache, or
+// compiles it and adds it to the cache.
+func (fp *Parser) compileCached(fml string) (*compiled, error) {
+
+	key := fp.compileKey(fml)
+	compileCache.Lock()
+	c, ok := compileCache.entries[key]
+	disabled := compileCache.disabled
+	compileCache.Unlock()
+	if ok {
+		return c, nil
+	}
+
+	c, err := fp.compileFormula(fml)
+	if err != nil {
+		return nil, err
+	}
+
+	if !disabled {
+		compileCache.Lock()
+		compileCache.entries[key] = c
+		compileCache.Unlock()
+	}
+
+	return c, nil
+}
@@ -0,0 +1,57 @@
+package formula
+
+import (
+	"testing"
+)
+
+func TestCompileCache(t *testing.T) {
+
+	ClearCompileCache()
+	defer SetCompileCache(true)
+
+	fp1, err := New("x1 + demog", simpleData(), &Config{Macros: map[string]string{"demog": "x4"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp2, err := New("x1 + demog", simpleData(), &Config{Macros: map[string]string{"demog": "x4"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp3, err := New("x1 + demog", simpleData(), &Config{Macros: map[string]string{"demog": "x3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if &fp1.rpn[0][0] != &fp2.rpn[0][0] {
+		t.Errorf("The compiled formula should be shared")
+	}
+	if &fp1.rpn[0][0] == &fp3.rpn[0][0] {
+		t.Errorf("The compiled formula depends on the macros")
+	}
+	if len(compileCache.entries) != 2 {
+		t.Errorf("Expected 2 cached formulas, found %d", len(compileCache.entries))
+	}
+
+	// The shared formula gives the same results
+	for _, fp := range []*Parser{fp1, fp2} {
+		cols, err := fp.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cols.Names()) != 2 || cols.Names()[1] != "x4" {
+			t.Errorf("Unexpected names %v", cols.Names())
+		}
+	}
+
+	ClearCompileCache()
+	if len(compileCache.entries) != 0 {
+		t.Errorf("The cache should be empty")
+	}
+
+	SetCompileCache(false)
+	if _, err := New("x1 + x4", simpleData(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(compileCache.entries) != 0 {
+		t.Errorf("The cache should be disabled")
+	}
+}
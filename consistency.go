@@ -0,0 +1,167 @@
+package formula
+
+import (
+	"fmt"
+)
+
+// SiteReport describes the differences between the design of one
+// dataset and the design of a reference dataset, see
+// CheckConsistency.
+type SiteReport struct {
+
+	// Site is the position of the dataset in the list of
+	// datasets.
+	Site int
+
+	// Err is the error that occurred when coding or parsing the
+	// dataset, if any, in which case the columns are not compared.
+	Err error
+
+	// TypeChanges holds the variables whose types differ from the
+	// types in the reference dataset, with a description of the
+	// change, e.g. "float64 -> string".
+	TypeChanges map[string]string
+
+	// MissingVars are the variables used by the formulas that are
+	// in the reference dataset but not in this dataset.
+	MissingVars []string
+
+	// NewLevels holds the levels of each categorical variable
+	// that are not in the reference dataset, and MissingLevels
+	// the levels of the reference dataset that are not in this
+	// dataset.
+	NewLevels     map[string][]string
+	MissingLevels map[string][]string
+
+	// MissingColumns are the columns of the reference design that
+	// are not in the design of this dataset, and ExtraColumns
+	// the columns of this design that are not in the reference
+	// design.
+	MissingColumns []string
+	ExtraColumns   []string
+
+	// Reordered is true if the columns that both designs have
+	// are in different orders.
+	Reordered bool
+}
+
+// OK returns true if the design of the dataset has the same columns
+// as the reference design, and its variables have the same types and
+// levels.
+func (r *SiteReport) OK() bool {
+	return r.Err == nil && len(r.TypeChanges) == 0 && len(r.MissingVars) == 0 &&
+		len(r.NewLevels) == 0 && len(r.MissingLevels) == 0 &&
+		len(r.MissingColumns) == 0 && len(r.ExtraColumns) == 0 && !r.Reordered
+}
+
+// dtype returns a description of the type of a variable in a dataset,
+// or "" if the variable is not present.
+func (fp *Parser) dtype(src DataSource, na string) string {
+
+	v := fp.convertData(na, src.Get(na))
+	_, isDate := fp.get(src, na).([]float64)
+	switch v.(type) {
+	case nil:
+		return ""
+	case []float64:
+		return "float64"
+	case []string:
+		if isDate {
+			return "date"
+		}
+		return "string"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// CheckConsistency applies the formulas to a reference dataset and to
+// each of the given datasets, e.g. the datasets of the sites of a
+// federated study, with each dataset coded independently, and reports
+// for each dataset how its design differs from the reference design.
+// An error is returned if the reference dataset can not be parsed.
+func CheckConsistency(formulas []string, ref DataSource, sites []DataSource, config *Config) ([]*SiteReport, error) {
+
+	fp, err := NewMulti(formulas, ref, config)
+	if err != nil {
+		return nil, err
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		return nil, err
+	}
+	vars := fp.varNames()
+
+	var reports []*SiteReport
+	for k, src := range sites {
+		r := &SiteReport{Site: k}
+		reports = append(reports, r)
+
+		for _, na := range vars {
+			t0, t1 := fp.dtype(ref, na), fp.dtype(src, na)
+			switch {
+			case t1 == "":
+				r.MissingVars = append(r.MissingVars, na)
+			case t0 != t1:
+				if r.TypeChanges == nil {
+					r.TypeChanges = make(map[string]string)
+				}
+				r.TypeChanges[na] = t0 + " -> " + t1
+			}
+		}
+
+		sp, err := NewMulti(formulas, src, config)
+		if err != nil {
+			r.Err = err
+			continue
+		}
+		scols, err := sp.Parse()
+		if err != nil {
+			r.Err = err
+			continue
+		}
+
+		for na, codes := range fp.codes {
+			scodes := sp.codes[na]
+			for _, lev := range levelsByCode(codes) {
+				if _, ok := scodes[lev]; !ok {
+					if r.MissingLevels == nil {
+						r.MissingLevels = make(map[string][]string)
+					}
+					r.MissingLevels[na] = append(r.MissingLevels[na], lev)
+				}
+			}
+			for _, lev := range levelsByCode(scodes) {
+				if _, ok := codes[lev]; !ok {
+					if r.NewLevels == nil {
+						r.NewLevels = make(map[string][]string)
+					}
+					r.NewLevels[na] = append(r.NewLevels[na], lev)
+				}
+			}
+		}
+
+		var common0, common1 []string
+		for _, na := range cols.names {
+			if find(scols.names, na) == -1 {
+				r.MissingColumns = append(r.MissingColumns, na)
+			} else {
+				common0 = append(common0, na)
+			}
+		}
+		for _, na := range scols.names {
+			if find(cols.names, na) == -1 {
+				r.ExtraColumns = append(r.ExtraColumns, na)
+			} else {
+				common1 = append(common1, na)
+			}
+		}
+		for j := range common0 {
+			if common0[j] != common1[j] {
+				r.Reordered = true
+			}
+		}
+	}
+
+	return reports, nil
+}
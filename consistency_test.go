@@ -0,0 +1,63 @@
+package formula
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckConsistency(t *testing.T) {
+
+	names := []string{"x1", "x3"}
+	ref := mustSource([]interface{}{
+		[]float64{1, 2, 3},
+		[]string{"a", "b", "c"},
+	}, names)
+	same := mustSource([]interface{}{
+		[]float64{4, 5, 6},
+		[]string{"b", "c", "a"},
+	}, names)
+	order := mustSource([]interface{}{
+		[]float64{4, 5, 6},
+		[]string{"c", "a", "b"},
+	}, names)
+	levels := mustSource([]interface{}{
+		[]float64{4, 5, 6},
+		[]string{"a", "b", "d"},
+	}, names)
+	types := mustSource([]interface{}{
+		[]string{"4", "5", "6"},
+		[]string{"a", "b", "c"},
+	}, names)
+
+	config := &Config{RefLevels: map[string]string{"x3": "a"}}
+	reports, err := CheckConsistency([]string{"x1 + x3"}, ref, []DataSource{same, order, levels, types}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 4 {
+		t.Fatalf("Expected 4 reports, got %d", len(reports))
+	}
+
+	if !reports[0].OK() {
+		t.Errorf("Unexpected report for site 0: %+v", reports[0])
+	}
+
+	// The levels are first seen in a different order
+	r := reports[1]
+	if r.OK() || !r.Reordered || len(r.MissingColumns) > 0 || len(r.ExtraColumns) > 0 {
+		t.Errorf("Unexpected report for site 1: %+v", r)
+	}
+
+	r = reports[2]
+	if r.OK() || !reflect.DeepEqual(r.NewLevels, map[string][]string{"x3": {"d"}}) ||
+		!reflect.DeepEqual(r.MissingLevels, map[string][]string{"x3": {"c"}}) ||
+		!reflect.DeepEqual(r.MissingColumns, []string{"x3[c]"}) ||
+		!reflect.DeepEqual(r.ExtraColumns, []string{"x3[d]"}) {
+		t.Errorf("Unexpected report for site 2: %+v", r)
+	}
+
+	r = reports[3]
+	if r.OK() || !reflect.DeepEqual(r.TypeChanges, map[string]string{"x1": "float64 -> string"}) {
+		t.Errorf("Unexpected report for site 3: %+v", r)
+	}
+}
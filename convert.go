@@ -0,0 +1,86 @@
+package formula
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Integer variables, i.e. variables whose data are []int or []int64,
+// are converted to numeric variables, or to categorical variables
+// whose levels are the decimal representations of the integers if
+// they are in Config.IntCategorical, e.g. integer codes of a
+// treatment group.  Boolean variables, whose data are []bool, are
+// converted to numeric variables that are 1 for true and 0 for false.
+// The conversion takes place when the data are read, so these
+// variables can be used anywhere that numeric or string variables
+// can.
+
+// convertData returns the values of an integer or boolean variable na
+// as []float64 or []string, according to Config.IntCategorical.
+// Other values are returned unchanged.
+func (fp *Parser) convertData(na string, v interface{}) interface{} {
+
+	cat := fp.intCategorical[na]
+	switch x := v.(type) {
+	case []bool:
+		f := make([]float64, len(x))
+		for i, u := range x {
+			if u {
+				f[i] = 1
+			}
+		}
+		return f
+	case []int:
+		if cat {
+			s := make([]string, len(x))
+			for i, u := range x {
+				s[i] = strconv.Itoa(u)
+			}
+			return s
+		}
+		f := make([]float64, len(x))
+		for i, u := range x {
+			f[i] = float64(u)
+		}
+		return f
+	case []int64:
+		if cat {
+			s := make([]string, len(x))
+			for i, u := range x {
+				s[i] = strconv.FormatInt(u, 10)
+			}
+			return s
+		}
+		f := make([]float64, len(x))
+		for i, u := range x {
+			f[i] = float64(u)
+		}
+		return f
+	default:
+		return v
+	}
+}
+
+// normalize returns the levels of a string variable with leading and
+// trailing white space removed if Config.TrimLevels is set, and in
+// lower case if Config.FoldLevels is set.  x is returned if there is
+// nothing to do.
+func (fp *Parser) normalize(x []string) []string {
+
+	if !fp.trimLevels && !fp.foldLevels {
+		return x
+	}
+
+	y := make([]string, len(x))
+	for i, v := range x {
+		if fp.trimLevels {
+			v = strings.TrimSpace(v)
+		}
+		if fp.foldLevels {
+			v = strings.ToLower(v)
+		}
+		y[i] = v
+	}
+
+	return y
+}
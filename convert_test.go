@@ -0,0 +1,127 @@
+package formula
+
+import (
+	"testing"
+)
+
+func TestIntVariables(t *testing.T) {
+
+	data := []interface{}{
+		[]int{1, 2, 3, 1},
+		[]int64{10, 20, 30, 40},
+		[]int{7, 8, 7, 7},
+	}
+	src, err := NewSource(data, []string{"grp", "n", "k"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	double := func(na string, x []float64) *ColSet {
+		y := make([]float64, len(x))
+		for i, v := range x {
+			y[i] = 2 * v
+		}
+		return NewColSet([]string{na}, [][]float64{y})
+	}
+	config := &Config{
+		RefLevels:      map[string]string{"grp": "1"},
+		IntCategorical: map[string]bool{"grp": true},
+		Funcs:          map[string]Func{"double": double},
+	}
+	fp, err := New("grp + n + double(k)", src, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &ColSet{
+		names: []string{"grp[2]", "grp[3]", "n", "double(k)"},
+		data: [][]float64{
+			{0, 1, 0, 0},
+			{0, 0, 1, 0},
+			{10, 20, 30, 40},
+			{14, 16, 14, 14},
+		},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+
+	if err := src.Append([]interface{}{[]int{2}, []int64{50}, []int{8}}); err != nil {
+		t.Fatal(err)
+	}
+	if src.NumRows() != 5 {
+		t.Errorf("Expected 5 rows after Append, found %d", src.NumRows())
+	}
+}
+
+func TestBoolVariables(t *testing.T) {
+
+	data := []interface{}{
+		[]bool{true, false, false, true},
+		[]float64{1, 2, 3, 4},
+	}
+	src, err := NewSource(data, []string{"smoker", "z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fp, err := New("smoker + smoker:z", src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &ColSet{
+		names: []string{"smoker", "smoker:z"},
+		data: [][]float64{
+			{1, 0, 0, 1},
+			{1, 0, 0, 4},
+		},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+}
+
+func TestNormalizeLevels(t *testing.T) {
+
+	data := []interface{}{
+		[]string{"Male", "male ", "MALE", " Female", "female"},
+	}
+	src, err := NewSource(data, []string{"sex"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{
+		RefLevels:  map[string]string{"sex": "female"},
+		TrimLevels: true,
+		FoldLevels: true,
+	}
+	fp, err := New("sex + C(sex)", src, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &ColSet{
+		names: []string{"sex[male]", "C(sex)[male]"},
+		data: [][]float64{
+			{1, 1, 1, 0, 0},
+			{1, 1, 1, 0, 0},
+		},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+}
@@ -0,0 +1,181 @@
+package formula
+
+import (
+	"fmt"
+	"io"
+	"math"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// CrossProd holds the cross product XᵀX and the column means of a
+// design matrix X, which are sufficient for solving the normal
+// equations of a linear regression.  Rows of X with missing values
+// are excluded.
+type CrossProd struct {
+
+	// Names are the names of the columns of X.
+	Names []string
+
+	// XtX is the (uncentered) cross product of X with itself.
+	XtX *mat.SymDense
+
+	// Means are the means of the columns of X.
+	Means []float64
+
+	// NumObs is the number of rows of X that were used.
+	NumObs int
+}
+
+// crossAccum accumulates a CrossProd one chunk at a time.
+type crossAccum struct {
+	names []string
+	xtx   []float64
+	sums  []float64
+	n     int
+}
+
+// add accumulates the rows of cs that have no missing values.
+func (ca *crossAccum) add(cs *ColSet) error {
+
+	p := len(cs.data)
+	if ca.xtx == nil {
+		ca.names = append([]string(nil), cs.names...)
+		ca.xtx = make([]float64, p*p)
+		ca.sums = make([]float64, p)
+	} else if p != len(ca.sums) {
+		return fmt.Errorf("chunk has %d columns, expected %d", p, len(ca.sums))
+	}
+
+	row := make([]float64, p)
+	for i := 0; i < numRowsColSet(cs); i++ {
+		ok := true
+		for j := range row {
+			row[j] = cs.data[j][i]
+			if math.IsNaN(row[j]) {
+				ok = false
+				break
+			}
+		}
+		if !ok {
+			continue
+		}
+		for j, u := range row {
+			ca.sums[j] += u
+			for k := j; k < p; k++ {
+				ca.xtx[j*p+k] += u * row[k]
+			}
+		}
+		ca.n++
+	}
+
+	return nil
+}
+
+// result returns the accumulated CrossProd, or an error if no rows
+// were accumulated.
+func (ca *crossAccum) result() (*CrossProd, error) {
+
+	if ca.n == 0 {
+		return nil, fmt.Errorf("CrossProd: no rows without missing values")
+	}
+
+	p := len(ca.sums)
+	cp := &CrossProd{Names: ca.names, Means: make([]float64, p), NumObs: ca.n}
+	if p == 0 {
+		return cp, nil
+	}
+
+	cp.XtX = mat.NewSymDense(p, ca.xtx)
+	for j, s := range ca.sums {
+		cp.Means[j] = s / float64(ca.n)
+	}
+
+	return cp, nil
+}
+
+// The number of rows of the data that are parsed at a time by
+// Parser.CrossProd
+const crossBlockSize = 1024
+
+// rowBlock is a DataSource holding the rows lo, ..., hi-1 of another
+// DataSource, without copying the data.
+type rowBlock struct {
+	src    DataSource
+	lo, hi int
+}
+
+// Names returns the names of the variables.
+func (b *rowBlock) Names() []string {
+	return b.src.Names()
+}
+
+// Get returns the rows of the block of one variable.
+func (b *rowBlock) Get(na string) interface{} {
+	switch x := b.src.Get(na).(type) {
+	case []float64:
+		return x[b.lo:b.hi]
+	case []string:
+		return x[b.lo:b.hi]
+	case []int:
+		return x[b.lo:b.hi]
+	case []int64:
+		return x[b.lo:b.hi]
+	case []bool:
+		return x[b.lo:b.hi]
+	default:
+		return x
+	}
+}
+
+// CrossProd returns the cross product and column means of the design
+// matrix of the parser's data.  The rows of the data are parsed in
+// blocks, using the codes learned from all the data, and the cross
+// product is accumulated one block at a time, so that the design
+// matrix is never held in memory.  An error is returned if no row of
+// the design matrix is free of missing values.
+func (fp *Parser) CrossProd() (*CrossProd, error) {
+
+	var ca crossAccum
+	p := fp.WithData(fp.RawData)
+	n := numRows(fp.RawData)
+	for lo := 0; lo < n; lo += crossBlockSize {
+		hi := lo + crossBlockSize
+		if hi > n {
+			hi = n
+		}
+		p.RawData = &rowBlock{src: fp.RawData, lo: lo, hi: hi}
+		cs, err := p.Parse()
+		if err != nil {
+			return nil, err
+		}
+		if err := ca.add(cs); err != nil {
+			return nil, fmt.Errorf("CrossProd: %v", err)
+		}
+	}
+
+	return ca.result()
+}
+
+// CrossProd returns the cross product and column means of the design
+// matrix of the remaining chunks of the stream, which are accumulated
+// one chunk at a time so that the design matrix is never held in
+// memory.  Fit is called first if the stream has not been fit.  An
+// error is returned if no row is free of missing values.
+func (s *Stream) CrossProd() (*CrossProd, error) {
+
+	var ca crossAccum
+	for {
+		cs, err := s.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if err := ca.add(cs); err != nil {
+			return nil, fmt.Errorf("CrossProd: %v", err)
+		}
+	}
+
+	return ca.result()
+}
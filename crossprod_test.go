@@ -0,0 +1,95 @@
+package formula
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+func TestCrossProd(t *testing.T) {
+
+	formulas := []string{"1 + x1 + x2 + x3*x4"}
+	config := &Config{RefLevels: map[string]string{"x3": "a", "x2": "0"}}
+
+	fp, err := NewMulti(formulas, simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	xd := full.ToDense()
+	var exp mat.Dense
+	exp.Mul(xd.T(), xd)
+
+	s, err := NewStream(formulas, chunkedData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp1, err := s.CrossProd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp2, err := fp.CrossProd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cp := range []*CrossProd{cp1, cp2} {
+		if !reflect.DeepEqual(cp.Names, full.Names()) || cp.NumObs != 5 {
+			t.Errorf("Unexpected names or number of observations")
+		}
+		if !mat.EqualApprox(&exp, cp.XtX, 1e-12) {
+			t.Errorf("Expected: %v\nObserved: %v\n", mat.Formatted(&exp), mat.Formatted(cp.XtX))
+		}
+		if !floats.EqualApprox(cp.Means, []float64{1, 2, 0.4, 0}, 1e-12) {
+			t.Errorf("Unexpected means %v", cp.Means)
+		}
+	}
+
+	// Rows with missing values are excluded
+	src := mustSource([]interface{}{[]float64{1, math.NaN(), 3}}, []string{"x"})
+	fp, err = New("x", src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp, err := fp.CrossProd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.NumObs != 2 || cp.XtX.At(0, 0) != 10 || cp.Means[0] != 2 {
+		t.Errorf("Unexpected cross product with missing values")
+	}
+
+	// The cross product of data with several blocks of rows
+	n := 2*crossBlockSize + 10
+	x := make([]float64, n)
+	for i := range x {
+		x[i] = float64(i % 7)
+	}
+	fp, err = New("x", mustSource([]interface{}{x}, []string{"x"}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp, err = fp.CrossProd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.NumObs != n || cp.XtX.At(0, 0) != floats.Dot(x, x) || math.Abs(cp.Means[0]-floats.Sum(x)/float64(n)) > 1e-12 {
+		t.Errorf("Unexpected cross product of several blocks")
+	}
+
+	// No rows is an error, rather than NaN means
+	src = mustSource([]interface{}{[]float64{math.NaN()}}, []string{"x"})
+	fp, err = New("x", src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.CrossProd(); err == nil {
+		t.Errorf("Expected an error for no rows")
+	}
+}
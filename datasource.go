@@ -1,5 +1,7 @@
 package formula
 
+import "fmt"
+
 // DataSource defines a dataset that will be processed through a formula.
 type DataSource interface {
 
@@ -7,11 +9,13 @@ type DataSource interface {
 	Names() []string
 
 	// Get returns the data corresponding to one variable.  It should
-	// only return []float64 or []string
+	// only return []float64, []string, []int, []int64 or []bool,
+	// see Config.IntCategorical for integer variables.
 	Get(string) interface{}
 }
 
-type basicSource struct {
+// MemorySource is a DataSource holding its data in memory.
+type MemorySource struct {
 	names []string
 	colix map[string]int
 	data  []interface{}
@@ -19,12 +23,12 @@ type basicSource struct {
 
 // Names returns a slice containing all the names of variables in the
 // source.
-func (b *basicSource) Names() []string {
+func (b *MemorySource) Names() []string {
 	return b.names
 }
 
 // Get returns the data corresponding to a given variable name.
-func (b *basicSource) Get(col string) interface{} {
+func (b *MemorySource) Get(col string) interface{} {
 	ix, ok := b.colix[col]
 	if !ok {
 		return nil
@@ -32,16 +36,221 @@ func (b *basicSource) Get(col string) interface{} {
 	return b.data[ix]
 }
 
-// NewSource returns a DataSource for the given variables
-// and data values.
-func NewSource(data []interface{}, names []string) DataSource {
+// NewSource returns a MemorySource for the given variables and data
+// values.  Each element of data must be a []float64, []string, []int,
+// []int64 or []bool, and all elements must have the same length.
+func NewSource(data []interface{}, names []string) (*MemorySource, error) {
+
+	if len(data) != len(names) {
+		return nil, fmt.Errorf("NewSource: %d names and %d data columns", len(names), len(data))
+	}
+
 	colix := make(map[string]int)
+	n := -1
 	for k, c := range names {
+		if _, ok := colix[c]; ok {
+			return nil, fmt.Errorf("NewSource: variable '%s' is duplicated", c)
+		}
 		colix[c] = k
+
+		m, err := columnLength(c, data[k])
+		if err != nil {
+			return nil, fmt.Errorf("NewSource: %v", err)
+		}
+		if n == -1 {
+			n = m
+		} else if m != n {
+			return nil, fmt.Errorf("NewSource: variable '%s' has length %d, expected %d", c, m, n)
+		}
 	}
-	return &basicSource{
+
+	return &MemorySource{
 		names: names,
 		colix: colix,
 		data:  data,
+	}, nil
+}
+
+// columnLength returns the length of a data column, or an error if
+// the column does not have a supported type.
+func columnLength(na string, x interface{}) (int, error) {
+	switch x := x.(type) {
+	case []float64:
+		return len(x), nil
+	case []string:
+		return len(x), nil
+	case []int:
+		return len(x), nil
+	case []int64:
+		return len(x), nil
+	case []bool:
+		return len(x), nil
+	default:
+		return 0, fmt.Errorf("variable '%s' has unsupported type %T", na, x)
+	}
+}
+
+// Append adds rows to the end of the source.  The elements of data
+// hold the new values of the variables, in the same order as Names,
+// and must have the same types as the existing data.  The slices
+// passed to NewSource are not modified.
+func (b *MemorySource) Append(data []interface{}) error {
+
+	if len(data) != len(b.names) {
+		return fmt.Errorf("Append: %d data columns for %d variables", len(data), len(b.names))
+	}
+
+	n := -1
+	for k, na := range b.names {
+		m, err := columnLength(na, data[k])
+		if err != nil {
+			return fmt.Errorf("Append: %v", err)
+		}
+		if n == -1 {
+			n = m
+		} else if m != n {
+			return fmt.Errorf("Append: variable '%s' has length %d, expected %d", na, m, n)
+		}
+		if !sameType(data[k], b.data[k]) {
+			return fmt.Errorf("Append: variable '%s' has type %T, expected %T", na, data[k], b.data[k])
+		}
+	}
+
+	// Don't modify the slices passed to NewSource.
+	cols := make([]interface{}, len(b.data))
+	for k := range b.names {
+		switch x := b.data[k].(type) {
+		case []float64:
+			cols[k] = append(x[0:len(x):len(x)], data[k].([]float64)...)
+		case []string:
+			cols[k] = append(x[0:len(x):len(x)], data[k].([]string)...)
+		case []int:
+			cols[k] = append(x[0:len(x):len(x)], data[k].([]int)...)
+		case []int64:
+			cols[k] = append(x[0:len(x):len(x)], data[k].([]int64)...)
+		case []bool:
+			cols[k] = append(x[0:len(x):len(x)], data[k].([]bool)...)
+		}
+	}
+	b.data = cols
+
+	return nil
+}
+
+// sameType returns true if x and y are data columns of the same type.
+func sameType(x, y interface{}) bool {
+	switch x.(type) {
+	case []float64:
+		_, ok := y.([]float64)
+		return ok
+	case []string:
+		_, ok := y.([]string)
+		return ok
+	case []int:
+		_, ok := y.([]int)
+		return ok
+	case []int64:
+		_, ok := y.([]int64)
+		return ok
+	case []bool:
+		_, ok := y.([]bool)
+		return ok
+	default:
+		return false
+	}
+}
+
+// NumRows returns the number of rows in the source.
+func (b *MemorySource) NumRows() int {
+	if len(b.data) == 0 {
+		return 0
+	}
+	n, _ := columnLength(b.names[0], b.data[0])
+	return n
+}
+
+// checkColumn returns an error if x cannot be used as a column of the
+// source.
+func (b *MemorySource) checkColumn(na string, x interface{}) error {
+
+	m, err := columnLength(na, x)
+	if err != nil {
+		return err
+	}
+	if len(b.data) > 0 && m != b.NumRows() {
+		return fmt.Errorf("variable '%s' has length %d, expected %d", na, m, b.NumRows())
 	}
+
+	return nil
+}
+
+// AddColumn adds a new variable to the end of the source.  The data
+// must be a []float64, []string, []int, []int64 or []bool with length
+// equal to NumRows.
+func (b *MemorySource) AddColumn(na string, x interface{}) error {
+
+	if _, ok := b.colix[na]; ok {
+		return fmt.Errorf("AddColumn: variable '%s' already exists", na)
+	}
+	if err := b.checkColumn(na, x); err != nil {
+		return fmt.Errorf("AddColumn: %v", err)
+	}
+
+	if b.colix == nil {
+		b.colix = make(map[string]int)
+	}
+	b.colix[na] = len(b.names)
+
+	// Don't modify the slices passed to NewSource.
+	b.names = append(b.names[0:len(b.names):len(b.names)], na)
+	b.data = append(b.data[0:len(b.data):len(b.data)], x)
+
+	return nil
+}
+
+// ReplaceColumn replaces the data of an existing variable.  The data
+// must be a []float64, []string, []int, []int64 or []bool with length
+// equal to NumRows, but need not have the same type as the data being
+// replaced.
+func (b *MemorySource) ReplaceColumn(na string, x interface{}) error {
+
+	ix, ok := b.colix[na]
+	if !ok {
+		return fmt.Errorf("ReplaceColumn: variable '%s' not found", na)
+	}
+	if err := b.checkColumn(na, x); err != nil {
+		return fmt.Errorf("ReplaceColumn: %v", err)
+	}
+
+	data := make([]interface{}, len(b.data))
+	copy(data, b.data)
+	data[ix] = x
+	b.data = data
+
+	return nil
+}
+
+// DropColumn removes a variable from the source.
+func (b *MemorySource) DropColumn(na string) error {
+
+	ix, ok := b.colix[na]
+	if !ok {
+		return fmt.Errorf("DropColumn: variable '%s' not found", na)
+	}
+
+	var names []string
+	var data []interface{}
+	names = append(names, b.names[0:ix]...)
+	names = append(names, b.names[ix+1:]...)
+	data = append(data, b.data[0:ix]...)
+	data = append(data, b.data[ix+1:]...)
+
+	b.names = names
+	b.data = data
+	b.colix = make(map[string]int)
+	for k, c := range names {
+		b.colix[c] = k
+	}
+
+	return nil
 }
@@ -0,0 +1,132 @@
+package formula
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNewSource(t *testing.T) {
+
+	for _, data := range [][]interface{}{
+		{[]float64{1, 2}, []string{"a"}},
+		{[]float64{1, 2}, []int32{1, 2}},
+		{[]float64{1, 2}},
+	} {
+		if _, err := NewSource(data, []string{"x", "y"}); err == nil {
+			t.Fail()
+		}
+	}
+
+	if _, err := NewSource([]interface{}{[]float64{1}, []float64{2}}, []string{"x", "x"}); err == nil {
+		t.Fail()
+	}
+
+	src, err := NewSource([]interface{}{[]float64{1, 2}, []string{"a", "b"}}, []string{"x", "y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := src.Append([]interface{}{[]float64{3}, []string{"c"}}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(src.Get("x"), []float64{1, 2, 3}) || !reflect.DeepEqual(src.Get("y"), []string{"a", "b", "c"}) {
+		t.Fail()
+	}
+
+	for _, data := range [][]interface{}{
+		{[]float64{3}},
+		{[]float64{3}, []string{"c", "d"}},
+		{[]string{"c"}, []float64{3}},
+	} {
+		if err := src.Append(data); err == nil {
+			t.Fail()
+		}
+	}
+	if !reflect.DeepEqual(src.Get("x"), []float64{1, 2, 3}) {
+		t.Fail()
+	}
+
+	// Appending must not write into the spare capacity of the
+	// caller's slices
+	x := make([]float64, 2, 10)
+	x[0], x[1] = 1, 2
+	data := []interface{}{x}
+	src, err = NewSource(data, []string{"x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Append([]interface{}{[]float64{3}}); err != nil {
+		t.Fatal(err)
+	}
+	if x[0:3][2] != 0 || len(data[0].([]float64)) != 2 {
+		t.Errorf("Append modified the data passed to NewSource")
+	}
+	if !reflect.DeepEqual(src.Get("x"), []float64{1, 2, 3}) {
+		t.Fail()
+	}
+}
+
+func TestMemorySourceColumns(t *testing.T) {
+
+	names := []string{"x", "y"}
+	src, err := NewSource([]interface{}{[]float64{1, 2}, []string{"a", "b"}}, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src.NumRows() != 2 {
+		t.Fail()
+	}
+
+	if err := src.AddColumn("z", []float64{5, 6}); err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range []error{
+		src.AddColumn("z", []float64{5, 6}),
+		src.AddColumn("w", []float64{5}),
+		src.ReplaceColumn("w", []float64{5, 6}),
+		src.ReplaceColumn("x", []string{"a"}),
+		src.DropColumn("w"),
+	} {
+		if err == nil {
+			t.Fail()
+		}
+	}
+
+	if err := src.ReplaceColumn("x", []string{"c", "d"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.DropColumn("y"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(src.Names(), []string{"x", "z"}) {
+		t.Fail()
+	}
+	if !reflect.DeepEqual(src.Get("x"), []string{"c", "d"}) || src.Get("y") != nil {
+		t.Fail()
+	}
+	if !reflect.DeepEqual(names, []string{"x", "y"}) {
+		t.Fail()
+	}
+
+	// The modified source can be parsed
+	fp, err := New("x + z", src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cs.Names(), []string{"x[c]", "x[d]", "z"}) {
+		t.Fail()
+	}
+
+	empty, err := NewSource(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty.NumRows() != 0 || empty.AddColumn("a", []float64{1, 2, 3}) != nil || empty.NumRows() != 3 {
+		t.Fail()
+	}
+}
@@ -0,0 +1,117 @@
+package formula
+
+import (
+	"math"
+	"time"
+)
+
+// parseDates returns the values of x as the number of seconds since
+// January 1, 1970 UTC, using the first of the layouts that can parse
+// all of the non-empty values, and that layout.  Empty values are
+// returned as NaN.  The last return value is false if no layout can
+// parse all the values, or if all the values are empty.
+func parseDates(x []string, layouts []string) ([]float64, string, bool) {
+
+	for _, layout := range layouts {
+		y := make([]float64, len(x))
+		ok, any := true, false
+		for i, v := range x {
+			if v == "" {
+				y[i] = math.NaN()
+				continue
+			}
+			t, err := time.Parse(layout, v)
+			if err != nil {
+				ok = false
+				break
+			}
+			y[i] = float64(t.UnixNano()) / 1e9
+			any = true
+		}
+		if ok && any {
+			return y, layout, true
+		}
+	}
+
+	return nil, "", false
+}
+
+// fitLayout fixes the layout of the dates in the string variable na
+// of src, which is the first of Config.DateLayouts that can parse its
+// values when the codes are learned, so that the values of every
+// chunk and of new data are parsed with the same layout.  Variables
+// that cannot be parsed have the empty layout, and are not dates.
+// Variables whose values are all empty are not fixed.
+func (fp *Parser) fitLayout(src DataSource, na string) {
+
+	if len(fp.dateLayouts) == 0 {
+		return
+	}
+	if _, ok := fp.layouts[na]; ok {
+		return
+	}
+	s, ok := fp.convertData(na, src.Get(na)).([]string)
+	if !ok {
+		return
+	}
+
+	_, layout, ok := parseDates(s, fp.dateLayouts)
+	if !ok {
+		var any bool
+		for _, v := range s {
+			any = any || v != ""
+		}
+		if !any {
+			return
+		}
+	}
+	fp.layouts[na] = layout
+}
+
+// fixedDates returns the values of x as dates in the given layout,
+// which was fixed by fitLayout.  Values that are empty or that do not
+// match the layout are returned as NaN, so that the variable remains
+// numeric.
+func fixedDates(x []string, layout string) []float64 {
+
+	y := make([]float64, len(x))
+	for i, v := range x {
+		t, err := time.Parse(layout, v)
+		if v == "" || err != nil {
+			y[i] = math.NaN()
+			continue
+		}
+		y[i] = float64(t.UnixNano()) / 1e9
+	}
+
+	return y
+}
+
+// get returns the data for a variable in src, with string variables
+// holding dates converted to numbers as specified by
+// Config.DateLayouts, using the layout fixed by fitLayout if there is
+// one, the levels of the other string variables normalized as
+// specified by Config.TrimLevels and Config.FoldLevels, and integer
+// and boolean variables converted as described in convert.go.
+func (fp *Parser) get(src DataSource, na string) interface{} {
+
+	v := fp.convertData(na, src.Get(na))
+	s, ok := v.([]string)
+	if !ok {
+		return v
+	}
+
+	if layout, ok := fp.layouts[na]; ok {
+		if layout != "" {
+			return fixedDates(s, layout)
+		}
+		return fp.normalize(s)
+	}
+	if len(fp.dateLayouts) > 0 {
+		if x, _, ok := parseDates(s, fp.dateLayouts); ok {
+			return x
+		}
+	}
+
+	return fp.normalize(s)
+}
@@ -0,0 +1,124 @@
+package formula
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestDates(t *testing.T) {
+
+	data := mustSource([]interface{}{
+		[]string{"2020-01-01", "2020-01-02", ""},
+		[]string{"01/03/2020", "01/01/2020", "01/02/2020"},
+		[]string{"a", "b", "2020-01-01"},
+	}, []string{"d1", "d2", "s"})
+	config := &Config{DateLayouts: []string{"2006-01-02", "01/02/2006"}}
+
+	fp, err := New("d1 + d2 + s", data, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(cs.Names(), []string{"d1", "d2", "s[a]", "s[b]", "s[2020-01-01]"}) {
+		t.Errorf("Unexpected names %v", cs.Names())
+	}
+	day := float64(24 * 60 * 60)
+	jan1 := float64(1577836800)
+	d1, d2 := cs.Data()[0], cs.Data()[1]
+	if d1[0] != jan1 || d1[1] != jan1+day || !math.IsNaN(d1[2]) {
+		t.Errorf("Unexpected d1 %v", d1)
+	}
+	if !reflect.DeepEqual(d2, []float64{jan1 + 2*day, jan1, jan1 + day}) {
+		t.Errorf("Unexpected d2 %v", d2)
+	}
+
+	spec, err := fp.FeatureSpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Inputs[0].Dtype != "date" || spec.Inputs[2].Dtype != "string" {
+		t.Fail()
+	}
+}
+
+func TestDateLayoutFitted(t *testing.T) {
+
+	// The layout is fixed by the training data, in which 01/13/2020
+	// can only be a month followed by a day
+	data := mustSource([]interface{}{
+		[]string{"01/13/2020", "01/14/2020"},
+	}, []string{"d"})
+	config := &Config{DateLayouts: []string{"02/01/2006", "01/02/2006"}}
+
+	fp, err := New("d + C(d)", data, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	if fp.Codes().DateLayouts["d"] != "01/02/2006" {
+		t.Errorf("Unexpected layouts %v", fp.Codes().DateLayouts)
+	}
+
+	// The new data are parsed with the same layout, although the
+	// first layout could parse them
+	p := fp.WithData(mustSource([]interface{}{
+		[]string{"01/14/2020", "01/02/2020"},
+	}, []string{"d"}))
+	cs, err := p.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := float64(24 * 60 * 60)
+	jan1 := float64(1577836800)
+	if !reflect.DeepEqual(cs.Data()[0], []float64{jan1 + 13*day, jan1 + day}) {
+		t.Errorf("Unexpected d %v", cs.Data()[0])
+	}
+
+	// C() codes the dates, not their text
+	if !reflect.DeepEqual(cs.Names(), []string{"d", "C(d)[1.5788736e+09]", "C(d)[1.57896e+09]"}) {
+		t.Errorf("Unexpected names %v", cs.Names())
+	}
+	if !reflect.DeepEqual(cs.Data()[1:], [][]float64{{0, 0}, {1, 0}}) {
+		t.Errorf("Unexpected C(d) %v", cs.Data()[1:])
+	}
+}
+
+func TestDateMalformed(t *testing.T) {
+
+	data := mustSource([]interface{}{
+		[]string{"2020-01-01", "2020-01-02"},
+		[]float64{1, 2},
+	}, []string{"d", "x"})
+	config := &Config{DateLayouts: []string{"2006-01-02"}}
+	fp, err := New("d + x", data, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.Parse(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A value that does not match the layout is missing, and the
+	// variable stays numeric
+	cs, err := fp.WithData(mustSource([]interface{}{
+		[]string{"2020/01/02", "2020-01-03", ""},
+		[]float64{3, 4, 5},
+	}, []string{"d", "x"})).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cs.Names(), []string{"d", "x"}) {
+		t.Fatalf("Unexpected names %v", cs.Names())
+	}
+	d := cs.Data()[0]
+	if !math.IsNaN(d[0]) || d[1] != 1577836800+2*24*60*60 || !math.IsNaN(d[2]) {
+		t.Errorf("Unexpected d %v", d)
+	}
+}
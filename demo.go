@@ -0,0 +1,25 @@
+package formula
+
+// DemoData returns a small dataset that is used in the examples, and
+// that can be used in tests.  It holds the blood pressure (bp) of 8
+// subjects along with their age, sex (F or M), treatment group
+// (treat: A, B or C), and the dose of the treatment.  A new copy of
+// the data is returned by each call.
+func DemoData() DataSource {
+
+	names := []string{"bp", "age", "sex", "treat", "dose"}
+	data := []interface{}{
+		[]float64{128, 135, 119, 142, 131, 125, 138, 122},
+		[]float64{45, 62, 38, 70, 55, 49, 66, 41},
+		[]string{"F", "M", "F", "M", "F", "M", "F", "M"},
+		[]string{"A", "B", "C", "A", "B", "C", "A", "B"},
+		[]float64{10, 20, 10, 30, 20, 10, 30, 20},
+	}
+
+	src, err := NewSource(data, names)
+	if err != nil {
+		panic(err)
+	}
+
+	return src
+}
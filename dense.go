@@ -0,0 +1,88 @@
+package formula
+
+import (
+	"fmt"
+	"math"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// ToDense returns the ColSet as a gonum Dense matrix, with the
+// variables in the columns and the observations in the rows.  The
+// data are copied.  A ColSet with no columns or no rows gives an
+// empty matrix, as gonum matrices can not have zero rows.
+func (cs *ColSet) ToDense() *mat.Dense {
+
+	if len(cs.data) == 0 || len(cs.data[0]) == 0 {
+		return &mat.Dense{}
+	}
+
+	n := len(cs.data[0])
+	p := len(cs.data)
+	x := mat.NewDense(n, p, nil)
+	for j, v := range cs.data {
+		x.SetCol(j, v)
+	}
+
+	return x
+}
+
+// LSArrays holds the arrays needed to fit a linear model by least
+// squares.  X and Y are the unweighted design matrix and response.
+// WX and WY are the design matrix and response with each row
+// multiplied by the square root of its weight.
+type LSArrays struct {
+	X  *mat.Dense
+	Y  *mat.VecDense
+	WX *mat.Dense
+	WY *mat.VecDense
+}
+
+// WLSArrays returns the design matrix and the response y as gonum
+// arrays, along with copies of them in which each row is scaled by
+// the square root of the corresponding weight in w.  The weighted
+// arrays can be passed directly to a least squares solver such as
+// mat.Dense.Solve to obtain weighted least squares estimates.  If w
+// is nil, all weights are taken to be 1, and the weighted arrays are
+// the same as the unweighted ones (ordinary least squares).
+func (cs *ColSet) WLSArrays(y, w []float64) (*LSArrays, error) {
+
+	if len(cs.data) == 0 {
+		return nil, fmt.Errorf("WLSArrays: ColSet has no columns")
+	}
+
+	n := len(cs.data[0])
+	if n == 0 {
+		return nil, fmt.Errorf("WLSArrays: ColSet has no rows")
+	}
+	if len(y) != n {
+		return nil, fmt.Errorf("WLSArrays: response has length %d, design has %d rows", len(y), n)
+	}
+	if w != nil && len(w) != n {
+		return nil, fmt.Errorf("WLSArrays: weights have length %d, design has %d rows", len(w), n)
+	}
+
+	x := cs.ToDense()
+	yv := mat.NewVecDense(n, append([]float64(nil), y...))
+
+	if w == nil {
+		return &LSArrays{X: x, Y: yv, WX: x, WY: yv}, nil
+	}
+
+	var wx mat.Dense
+	wx.CloneFrom(x)
+	wy := mat.NewVecDense(n, nil)
+	for i, v := range w {
+		if v < 0 {
+			return nil, fmt.Errorf("WLSArrays: weight %d is negative", i)
+		}
+		s := math.Sqrt(v)
+		row := wx.RawRowView(i)
+		for j := range row {
+			row[j] *= s
+		}
+		wy.SetVec(i, s*y[i])
+	}
+
+	return &LSArrays{X: x, Y: yv, WX: &wx, WY: wy}, nil
+}
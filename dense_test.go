@@ -0,0 +1,56 @@
+package formula
+
+import (
+	"math"
+	"testing"
+
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+func TestWLSArrays(t *testing.T) {
+
+	cs := &ColSet{
+		names: []string{"icept", "x"},
+		data:  [][]float64{{1, 1, 1, 1}, {0, 1, 2, 3}},
+	}
+	y := []float64{1, 3, 5, 7}
+	w := []float64{1, 4, 1, 4}
+
+	ls, err := cs.WLSArrays(y, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r, c := ls.X.Dims(); r != 4 || c != 2 {
+		t.Fatalf("X has dimensions %dx%d", r, c)
+	}
+	if ls.WX.At(1, 1) != 2 || ls.WY.AtVec(3) != 14 || ls.X.At(1, 1) != 1 {
+		t.Fail()
+	}
+
+	var beta mat.VecDense
+	if err := beta.SolveVec(ls.WX, ls.WY); err != nil {
+		t.Fatal(err)
+	}
+	eq := func(x, y float64) bool { return math.Abs(x-y) < 1e-8 }
+	if !floats.EqualFunc(beta.RawVector().Data, []float64{1, 2}, eq) {
+		t.Fail()
+	}
+
+	if _, err := cs.WLSArrays(y[0:3], nil); err == nil {
+		t.Fail()
+	}
+	if _, err := cs.WLSArrays(y, []float64{1, -1, 1, 1}); err == nil {
+		t.Fail()
+	}
+
+	// A design with no rows
+	empty := &ColSet{names: []string{"a", "b"}, data: [][]float64{{}, {}}}
+	if r, c := empty.ToDense().Dims(); r != 0 || c != 0 {
+		t.Errorf("Unexpected dimensions %d, %d", r, c)
+	}
+	if _, err := empty.WLSArrays(nil, nil); err == nil {
+		t.Errorf("Expected an error for a design with no rows")
+	}
+}
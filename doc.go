@@ -1,3 +1,36 @@
 // Package formula allows formulas to be used to specify a dstream in terms of
 // another dstream.  These formulas roughly follow R-style formula syntax.
+//
+// # Ordering
+//
+// All listings of names and levels produced by this package have a
+// well-defined order that does not depend on Go map iteration, so
+// that repeated runs on the same data produce identical results:
+//
+// The variables of a DataSource are in the order given by its Names
+// method.  ReadCSV uses the order of the header, and ReadJSONL uses
+// the order of first appearance, with new variables in the same
+// record taken in sorted order.  ConcatRows uses the order of the
+// first source, ConcatCols the order of the sources.
+//
+// The columns of a ColSet, and the names returned by Parser.Names,
+// are in formula order: the terms of each formula from left to right,
+// with the formulas passed to NewMulti taken in turn.  The products
+// formed by an interaction vary the columns of the right operand
+// fastest, and the terms produced by the ^ operator are ordered by
+// the number of variables they involve.
+//
+// The levels of a categorical variable, and hence its indicator
+// columns, exclude the reference level and are by default in order of
+// first appearance in the data (in chunk order for a Stream).  This
+// includes numeric variables coded using C().  The levels declared in
+// Config.Levels come first, in the given order.  With
+// Config.SortLevels the other levels are in sorted order, and
+// otherwise with Config.TopLevels the most frequent levels are in
+// order of decreasing count, with ties in sorted order.  When
+// Config.RefPolicy chooses the reference level of a variable, its
+// levels are reordered in sorted order.  Levels pooled by
+// Config.MinLevelCount are coded by a last column named like
+// x[_other_].  Vocabularies in a FeatureSpec and the levels used by
+// Simulate follow the same order.
 package formula
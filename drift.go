@@ -0,0 +1,132 @@
+package formula
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// The number of bins used for the population stability index, and
+// the smallest proportion of a bin, which keeps the index finite for
+// empty bins
+const (
+	psiBins  = 10
+	psiFloor = 1e-4
+)
+
+// ColumnShift describes how the distribution of a column of the design
+// matrix of new data differs from its distribution in the design of
+// reference data, see DiffDesigns.  The first element of each pair
+// refers to the reference data and the second to the new data, and
+// the statistics are computed over the rows where the column is not
+// missing.
+type ColumnShift struct {
+
+	// Column is the name of the column.
+	Column string
+
+	// N holds the numbers of rows where the column is not
+	// missing.
+	N [2]int
+
+	// Mean and SD hold the means and standard deviations of the
+	// column.
+	Mean [2]float64
+	SD   [2]float64
+
+	// PSI is the population stability index of the new data
+	// relative to the reference data, the sum over bins of
+	// (q - p) * log(q / p), where p and q are the proportions of the
+	// reference and new data in a bin.  The bins are bounded by the
+	// deciles of the column in the reference data, so indicators
+	// have a bin for each value.  Values above 0.25 are commonly
+	// taken to indicate a substantial shift.
+	PSI float64
+}
+
+// DiffDesigns applies the formulas to reference data, e.g. the
+// training data of a model, and to new data, e.g. the data scored by
+// the model, using the codes that fp learned from its data, and
+// reports for each column of the reference design how its
+// distribution has shifted, for monitoring the inputs of a model.  An
+// error is returned if a column of the reference design is not in the
+// design of the new data.
+func (fp *Parser) DiffDesigns(ref, cur DataSource) ([]*ColumnShift, error) {
+
+	cs0, err := fp.WithData(ref).Parse()
+	if err != nil {
+		return nil, err
+	}
+	cs1, err := fp.WithData(cur).Parse()
+	if err != nil {
+		return nil, err
+	}
+
+	var shifts []*ColumnShift
+	for j, na := range cs0.names {
+		k := find(cs1.names, na)
+		if k == -1 {
+			return nil, fmt.Errorf("DiffDesigns: column '%s' is not in the design of the new data", na)
+		}
+		x, y := observed(cs0.data[j]), observed(cs1.data[k])
+		sh := &ColumnShift{Column: na, N: [2]int{len(x), len(y)}}
+		sh.Mean[0], sh.SD[0] = meanSD(x)
+		sh.Mean[1], sh.SD[1] = meanSD(y)
+		sh.PSI = psi(x, y)
+		shifts = append(shifts, sh)
+	}
+
+	return shifts, nil
+}
+
+// observed returns the values of x that are not missing, in increasing
+// order.
+func observed(x []float64) []float64 {
+
+	var v []float64
+	for _, u := range x {
+		if !math.IsNaN(u) {
+			v = append(v, u)
+		}
+	}
+	sort.Float64s(v)
+
+	return v
+}
+
+// psi returns the population stability index of the sorted values y
+// relative to the sorted values x.
+func psi(x, y []float64) float64 {
+
+	if len(x) == 0 || len(y) == 0 {
+		return math.NaN()
+	}
+
+	// The distinct deciles of x bound the bins
+	var edges []float64
+	for b := 1; b < psiBins; b++ {
+		e := x[int(math.Ceil(float64(b*len(x))/psiBins))-1]
+		if len(edges) == 0 || e > edges[len(edges)-1] {
+			edges = append(edges, e)
+		}
+	}
+
+	props := func(v []float64) []float64 {
+		p := make([]float64, len(edges)+1)
+		for _, u := range v {
+			p[sort.SearchFloat64s(edges, u)]++
+		}
+		for i := range p {
+			p[i] = math.Max(p[i]/float64(len(v)), psiFloor)
+		}
+		return p
+	}
+	p, q := props(x), props(y)
+
+	var s float64
+	for i := range p {
+		s += (q[i] - p[i]) * math.Log(q[i]/p[i])
+	}
+
+	return s
+}
@@ -0,0 +1,65 @@
+package formula
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDiffDesigns(t *testing.T) {
+
+	n := 100
+	x0, x1 := make([]float64, n), make([]float64, n)
+	g0, g1 := make([]string, n), make([]string, n)
+	for i := 0; i < n; i++ {
+		x0[i] = float64(i)
+		x1[i] = float64(i) + 50
+		g0[i], g1[i] = "a", "a"
+		if i%2 == 0 {
+			g0[i] = "b"
+		}
+		if i%4 == 0 {
+			g1[i] = "b"
+		}
+	}
+	ref := mustSource([]interface{}{x0, g0}, []string{"x", "g"})
+	cur := mustSource([]interface{}{x1, g1}, []string{"x", "g"})
+
+	config := &Config{RefLevels: map[string]string{"g": "a"}}
+	fp, err := New("x + g", ref, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The reference data have not shifted
+	shifts, err := fp.DiffDesigns(ref, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sh := range shifts {
+		if sh.PSI != 0 || sh.Mean[0] != sh.Mean[1] || sh.SD[0] != sh.SD[1] {
+			t.Errorf("Unexpected shift %+v", sh)
+		}
+	}
+
+	shifts, err = fp.DiffDesigns(ref, cur)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shifts) != 2 || shifts[0].Column != "x" || shifts[1].Column != "g[b]" {
+		t.Fatalf("Unexpected columns %+v", shifts)
+	}
+
+	sx := shifts[0]
+	if sx.Mean != [2]float64{49.5, 99.5} || math.Abs(sx.SD[0]-sx.SD[1]) > 1e-12 {
+		t.Errorf("Unexpected moments %+v", sx)
+	}
+	if sx.PSI < 1 {
+		t.Errorf("Expected a large PSI for x, found %v", sx.PSI)
+	}
+
+	// Half the reference rows and a quarter of the new rows are b
+	exp := 0.25*math.Log(0.75/0.5) + 0.25*math.Log(0.5/0.25)
+	if sg := shifts[1]; sg.N != [2]int{n, n} || math.Abs(sg.PSI-exp) > 1e-12 {
+		t.Errorf("Expected PSI %v for g[b], found %+v", exp, sg)
+	}
+}
@@ -0,0 +1,120 @@
+package formula
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// StatEncoder codes a categorical variable by statistics of its
+// levels, e.g. the mean response (target encoding) or the frequency
+// of each level, instead of by indicators.  The statistics are
+// supplied by the caller, e.g. computed from training data, and
+// StatEncoders are given per variable in Config.Encoders.
+type StatEncoder interface {
+
+	// Stats returns the names of the statistics, which name the
+	// columns of the variable, e.g. x[mean].
+	Stats() []string
+
+	// Encode returns the statistics of a level, in the order of
+	// Stats, or false if the level has no statistics.
+	Encode(level string) ([]float64, bool)
+}
+
+// LevelStats is a StatEncoder holding the statistics of each level in
+// a map.
+type LevelStats struct {
+
+	// Names are the names of the statistics.
+	Names []string
+
+	// Levels holds the statistics of each level, in the order of
+	// Names.
+	Levels map[string][]float64
+
+	// Default holds the statistics of the levels that are not in
+	// Levels, e.g. the overall mean response.  If nil, these
+	// levels are coded as missing (NaN).
+	Default []float64
+}
+
+// Stats returns the names of the statistics.
+func (ls *LevelStats) Stats() []string {
+	return ls.Names
+}
+
+// Encode returns the statistics of a level.
+func (ls *LevelStats) Encode(level string) ([]float64, bool) {
+
+	if x, ok := ls.Levels[level]; ok {
+		return x, true
+	}
+	if ls.Default != nil {
+		return ls.Default, true
+	}
+
+	return nil, false
+}
+
+// validateEncoders returns the problems with the encoders, which must
+// not be nil and must have at least one statistic.
+func (fp *Parser) validateEncoders() []string {
+
+	var names []string
+	for na := range fp.encoders {
+		names = append(names, na)
+	}
+	sort.Strings(names)
+
+	var problems []string
+	for _, na := range names {
+		enc := fp.encoders[na]
+		switch {
+		case enc == nil:
+			problems = append(problems, fmt.Sprintf("encoder for '%s' is nil", na))
+		case len(enc.Stats()) == 0:
+			problems = append(problems, fmt.Sprintf("encoder for '%s' has no statistics", na))
+		}
+	}
+
+	return problems
+}
+
+// codeStats returns a column for each statistic of the StatEncoder of
+// the categorical variable na, holding the statistic of the level of
+// each row.
+func (fp *Parser) codeStats(na string, enc StatEncoder, s []string) (*ColSet, error) {
+
+	stats := enc.Stats()
+	dat := make([][]float64, len(stats))
+	for j := range dat {
+		dat[j] = make([]float64, len(s))
+	}
+
+	for i, x := range s {
+		v, ok := enc.Encode(x)
+		switch {
+		case !ok:
+			for j := range dat {
+				dat[j][i] = math.NaN()
+			}
+		case len(v) != len(stats):
+			return nil, fmt.Errorf("the encoder of '%s' returned %d statistics for level '%s', expected %d", na, len(v), x, len(stats))
+		default:
+			for j := range dat {
+				dat[j][i] = v[j]
+			}
+		}
+	}
+
+	v := &origin{op: "variable", name: na}
+	cs := &ColSet{data: dat}
+	for _, st := range stats {
+		cna := fmt.Sprintf("%s[%s]", na, st)
+		cs.names = append(cs.names, cna)
+		cs.origins = append(cs.origins, &origin{op: "statistic", detail: st, name: cna, inputs: []*origin{v}})
+	}
+
+	return cs.withTerm(na), nil
+}
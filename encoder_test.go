@@ -0,0 +1,61 @@
+package formula
+
+import (
+	"math"
+	"testing"
+)
+
+func TestLevelStats(t *testing.T) {
+
+	data := []interface{}{
+		[]string{"a", "b", "c", "a", "d"},
+		[]float64{1, 2, 3, 4, 5},
+	}
+	src := mustSource(data, []string{"x", "z"})
+
+	stats := &LevelStats{
+		Names: []string{"mean", "n"},
+		Levels: map[string][]float64{
+			"a": {0.5, 20},
+			"b": {1.5, 10},
+			"c": {2.5, 5},
+		},
+	}
+	config := &Config{Encoders: map[string]StatEncoder{"x": stats}}
+	fp, err := New("x + z", src, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nan := math.NaN()
+	exp := &ColSet{
+		names: []string{"x[mean]", "x[n]", "z"},
+		data: [][]float64{
+			{0.5, 1.5, 2.5, 0.5, nan},
+			{20, 10, 5, 20, nan},
+			{1, 2, 3, 4, 5},
+		},
+	}
+	if ok, diff := exp.EqualTol(cols, 0); !ok {
+		t.Errorf("%v", diff)
+	}
+
+	// Levels without statistics get the default
+	stats.Default = []float64{1, 0}
+	cols, err = fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cols.data[0][4] != 1 || cols.data[1][4] != 0 {
+		t.Errorf("Unexpected default statistics %v, %v", cols.data[0][4], cols.data[1][4])
+	}
+
+	config.Encoders["x"] = &LevelStats{}
+	if _, err := New("x + z", src, config); err == nil {
+		t.Errorf("Expected an error for an encoder without statistics")
+	}
+}
@@ -0,0 +1,89 @@
+package formula
+
+import (
+	"fmt"
+	"math"
+)
+
+// ColSetDiff describes how two ColSets differ, as found by
+// ColSet.EqualTol.
+type ColSetDiff struct {
+
+	// Reason describes a difference in the names or dimensions
+	// of the ColSets, and is empty if they only differ in their
+	// values.
+	Reason string
+
+	// Column and Row locate the first value that differs, in
+	// column order, and A and B are the two values.  Row is -1 if
+	// the ColSets differ in their names or dimensions.
+	Column string
+	Row    int
+	A, B   float64
+
+	// MaxAbsDiff is the largest absolute difference between two
+	// values, and MaxColumn is the column in which it occurs.  A
+	// value that is missing (NaN) in only one of the ColSets
+	// counts as an infinite difference.
+	MaxAbsDiff float64
+	MaxColumn  string
+}
+
+func (d *ColSetDiff) String() string {
+	if d.Reason != "" {
+		return d.Reason
+	}
+	return fmt.Sprintf("column '%s' differs first in row %d (%v vs %v), the maximum absolute difference is %v in column '%s'",
+		d.Column, d.Row, d.A, d.B, d.MaxAbsDiff, d.MaxColumn)
+}
+
+// EqualTol returns true if the ColSet has the same column names, in
+// the same order, as other, and the values in each column differ by
+// at most tol.  Missing values (NaN) must be in the same positions.
+// If the ColSets are not equal, the returned ColSetDiff describes how
+// they differ, otherwise it is nil.
+func (cs *ColSet) EqualTol(other *ColSet, tol float64) (bool, *ColSetDiff) {
+
+	if len(cs.names) != len(other.names) {
+		reason := fmt.Sprintf("the ColSets have %d and %d columns", len(cs.names), len(other.names))
+		return false, &ColSetDiff{Reason: reason, Row: -1}
+	}
+	for j, na := range cs.names {
+		if other.names[j] != na {
+			reason := fmt.Sprintf("column %d is named '%s' and '%s'", j, na, other.names[j])
+			return false, &ColSetDiff{Reason: reason, Row: -1}
+		}
+		if len(cs.data[j]) != len(other.data[j]) {
+			reason := fmt.Sprintf("column '%s' has %d and %d rows", na, len(cs.data[j]), len(other.data[j]))
+			return false, &ColSetDiff{Reason: reason, Column: na, Row: -1}
+		}
+	}
+
+	var diff *ColSetDiff
+	for j, na := range cs.names {
+		for i, a := range cs.data[j] {
+			b := other.data[j][i]
+			var d float64
+			switch {
+			case math.IsNaN(a) && math.IsNaN(b), a == b:
+				continue
+			case math.IsNaN(a) || math.IsNaN(b):
+				d = math.Inf(1)
+			default:
+				d = math.Abs(a - b)
+			}
+			if d <= tol {
+				continue
+			}
+			if diff == nil {
+				diff = &ColSetDiff{Column: na, Row: i, A: a, B: b}
+			}
+			if d > diff.MaxAbsDiff {
+				diff.MaxAbsDiff = d
+				diff.MaxColumn = na
+			}
+		}
+	}
+
+	return diff == nil, diff
+}
@@ -0,0 +1,43 @@
+package formula
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEqualTol(t *testing.T) {
+
+	a := NewColSet([]string{"x1", "x2"}, [][]float64{{1, 2, math.NaN()}, {3, 4, 5}})
+	b := NewColSet([]string{"x1", "x2"}, [][]float64{{1, 2.001, math.NaN()}, {3, 4.5, 5.2}})
+
+	if ok, diff := a.EqualTol(b, 0.6); !ok || diff != nil {
+		t.Errorf("Expected equal ColSets")
+	}
+
+	ok, diff := a.EqualTol(b, 0.1)
+	if ok || diff == nil {
+		t.Fatalf("Expected different ColSets")
+	}
+	if diff.Column != "x2" || diff.Row != 1 || diff.A != 4 || diff.B != 4.5 || diff.MaxColumn != "x2" || math.Abs(diff.MaxAbsDiff-0.5) > 1e-12 {
+		t.Errorf("Unexpected difference %+v", diff)
+	}
+	if diff.String() != "column 'x2' differs first in row 1 (4 vs 4.5), the maximum absolute difference is 0.5 in column 'x2'" {
+		t.Errorf("Unexpected text '%s'", diff)
+	}
+
+	// A value missing in only one ColSet
+	c := NewColSet([]string{"x1", "x2"}, [][]float64{{1, 2, 0}, {3, 4, 5}})
+	if _, diff := a.EqualTol(c, 1); diff == nil || diff.Row != 2 || !math.IsInf(diff.MaxAbsDiff, 1) {
+		t.Errorf("Unexpected difference %+v", diff)
+	}
+
+	for _, o := range []*ColSet{
+		NewColSet([]string{"x1"}, [][]float64{{1, 2, 3}}),
+		NewColSet([]string{"x1", "x3"}, [][]float64{{1, 2, 3}, {3, 4, 5}}),
+		NewColSet([]string{"x1", "x2"}, [][]float64{{1, 2, 3}, {3, 4}}),
+	} {
+		if ok, diff := a.EqualTol(o, 1); ok || diff == nil || diff.Reason == "" || diff.Row != -1 {
+			t.Errorf("Unexpected difference %+v", diff)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package formula_test
+
+import (
+	"fmt"
+
+	"github.com/kshedden/formula"
+	"gonum.org/v1/gonum/mat"
+)
+
+func ExampleNew() {
+
+	config := &formula.Config{RefLevels: map[string]string{"treat": "A"}}
+	fp, err := formula.New("bp ~ 1 + age + treat", formula.DemoData(), config)
+	if err != nil {
+		panic(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Println(cols.Names())
+	fmt.Println(fp.Response().Names())
+	// Output:
+	// [icept age treat[B] treat[C]]
+	// [bp]
+}
+
+func ExampleNewMulti() {
+
+	formulas := []string{"age + sex", "dose:treat"}
+	fp, err := formula.NewMulti(formulas, formula.DemoData(), nil)
+	if err != nil {
+		panic(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		panic(err)
+	}
+
+	for _, na := range cols.Names() {
+		x, _ := cols.Get(na)
+		fmt.Println(na, x)
+	}
+	// Output:
+	// age [45 62 38 70 55 49 66 41]
+	// sex[F] [1 0 1 0 1 0 1 0]
+	// sex[M] [0 1 0 1 0 1 0 1]
+	// dose:treat[A] [10 0 0 30 0 0 30 0]
+	// dose:treat[B] [0 20 0 0 20 0 0 20]
+	// dose:treat[C] [0 0 10 0 0 10 0 0]
+}
+
+func ExampleColSet_ToDense() {
+
+	config := &formula.Config{RefLevels: map[string]string{"sex": "F"}}
+	fp, err := formula.New("1 + dose + sex", formula.DemoData(), config)
+	if err != nil {
+		panic(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		panic(err)
+	}
+
+	x := cols.ToDense()
+	fmt.Printf("%v\n", mat.Formatted(x))
+	// Output:
+	// ⎡ 1  10   0⎤
+	// ⎢ 1  20   1⎥
+	// ⎢ 1  10   0⎥
+	// ⎢ 1  30   1⎥
+	// ⎢ 1  20   0⎥
+	// ⎢ 1  10   1⎥
+	// ⎢ 1  30   0⎥
+	// ⎣ 1  20   1⎦
+}
@@ -0,0 +1,148 @@
+package formula
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// WriteLibSVM writes the ColSet to w in the sparse text format used
+// by libsvm and liblinear.  Each observation is written on its own
+// line, starting with its label, followed by index:value pairs for
+// the non-zero values.  Indices are 1-based positions of the columns
+// in the ColSet.  Since the format has no representation for missing
+// values, an error is returned at the first row whose label or data
+// contain a NaN value, after the rows before it have been written.
+func (cs *ColSet) WriteLibSVM(w io.Writer, labels []float64) error {
+
+	n := len(labels)
+	for j, v := range cs.data {
+		if len(v) != n {
+			return fmt.Errorf("WriteLibSVM: column '%s' has length %d, but there are %d labels", cs.names[j], len(v), n)
+		}
+	}
+
+	wtr := bufio.NewWriter(w)
+
+	// fail writes the rows before the error
+	fail := func(err error) error {
+		if ferr := wtr.Flush(); ferr != nil {
+			return ferr
+		}
+		return err
+	}
+
+	var buf []byte
+	for i, y := range labels {
+		if math.IsNaN(y) {
+			return fail(fmt.Errorf("WriteLibSVM: missing label in row %d", i+1))
+		}
+		buf = strconv.AppendFloat(buf[0:0], y, 'g', -1, 64)
+		for j, v := range cs.data {
+			x := v[i]
+			if math.IsNaN(x) {
+				return fail(fmt.Errorf("WriteLibSVM: missing value in column '%s', row %d", cs.names[j], i+1))
+			}
+			if x == 0 {
+				continue
+			}
+			buf = append(buf, ' ')
+			buf = strconv.AppendInt(buf, int64(j+1), 10)
+			buf = append(buf, ':')
+			buf = strconv.AppendFloat(buf, x, 'g', -1, 64)
+		}
+		buf = append(buf, '\n')
+		if _, err := wtr.Write(buf); err != nil {
+			return fail(err)
+		}
+	}
+
+	return wtr.Flush()
+}
+
+// FormatOptions control how a ColSet is written as text.
+type FormatOptions struct {
+
+	// Format is the format used for the values, one of 'f', 'e',
+	// 'E', 'g' or 'G' as in strconv.FormatFloat.  If Format is
+	// zero, the shortest representation that reproduces each
+	// value exactly is used.
+	Format byte
+
+	// Precision is the number of digits used by Format, as in
+	// strconv.FormatFloat.  It is ignored if Format is zero.
+	Precision int
+
+	// NA is written in place of missing (NaN) values.
+	NA string
+
+	// Comma is the field delimiter, ',' if zero.
+	Comma rune
+}
+
+// appendFloat appends the text form of x to buf.
+func (opts *FormatOptions) appendFloat(buf []byte, x float64) []byte {
+
+	switch {
+	case math.IsNaN(x):
+		return append(buf, opts.NA...)
+	case opts.Format == 0:
+		return strconv.AppendFloat(buf, x, 'g', -1, 64)
+	default:
+		return strconv.AppendFloat(buf, x, opts.Format, opts.Precision, 64)
+	}
+}
+
+// WriteCSV writes the ColSet to w in CSV format, with a header row
+// containing the column names followed by one row per observation.
+// If opts is nil, values are written in their shortest exact form,
+// and missing values as empty fields, which ReadCSV reads back as
+// NaN.
+func (cs *ColSet) WriteCSV(w io.Writer, opts *FormatOptions) error {
+
+	if opts == nil {
+		opts = new(FormatOptions)
+	}
+
+	switch opts.Format {
+	case 0, 'f', 'e', 'E', 'g', 'G':
+	default:
+		return fmt.Errorf("WriteCSV: invalid format '%c'", opts.Format)
+	}
+
+	var n int
+	for j, v := range cs.data {
+		if j == 0 {
+			n = len(v)
+		} else if len(v) != n {
+			return fmt.Errorf("WriteCSV: column '%s' has length %d, expected %d", cs.names[j], len(v), n)
+		}
+	}
+
+	wtr := csv.NewWriter(w)
+	if opts.Comma != 0 {
+		wtr.Comma = opts.Comma
+	}
+
+	if err := wtr.Write(cs.names); err != nil {
+		return err
+	}
+
+	var buf []byte
+	row := make([]string, len(cs.data))
+	for i := 0; i < n; i++ {
+		for j, v := range cs.data {
+			buf = opts.appendFloat(buf[0:0], v[i])
+			row[j] = string(buf)
+		}
+		if err := wtr.Write(row); err != nil {
+			return err
+		}
+	}
+
+	wtr.Flush()
+	return wtr.Error()
+}
@@ -0,0 +1,100 @@
+package formula
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestWriteLibSVM(t *testing.T) {
+
+	cs := &ColSet{
+		names: []string{"a", "b", "c"},
+		data:  [][]float64{{1, 0, 2.5}, {0, 0, 1}, {-3, 0, 0}},
+	}
+
+	var buf bytes.Buffer
+	if err := cs.WriteLibSVM(&buf, []float64{1, 0, -1}); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := "1 1:1 3:-3\n0\n-1 1:2.5 2:1\n"
+	if buf.String() != exp {
+		t.Fatalf("Expected:\n%s\nObserved:\n%s", exp, buf.String())
+	}
+
+	if err := cs.WriteLibSVM(&buf, []float64{1, 2}); err == nil {
+		t.Fail()
+	}
+
+	// The rows before a missing value are written
+	cs.data[1][1] = math.NaN()
+	buf.Reset()
+	if err := cs.WriteLibSVM(&buf, []float64{1, 0, -1}); err == nil {
+		t.Errorf("Expected an error for a missing value")
+	}
+	if buf.String() != "1 1:1 3:-3\n" {
+		t.Errorf("Unexpected output %q", buf.String())
+	}
+
+	cs.data[1][1] = 0
+	buf.Reset()
+	if err := cs.WriteLibSVM(&buf, []float64{1, 0, math.NaN()}); err == nil {
+		t.Errorf("Expected an error for a missing label")
+	}
+	if buf.String() != "1 1:1 3:-3\n0\n" {
+		t.Errorf("Unexpected output %q", buf.String())
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+
+	cs := &ColSet{
+		names: []string{"a", "b:c"},
+		data:  [][]float64{{1, 0.125, math.NaN()}, {1234.5, 0, 1e-7}},
+	}
+
+	for _, pr := range []struct {
+		opts *FormatOptions
+		exp  string
+	}{
+		{
+			opts: nil,
+			exp:  "a,b:c\n1,1234.5\n0.125,0\n,1e-07\n",
+		},
+		{
+			opts: &FormatOptions{Format: 'f', Precision: 2, NA: "NA", Comma: '\t'},
+			exp:  "a\tb:c\n1.00\t1234.50\n0.12\t0.00\nNA\t0.00\n",
+		},
+		{
+			opts: &FormatOptions{Format: 'e', Precision: 1},
+			exp:  "a,b:c\n1.0e+00,1.2e+03\n1.2e-01,0.0e+00\n,1.0e-07\n",
+		},
+	} {
+		var buf bytes.Buffer
+		if err := cs.WriteCSV(&buf, pr.opts); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != pr.exp {
+			t.Errorf("Expected:\n%s\nObserved:\n%s", pr.exp, buf.String())
+		}
+	}
+
+	// Round trip through ReadCSV
+	var buf bytes.Buffer
+	if err := cs.WriteCSV(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	src, err := ReadCSV(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := src.Get("a").([]float64)
+	if x[0] != 1 || x[1] != 0.125 || !math.IsNaN(x[2]) {
+		t.Fail()
+	}
+
+	if err := cs.WriteCSV(&buf, &FormatOptions{Format: 'x'}); err == nil {
+		t.Fail()
+	}
+}
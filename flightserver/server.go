@@ -0,0 +1,141 @@
+//go:build flight
+// +build flight
+
+// Package flightserver serves the design matrices produced by a
+// formula.Stream over Arrow Flight, so that e.g. Spark or Python
+// consumers can pull the chunks of a design from a Go service as
+// Arrow record batches.
+//
+// The package depends on the Apache Arrow Go module and its gRPC
+// stack, which are not dependencies of the formula package, and is
+// only built with the flight build tag:
+//
+//	go build -tags flight ./flightserver
+package flightserver
+
+import (
+	"io"
+	"net"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/flight"
+	"github.com/apache/arrow/go/arrow/ipc"
+	"github.com/apache/arrow/go/arrow/memory"
+	"github.com/kshedden/formula"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Server serves designs over Arrow Flight.  A client requests a
+// design by calling DoGet with a ticket holding the name of the
+// design, and receives the chunks of the design, one record batch
+// per chunk, with a float64 column for each column of the design.
+type Server struct {
+
+	// Designs returns a new Stream producing the named design.  It
+	// is called once for each request, and may be called
+	// concurrently.
+	Designs func(name string) (*formula.Stream, error)
+
+	server flight.Server
+}
+
+// New returns a Server producing the designs returned by designs.
+func New(designs func(name string) (*formula.Stream, error)) *Server {
+	return &Server{Designs: designs}
+}
+
+// Init binds the server to the given address, e.g. "localhost:0",
+// and registers the Flight service.  The server is started by Serve.
+func (s *Server) Init(addr string) error {
+
+	s.server = flight.NewFlightServer(nil)
+	if err := s.server.Init(addr); err != nil {
+		return err
+	}
+	s.server.RegisterFlightService(&flight.FlightServiceService{DoGet: s.doGet})
+
+	return nil
+}
+
+// Addr returns the address that the server listens on.
+func (s *Server) Addr() net.Addr {
+	return s.server.Addr()
+}
+
+// Serve accepts connections until Shutdown is called.
+func (s *Server) Serve() error {
+	return s.server.Serve()
+}
+
+// Shutdown stops the server after the current requests complete.
+func (s *Server) Shutdown() {
+	s.server.Shutdown()
+}
+
+// doGet sends the chunks of the design named in the ticket.
+func (s *Server) doGet(tkt *flight.Ticket, fs flight.FlightService_DoGetServer) error {
+
+	name := string(tkt.GetTicket())
+	stream, err := s.Designs(name)
+	if err != nil {
+		return status.Errorf(codes.NotFound, "design '%s': %v", name, err)
+	}
+
+	var w *ipc.FlightDataWriter
+	for {
+		cs, err := stream.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return status.Errorf(codes.Internal, "design '%s': %v", name, err)
+		}
+
+		rec := Record(cs)
+		if w == nil {
+			w = ipc.NewFlightDataWriter(fs, ipc.WithSchema(rec.Schema()))
+		}
+		err = w.Write(rec)
+		rec.Release()
+		if err != nil {
+			return err
+		}
+	}
+
+	// A design with no chunks has no schema, and nothing is sent
+	if w == nil {
+		return nil
+	}
+
+	return w.Close()
+}
+
+// Record returns the columns of cs as an Arrow record batch with a
+// float64 column for each column of cs.  The columns share the memory
+// of cs, which must not be modified while the record is in use.
+func Record(cs *formula.ColSet) array.Record {
+
+	names := cs.Names()
+	data := cs.Data()
+
+	fields := make([]arrow.Field, len(names))
+	cols := make([]array.Interface, len(names))
+	var nrow int
+	for j, na := range names {
+		fields[j] = arrow.Field{Name: na, Type: arrow.PrimitiveTypes.Float64}
+		buf := memory.NewBufferBytes(arrow.Float64Traits.CastToBytes(data[j]))
+		ad := array.NewData(arrow.PrimitiveTypes.Float64, len(data[j]), []*memory.Buffer{nil, buf}, nil, 0, 0)
+		cols[j] = array.MakeFromData(ad)
+		ad.Release()
+		nrow = len(data[j])
+	}
+
+	schema := arrow.NewSchema(fields, nil)
+	rec := array.NewRecord(schema, cols, int64(nrow))
+	for _, c := range cols {
+		c.Release()
+	}
+
+	return rec
+}
@@ -0,0 +1,108 @@
+//go:build flight
+// +build flight
+
+package flightserver
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/flight"
+	"github.com/apache/arrow/go/arrow/ipc"
+	"github.com/kshedden/formula"
+	"google.golang.org/grpc"
+)
+
+func chunks() formula.ChunkSource {
+
+	names := []string{"x1", "x2"}
+	chunk1, _ := formula.NewSource([]interface{}{
+		[]float64{0, 1, 2},
+		[]string{"a", "b", "a"},
+	}, names)
+	chunk2, _ := formula.NewSource([]interface{}{
+		[]float64{3, 4},
+		[]string{"c", "a"},
+	}, names)
+
+	return formula.NewChunkSource(chunk1, chunk2)
+}
+
+func TestServer(t *testing.T) {
+
+	formulas := []string{"x1 + x2"}
+	s := New(func(name string) (*formula.Stream, error) {
+		if name != "design" {
+			return nil, fmt.Errorf("unknown design")
+		}
+		return formula.NewStream(formulas, chunks(), nil)
+	})
+	if err := s.Init("localhost:0"); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	defer s.Shutdown()
+
+	client, err := flight.NewFlightClient(s.Addr().String(), nil, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	stream, err := client.DoGet(context.Background(), &flight.Ticket{Ticket: []byte("design")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdr, err := ipc.NewFlightDataReader(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdr.Release()
+
+	var names []string
+	for _, f := range rdr.Schema().Fields() {
+		names = append(names, f.Name)
+	}
+	exp := []string{"x1", "x2[a]", "x2[b]", "x2[c]"}
+	if !reflect.DeepEqual(names, exp) {
+		t.Errorf("Expected columns %v, observed %v", exp, names)
+	}
+
+	cols := make([][]float64, len(names))
+	nchunk := 0
+	for rdr.Next() {
+		rec := rdr.Record()
+		for j := range cols {
+			cols[j] = append(cols[j], rec.Column(j).(*array.Float64).Float64Values()...)
+		}
+		nchunk++
+	}
+	if err := rdr.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if nchunk != 2 {
+		t.Errorf("Expected 2 chunks, observed %d", nchunk)
+	}
+	expData := [][]float64{
+		{0, 1, 2, 3, 4},
+		{1, 0, 1, 0, 1},
+		{0, 1, 0, 0, 0},
+		{0, 0, 0, 1, 0},
+	}
+	if !reflect.DeepEqual(cols, expData) {
+		t.Errorf("Expected data %v, observed %v", expData, cols)
+	}
+
+	// An unknown design fails
+	stream, err = client.DoGet(context.Background(), &flight.Ticket{Ticket: []byte("other")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err == nil {
+		t.Errorf("Expected an error for an unknown design")
+	}
+}
@@ -3,8 +3,12 @@ package formula
 import (
 	"fmt"
 	"math"
+	"sort"
+	"strconv"
 	"strings"
+	"text/template"
 	"unicode"
+	"unicode/utf8"
 )
 
 // Tokens that can appear in a formula.
@@ -19,23 +23,77 @@ const (
 	plus
 	icept
 	funct
+	colon
+	power
+	number
+	nest
+	minus
+	arith
+	noicept
+	dot
+	comma
+	str
+	subexpr
+	tilde
+	binop
+	equals
+	labeled
+	pipe
 )
 
 // Func is a transformation of a numeric column to a column set.
 type Func func(string, []float64) *ColSet
 
+// StrFunc is a transformation of a string column to a column set,
+// e.g. a recoding or a collapsing of the levels of a categorical
+// variable.
+type StrFunc func(string, []string) *ColSet
+
+// Call holds the arguments of a function call in a formula.
+type Call struct {
+
+	// Name is the text of the call, e.g. "ratio(a, b)", which
+	// can be used to name the columns produced by the function.
+	Name string
+
+	// Args holds the data of the variable arguments, in order.
+	Args [][]float64
+
+	// Params holds the values of the literal arguments, in
+	// order.  Each value is a float64 for a number, e.g. the 3 in
+	// poly(x, 3), or a string for a quoted string, e.g. the "a"
+	// in cut(x, "a").
+	Params []interface{}
+}
+
+// MultiFunc is a transformation of one or more numeric columns to a
+// column set.
+type MultiFunc func(*Call) (*ColSet, error)
+
 // Operator precedence values; lower number is higher precedence.
-var precedence = map[tokType]int{times: 0, plus: 1}
+var precedence = map[tokType]int{power: 0, colon: 1, times: 2, nest: 2, plus: 3, minus: 3}
 
 // The token is either a symbol (operator or parentheses), a variable
 // name, or a function
 type token struct {
 	symbol tokType
 	name   string // only used if symbol == vname
+	prec   int    // only used if symbol == binop
+	pos    int    // byte offset of the token in the formula
 
-	// Below are only used for functions
+	// Below are only used for functions.  Each argument is a
+	// variable (vname), a literal (number or str), a nested
+	// function call (funct), or an expression (subexpr).  funcn
+	// is also the label of a labeled term.
 	funcn string
-	arg   string
+	args  []*token
+
+	// Only used if symbol == number
+	value float64
+
+	// Only used if symbol == arith, subexpr or labeled, the RPN
+	// of the expression
+	expr []*token
 }
 
 // pop removes the last token from the slice, and returns it along
@@ -69,7 +127,112 @@ func push(tokens []*token, tok *token) []*token {
 
 // lex takes a formula and lexes it to obtain an array of tokens.
 func lex(input string) ([]*token, error) {
+	return lexWith(input, nil, nil)
+}
+
+// lexWith lexes the formula, recognizing the symbols of the binary
+// operators in ops, and replacing each variable name that is a key of
+// macros with the parenthesized formula fragment it maps to.
+func lexWith(input string, macros map[string]string, ops map[string]BinaryOp) ([]*token, error) {
+
+	tokens, err := scan(input, ops)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err = expandMacros(tokens, macros, ops, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err = lexPipes(tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err = lexArith(tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err = lexFuncs(tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err = lexLabels(tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkLiterals(tokens); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// expandMacros replaces the variable names in tokens that are macros
+// with the tokens of the macros, recursively.  The macros currently
+// being expanded are in active.
+func expandMacros(tokens []*token, macros map[string]string, ops map[string]BinaryOp, active []string) ([]*token, error) {
+
+	if len(macros) == 0 {
+		return tokens, nil
+	}
+
+	var output []*token
+	for i, tok := range tokens {
+		body, ok := macros[tok.name]
+		if tok.symbol != vname || !ok || (i+1 < len(tokens) && tokens[i+1].symbol == leftp) {
+			output = append(output, tok)
+			continue
+		}
+		if find(active, tok.name) != -1 {
+			return nil, fmt.Errorf("Macro '%s' is defined in terms of itself", tok.name)
+		}
+
+		mtoks, err := scan(body, ops)
+		if err != nil {
+			return nil, fmt.Errorf("Macro '%s': %v", tok.name, err)
+		}
+		mtoks, err = expandMacros(mtoks, macros, ops, append(active, tok.name))
+		if err != nil {
+			return nil, err
+		}
+		for _, mt := range mtoks {
+			mt.pos = tok.pos
+		}
+		output = append(output, &token{symbol: leftp, pos: tok.pos})
+		output = append(output, mtoks...)
+		output = append(output, &token{symbol: rightp, pos: tok.pos})
+	}
+
+	return output, nil
+}
+
+// textReplacer converts characters that are often introduced when
+// formulas are copied from documents: smart quotes are converted to
+// plain quotes, dashes and minus signs to hyphens, and byte order
+// marks and zero width spaces are removed.  Non-breaking spaces are
+// whitespace, which is skipped by the lexer.
+var textReplacer = strings.NewReplacer(
+	"\u2018", "'", "\u2019", "'", "\u201C", "\"", "\u201D", "\"",
+	"\u2212", "-", "\u2013", "-",
+	"\uFEFF", "", "\u200B", "",
+)
 
+// normalizeText returns the formula with the characters handled by
+// textReplacer converted.
+func normalizeText(input string) string {
+	return textReplacer.Replace(input)
+}
+
+// scan splits the formula into tokens, recognizing the symbols of the
+// binary operators in ops.
+func scan(input string, ops map[string]BinaryOp) ([]*token, error) {
+
+	input = normalizeText(input)
 	var tokens []*token
 	rdr := strings.NewReader(input)
 
@@ -85,6 +248,8 @@ func lex(input string) ([]*token, error) {
 		if err != nil {
 			return nil, err
 		}
+		pos := len(input) - rdr.Len() - utf8.RuneLen(r)
+		n := len(tokens)
 		switch {
 		case r == '(':
 			tokens = append(tokens, &token{symbol: leftp})
@@ -94,10 +259,94 @@ func lex(input string) ([]*token, error) {
 			tokens = append(tokens, &token{symbol: plus})
 		case r == '*':
 			tokens = append(tokens, &token{symbol: times})
-		case r == '1':
-			tokens = append(tokens, &token{symbol: icept})
-		case r == ' ':
+		case r == ':':
+			tokens = append(tokens, &token{symbol: colon})
+		case r == '^':
+			tokens = append(tokens, &token{symbol: power})
+		case r == '/':
+			tokens = append(tokens, &token{symbol: nest})
+		case r == '-':
+			tokens = append(tokens, &token{symbol: minus})
+		case r == '.':
+			tokens = append(tokens, &token{symbol: dot, name: "."})
+		case r == ',':
+			tokens = append(tokens, &token{symbol: comma})
+		case r == '~':
+			tokens = append(tokens, &token{symbol: tilde})
+		case r == '=':
+			tokens = append(tokens, &token{symbol: equals, name: "="})
+		case r == '|' && strings.HasPrefix(input[pos+1:], ">"):
+			_, _, _ = rdr.ReadRune()
+			tokens = append(tokens, &token{symbol: pipe, name: "|>"})
+		case r == '"' || r == '\'':
+			var lit []rune
+			for {
+				if rdr.Len() == 0 {
+					return nil, syntaxError(input, pos, "unterminated string")
+				}
+				q, _, err := rdr.ReadRune()
+				if err != nil {
+					panic(err)
+				}
+				if q == r {
+					break
+				}
+				lit = append(lit, q)
+			}
+			tokens = append(tokens, &token{symbol: str, name: string(lit)})
+		case r == '`':
+			// A quoted variable name, which can contain any
+			// character other than a backtick
+			var name []rune
+			for {
+				if rdr.Len() == 0 {
+					return nil, syntaxError(input, pos, "unterminated variable name")
+				}
+				q, _, err := rdr.ReadRune()
+				if err != nil {
+					panic(err)
+				}
+				if q == '`' {
+					break
+				}
+				name = append(name, q)
+			}
+			if len(name) == 0 {
+				return nil, syntaxError(input, pos, "empty variable name")
+			}
+			tokens = append(tokens, &token{symbol: vname, name: string(name)})
+		case unicode.IsDigit(r):
+			num := []rune{r}
+			for rdr.Len() > 0 {
+				q, _, err := rdr.ReadRune()
+				if err != nil {
+					panic(err)
+				}
+				if !unicode.IsDigit(q) && q != '.' {
+					_ = rdr.UnreadRune()
+					break
+				}
+				num = append(num, q)
+			}
+			tok, err := numberToken(string(num), peek(tokens))
+			if err != nil {
+				return nil, syntaxError(input, pos, "%v", err)
+			}
+			tokens = append(tokens, tok)
+		case unicode.IsSpace(r):
 			// skip whitespace
+		case r == '#':
+			// skip a comment, which extends to the end of the
+			// line
+			for rdr.Len() > 0 {
+				q, _, err := rdr.ReadRune()
+				if err != nil {
+					panic(err)
+				}
+				if q == '\n' {
+					break
+				}
+			}
 		case unicode.IsLetter(r) || r == '_':
 			name := []rune{r}
 			for rdr.Len() > 0 {
@@ -113,67 +362,325 @@ func lex(input string) ([]*token, error) {
 			}
 			tokens = append(tokens, &token{symbol: vname, name: string(name)})
 		default:
-			return nil, fmt.Errorf("Invalid formula, symbol '%s' is not known.", string(r))
+			tok := scanOp(input, pos, rdr, ops)
+			if tok == nil {
+				return nil, syntaxError(input, pos, "unknown symbol '%s'", string(r))
+			}
+			tokens = append(tokens, tok)
+		}
+		for _, tok := range tokens[n:] {
+			tok.pos = pos
+		}
+	}
+
+	return tokens, nil
+}
+
+// checkLiterals returns an error if the tokens contain a literal that
+// is not an exponent.  Other literals are only allowed as function
+// arguments, which have already been collapsed into function tokens.
+func checkLiterals(tokens []*token) error {
+
+	for i, tok := range tokens {
+		switch {
+		case tok.symbol == str:
+			return syntaxError("", tok.pos, "string \"%s\" is not allowed here", tok.name)
+		case tok.symbol == number && (i == 0 || tokens[i-1].symbol != power):
+			return syntaxError("", tok.pos, "number '%s' is not allowed here", tok.name)
+		}
+	}
+
+	return nil
+}
+
+// numberToken returns the token for a number appearing in a formula
+// after the token prev.  Numbers can be used as exponents, as function
+// arguments, and as constants in I().  Otherwise, the number 1 denotes
+// the intercept and the number 0 denotes the absence of an intercept.
+func numberToken(num string, prev *token) (*token, error) {
+
+	literal := func() (*token, error) {
+		v, err := strconv.ParseFloat(num, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number '%s'", num)
 		}
+		return &token{symbol: number, name: num, value: v}, nil
+	}
+
+	switch {
+	case prev != nil && (prev.symbol == power || prev.symbol == comma):
+		return literal()
+	case num == "1":
+		return &token{symbol: icept}, nil
+	case num == "0":
+		return &token{symbol: noicept}, nil
+	default:
+		// Possibly a function argument or a constant in I(),
+		// checked after these are lexed
+		return literal()
 	}
+}
 
-	tokens, err := lexFuncs(tokens)
-	return tokens, err
+// hasSymbol returns true if any of the tokens has the given symbol.
+func hasSymbol(tokens []*token, symbol tokType) bool {
+	for _, tok := range tokens {
+		if tok.symbol == symbol {
+			return true
+		}
+	}
+	return false
 }
 
+// lexFuncs collapses each function call, e.g. f(x), f(x, y) or
+// f(g(x)), into a single token.
 func lexFuncs(input []*token) ([]*token, error) {
 
 	output := make([]*token, 0, len(input))
 	i := 0
 	m := len(input)
 	for i < m {
-		if i+1 < m && input[i].symbol == vname && input[i+1].symbol == leftp {
-			if i+3 < m && input[i+3].symbol == rightp {
-				// A function
-				name := fmt.Sprintf("%s(%s)", input[i].name, input[i+2].name)
-				newtok := &token{symbol: funct, name: name, arg: input[i+2].name, funcn: input[i].name}
-				output = append(output, newtok)
-				i = i + 4
-			} else {
-				return nil, fmt.Errorf("Malformed function call")
-			}
-		} else {
+		if input[i].symbol == comma {
+			return nil, syntaxError("", input[i].pos, "',' can only be used in function calls")
+		}
+		if i+1 >= m || input[i].symbol != vname || input[i+1].symbol != leftp {
 			// Not a function
 			output = append(output, input[i])
 			i++
+			continue
 		}
+
+		tok, next, err := lexCall(input, i)
+		if err != nil {
+			return nil, err
+		}
+		output = append(output, tok)
+		i = next
 	}
 
 	return output, nil
 }
 
-// isOperator returns true if the token is an opertor (times or plus)
+// lexCall collapses the function call starting at position i of the
+// input into a single token, and returns the token along with the
+// position following the call.
+func lexCall(input []*token, i int) (*token, int, error) {
+
+	m := len(input)
+	tok := &token{symbol: funct, funcn: input[i].name, pos: input[i].pos}
+	hasVar := false
+	j := i + 2
+	for {
+		// The argument ends at the next comma or right
+		// parenthesis that is not nested in parentheses
+		end, depth := j, 0
+		for ; end < m; end++ {
+			s := input[end].symbol
+			if depth == 0 && (s == comma || s == rightp) {
+				break
+			}
+			switch s {
+			case leftp:
+				depth++
+			case rightp:
+				depth--
+			}
+		}
+		if end == m {
+			return nil, 0, syntaxError("", tok.pos, "unterminated call of function '%s'", tok.funcn)
+		}
+		if end == j {
+			return nil, 0, syntaxError("", input[end].pos, "missing argument of function '%s'", tok.funcn)
+		}
+
+		arg, err := lexArg(input[j:end])
+		if err != nil {
+			return nil, 0, err
+		}
+		tok.args = append(tok.args, arg)
+		hasVar = hasVar || (arg.symbol != number && arg.symbol != str)
+
+		j = end + 1
+		if input[end].symbol == rightp {
+			break
+		}
+	}
+	if !hasVar {
+		return nil, 0, syntaxError("", tok.pos, "function '%s' must have a variable argument", tok.funcn)
+	}
+
+	text := make([]string, len(tok.args))
+	for k, arg := range tok.args {
+		text[k] = argText(arg)
+	}
+	tok.name = fmt.Sprintf("%s(%s)", tok.funcn, strings.Join(text, ", "))
+
+	return tok, j, nil
+}
+
+// lexArg returns a token representing one argument of a function
+// call: a variable, a literal, a nested function call, or an
+// expression.
+func lexArg(input []*token) (*token, error) {
+
+	tokens, err := lexFuncs(input)
+	if err != nil {
+		return nil, err
+	}
+	for _, tok := range tokens {
+		switch tok.symbol {
+		case tilde:
+			return nil, syntaxError("", tok.pos, "'~' can not be used in function calls")
+		case equals:
+			return nil, syntaxError("", tok.pos, "labels can not be used in function calls")
+		}
+	}
+
+	// A possibly negative number; 1 and 0 are numbers in a
+	// function call
+	lit := tokens
+	neg := len(lit) == 2 && lit[0].symbol == minus
+	if neg {
+		lit = lit[1:]
+	}
+	if len(lit) == 1 {
+		v, text := lit[0].value, lit[0].name
+		switch lit[0].symbol {
+		case icept:
+			v, text = 1, "1"
+		case noicept:
+			v, text = 0, "0"
+		}
+		switch lit[0].symbol {
+		case number, icept, noicept:
+			if neg {
+				v, text = -v, "-"+text
+			}
+			return &token{symbol: number, name: text, value: v, pos: tokens[0].pos}, nil
+		case vname, funct, str:
+			if !neg {
+				return lit[0], nil
+			}
+		}
+	}
+
+	if err := checkLiterals(tokens); err != nil {
+		return nil, err
+	}
+	rpn, err := parse(tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	return &token{symbol: subexpr, name: renderTokens(tokens), expr: rpn, pos: tokens[0].pos}, nil
+}
+
+// argText returns the text of a function argument.  Variable names
+// that are not identifiers are quoted with backticks.
+func argText(arg *token) string {
+	switch {
+	case arg.symbol == str:
+		return strconv.Quote(arg.name)
+	case arg.symbol == vname && !isIdent(arg.name):
+		return "`" + arg.name + "`"
+	}
+	return arg.name
+}
+
+// isIdent returns true if na is a valid variable name without
+// quoting.
+func isIdent(na string) bool {
+	for i, r := range na {
+		if !(unicode.IsLetter(r) || r == '_' || (i > 0 && unicode.IsDigit(r))) {
+			return false
+		}
+	}
+	return na != ""
+}
+
+// renderTokens returns the text of a formula expression.
+func renderTokens(tokens []*token) string {
+
+	var parts []string
+	for _, tok := range tokens {
+		switch tok.symbol {
+		case leftp:
+			parts = append(parts, "(")
+		case rightp:
+			parts = append(parts, ")")
+		case plus:
+			parts = append(parts, " + ")
+		case minus:
+			parts = append(parts, " - ")
+		case times:
+			parts = append(parts, "*")
+		case nest:
+			parts = append(parts, "/")
+		case colon:
+			parts = append(parts, ":")
+		case power:
+			parts = append(parts, "^")
+		case icept:
+			parts = append(parts, "1")
+		case noicept:
+			parts = append(parts, "0")
+		default:
+			parts = append(parts, argText(tok))
+		}
+	}
+
+	return strings.Join(parts, "")
+}
+
+// isOperator returns true if the token is an opertor (times, colon,
+// power, nest, plus or minus)
 func isOperator(tok *token) bool {
-	if tok.symbol == times || tok.symbol == plus {
+	switch tok.symbol {
+	case times, colon, power, nest, plus, minus, binop:
 		return true
 	}
 	return false
 }
 
+// tokPrecedence returns the precedence of an operator token.
+func tokPrecedence(tok *token) int {
+	if tok.symbol == binop {
+		return tok.prec
+	}
+	return precedence[tok.symbol]
+}
+
 // parse converts the formula to RPN
 // https://en.wikipedia.org/wiki/Shunting-yard_algorithm
 func parse(input []*token) ([]*token, error) {
 
+	if len(input) == 0 {
+		return nil, syntaxError("", 0, "empty formula")
+	}
+
 	var stack, output []*token
 	var last *token
+	expectOperand := true
 
 	for _, tok := range input {
 
 		switch {
-		case tok.symbol == vname || tok.symbol == funct || tok.symbol == icept:
+		case tok.symbol == vname || tok.symbol == funct || tok.symbol == icept || tok.symbol == noicept || tok.symbol == dot || tok.symbol == number || tok.symbol == arith || tok.symbol == labeled:
+			if !expectOperand {
+				return nil, syntaxError("", tok.pos, "missing operator before '%s'", tokText(tok))
+			}
 			output = append(output, tok)
+			expectOperand = false
 		case isOperator(tok):
+			if expectOperand {
+				return nil, syntaxError("", tok.pos, "unexpected '%s'", tokText(tok))
+			}
 			for {
 				last := peek(stack)
 				if last == nil || !isOperator(last) {
 					break
 				}
-				if precedence[tok.symbol] > precedence[last.symbol] {
+				// All operators are left associative
+				if tokPrecedence(tok) >= tokPrecedence(last) {
 					stack, last = pop(stack)
 					output = append(output, last)
 				} else {
@@ -181,13 +688,20 @@ func parse(input []*token) ([]*token, error) {
 				}
 			}
 			stack = push(stack, tok)
+			expectOperand = true
 		case tok.symbol == leftp:
+			if !expectOperand {
+				return nil, syntaxError("", tok.pos, "missing operator before '('")
+			}
 			stack = push(stack, tok)
 		case tok.symbol == rightp:
+			if expectOperand {
+				return nil, syntaxError("", tok.pos, "unexpected ')'")
+			}
 			for {
 				stack, last = pop(stack)
 				if last == nil {
-					return nil, fmt.Errorf("Unbalanced parentheses")
+					return nil, syntaxError("", tok.pos, "unbalanced parentheses")
 				}
 				if last.symbol == leftp {
 					break
@@ -195,16 +709,23 @@ func parse(input []*token) ([]*token, error) {
 					output = append(output, last)
 				}
 			}
+		default:
+			return nil, syntaxError("", tok.pos, "unexpected '%s'", tokText(tok))
 		}
 	}
 
+	if expectOperand {
+		tok := input[len(input)-1]
+		return nil, syntaxError("", tok.pos, "missing operand after '%s'", tokText(tok))
+	}
+
 	for {
 		stack, last = pop(stack)
 		if last == nil {
 			break
 		}
 		if last.symbol == leftp || last.symbol == rightp {
-			return nil, fmt.Errorf("mismatched parentheses")
+			return nil, syntaxError("", last.pos, "unbalanced parentheses")
 		}
 		output = append(output, last)
 	}
@@ -237,35 +758,218 @@ type Parser struct {
 	// Map from function name to function.
 	funcs map[string]Func
 
+	// Map from function name to function, for functions that
+	// can take several arguments
+	multiFuncs map[string]MultiFunc
+
+	// Map from function name to function, for functions of
+	// string variables
+	strFuncs map[string]StrFunc
+
+	// Map from function name to function, for functions that
+	// produce categorical variables
+	catFuncs map[string]CatFunc
+
+	// Layouts of string variables holding dates
+	dateLayouts []string
+
+	// Named formula fragments
+	macros map[string]string
+
+	// Binary operators in addition to the built-in operators
+	binaryOps map[string]BinaryOp
+
+	// The template for naming the columns produced by functions,
+	// and its parsed form
+	nameTemplate string
+	nameTmpl     *template.Template
+
+	// How to handle duplicated column names
+	dupPolicy DupPolicy
+
+	// If true, a*b includes main effects
+	rStyle bool
+
+	// If true, formulas include an intercept unless it is
+	// suppressed with 0
+	autoIcept bool
+
+	// Whether the design and responses are scaled by the weights
+	weightScaling WeightScaling
+
+	// The mean weight of the data that the codes were learned
+	// from, used by RelativeWeights
+	meanWeight float64
+
+	// The coding of the categorical variables, and the levels of
+	// the ordered categorical variables
+	contrasts map[string]Contrast
+	ordered   map[string][]string
+	levels    map[string][]string
+
+	// How reference levels are chosen, and the reference levels
+	// that were chosen from the data
+	refPolicy RefPolicy
+	autoRefs  map[string]string
+
+	// If true, the levels learned from the data are coded in
+	// sorted order
+	sortCodes bool
+
+	// Levels occurring fewer than minLevelCount times are pooled,
+	// the number of times that each level was seen, and the
+	// pooled levels of each variable
+	minLevelCount int
+	levelCounts   map[string]map[string]int
+	pooled        map[string]map[string]bool
+
+	// How levels that were not seen when the codes were
+	// determined are coded
+	unknownLevels UnknownPolicy
+
+	// Whether the categorical variables are coded by an indicator
+	// for every level, and the variables for which this is
+	// overridden
+	oneHot     bool
+	oneHotVars map[string]bool
+
+	// The default transformations of the variables
+	recipe *Recipe
+
+	// The rescaling of the blocks of columns produced by
+	// functions, the offset and scale of each rescaled column, and
+	// whether these have been learned from the data
+	blockScaling BlockScaling
+	blockScales  map[string][2]float64
+	blockFitted  bool
+
+	// How interactions of categorical variables are coded
+	interactionCoding InteractionCoding
+
+	// The categorical variables coded by statistics of their
+	// levels
+	encoders map[string]StatEncoder
+
+	// The categorical variables coded by a Coder
+	coders map[string]Coder
+
+	// Parameters learned by another parser, which are used
+	// instead of learning them from the data
+	fitted *Codes
+
+	// The integer variables that are categorical
+	intCategorical map[string]bool
+
+	// Whether the levels of string variables are trimmed and
+	// case-folded
+	trimLevels bool
+	foldLevels bool
+
+	// The number of most frequent levels that are coded, and the
+	// counts of the levels of each variable if it is positive
+	topLevels int
+	heavy     map[string]*spaceSaving
+
+	// The sketches of the quantiles of the numeric variables that
+	// are used by ecdf, winsor, cut, and bs and te if the knots are
+	// placed at quantiles
+	quantiles     map[string]*quantileSketch
+	quantileKnots bool
+
+	// The values of categorical variables that are missing, and
+	// how they are coded
+	missingLevels map[string]bool
+	missingPolicy MissingPolicy
+
+	// The variable identifying the rows, and the number of rows
+	// in the most recently parsed data
+	rowID string
+	nobs  int
+
 	// The final data produced by parsing the formula
 	data *ColSet
 
+	// The columns produced by the left-hand sides of the
+	// formulas
+	response *ColSet
+
+	// The columns produced by calls to offset and weights
+	offsets *ColSet
+	weights []float64
+
 	ErrorState error
 
-	// Intermediate data
+	// Intermediate data, see workKey
 	workData map[string]*ColSet
 
+	// The variables of the data converted by get, during Parse
+	rawCache map[string]interface{}
+
+	// Columns produced by functions, which can be used as inputs
+	// to other functions
+	derived        map[string][]float64
+	derivedOrigins map[string]*origin
+
+	// Evaluated sub-expressions, shared by all formulas
+	cache map[string]*ColSet
+
+	// The rows of each categorical term whose level was not seen
+	// when the codes were determined, and is coded by zeros, during
+	// Parse
+	unseen map[string][]bool
+
 	facNames map[string][]string
+
+	// The categorical variables whose reference level has been
+	// seen in the data
+	refSeen map[string]bool
+
+	// The minimum and maximum of each numeric variable that has
+	// non-missing values
+	ranges map[string][2]float64
+
+	// The variables seen in the data, in order of first
+	// appearance
+	vars []string
+
+	// The versions of the variables in the data that the codes
+	// were learned from, see VersionedSource
+	versions map[string]string
+
+	// The date layout of each string variable fixed when the
+	// codes were learned, or "" if it does not hold dates
+	layouts map[string]string
+
+	// The count, mean and sum of squared deviations of the
+	// numeric variables used by standardize
+	moments map[string][3]float64
+
 	rpn      [][]*token // separate RPN for each formula
+	lhs      []bool     // true if the RPN is a left-hand side
 	rawNames []string
 	names    []string
+
+	// The variables of the left-hand side of the formula being
+	// evaluated, which are not included by '.'
+	dotSkip map[string]bool
 }
 
 // New creates a Parser from a formula and a data stream.
 func New(formula string, rawdata DataSource, config *Config) (*Parser, error) {
+	return NewMulti([]string{formula}, rawdata, config)
+}
+
+// NewMulti accepts several formulas and includes all their parsed
+// terms in the resulting data set.  If the configuration has
+// problems, e.g. a reference level for a variable that is not in the
+// data, a *ConfigError describing all of them is returned.
+func NewMulti(formulas []string, rawdata DataSource, config *Config) (*Parser, error) {
 
 	fp := &Parser{
-		Formulas: []string{formula},
+		Formulas: formulas,
 		RawData:  rawdata,
 	}
-
-	if config != nil && config.Funcs != nil {
-		fp.funcs = config.Funcs
-	}
-
-	if config != nil && config.RefLevels != nil {
-		fp.refLevels = config.RefLevels
-	}
+	fp.configure(config)
 
 	if err := fp.init(); err != nil {
 		return nil, err
@@ -274,28 +978,92 @@ func New(formula string, rawdata DataSource, config *Config) (*Parser, error) {
 	return fp, nil
 }
 
-// NewMulti accepts several formulas and includes all their parsed
-// terms in the resulting data set.
-func NewMulti(formulas []string, rawdata DataSource, config *Config) (*Parser, error) {
+// WithData returns a parser that applies the formulas of fp to the
+// data in src, using the categorical codes that fp learned from its
+// own data.  This allows a design matrix for new data, e.g. a
+// validation set, to be coded in the same way as the design matrix
+// for the training data.  Levels not seen by fp have no indicator.
+// The returned parser has its own copy of the parameters learned by
+// fp, so that parsing the new data does not change fp.
+func (fp *Parser) WithData(src DataSource) *Parser {
+
+	p := *fp
+	p.setFitted(fp.Codes())
+	p.RawData = src
+	p.data = nil
+	p.response = nil
+	p.offsets = nil
+	p.weights = nil
+	p.names = nil
+
+	return &p
+}
 
-	fp := &Parser{
-		Formulas: formulas,
-		RawData:  rawdata,
-	}
+// configure copies the settings in config into the parser.
+func (fp *Parser) configure(config *Config) {
 
 	if config != nil && config.Funcs != nil {
 		fp.funcs = config.Funcs
 	}
 
+	if config != nil && config.MultiFuncs != nil {
+		fp.multiFuncs = config.MultiFuncs
+	}
+
+	if config != nil && config.StrFuncs != nil {
+		fp.strFuncs = config.StrFuncs
+	}
+
+	if config != nil && config.CatFuncs != nil {
+		fp.catFuncs = config.CatFuncs
+	}
+
+	if config != nil {
+		fp.dateLayouts = config.DateLayouts
+		fp.macros = config.Macros
+		fp.binaryOps = config.BinaryOps
+		fp.nameTemplate = config.NameTemplate
+	}
+	fp.binaryOps = binaryOps(fp.binaryOps)
+
 	if config != nil && config.RefLevels != nil {
 		fp.refLevels = config.RefLevels
 	}
 
-	if err := fp.init(); err != nil {
-		return nil, err
+	if config != nil {
+		fp.dupPolicy = config.Duplicates
+		fp.rStyle = config.RStyleOperators
+		fp.autoIcept = config.AutoIntercept
+		fp.weightScaling = config.WeightScaling
+		fp.contrasts = config.Contrasts
+		fp.ordered = config.Ordered
+		fp.levels = config.Levels
+		fp.refPolicy = config.RefPolicy
+		fp.sortCodes = config.SortLevels
+		fp.minLevelCount = config.MinLevelCount
+		fp.unknownLevels = config.UnknownLevels
+		fp.oneHot = config.OneHot
+		fp.oneHotVars = config.OneHotVars
+		fp.recipe = config.Recipe
+		fp.blockScaling = config.BlockScaling
+		fp.interactionCoding = config.InteractionCoding
+		fp.encoders = config.Encoders
+		fp.coders = config.Coders
+		fp.fitted = config.Codes
+		fp.intCategorical = config.IntCategorical
+		fp.trimLevels = config.TrimLevels
+		fp.foldLevels = config.FoldLevels
+		fp.topLevels = config.TopLevels
+		fp.missingPolicy = config.MissingPolicy
+		fp.quantileKnots = config.QuantileKnots
+		if len(config.MissingLevels) > 0 {
+			fp.missingLevels = make(map[string]bool)
+			for _, x := range config.MissingLevels {
+				fp.missingLevels[x] = true
+			}
+		}
+		fp.rowID = config.RowID
 	}
-
-	return fp, nil
 }
 
 // ColSet represents a design matrix.  It is an ordered set of named
@@ -303,6 +1071,28 @@ func NewMulti(formulas []string, rawdata DataSource, config *Config) (*Parser, e
 type ColSet struct {
 	names []string
 	data  [][]float64
+
+	// The positions of the rows in the data, and the values of
+	// the row identifier variable in these rows.  If rows is nil,
+	// the rows are in data order.  If ids is nil, there is no row
+	// identifier.
+	rows []int
+	ids  interface{}
+
+	// The label of the term that each column belongs to, e.g.
+	// "x2" for the indicator columns of a factor x2, or "x1:x2"
+	// for their interactions with x1.  If nil, each column is its
+	// own term.
+	terms []string
+
+	// How each column was derived.  If nil, the columns were not
+	// produced by a Parser.
+	origins []*origin
+
+	// Descriptions of the columns returned by a function, see
+	// NewColSetMeta.  If nil, the columns are named by the
+	// function.
+	meta []ColumnMeta
 }
 
 func NewColSet(names []string, data [][]float64) *ColSet {
@@ -322,14 +1112,19 @@ func (cs *ColSet) Get(na string) ([]float64, error) {
 	return nil, fmt.Errorf("No column '%s'", na)
 }
 
+// Names returns the names of the columns, in column order.
 func (cs *ColSet) Names() []string {
 	return cs.names
 }
 
+// Data returns the data of the columns, in the same order as Names.
 func (cs *ColSet) Data() [][]float64 {
 	return cs.data
 }
 
+// DropNA returns a ColSet containing the rows of cs that have no
+// missing values.  The rows can be traced to the data with Rows and
+// RowIDs.
 func (cs *ColSet) DropNA() *ColSet {
 
 	var ii []int
@@ -360,32 +1155,368 @@ func (cs *ColSet) DropNA() *ColSet {
 	copy(names1, cs.names)
 
 	return &ColSet{
-		names: names1,
-		data:  da,
+		names:   names1,
+		data:    da,
+		rows:    cs.subRows(ii),
+		ids:     subIDs(cs.ids, ii),
+		terms:   append([]string(nil), cs.terms...),
+		origins: append([]*origin(nil), cs.origins...),
 	}
 }
 
-// Extend a ColSet with the data of another ColSet.
-func (c *ColSet) Extend(o *ColSet) {
+// term returns the label of the term containing column j.
+func (cs *ColSet) term(j int) string {
+	if cs.terms == nil {
+		return cs.names[j]
+	}
+	return cs.terms[j]
+}
+
+// withTerm returns a shallow copy of cs in which all columns belong to
+// the term with the given label.
+func (cs *ColSet) withTerm(label string) *ColSet {
 
-	// Don't add duplicate terms (which may arise when parsing
-	// multiple formulas).
-	mp := make(map[string]bool)
-	for _, na := range c.names {
-		mp[na] = true
+	terms := make([]string, len(cs.names))
+	for j := range terms {
+		terms[j] = label
+	}
+
+	return &ColSet{names: cs.names, data: cs.data, terms: terms, origins: cs.origins}
+}
+
+// blocks returns the positions of the columns belonging to each term,
+// in order of the first appearance of each term.
+func (cs *ColSet) blocks() [][]int {
+
+	var blocks [][]int
+	ix := make(map[string]int)
+	for j := range cs.names {
+		t := cs.term(j)
+		k, ok := ix[t]
+		if !ok {
+			k = len(blocks)
+			ix[t] = k
+			blocks = append(blocks, nil)
+		}
+		blocks[k] = append(blocks[k], j)
+	}
+
+	return blocks
+}
+
+// sub returns a ColSet containing the columns of cs at the given
+// positions.
+func (cs *ColSet) sub(ix []int) *ColSet {
+
+	sb := new(ColSet)
+	for _, j := range ix {
+		sb.names = append(sb.names, cs.names[j])
+		sb.data = append(sb.data, cs.data[j])
+		sb.terms = append(sb.terms, cs.term(j))
+		sb.origins = append(sb.origins, cs.origin(j))
+	}
+
+	return sb
+}
+
+// DupPolicy determines how a column is handled when it is added to a
+// ColSet that already contains a column with the same name.
+type DupPolicy int
+
+const (
+	// DupSkip silently skips the new column.  This is the
+	// default.
+	DupSkip DupPolicy = iota
+
+	// DupError skips the new column if its data are identical to
+	// the data of the existing column, and otherwise returns an
+	// error.
+	DupError
+
+	// DupRename adds the new column, with a suffix "_2", "_3",
+	// etc. appended to its name to make it unique.
+	DupRename
+)
+
+// Extend a ColSet with the data of another ColSet.  Columns of o whose
+// names are already present in c are skipped.
+func (c *ColSet) Extend(o *ColSet) {
+	// Cannot fail with DupSkip
+	_ = c.ExtendPolicy(o, DupSkip)
+}
+
+// ExtendPolicy extends a ColSet with the data of another ColSet, using
+// the given policy to handle columns of o whose names are already
+// present in c.
+func (c *ColSet) ExtendPolicy(o *ColSet, policy DupPolicy) error {
+
+	if c.terms == nil {
+		c.terms = make([]string, len(c.names))
+		for j := range c.names {
+			c.terms[j] = c.term(j)
+		}
+	}
+	if c.origins == nil {
+		c.origins = make([]*origin, len(c.names))
+		for j := range c.names {
+			c.origins[j] = c.origin(j)
+		}
+	}
+
+	// Duplicate terms may arise when parsing multiple formulas.
+	mp := make(map[string]int)
+	for j, na := range c.names {
+		mp[na] = j
 	}
 
 	for j, na := range o.names {
-		if !mp[na] {
-			c.names = append(c.names, na)
-			c.data = append(c.data, o.data[j])
+		k, ok := mp[na]
+		if ok {
+			switch policy {
+			case DupSkip:
+				continue
+			case DupError:
+				if !sameData(c.data[k], o.data[j]) {
+					return fmt.Errorf("Column '%s' is duplicated with different data", na)
+				}
+				continue
+			case DupRename:
+				for i := 2; ok; i++ {
+					na = fmt.Sprintf("%s_%d", o.names[j], i)
+					_, ok = mp[na]
+				}
+			default:
+				return fmt.Errorf("Unknown duplicate column policy %d", policy)
+			}
+		}
+		mp[na] = len(c.names)
+		org := o.origin(j)
+		if na != o.names[j] {
+			org = &origin{op: "rename", name: na, inputs: []*origin{org}}
 		}
+		c.terms = append(c.terms, o.term(j))
+		c.origins = append(c.origins, org)
+		c.names = append(c.names, na)
+		c.data = append(c.data, o.data[j])
 	}
+
+	return nil
+}
+
+// sameData returns true if x and y are identical, treating NaN values
+// as equal to each other.
+func sameData(x, y []float64) bool {
+
+	if len(x) != len(y) {
+		return false
+	}
+
+	for i := range x {
+		if x[i] != y[i] && !(math.IsNaN(x[i]) && math.IsNaN(y[i])) {
+			return false
+		}
+	}
+
+	return true
 }
 
 type Config struct {
 	RefLevels map[string]string
 	Funcs     map[string]Func
+
+	// MultiFuncs are functions that can be called with several
+	// arguments, e.g. ratio(a, b).  If a name is in both Funcs
+	// and MultiFuncs, the MultiFunc is used.
+	MultiFuncs map[string]MultiFunc
+
+	// StrFuncs are functions of a single string variable.  A
+	// name can be in StrFuncs as well as in Funcs or MultiFuncs,
+	// in which case the StrFunc is used when the argument is a
+	// string variable.
+	StrFuncs map[string]StrFunc
+
+	// CatFuncs are functions of a single numeric variable that
+	// produce a categorical variable, which is dummy-coded like
+	// a string variable.  A CatFunc takes precedence over a
+	// function with the same name in Funcs or MultiFuncs.
+	CatFuncs map[string]CatFunc
+
+	// Duplicates determines how columns with the same name
+	// produced by different formulas are handled.
+	Duplicates DupPolicy
+
+	// If RStyleOperators is true, a*b includes the main effects
+	// of a and b as well as their interaction, i.e. it is
+	// equivalent to a + b + a:b, as in R, and a term that is
+	// repeated in a sum, e.g. x + x, gives its columns once.
+	// Otherwise a*b is equivalent to a:b.
+	RStyleOperators bool
+
+	// If AutoIntercept is true, each formula includes an
+	// intercept as if it began with "1 +", unless the formula
+	// contains 0.  Either way, the intercept can be removed with
+	// "- 1".
+	AutoIntercept bool
+
+	// DateLayouts are layouts, as used by time.Parse, of string
+	// variables that hold dates.  A string variable is treated
+	// as a numeric variable holding the number of seconds since
+	// January 1, 1970 UTC if all of its non-empty values can be
+	// parsed with one of the layouts.  The layouts are tried in
+	// order, and empty values are treated as missing (NaN).  The
+	// layout of each variable is fixed when the codes are
+	// learned, and is used for all the chunks of a stream and
+	// for new data, in which values that do not match the layout
+	// are missing (NaN).
+	DateLayouts []string
+
+	// Macros are named formula fragments.  A variable name in a
+	// formula that is a key of Macros is replaced with the
+	// fragment in parentheses, e.g. with the macro "demog" for
+	// "age + sex", the formula "demog*time" is equivalent to
+	// "(age + sex)*time".  Macros can refer to other macros.
+	Macros map[string]string
+
+	// BinaryOps are binary operators that can be used in
+	// formulas in addition to the built-in operators, keyed by
+	// their symbols, e.g. "%max%".
+	BinaryOps map[string]BinaryOp
+
+	// NameTemplate is a text/template used to name the columns
+	// that functions return with NewColSetMeta, which is
+	// executed with the ColumnMeta of each column, e.g.
+	// "{{.Base}}^{{.Component}}".  If empty,
+	// DefaultNameTemplate is used.
+	NameTemplate string
+
+	// WeightScaling determines whether the columns returned by
+	// Parse and Response are multiplied by the square roots of
+	// the weights given by weights(w) in the formulas.
+	WeightScaling WeightScaling
+
+	// Contrasts determines the coding of categorical variables,
+	// keyed like RefLevels by variable name or by the text of a
+	// call to C or a CatFunc.  Variables that are not in
+	// Contrasts use TreatmentContrast.
+	Contrasts map[string]Contrast
+
+	// Ordered gives the levels of ordered categorical variables
+	// in order, keyed like Contrasts.  The ordered variables use
+	// PolyContrast unless another contrast is given in Contrasts,
+	// in which case the levels are coded in the given order, e.g.
+	// so that HelmertContrast compares each level to the levels
+	// before it in this order.
+	Ordered map[string][]string
+
+	// Levels declares levels of categorical variables, keyed like
+	// RefLevels, that receive columns even if they do not occur
+	// in the data, e.g. rare categories, so that designs for
+	// different datasets have the same columns.  The declared
+	// levels precede the levels found in the data.
+	Levels map[string][]string
+
+	// MinLevelCount pools the levels of categorical variables
+	// that occur fewer than MinLevelCount times in the data into
+	// a single level, OtherLevel, which is coded by a column
+	// named like x[_other_].  Reference levels and declared
+	// levels are not pooled, nor are the levels of ordered
+	// variables.
+	MinLevelCount int
+
+	// RefPolicy chooses the reference levels of the categorical
+	// variables that have none in RefLevels or in the formula.
+	RefPolicy RefPolicy
+
+	// SortLevels codes the levels of the categorical variables
+	// learned from the data in sorted order, as with RefFirst,
+	// instead of in order of first appearance, so that the order
+	// of the columns does not depend on the order of the rows.
+	// Levels declared in Levels still come first.
+	SortLevels bool
+
+	// UnknownLevels determines how levels of categorical
+	// variables that were not seen when the codes were
+	// determined, e.g. in new data given to WithData, are coded.
+	UnknownLevels UnknownPolicy
+
+	// OneHot codes the categorical variables by an indicator for
+	// every level, including the reference level, as used by
+	// regularized models and trees.  OneHotVars overrides OneHot
+	// for the variables or calls it contains, keyed like
+	// RefLevels.  Variables with a contrast other than
+	// TreatmentContrast are not affected.
+	OneHot     bool
+	OneHotVars map[string]bool
+
+	// Recipe gives default transformations of the variables by
+	// type, which are applied unless a formula transforms the
+	// variable explicitly.
+	Recipe *Recipe
+
+	// BlockScaling rescales the blocks of columns produced by
+	// function calls, e.g. spline bases.
+	BlockScaling BlockScaling
+
+	// InteractionCoding determines how interactions of
+	// categorical variables are coded, e.g. by an indicator for
+	// each combination of their levels.
+	InteractionCoding InteractionCoding
+
+	// Encoders code categorical variables by statistics of their
+	// levels instead of by indicators, keyed like RefLevels.
+	Encoders map[string]StatEncoder
+
+	// Coders code categorical variables by the columns returned by
+	// a Coder instead of by indicators, keyed like RefLevels.
+	Coders map[string]Coder
+
+	// Codes are the categorical codes and the other parameters
+	// learned from the data by another parser, see Parser.Codes,
+	// which are used instead of learning them from the data, so
+	// that the designs have the same columns as the designs of
+	// that parser.  The formulas and the rest of the
+	// configuration should be the same as those of that parser.
+	Codes *Codes
+
+	// IntCategorical holds the integer variables, whose data are
+	// []int or []int64, that are categorical variables.  The other
+	// integer variables are numeric.
+	IntCategorical map[string]bool
+
+	// TrimLevels removes leading and trailing white space from
+	// the values of string variables, and FoldLevels converts them
+	// to lower case, before they are coded, so that e.g. "Male",
+	// "male " and "MALE" are the same level.  Reference levels and
+	// other levels given in the configuration must be given in
+	// normalized form, e.g. "male".
+	TrimLevels bool
+	FoldLevels bool
+
+	// TopLevels, if positive, is the number of levels of each
+	// categorical variable that are coded, which are the most
+	// frequent levels, selected in one pass over the data without
+	// storing all the levels.  The other levels are coded
+	// according to UnknownLevels.  TopLevels can not be used with
+	// MinLevelCount.
+	TopLevels int
+
+	// QuantileKnots places the interior knots of the splines of
+	// bs and te at quantiles of the variables, instead of equally
+	// spaced over their ranges.
+	QuantileKnots bool
+
+	// MissingLevels are values of categorical variables that
+	// denote missing values, e.g. "" or "NA", which are coded as
+	// specified by MissingPolicy.
+	MissingLevels []string
+	MissingPolicy MissingPolicy
+
+	// RowID is the name of a variable identifying the rows of the
+	// data, whose values are carried by the ColSets returned by
+	// Parse and Response, see ColSet.RowIDs.  The variable is not
+	// included in the columns of "." and is only in the design if
+	// a formula names it.
+	RowID string
 }
 
 // checkConv ensures that the variables with the given names have been
@@ -404,46 +1535,208 @@ func (fp *Parser) checkConv(v ...string) error {
 // variable.
 func (fp *Parser) setCodes() {
 
+	fp.resetCodes()
+	fp.updateCodes(fp.RawData)
+}
+
+// resetCodes discards all information learned from the data, keeping
+// only the declared levels.
+func (fp *Parser) resetCodes() {
 	fp.codes = make(map[string]map[string]int)
 	fp.facNames = make(map[string][]string)
+	fp.refSeen = make(map[string]bool)
+	fp.ranges = make(map[string][2]float64)
+	fp.vars = nil
+	fp.versions = make(map[string]string)
+	fp.quantiles = make(map[string]*quantileSketch)
+	fp.layouts = make(map[string]string)
+	fp.moments = make(map[string][3]float64)
+	fp.heavy = nil
+
+	// The declared levels come first, in the given order, and are
+	// not counted
+	fp.levelCounts = make(map[string]map[string]int)
+	for na := range fp.levels {
+		fp.updateLevels(na, fp.refLevel(na), fp.declaredLevels(na))
+	}
+	for na := range fp.ordered {
+		if _, ok := fp.levels[na]; !ok && fp.contrast(na) != PolyContrast {
+			fp.updateLevels(na, fp.refLevel(na), fp.declaredLevels(na))
+		}
+	}
+	fp.levelCounts = make(map[string]map[string]int)
+	fp.pooled = make(map[string]map[string]bool)
+	if fp.topLevels > 0 {
+		fp.heavy = make(map[string]*spaceSaving)
+	}
+}
 
-	for _, na := range fp.RawData.Names() {
-		v := fp.RawData.Get(na)
+// updateCodes extends the existing codes with any levels of the
+// categorical variables in src that have not been seen before, and
+// the ranges of the numeric variables to include the values in src.
+func (fp *Parser) updateCodes(src DataSource) {
+
+	qvars := fp.quantileVars()
+	mvars, allMoments := fp.momentVars()
+	for _, na := range src.Names() {
+		fp.fitLayout(src, na)
+		v := fp.get(src, na)
 		if v == nil {
 			break
 		}
+		if find(fp.vars, na) == -1 {
+			fp.vars = append(fp.vars, na)
+		}
 		switch v := v.(type) {
-		case []string:
-			// Get the category codes for this
-			// variable.  If this is the first
-			// chunk, start from scratch.
-			codes, ok := fp.codes[na]
-			if !ok {
-				codes = make(map[string]int)
-				fp.codes[na] = codes
-			}
-
-			ref := fp.refLevels[na]
+		case []float64:
+			// Variables with no observed values do not
+			// have a range.
+			r, ok := fp.ranges[na]
 			for _, x := range v {
-				if x == ref {
+				if math.IsNaN(x) {
 					continue
 				}
-				_, ok := codes[x]
-				if !ok {
-					// New code
-					fm := fmt.Sprintf("%s[%s]", na, x)
-					fp.facNames[na] = append(fp.facNames[na], fm)
-					codes[x] = len(codes)
+				if !ok || x < r[0] {
+					r[0] = x
+				}
+				if !ok || x > r[1] {
+					r[1] = x
 				}
+				ok = true
+			}
+			if ok {
+				fp.ranges[na] = r
+			}
+			if qvars[na] {
+				fp.updateQuantiles(na, v)
+			}
+			if allMoments || mvars[na] {
+				fp.updateMoments(na, v)
+			}
+		case []string:
+			fp.updateLevels(na, fp.refLevels[na], v)
+		}
+	}
+
+	fp.updateCatCodes(src)
+	fp.updateVersions(src)
+}
+
+// updateLevels extends the codes of the categorical variable na with
+// the levels in v that have not been seen before.
+func (fp *Parser) updateLevels(na, ref string, v []string) {
+
+	if fp.heavy != nil {
+		fp.addHeavy(na, ref, v)
+		return
+	}
+
+	// Get the category codes for this variable.  If this is the
+	// first chunk, start from scratch.
+	codes, ok := fp.codes[na]
+	if !ok {
+		codes = make(map[string]int)
+		fp.codes[na] = codes
+	}
+
+	var counts map[string]int
+	if fp.countsLevels() {
+		counts = fp.levelCounts[na]
+		if counts == nil {
+			counts = make(map[string]int)
+			fp.levelCounts[na] = counts
+		}
+	}
+
+	oneHot := fp.isOneHot(na)
+	for _, x := range v {
+		if fp.missingPolicy != MissingAsLevel && fp.missingLevels[x] {
+			continue
+		}
+		if counts != nil {
+			counts[x]++
+		}
+		if x == ref {
+			fp.refSeen[na] = true
+			if !oneHot {
+				continue
 			}
 		}
+		_, ok := codes[x]
+		if !ok {
+			// New code
+			fm := fmt.Sprintf("%s[%s]", na, x)
+			fp.facNames[na] = append(fp.facNames[na], fm)
+			codes[x] = len(codes)
+		}
+	}
+}
+
+// refLevel returns the reference level of the categorical variable
+// or call to C or a CatFunc with the given name.
+func (fp *Parser) refLevel(na string) string {
+
+	for _, tok := range fp.catCalls() {
+		if tok.name == na {
+			return fp.catRef(tok)
+		}
 	}
+
+	return fp.refLevels[na]
 }
 
-// codeStrings creates a ColSet from a string array, creating
+// checkRefLevels returns an error if the reference level of a
+// categorical variable was not seen when determining the codes, which
+// usually indicates a misspelled level.
+func (fp *Parser) checkRefLevels() error {
+
+	var names []string
+	for na := range fp.codes {
+		names = append(names, na)
+	}
+	sort.Strings(names)
+
+	for _, na := range names {
+		if ref := fp.refLevel(na); ref != "" && !fp.refSeen[na] {
+			return fmt.Errorf("Reference level '%s' of '%s' does not occur in the data", ref, na)
+		}
+	}
+
+	return nil
+}
+
+// codeStrings returns a ColSet created from a string array, with
 // indicator variables for each distinct value in the string array,
-// except for ref (the reference level).
-func (fp *Parser) codeStrings(na, ref string, s []string) {
+// except for ref (the reference level) unless the variable is one-hot
+// coded.  Values that were not seen when the codes were determined
+// are handled according to Config.UnknownLevels.
+func (fp *Parser) codeStrings(na, ref string, s []string) (*ColSet, error) {
+
+	miss, err := fp.missingRows(na, s)
+	if err != nil {
+		return nil, err
+	}
+	if miss != nil {
+		cs, err := fp.codeLevels(na, ref, s, miss)
+		if err != nil {
+			return nil, err
+		}
+		return setMissing(cs, miss), nil
+	}
+
+	return fp.codeLevels(na, ref, s, nil)
+}
+
+// codeLevels codes the levels of a categorical variable for
+// codeStrings, skipping the rows that are true in miss.
+func (fp *Parser) codeLevels(na, ref string, s []string, miss []bool) (*ColSet, error) {
+
+	if enc, ok := fp.encoders[na]; ok {
+		return fp.codeStats(na, enc, s)
+	}
+	if c, ok := fp.coders[na]; ok {
+		return fp.codeCustom(na, c, s)
+	}
 
 	// Get the category codes for this variable
 	codes := fp.codes[na]
@@ -453,15 +1746,84 @@ func (fp *Parser) codeStrings(na, ref string, s []string) {
 		dat = append(dat, make([]float64, len(s)))
 	}
 
+	contrast := fp.contrast(na)
+	if contrast == PolyContrast {
+		return fp.codePoly(na, s).withTerm(na), nil
+	}
+	oneHot := fp.isOneHot(na)
+
+	// The column for pooled and unseen levels
+	oc, hasOther := codes[OtherLevel]
+	var other []float64
+	if fp.unknownLevels == UnknownOther && !hasOther {
+		other = make([]float64, len(s))
+	}
+
+	pooled := fp.pooled[na]
+	var unseen []bool
 	for i, x := range s {
-		if x == ref {
+		if miss != nil && miss[i] {
 			continue
 		}
-		c := codes[x]
-		dat[c][i] = 1
+		if pooled[x] {
+			x = OtherLevel
+		}
+		c, ok := codes[x]
+		switch {
+		case x == ref && contrast != TreatmentContrast:
+			for c := range dat {
+				dat[c][i] = -1
+			}
+		case x == ref && !oneHot:
+		case !ok:
+			switch fp.unknownLevels {
+			case UnknownError:
+				return nil, fmt.Errorf("level '%s' of variable '%s' in row %d was not seen when the codes were determined", x, na, i+1)
+			case UnknownOther:
+				if hasOther {
+					dat[oc][i] = 1
+				} else {
+					other[i] = 1
+				}
+			default:
+				if unseen == nil {
+					unseen = make([]bool, len(s))
+				}
+				unseen[i] = true
+			}
+		case contrast == HelmertContrast:
+			// The level is compared to the reference level and
+			// the levels with smaller codes
+			dat[c][i] = float64(c + 1)
+			for c1 := c + 1; c1 < len(dat); c1++ {
+				dat[c1][i] = -1
+			}
+		default:
+			dat[c][i] = 1
+		}
+	}
+
+	v := &origin{op: "variable", name: na}
+	names := make([]string, len(codes))
+	var origins []*origin
+	for c, level := range levelsByCode(codes) {
+		names[c] = fp.levelColumn(na, level, c)
+		o := &origin{op: "indicator", detail: level, name: names[c], inputs: []*origin{v}}
+		origins = append(origins, o)
+	}
+	if other != nil {
+		cna := fmt.Sprintf("%s[%s]", na, OtherLevel)
+		names = append(names, cna)
+		dat = append(dat, other)
+		origins = append(origins, &origin{op: "indicator", detail: OtherLevel, name: cna, inputs: []*origin{v}})
 	}
 
-	fp.workData[na] = &ColSet{names: fp.facNames[na], data: dat}
+	if unseen != nil && fp.unseen != nil {
+		fp.unseen[na] = unseen
+	}
+
+	cs := &ColSet{names: names, data: dat, origins: origins}
+	return cs.withTerm(na), nil
 }
 
 // convertColumn converts the raw data column with the given name to a
@@ -473,29 +1835,48 @@ func (fp *Parser) convertColumn(na string) error {
 	if ok {
 		return nil
 	}
+	if cs, ok := fp.cached(varKey(na)); ok {
+		fp.workData[na] = cs
+		return nil
+	}
+
+	s := fp.rawColumn(na)
+	if s == nil {
+		if x, ok := fp.derived[na]; ok {
+			s = x
+		}
+	}
 
-	s := fp.RawData.Get(na)
 	switch s := s.(type) {
 	case nil:
-		return fmt.Errorf("Variable '%s' not found.\n", na)
+		return &missingError{na}
 	case []string:
 		ref := fp.refLevels[na]
-		fp.codeStrings(na, ref, s)
+		cs, err := fp.codeStrings(na, ref, s)
+		if err != nil {
+			return err
+		}
+		fp.workData[na] = cs
 	case []float64:
 		fp.workData[na] = &ColSet{
-			names: []string{na},
-			data:  [][]float64{s},
+			names:   []string{na},
+			data:    [][]float64{s},
+			terms:   []string{na},
+			origins: []*origin{fp.varOrigin(na)},
 		}
 	default:
 		return fmt.Errorf("unknown type %T for variable '%s' in convertColumn", s, na)
 	}
+	fp.store(varKey(na), fp.workData[na])
 
 	return nil
 }
 
 // doPlus creates a new ColSet by adding the columnsets named 'a' and
 // 'b'.  Addition of two ColSet objects produces a new ColSet with
-// columns comprising the union of the two arguments.
+// columns comprising the columns of the two arguments.  With
+// RStyleOperators, columns of 'b' with the same names as columns of
+// 'a' are not repeated.
 func (fp *Parser) doPlus(a, b string) *ColSet {
 
 	ds1, ok := fp.workData[a]
@@ -510,27 +1891,146 @@ func (fp *Parser) doPlus(a, b string) *ColSet {
 		panic(msg)
 	}
 
-	var names []string
-	var dat [][]float64
+	if fp.rStyle {
+		return union(ds1, ds2)
+	}
+
+	return concat(ds1, ds2)
+}
+
+// doDot creates a ColSet named "." containing all the variables in
+// the data, in order, except the row identifier and the variables of
+// the response.
+func (fp *Parser) doDot() error {
+
+	rslt := new(ColSet)
+	for _, na := range fp.rawNames {
+		if na == fp.rowID || fp.dotSkip[na] {
+			continue
+		}
+		if err := fp.checkConv(na); err != nil {
+			return err
+		}
+		rslt = union(rslt, fp.workData[na])
+	}
+	fp.workData[workKey(".")] = rslt
+
+	return nil
+}
+
+// responseVars returns the variables used by the left-hand side of
+// the formula whose right-hand side is rpns[i], which follows it in
+// rpns, or nil if the formula has no left-hand side.
+func (fp *Parser) responseVars(rpns [][]*token, i int) map[string]bool {
 
-	names = append(names, ds1.names...)
-	names = append(names, ds2.names...)
-	dat = append(dat, ds1.data...)
-	dat = append(dat, ds2.data...)
+	if fp.lhs[i] || i+1 == len(rpns) || !fp.lhs[i+1] {
+		return nil
+	}
+
+	vars := make(map[string]bool)
+	var walk func([]*token)
+	walk = func(tokens []*token) {
+		for _, tok := range tokens {
+			switch tok.symbol {
+			case vname:
+				vars[tok.name] = true
+			case funct:
+				walk(tok.args)
+			case subexpr, labeled:
+				walk(tok.expr)
+			}
+		}
+	}
+	walk(rpns[i+1])
+
+	return vars
+}
+
+// doMinus creates a new ColSet containing the columns of the
+// columnset named 'a' that are not in the columnset named 'b'.
+func (fp *Parser) doMinus(a, b string) *ColSet {
+	return difference(fp.workData[a], fp.workData[b])
+}
+
+// difference returns a ColSet containing the columns of ds1 that are
+// not in ds2.
+func difference(ds1, ds2 *ColSet) *ColSet {
+
+	var ix []int
+	for j, na := range ds1.names {
+		if find(ds2.names, na) == -1 {
+			ix = append(ix, j)
+		}
+	}
+
+	return ds1.sub(ix)
+}
+
+// concat returns a ColSet containing the columns of ds1 followed by
+// the columns of ds2.
+func concat(ds1, ds2 *ColSet) *ColSet {
+
+	rslt := ds1.sub(seq(len(ds1.names)))
+	for j, na := range ds2.names {
+		rslt.names = append(rslt.names, na)
+		rslt.data = append(rslt.data, ds2.data[j])
+		rslt.terms = append(rslt.terms, ds2.term(j))
+		rslt.origins = append(rslt.origins, ds2.origin(j))
+	}
+
+	return rslt
+}
+
+// union returns a ColSet containing the columns of ds1 followed by
+// the columns of ds2 that are not in ds1.  A column is in ds1 if a
+// column of ds1 has the same name and term, so that e.g. the column
+// of offset(x) is kept along with the column of x.
+func union(ds1, ds2 *ColSet) *ColSet {
+
+	rslt := ds1.sub(seq(len(ds1.names)))
+	for j, na := range ds2.names {
+		dup := false
+		for k := range ds1.names {
+			if ds1.names[k] == na && ds1.term(k) == ds2.term(j) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			rslt.names = append(rslt.names, na)
+			rslt.data = append(rslt.data, ds2.data[j])
+			rslt.terms = append(rslt.terms, ds2.term(j))
+			rslt.origins = append(rslt.origins, ds2.origin(j))
+		}
+	}
 
-	return &ColSet{names: names, data: dat}
+	return rslt
+}
+
+// seq returns the integers 0, 1, ..., n-1.
+func seq(n int) []int {
+	x := make([]int, n)
+	for i := range x {
+		x[i] = i
+	}
+	return x
 }
 
 // doTimes creates a new ColSet by multiplying the columnsets named
 // 'a' and 'b'.  Multiplication produces a new ColSet with columns
-// comprising all pairwise product of the two arguments.
+// comprising all pairwise product of the two arguments, or the cells
+// of categorical variables, see CellCoding.
 func (fp *Parser) doTimes(a, b string) *ColSet {
+	return fp.interact(fp.workData[a], fp.workData[b])
+}
 
-	ds1 := fp.workData[a]
-	ds2 := fp.workData[b]
+// product returns a ColSet containing the products of all pairs of
+// columns from ds1 and ds2.
+func product(ds1, ds2 *ColSet) *ColSet {
 
-	var names []string
+	var names, terms []string
 	var dat [][]float64
+	var origins []*origin
 
 	for j1, na1 := range ds1.names {
 		for j2, na2 := range ds2.names {
@@ -541,197 +2041,819 @@ func (fp *Parser) doTimes(a, b string) *ColSet {
 				x[i] = d1[i] * d2[i]
 			}
 			names = append(names, na1+":"+na2)
+			terms = append(terms, ds1.term(j1)+":"+ds2.term(j2))
 			dat = append(dat, x)
+			o := &origin{op: "interaction", name: na1 + ":" + na2, inputs: []*origin{ds1.origin(j1), ds2.origin(j2)}}
+			origins = append(origins, o)
 		}
 	}
 
-	return &ColSet{names, dat}
+	return &ColSet{names: names, data: dat, terms: terms, origins: origins}
 }
 
-// createIcept inserts an intercept (array of 1's) into the dataset
-// being constructed and returns true if an intercept is not already
-// included, otherwise returns false.
-func (fp *Parser) createIcept() bool {
+// doPower creates a new ColSet containing the terms of the columnset
+// named 'a', and all interactions among up to 'order' of these terms.
+// Interactions are ordered by the number of terms they involve.
+// Interactions in which a variable would appear more than once are
+// omitted.
+func (fp *Parser) doPower(a string, order int) *ColSet {
+
+	ds := fp.workData[a]
+	blocks := ds.blocks()
+
+	// The variables involved in each term
+	vars := make([]map[string]bool, len(blocks))
+	for k, b := range blocks {
+		vars[k] = make(map[string]bool)
+		for _, v := range strings.Split(ds.term(b[0]), ":") {
+			vars[k][v] = true
+		}
+	}
 
-	if _, ok := fp.workData["icept"]; ok {
-		return false
+	// Returns the product of the given blocks, or nil if a
+	// variable is repeated.
+	prod := func(combo []int) *ColSet {
+		seen := make(map[string]bool)
+		var rslt *ColSet
+		for _, k := range combo {
+			for v := range vars[k] {
+				if seen[v] {
+					return nil
+				}
+				seen[v] = true
+			}
+			if rslt == nil {
+				rslt = ds.sub(blocks[k])
+			} else {
+				rslt = fp.interact(rslt, ds.sub(blocks[k]))
+			}
+		}
+		return rslt
 	}
 
-	// Get the length of the data set.
-	var nobs int
-	{
-		na0 := fp.RawData.Names()[0]
-		x := fp.RawData.Get(na0)
-		switch x := x.(type) {
-		case []float64:
-			nobs = len(x)
-		case []string:
-			nobs = len(x)
-		default:
-			panic("unknown type")
+	rslt := new(ColSet)
+	for k := 1; k <= order && k <= len(blocks); k++ {
+		for _, combo := range combinations(len(blocks), k) {
+			if p := prod(combo); p != nil {
+				rslt = union(rslt, p)
+			}
+		}
+	}
+
+	return rslt
+}
+
+// doNest creates a new ColSet in which the terms of the columnset
+// named 'b' are nested within the columnset named 'a'.  The result
+// contains the terms of 'a', followed by the interaction of all terms
+// of 'a' with 'b', so that a/b is a + a:b, and (a + b)/c is
+// a + b + a:b:c.
+func (fp *Parser) doNest(a, b string) *ColSet {
+
+	ds1 := fp.workData[a]
+	ds2 := fp.workData[b]
+
+	var inner *ColSet
+	for _, blk := range ds1.blocks() {
+		if inner == nil {
+			inner = ds1.sub(blk)
+		} else {
+			inner = fp.interact(inner, ds1.sub(blk))
+		}
+	}
+	if inner == nil {
+		return union(ds1, ds2)
+	}
+
+	return union(ds1, fp.interact(inner, ds2))
+}
+
+// combinations returns all subsets of size k from 0, 1, ..., n-1, in
+// lexicographic order.
+func combinations(n, k int) [][]int {
+
+	var rslt [][]int
+	combo := make([]int, k)
+
+	var rec func(pos, start int)
+	rec = func(pos, start int) {
+		if pos == k {
+			rslt = append(rslt, append([]int(nil), combo...))
+			return
+		}
+		for i := start; i < n; i++ {
+			combo[pos] = i
+			rec(pos+1, i+1)
 		}
 	}
+	rec(0, 0)
+
+	return rslt
+}
+
+// createIcept inserts an intercept (array of 1's) into the dataset
+// being constructed, if it is not already present.
+func (fp *Parser) createIcept() {
+
+	if _, ok := fp.workData[workKey("icept")]; ok {
+		return
+	}
 
-	x := make([]float64, nobs)
+	x := make([]float64, fp.numRows())
 	for i := range x {
 		x[i] = 1
 	}
-	fp.workData["icept"] = &ColSet{names: []string{"icept"}, data: [][]float64{x}}
-
-	return true
+	o := &origin{op: "intercept", name: "icept"}
+	fp.workData[workKey("icept")] = &ColSet{names: []string{"icept"}, data: [][]float64{x}, terms: []string{"icept"}, origins: []*origin{o}}
 }
 
-// Names returns the names of the variables.
+// Names returns the names of the columns produced by the most recent
+// call to Parse, in the same order as the columns of the ColSet
+// returned by Parse.  Names returns nil if Parse has not been called.
 func (fp *Parser) Names() []string {
 	return fp.names
 }
 
-func checkParens(fml string) bool {
+// checkParens returns the position of a parenthesis in the formula
+// that is not matched, or -1 if the parentheses are balanced.
+// Parentheses in quotes and comments are ignored.
+func checkParens(fml string) int {
 
-	l, r := 0, 0
-	for _, c := range fml {
-		if c == '(' {
-			l++
-		} else if c == ')' {
-			r++
+	var open []int
+	var quote rune
+	comment := false
+	for i, c := range fml {
+		switch {
+		case comment:
+			comment = c != '\n'
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'' || c == '`':
+			quote = c
+		case c == '#':
+			comment = true
+		case c == '(':
+			open = append(open, i)
+		case c == ')':
+			if len(open) == 0 {
+				return i
+			}
+			open = open[0 : len(open)-1]
 		}
 	}
 
-	return l == r
+	if len(open) > 0 {
+		return open[len(open)-1]
+	}
+
+	return -1
 }
 
 // init performs lexing and parsing of the formula, only done once.
 func (fp *Parser) init() error {
 
-	for _, fml := range fp.Formulas {
+	if err := fp.compile(); err != nil {
+		return err
+	}
 
-		if !checkParens(fml) {
-			return fmt.Errorf("Unbalanced parentheses in '%s'", fml)
-		}
+	if err := fp.validate(); err != nil {
+		return err
+	}
 
-		fmx, err := lex(fml)
-		if err != nil {
+	if fp.codes == nil && fp.fitted != nil {
+		fp.setFitted(fp.fitted)
+		if err := fp.checkRefLevels(); err != nil {
 			return err
 		}
-		rpn, err := parse(fmx)
-		if err != nil {
+	} else if fp.codes == nil {
+		fp.setCodes()
+		fp.selectTopLevels()
+		fp.sortLevelCodes()
+		fp.poolLevels()
+		fp.applyRefPolicy()
+		if err := fp.checkRefLevels(); err != nil {
+			return err
+		}
+		if err := fp.fitMeanWeight(); err != nil {
 			return err
 		}
-		fp.rpn = append(fp.rpn, rpn)
 	}
 
-	if fp.codes == nil {
-		fp.setCodes()
+	if err := fp.fitBlockScales(); err != nil {
+		return err
+	}
+
+	if fp.weightScaling == RelativeWeights && fp.meanWeight <= 0 {
+		return fmt.Errorf("the codes have no mean weight for relative weight scaling")
 	}
 
 	return nil
 }
 
-func (fp *Parser) doFormula(rpn []*token) error {
+// compile lexes and parses the formulas.
+func (fp *Parser) compile() error {
 
-	if err := fp.runFuncs(rpn); err != nil {
-		return err
+	for _, fml := range fp.Formulas {
+		c, err := fp.compileCached(fml)
+		if err != nil {
+			return err
+		}
+		fp.rpn = append(fp.rpn, c.rhs)
+		fp.lhs = append(fp.lhs, false)
+		if c.lhs != nil {
+			fp.rpn = append(fp.rpn, c.lhs)
+			fp.lhs = append(fp.lhs, true)
+		}
 	}
 
-	// Special case a single variable with no operators
-	if len(rpn) == 1 {
-		na := rpn[0].name
-		if err := fp.checkConv(na); err != nil {
+	for _, tok := range fp.catCalls() {
+		if err := checkCat(tok); err != nil {
 			return err
 		}
-		fp.data.Extend(fp.workData[na])
-		fp.workData = nil
-		return nil
 	}
 
-	var stack []string
+	return nil
+}
+
+// compileFormula lexes and parses one formula.  Syntax errors are
+// annotated with the text of the formula.
+func (fp *Parser) compileFormula(fml string) (*compiled, error) {
+
+	c, err := fp.compileText(normalizeText(fml))
+	if se, ok := err.(*SyntaxError); ok && se.Formula == "" {
+		se.Formula = normalizeText(fml)
+	}
+
+	return c, err
+}
+
+// compileText lexes and parses one formula, which has been normalized
+// with normalizeText.
+func (fp *Parser) compileText(fml string) (*compiled, error) {
+
+	if pos := checkParens(fml); pos != -1 {
+		return nil, syntaxError(fml, pos, "unbalanced parentheses")
+	}
+
+	fmx, err := lexWith(fml, fp.macros, fp.binaryOps)
+	if err != nil {
+		return nil, err
+	}
+
+	// Split off the left-hand side, if present
+	var lhs []*token
+	for i, tok := range fmx {
+		if tok.symbol != tilde {
+			continue
+		}
+		lhs, fmx = fmx[0:i], fmx[i+1:]
+		if len(lhs) == 0 || len(fmx) == 0 || hasSymbol(fmx, tilde) {
+			return nil, syntaxError(fml, tok.pos, "'~' must separate a response from the terms")
+		}
+		break
+	}
+
+	if fp.autoIcept && !hasSymbol(fmx, noicept) {
+		fmx = append([]*token{{symbol: icept}, {symbol: plus}}, fmx...)
+	}
+	c := new(compiled)
+	c.rhs, err = parse(fmx)
+	if err != nil {
+		return nil, err
+	}
+
+	if lhs != nil {
+		if len(lhs) == 1 && lhs[0].symbol == funct && lhs[0].funcn == "cbind" {
+			c.lhs, err = cbind(lhs[0])
+		} else {
+			c.lhs, err = parse(lhs)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// cbind returns the RPN of a list of responses, e.g. cbind(y1, y2)
+// on the left-hand side of a formula, which is equivalent to y1 + y2.
+func cbind(tok *token) ([]*token, error) {
+
+	var rpn []*token
+	for k, arg := range tok.args {
+		switch arg.symbol {
+		case vname, funct:
+			rpn = append(rpn, arg)
+		case subexpr:
+			rpn = append(rpn, arg.expr...)
+		default:
+			return nil, syntaxError("", arg.pos, "the arguments of cbind must be variables or expressions")
+		}
+		if k > 0 {
+			rpn = append(rpn, &token{symbol: plus})
+		}
+	}
+
+	return rpn, nil
+}
+
+// doFormula evaluates one formula in RPN form, returning the
+// resulting columns.
+func (fp *Parser) doFormula(rpn []*token) (*ColSet, error) {
+
+	if err := fp.runFuncs(rpn); err != nil {
+		return nil, err
+	}
+
+	// The stack holds names in workData, keys holds the
+	// corresponding cache keys.  The variables are in workData
+	// under their names, and the other results under workKey.
+	var stack, keys []string
 
 	for ix, tok := range rpn {
-		last := ix == len(rpn)-1
 		switch {
 		case isOperator(tok):
 			if len(stack) < 2 {
-				return fmt.Errorf("not enough arguments")
+				return nil, fmt.Errorf("not enough arguments")
 			}
 
 			// Pop the last two arguments off the stack
 			arg2 := stack[len(stack)-1]
 			arg1 := stack[len(stack)-2]
 			stack = stack[0 : len(stack)-2]
+			key := exprKey(tok, keys[len(keys)-2], keys[len(keys)-1])
+			keys = append(keys[0:len(keys)-2], key)
+
+			nm := workKey(fmt.Sprintf("tmp%d", ix))
+			if rslt, ok := fp.cached(key); ok {
+				fp.workData[nm] = rslt
+				stack = append(stack, nm)
+				continue
+			}
 
-			fp.checkConv(arg1, arg2)
 			var rslt *ColSet
+			if tok.symbol == power {
+				order, err := strconv.Atoi(arg2)
+				if err != nil || order < 1 {
+					return nil, fmt.Errorf("The exponent '%s' is not a positive integer", arg2)
+				}
+				if err := fp.checkConv(arg1); err != nil {
+					return nil, err
+				}
+				rslt = fp.doPower(arg1, order)
+			} else if err := fp.checkConv(arg1, arg2); err != nil {
+				return nil, err
+			}
+
 			switch tok.symbol {
 			case plus:
 				rslt = fp.doPlus(arg1, arg2)
+			case minus:
+				rslt = fp.doMinus(arg1, arg2)
 			case times:
 				rslt = fp.doTimes(arg1, arg2)
+				if fp.rStyle {
+					// a*b is a + b + a:b
+					rslt = union(fp.doPlus(arg1, arg2), rslt)
+				}
+			case colon:
+				rslt = fp.doTimes(arg1, arg2)
+			case nest:
+				rslt = fp.doNest(arg1, arg2)
+			case binop:
+				var err error
+				rslt, err = fp.doBinaryOp(tok, arg1, arg2)
+				if err != nil {
+					return nil, err
+				}
+			case power:
+				// Already handled
 			default:
-				return fmt.Errorf("Invalid symbol: %v", tok.symbol)
-			}
-			if last {
-				// The last thing computed is the result
-				fp.data.Extend(rslt)
+				return nil, fmt.Errorf("Invalid symbol: %v", tok.symbol)
 			}
-			nm := fmt.Sprintf("tmp%d", ix)
+			fp.store(key, rslt)
 			fp.workData[nm] = rslt
 			stack = append(stack, nm)
 		case tok.symbol == icept:
-			q := fp.createIcept()
-			if q {
-				stack = append(stack, "icept")
+			fp.createIcept()
+			stack = append(stack, workKey("icept"))
+			keys = append(keys, "1")
+		case tok.symbol == noicept:
+			fp.workData[workKey("noicept")] = new(ColSet)
+			stack = append(stack, workKey("noicept"))
+			keys = append(keys, "0")
+		case tok.symbol == dot:
+			if err := fp.doDot(); err != nil {
+				return nil, err
 			}
+			stack = append(stack, workKey("."))
+			keys = append(keys, ".")
 		case tok.symbol == vname:
-			fp.checkConv(tok.name)
+			if err := fp.checkConv(tok.name); err != nil {
+				return nil, err
+			}
 			stack = append(stack, tok.name)
-		case tok.symbol == funct:
+			keys = append(keys, varKey(tok.name))
+		case tok.symbol == funct || tok.symbol == arith:
+			stack = append(stack, workKey(tok.name))
+			keys = append(keys, tok.name)
+		case tok.symbol == number:
 			stack = append(stack, tok.name)
+			keys = append(keys, tok.name)
+		case tok.symbol == labeled:
+			cs, err := fp.doLabel(tok)
+			if err != nil {
+				return nil, err
+			}
+			fp.workData[workKey(tok.name)] = cs
+			stack = append(stack, workKey(tok.name))
+			keys = append(keys, tok.name)
 		}
 	}
 
 	if len(stack) != 1 {
-		return fmt.Errorf("invalid formula")
+		return nil, fmt.Errorf("invalid formula")
 	}
 
-	return nil
+	// The last thing computed is the result
+	rslt, ok := fp.workData[stack[0]]
+	if !ok {
+		return nil, fmt.Errorf("invalid formula")
+	}
+
+	// 0 anywhere in the formula suppresses the intercept
+	if hasSymbol(rpn, noicept) {
+		rslt = difference(rslt, &ColSet{names: []string{"icept"}})
+	}
+
+	return rslt, nil
 }
 
+// Parse evaluates the formulas and returns the resulting columns.
+// A function may be applied to columns that are produced by other
+// functions, in the same formula or in a different formula.  The
+// formulas are evaluated in an order that makes such columns available
+// before they are needed, but the columns of the result are always in
+// formula order.
 func (fp *Parser) Parse() (*ColSet, error) {
 
+	if err := fp.checkVersions(); err != nil {
+		return nil, err
+	}
+
 	fp.data = new(ColSet)
+	fp.response = nil
+	fp.offsets = nil
+	fp.weights = nil
+	fp.derived = make(map[string][]float64)
+	fp.derivedOrigins = make(map[string]*origin)
+	fp.cache = make(map[string]*ColSet)
+	fp.unseen = make(map[string][]bool)
 
 	fp.rawNames = fp.RawData.Names()
+	fp.rawCache = make(map[string]interface{})
+	defer func() { fp.rawCache = nil }()
+	if !fp.blockFitted {
+		fp.blockScales = make(map[string][2]float64)
+	}
 
-	for _, rpn := range fp.rpn {
-		fp.workData = make(map[string]*ColSet)
-		if err := fp.doFormula(rpn); err != nil {
+	// Repeatedly evaluate the formulas that refer to columns not
+	// yet produced, until no more progress can be made.
+	rpns := fp.applyRecipe()
+	results := make([]*ColSet, len(rpns))
+	pending := seq(len(rpns))
+	for len(pending) > 0 {
+		var retry []int
+		var lastErr error
+		for _, i := range pending {
+			fp.workData = make(map[string]*ColSet)
+			fp.dotSkip = fp.responseVars(rpns, i)
+			cs, err := fp.doFormula(rpns[i])
+			if _, ok := err.(*missingError); ok {
+				retry = append(retry, i)
+				lastErr = err
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			results[i] = cs
+		}
+		if len(retry) == len(pending) {
+			return nil, lastErr
+		}
+		pending = retry
+	}
+
+	for i, cs := range results {
+		if !fp.lhs[i] {
+			cs, off := splitMarked(cs, rpns[i], "offset")
+			cs, wgt := splitMarked(cs, rpns[i], "weights")
+			if err := fp.data.ExtendPolicy(cs, fp.dupPolicy); err != nil {
+				return nil, err
+			}
+			if off != nil {
+				if fp.offsets == nil {
+					fp.offsets = new(ColSet)
+				}
+				if err := fp.offsets.ExtendPolicy(off, fp.dupPolicy); err != nil {
+					return nil, err
+				}
+			}
+			if wgt != nil {
+				if len(wgt.data) != 1 || fp.weights != nil {
+					return nil, fmt.Errorf("The formulas must specify a single column of weights")
+				}
+				fp.weights = wgt.data[0]
+			}
+			continue
+		}
+		if fp.response == nil {
+			fp.response = new(ColSet)
+		}
+		if err := fp.response.ExtendPolicy(cs, fp.dupPolicy); err != nil {
 			return nil, err
 		}
 	}
 
 	fp.workData = nil
+	fp.dotSkip = nil
+	if err := fp.scaleByWeights(); err != nil {
+		return nil, err
+	}
+	fp.names = append([]string(nil), fp.data.names...)
+	if err := fp.setRowIDs(); err != nil {
+		return nil, err
+	}
+	fp.blockFitted = true
 
 	return fp.data, nil
 }
 
+// Response returns the columns produced by the left-hand sides of
+// the formulas, e.g. y in y ~ x1 + x2, in formula order.  The
+// left-hand sides are not included in the ColSet returned by Parse.
+// Response returns nil if no formula has a left-hand side, or if
+// Parse has not been called.
+func (fp *Parser) Response() *ColSet {
+	return fp.response
+}
+
+// missingError indicates that a variable was not found in the data or
+// among the columns produced by functions.
+type missingError struct {
+	name string
+}
+
+func (e *missingError) Error() string {
+	return fmt.Sprintf("Variable '%s' not found.", e.name)
+}
+
+// numeric returns the numeric data for a raw variable, or for a column
+// produced by a function.  A missingError is returned if there is no
+// such variable or column.
+func (fp *Parser) numeric(na string) ([]float64, error) {
+
+	switch x := fp.rawColumn(na).(type) {
+	case []float64:
+		return x, nil
+	case nil:
+		y, ok := fp.derived[na]
+		if !ok {
+			return nil, &missingError{na}
+		}
+		return y, nil
+	default:
+		return nil, fmt.Errorf("Variable '%s' is not a numeric variable", na)
+	}
+}
+
+// addDerived makes the columns of cs available to functions and
+// formulas.
+func (fp *Parser) addDerived(cs *ColSet) {
+	for j, na := range cs.names {
+		if _, ok := fp.derived[na]; !ok {
+			fp.derived[na] = cs.data[j]
+			fp.derivedOrigins[na] = cs.origin(j)
+		}
+	}
+}
+
+// evalFunc returns the result of a function call, which is computed
+// if it is not in the cache.
+func (fp *Parser) evalFunc(tok *token) (*ColSet, error) {
+
+	if cs, ok := fp.cached(tok.name); ok {
+		return cs, nil
+	}
+
+	var cs *ColSet
+	var err error
+	if fp.isCat(tok) {
+		cs, err = fp.codeCat(tok)
+	} else if isMarker(tok) {
+		cs, err = fp.marker(tok)
+	} else if fp.isSmooth(tok) {
+		cs, err = fp.smooth(tok)
+	} else if fp.isHash(tok) {
+		cs, err = fp.hashCode(tok)
+	} else if fp.isQuantile(tok) {
+		cs, err = fp.quantileCode(tok)
+	} else if fp.isStandardize(tok) {
+		cs, err = fp.standardize(tok)
+	} else {
+		cs, err = fp.callFunc(tok)
+	}
+	if err != nil {
+		return nil, err
+	}
+	isCut := fp.isQuantile(tok) && tok.funcn == "cut"
+	if !fp.isCat(tok) && !isMarker(tok) && !fp.isHash(tok) && !isCut {
+		cs = fp.scaleBlock(cs)
+	}
+	cs = cs.withTerm(tok.name)
+	fp.store(tok.name, cs)
+	fp.addDerived(cs)
+
+	return cs, nil
+}
+
+// argument returns the columns of a variable argument of a function
+// call, or nil if the argument is a literal.
+func (fp *Parser) argument(arg *token) (*ColSet, error) {
+
+	switch arg.symbol {
+	case vname:
+		x, err := fp.numeric(arg.name)
+		if err != nil {
+			return nil, err
+		}
+		o := fp.varOrigin(arg.name)
+		return &ColSet{names: []string{arg.name}, data: [][]float64{x}, origins: []*origin{o}}, nil
+	case funct:
+		return fp.evalFunc(arg)
+	case subexpr:
+		// Evaluate the expression as a separate formula
+		saved := fp.workData
+		fp.workData = make(map[string]*ColSet)
+		cs, err := fp.doFormula(arg.expr)
+		fp.workData = saved
+		return cs, err
+	default:
+		return nil, nil
+	}
+}
+
+// callFunc applies the function in a funct token to its arguments.
+// If an argument has several columns, e.g. the argument x1 + x4 in
+// square(x1 + x4), the function is applied to each column in turn.
+// All such arguments must have the same number of columns.
+func (fp *Parser) callFunc(tok *token) (*ColSet, error) {
+
+	if sf, ok := fp.strFuncs[tok.funcn]; ok && len(tok.args) == 1 && tok.args[0].symbol == vname {
+		if x, ok := fp.rawColumn(tok.args[0].name).([]string); ok {
+			cs := sf(tok.name, x)
+			names, err := fp.funcNames(cs)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", tok.name, err)
+			}
+			v := &origin{op: "variable", name: tok.args[0].name}
+			rslt := &ColSet{names: names, data: cs.data}
+			for _, na := range names {
+				o := &origin{op: "function", detail: tok.funcn, name: na, inputs: []*origin{v}}
+				rslt.origins = append(rslt.origins, o)
+			}
+			return rslt, nil
+		}
+	}
+
+	mf, multi := fp.multiFuncs[tok.funcn]
+	f, single := fp.funcs[tok.funcn]
+	_, strf := fp.strFuncs[tok.funcn]
+	switch {
+	case !multi && !single && strf:
+		return nil, fmt.Errorf("Function '%s' takes one string variable as its argument", tok.funcn)
+	case !multi && !single:
+		return nil, fmt.Errorf("Function '%s' not found", tok.funcn)
+	case !multi && len(tok.args) != 1:
+		return nil, fmt.Errorf("Function '%s' takes one argument, but %d were given", tok.funcn, len(tok.args))
+	}
+
+	// Evaluate the variable arguments, and determine how many
+	// times to call the function
+	vals := make([]*ColSet, len(tok.args))
+	ncall := 1
+	for k, arg := range tok.args {
+		cs, err := fp.argument(arg)
+		if err != nil {
+			return nil, err
+		}
+		vals[k] = cs
+		switch {
+		case cs == nil || len(cs.data) == 1:
+		case len(cs.data) == 0:
+			return nil, fmt.Errorf("%s: the argument '%s' has no columns", tok.name, arg.name)
+		case ncall == 1:
+			ncall = len(cs.data)
+		case len(cs.data) != ncall:
+			return nil, fmt.Errorf("%s: the arguments have different numbers of columns", tok.name)
+		}
+	}
+
+	rslt := new(ColSet)
+	for c := 0; c < ncall; c++ {
+		var args [][]float64
+		var params []interface{}
+		var inputs []*origin
+		text := make([]string, len(tok.args))
+		for k, arg := range tok.args {
+			cs := vals[k]
+			text[k] = argText(arg)
+			switch {
+			case cs == nil && arg.symbol == str:
+				params = append(params, arg.name)
+			case cs == nil:
+				params = append(params, arg.value)
+			case len(cs.data) == 1:
+				args = append(args, cs.data[0])
+				inputs = append(inputs, cs.origin(0))
+			default:
+				args = append(args, cs.data[c])
+				inputs = append(inputs, cs.origin(c))
+				text[k] = cs.names[c]
+			}
+		}
+
+		name := tok.name
+		if ncall > 1 {
+			name = fmt.Sprintf("%s(%s)", tok.funcn, strings.Join(text, ", "))
+		}
+
+		var cs *ColSet
+		if multi {
+			var err error
+			cs, err = mf(&Call{Name: name, Args: args, Params: params})
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+		} else if len(args) == 1 {
+			cs = f(name, args[0])
+		} else {
+			return nil, fmt.Errorf("Function '%s' takes one variable argument", tok.funcn)
+		}
+		names, err := fp.funcNames(cs)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		rslt.names = append(rslt.names, names...)
+		rslt.data = append(rslt.data, cs.data...)
+		for _, na := range names {
+			o := &origin{op: "function", detail: tok.funcn, name: na, inputs: inputs}
+			rslt.origins = append(rslt.origins, o)
+		}
+	}
+
+	return rslt, nil
+}
+
 func (fp *Parser) runFuncs(rpn []*token) error {
 
 	for _, tok := range rpn {
-		if tok.symbol != funct {
+		if tok.symbol != arith && tok.symbol != funct {
+			continue
+		}
+		if cs, ok := fp.cached(tok.name); ok {
+			fp.workData[workKey(tok.name)] = cs
 			continue
 		}
 
-		f, ok := fp.funcs[tok.funcn]
-		if !ok {
-			return fmt.Errorf("Function '%s' not found", tok.funcn)
+		if tok.symbol == arith {
+			x, err := fp.evalArith(tok.expr)
+			if _, ok := err.(*missingError); ok {
+				return err
+			} else if err != nil {
+				return fmt.Errorf("%s: %v", tok.name, err)
+			}
+			o := &origin{op: "arithmetic", detail: tok.name, name: tok.name}
+			for _, t := range tok.expr {
+				if t.symbol == vname {
+					o.inputs = append(o.inputs, fp.varOrigin(t.name))
+				}
+			}
+			cs := &ColSet{names: []string{tok.name}, data: [][]float64{x}, terms: []string{tok.name}, origins: []*origin{o}}
+			fp.workData[workKey(tok.name)] = cs
+			fp.store(tok.name, cs)
+			fp.addDerived(cs)
+			continue
 		}
-		x := fp.RawData.Get(tok.arg)
-		switch x := x.(type) {
-		case []float64:
-			fp.workData[tok.name] = f(tok.name, x)
-		default:
-			panic("funtions can only be applied to numeric data")
+
+		cs, err := fp.evalFunc(tok)
+		if err != nil {
+			return err
 		}
+		fp.workData[workKey(tok.name)] = cs
 	}
 
 	return nil
@@ -2,7 +2,10 @@ package formula
 
 import (
 	"fmt"
+	"io"
 	"math"
+	"reflect"
+	"strings"
 	"testing"
 
 	"gonum.org/v1/gonum/floats"
@@ -14,7 +17,7 @@ func tokEq(a, b []*token) bool {
 	}
 
 	for i := range a {
-		if *a[i] != *b[i] {
+		if !reflect.DeepEqual(noPos(a[i]), noPos(b[i])) {
 			return false
 		}
 	}
@@ -22,6 +25,23 @@ func tokEq(a, b []*token) bool {
 	return true
 }
 
+// noPos returns a copy of the token without the positions of it and
+// its arguments, which are not compared by tokEq.
+func noPos(tok *token) token {
+	c := *tok
+	c.pos = 0
+	c.args, c.expr = nil, nil
+	for _, arg := range tok.args {
+		a := noPos(arg)
+		c.args = append(c.args, &a)
+	}
+	for _, e := range tok.expr {
+		a := noPos(e)
+		c.expr = append(c.expr, &a)
+	}
+	return c
+}
+
 func TestColSet(t *testing.T) {
 
 	cs := ColSet{
@@ -74,7 +94,7 @@ func TestLexParse(t *testing.T) {
 		{symbol: rightp}, {symbol: times},
 		{name: "c"}, {symbol: plus},
 		{name: "d"}, {symbol: times},
-		{symbol: funct, name: "f(e)", funcn: "f", arg: "e"},
+		{symbol: funct, name: "f(e)", funcn: "f", args: []*token{{name: "e"}}},
 	}
 
 	if !tokEq(v, exp) {
@@ -90,7 +110,7 @@ func TestLexParse(t *testing.T) {
 		{name: "A"}, {name: "b"},
 		{symbol: plus}, {name: "c"},
 		{symbol: times}, {name: "d"},
-		{symbol: funct, name: "f(e)", funcn: "f", arg: "e"},
+		{symbol: funct, name: "f(e)", funcn: "f", args: []*token{{name: "e"}}},
 		{symbol: times}, {symbol: plus},
 	}
 
@@ -99,6 +119,29 @@ func TestLexParse(t *testing.T) {
 	}
 }
 
+func TestLexParseColon(t *testing.T) {
+
+	v, err := lex("a*b:c + d:e")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := parse(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []*token{
+		{name: "a"}, {name: "b"}, {name: "c"},
+		{symbol: colon}, {symbol: times},
+		{name: "d"}, {name: "e"}, {symbol: colon},
+		{symbol: plus},
+	}
+
+	if !tokEq(b, exp) {
+		t.Fail()
+	}
+}
+
 // Create some functions
 func makeFuncs() map[string]Func {
 	funcs := make(map[string]Func)
@@ -131,7 +174,15 @@ func simpleData() DataSource {
 		[]float64{-1, 0, 1, 0, -1},
 	}
 
-	return NewSource(data, names)
+	return mustSource(data, names)
+}
+
+func mustSource(data []interface{}, names []string) DataSource {
+	src, err := NewSource(data, names)
+	if err != nil {
+		panic(err)
+	}
+	return src
 }
 
 func TestSingle(t *testing.T) {
@@ -187,6 +238,27 @@ func TestSingle(t *testing.T) {
 				},
 			},
 		},
+		{
+			formula:   "x4 + x1:x2",
+			reflevels: map[string]string{"x2": "0"},
+			expected: &ColSet{
+				names: []string{"x4", "x1:x2[1]"},
+				data: [][]float64{
+					{-1, 0, 1, 0, -1},
+					{0, 0, 0, 3, 4},
+				},
+			},
+		},
+		{
+			formula:   "x1:x3*x4",
+			reflevels: map[string]string{"x3": "a"},
+			expected: &ColSet{
+				names: []string{"x1:x3[b]:x4"},
+				data: [][]float64{
+					{0, 0, 0, 0, 0},
+				},
+			},
+		},
 		{
 			formula:   "( ( x2*x3))",
 			reflevels: map[string]string{"x2": "0", "x3": "a"},
@@ -274,7 +346,7 @@ func TestSingle(t *testing.T) {
 			},
 		},
 	} {
-		fp, err := New(pr.formula, rawData, &Config{pr.reflevels, funcs})
+		fp, err := New(pr.formula, rawData, &Config{RefLevels: pr.reflevels, Funcs: funcs})
 		if err != nil {
 			fmt.Printf("%+v\n", err)
 			t.Fail()
@@ -329,7 +401,7 @@ func TestError(t *testing.T) {
 			parseError: true,
 		},
 	} {
-		fp, err := New(pr.formula, rawData, &Config{pr.reflevels, funcs})
+		fp, err := New(pr.formula, rawData, &Config{RefLevels: pr.reflevels, Funcs: funcs})
 		if pr.parseError {
 			if err == nil {
 				t.Fail()
@@ -389,7 +461,7 @@ func TestMulti(t *testing.T) {
 			},
 		},
 	} {
-		fp, err := NewMulti(pr.formulas, rawData, &Config{pr.reflevels, funcs})
+		fp, err := NewMulti(pr.formulas, rawData, &Config{RefLevels: pr.reflevels, Funcs: funcs})
 		if err != nil {
 			fmt.Printf("%v\n", err)
 			t.Fail()
@@ -408,3 +480,1717 @@ func TestMulti(t *testing.T) {
 		}
 	}
 }
+
+func TestExtendPolicy(t *testing.T) {
+
+	base := func() *ColSet {
+		return &ColSet{
+			names: []string{"a", "b"},
+			data:  [][]float64{{1, 2}, {3, 4}},
+		}
+	}
+	same := &ColSet{names: []string{"b", "c"}, data: [][]float64{{3, 4}, {5, 6}}}
+	diff := &ColSet{names: []string{"b", "c"}, data: [][]float64{{3, 5}, {5, 6}}}
+
+	cs := base()
+	cs.Extend(diff)
+	if !colSetEq(cs, &ColSet{names: []string{"a", "b", "c"}, data: [][]float64{{1, 2}, {3, 4}, {5, 6}}}) {
+		t.Fail()
+	}
+
+	cs = base()
+	if err := cs.ExtendPolicy(same, DupError); err != nil {
+		t.Fail()
+	}
+	if err := base().ExtendPolicy(diff, DupError); err == nil {
+		t.Fail()
+	}
+
+	cs = base()
+	if err := cs.ExtendPolicy(diff, DupRename); err != nil {
+		t.Fail()
+	}
+	if err := cs.ExtendPolicy(diff, DupRename); err != nil {
+		t.Fail()
+	}
+	exp := &ColSet{
+		names: []string{"a", "b", "b_2", "c", "b_3", "c_2"},
+		data:  [][]float64{{1, 2}, {3, 4}, {3, 5}, {5, 6}, {3, 5}, {5, 6}},
+	}
+	if !colSetEq(cs, exp) {
+		t.Fail()
+	}
+
+	// Two formulas producing different columns named "x1"
+	funcs := map[string]Func{
+		"x1": func(na string, x []float64) *ColSet {
+			return &ColSet{names: []string{"x1"}, data: [][]float64{x}}
+		},
+	}
+	config := &Config{Funcs: funcs, Duplicates: DupError}
+	fp, err := NewMulti([]string{"x1", "x1(x4)"}, simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.Parse(); err == nil {
+		t.Fail()
+	}
+}
+
+func TestRStyle(t *testing.T) {
+
+	rawData := simpleData()
+
+	for ip, pr := range []struct {
+		formula  string
+		expected *ColSet
+	}{
+		{
+			formula: "x1*x2",
+			expected: &ColSet{
+				names: []string{"x1", "x2[1]", "x1:x2[1]"},
+				data: [][]float64{
+					{0, 1, 2, 3, 4},
+					{0, 0, 0, 1, 1},
+					{0, 0, 0, 3, 4},
+				},
+			},
+		},
+		{
+			formula: "x1:x2",
+			expected: &ColSet{
+				names: []string{"x1:x2[1]"},
+				data: [][]float64{
+					{0, 0, 0, 3, 4},
+				},
+			},
+		},
+		{
+			formula: "x1*x2 + x1 + x4",
+			expected: &ColSet{
+				names: []string{"x1", "x2[1]", "x1:x2[1]", "x4"},
+				data: [][]float64{
+					{0, 1, 2, 3, 4},
+					{0, 0, 0, 1, 1},
+					{0, 0, 0, 3, 4},
+					{-1, 0, 1, 0, -1},
+				},
+			},
+		},
+	} {
+		config := &Config{RefLevels: map[string]string{"x2": "0"}, RStyleOperators: true}
+		fp, err := New(pr.formula, rawData, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cols, err := fp.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !colSetEq(pr.expected, cols) {
+			fmt.Printf("Mismatch:\nip=%d\n", ip)
+			fmt.Printf("Expected: %v\n", pr.expected)
+			fmt.Printf("Observed: %v\n", cols)
+			t.Fail()
+		}
+	}
+}
+
+func TestPlusDuplicates(t *testing.T) {
+
+	// A repeated term gives repeated columns, which are renamed
+	// here, unless the R-style operators are used
+	for _, tc := range []struct {
+		rStyle bool
+		names  []string
+	}{
+		{false, []string{"x1", "x1_2", "x4"}},
+		{true, []string{"x1", "x4"}},
+	} {
+		config := &Config{RStyleOperators: tc.rStyle, Duplicates: DupRename}
+		fp, err := New("x1 + x1 + x4", simpleData(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cols, err := fp.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(cols.Names(), tc.names) {
+			t.Errorf("rStyle=%v: expected %v, found %v", tc.rStyle, tc.names, cols.Names())
+		}
+	}
+}
+
+func TestPower(t *testing.T) {
+
+	rawData := simpleData()
+
+	v, err := lex("(a + b)^2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := parse(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []*token{
+		{name: "a"}, {name: "b"}, {symbol: plus},
+		{symbol: number, name: "2", value: 2}, {symbol: power},
+	}
+	if !tokEq(b, exp) {
+		t.Fail()
+	}
+
+	for ip, pr := range []struct {
+		formula  string
+		expected *ColSet
+	}{
+		{
+			formula: "(x1 + x3 + x4)^2",
+			expected: &ColSet{
+				names: []string{"x1", "x3[b]", "x4", "x1:x3[b]", "x1:x4", "x3[b]:x4"},
+				data: [][]float64{
+					{0, 1, 2, 3, 4},
+					{0, 1, 0, 1, 0},
+					{-1, 0, 1, 0, -1},
+					{0, 1, 0, 3, 0},
+					{0, 0, 2, 0, -4},
+					{0, 0, 0, 0, 0},
+				},
+			},
+		},
+		{
+			formula: "(x1 + x2)^2",
+			expected: &ColSet{
+				names: []string{"x1", "x2[0]", "x2[1]", "x1:x2[0]", "x1:x2[1]"},
+				data: [][]float64{
+					{0, 1, 2, 3, 4},
+					{1, 1, 1, 0, 0},
+					{0, 0, 0, 1, 1},
+					{0, 1, 2, 0, 0},
+					{0, 0, 0, 3, 4},
+				},
+			},
+		},
+		{
+			formula: "(x1 + x1:x4)^2",
+			expected: &ColSet{
+				names: []string{"x1", "x1:x4"},
+				data: [][]float64{
+					{0, 1, 2, 3, 4},
+					{0, 0, 2, 0, -4},
+				},
+			},
+		},
+		{
+			formula: "(x1 + x3 + x4)^1",
+			expected: &ColSet{
+				names: []string{"x1", "x3[b]", "x4"},
+				data: [][]float64{
+					{0, 1, 2, 3, 4},
+					{0, 1, 0, 1, 0},
+					{-1, 0, 1, 0, -1},
+				},
+			},
+		},
+	} {
+		config := &Config{RefLevels: map[string]string{"x3": "a"}}
+		fp, err := New(pr.formula, rawData, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cols, err := fp.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !colSetEq(pr.expected, cols) {
+			fmt.Printf("Mismatch:\nip=%d\n", ip)
+			fmt.Printf("Expected: %v\n", pr.expected)
+			fmt.Printf("Observed: %v\n", cols)
+			t.Fail()
+		}
+	}
+
+	for _, fml := range []string{"(x1 + x4)^0", "(x1 + x4)^1.5", "x1 + 2"} {
+		fp, err := New(fml, rawData, nil)
+		if err != nil {
+			continue
+		}
+		if _, err := fp.Parse(); err == nil {
+			t.Fail()
+		}
+	}
+}
+
+func TestNest(t *testing.T) {
+
+	rawData := simpleData()
+
+	v, err := lex("a/b/c + d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := parse(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []*token{
+		{name: "a"}, {name: "b"}, {symbol: nest},
+		{name: "c"}, {symbol: nest},
+		{name: "d"}, {symbol: plus},
+	}
+	if !tokEq(b, exp) {
+		t.Fail()
+	}
+
+	for ip, pr := range []struct {
+		formula  string
+		expected *ColSet
+	}{
+		{
+			formula: "x3/x1",
+			expected: &ColSet{
+				names: []string{"x3[b]", "x3[b]:x1"},
+				data: [][]float64{
+					{0, 1, 0, 1, 0},
+					{0, 1, 0, 3, 0},
+				},
+			},
+		},
+		{
+			formula: "(x1 + x3)/x4",
+			expected: &ColSet{
+				names: []string{"x1", "x3[b]", "x1:x3[b]:x4"},
+				data: [][]float64{
+					{0, 1, 2, 3, 4},
+					{0, 1, 0, 1, 0},
+					{0, 0, 0, 0, 0},
+				},
+			},
+		},
+		{
+			formula: "x2/x3 + x4",
+			expected: &ColSet{
+				names: []string{"x2[1]", "x2[1]:x3[b]", "x4"},
+				data: [][]float64{
+					{0, 0, 0, 1, 1},
+					{0, 0, 0, 1, 0},
+					{-1, 0, 1, 0, -1},
+				},
+			},
+		},
+	} {
+		config := &Config{RefLevels: map[string]string{"x2": "0", "x3": "a"}}
+		fp, err := New(pr.formula, rawData, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cols, err := fp.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !colSetEq(pr.expected, cols) {
+			fmt.Printf("Mismatch:\nip=%d\n", ip)
+			fmt.Printf("Expected: %v\n", pr.expected)
+			fmt.Printf("Observed: %v\n", cols)
+			t.Fail()
+		}
+	}
+}
+
+func TestNames(t *testing.T) {
+
+	config := &Config{RefLevels: map[string]string{"x3": "a"}}
+	fp, err := NewMulti([]string{"x4 + x3", "x2*x1"}, simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fp.Names() != nil {
+		t.Fail()
+	}
+
+	exp := []string{"x4", "x3[b]", "x2[0]:x1", "x2[1]:x1"}
+	for k := 0; k < 3; k++ {
+		cs, err := fp.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(cs.Names(), exp) || !reflect.DeepEqual(fp.Names(), exp) {
+			t.Fail()
+		}
+	}
+}
+
+func TestArith(t *testing.T) {
+
+	rawData := simpleData()
+
+	v, err := lex("x2 + I((x1 - x4)*x1/x4) + I(x1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []*token{
+		{name: "x2"}, {symbol: plus},
+		{symbol: arith, name: "I((x1-x4)*x1/x4)", expr: []*token{
+			{name: "x1"}, {name: "x4"}, {symbol: minus},
+			{name: "x1"}, {symbol: times}, {name: "x4"}, {symbol: nest},
+		}},
+		{symbol: plus},
+		{symbol: arith, name: "I(x1)", expr: []*token{{name: "x1"}}},
+	}
+	if !tokEq(v, exp) {
+		t.Fail()
+	}
+
+	for ip, pr := range []struct {
+		formula  string
+		expected *ColSet
+	}{
+		{
+			formula: "I(x1 + x4)",
+			expected: &ColSet{
+				names: []string{"I(x1+x4)"},
+				data: [][]float64{
+					{-1, 1, 3, 3, 3},
+				},
+			},
+		},
+		{
+			formula: "x1 + I(x1 - x4*x1) + I(x1*x1)",
+			expected: &ColSet{
+				names: []string{"x1", "I(x1-x4*x1)", "I(x1*x1)"},
+				data: [][]float64{
+					{0, 1, 2, 3, 4},
+					{0, 1, 0, 3, 8},
+					{0, 1, 4, 9, 16},
+				},
+			},
+		},
+		{
+			formula: "I(2*x1) + I(x1/100) + I(1 - x4) + I(x1 + 0.5)",
+			expected: &ColSet{
+				names: []string{"I(2*x1)", "I(x1/100)", "I(1-x4)", "I(x1+0.5)"},
+				data: [][]float64{
+					{0, 2, 4, 6, 8},
+					{0, 0.01, 0.02, 0.03, 0.04},
+					{2, 1, 0, 1, 2},
+					{0.5, 1.5, 2.5, 3.5, 4.5},
+				},
+			},
+		},
+		{
+			formula: "x3*I((x1 + x4)/(x1 - x4))",
+			expected: &ColSet{
+				names: []string{"x3[b]:I((x1+x4)/(x1-x4))"},
+				data: [][]float64{
+					{0, 1, 0, 1, 0},
+				},
+			},
+		},
+	} {
+		config := &Config{RefLevels: map[string]string{"x3": "a"}}
+		fp, err := New(pr.formula, rawData, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cols, err := fp.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !colSetEq(pr.expected, cols) {
+			fmt.Printf("Mismatch:\nip=%d\n", ip)
+			fmt.Printf("Expected: %v\n", pr.expected)
+			fmt.Printf("Observed: %v\n", cols)
+			t.Fail()
+		}
+	}
+
+	for _, fml := range []string{"I(x1 + x3)", "I(x1 +)", "I()", "I(x1 x4)", "x1 - ", "I(square(x1))", "x1 + 2", "I(x1 2)", "I(x1*'a')"} {
+		fp, err := New(fml, rawData, nil)
+		if err != nil {
+			continue
+		}
+		if _, err := fp.Parse(); err == nil {
+			t.Errorf("%s should fail", fml)
+		}
+	}
+}
+
+func TestDerived(t *testing.T) {
+
+	funcs := makeFuncs()
+	funcs["pca"] = func(na string, x []float64) *ColSet {
+		y := make([]float64, len(x))
+		for i, v := range x {
+			y[i] = -v
+		}
+		return &ColSet{names: []string{"pc1", "pc2"}, data: [][]float64{x, y}}
+	}
+
+	for ip, pr := range []struct {
+		formulas []string
+		expected *ColSet
+	}{
+		{
+			formulas: []string{"pca(x1) + square(pc2)"},
+			expected: &ColSet{
+				names: []string{"pc1", "pc2", "square(pc2)"},
+				data: [][]float64{
+					{0, 1, 2, 3, 4},
+					{0, -1, -2, -3, -4},
+					{0, 1, 4, 9, 16},
+				},
+			},
+		},
+		{
+			// The columns used by the first formula are produced
+			// by the second formula.
+			formulas: []string{"square(pc1) + I(pc1 + x4)", "pca(x1)"},
+			expected: &ColSet{
+				names: []string{"square(pc1)", "I(pc1+x4)", "pc1", "pc2"},
+				data: [][]float64{
+					{0, 1, 4, 9, 16},
+					{-1, 1, 3, 3, 3},
+					{0, 1, 2, 3, 4},
+					{0, -1, -2, -3, -4},
+				},
+			},
+		},
+	} {
+		fp, err := NewMulti(pr.formulas, simpleData(), &Config{Funcs: funcs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cols, err := fp.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !colSetEq(pr.expected, cols) {
+			fmt.Printf("Mismatch:\nip=%d\n", ip)
+			fmt.Printf("Expected: %v\n", pr.expected)
+			fmt.Printf("Observed: %v\n", cols)
+			t.Fail()
+		}
+	}
+
+	fp, err := NewMulti([]string{"square(pc3)", "pca(x1)"}, simpleData(), &Config{Funcs: funcs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.Parse(); err == nil {
+		t.Fail()
+	}
+}
+
+func TestIntercept(t *testing.T) {
+
+	icept := []float64{1, 1, 1, 1, 1}
+	x1 := []float64{0, 1, 2, 3, 4}
+	x4 := []float64{-1, 0, 1, 0, -1}
+
+	for ip, pr := range []struct {
+		formula   string
+		autoIcept bool
+		expected  *ColSet
+	}{
+		{
+			formula:  "1 + x1 + x4 - 1",
+			expected: &ColSet{names: []string{"x1", "x4"}, data: [][]float64{x1, x4}},
+		},
+		{
+			formula:  "1 + x1 + 0",
+			expected: &ColSet{names: []string{"x1"}, data: [][]float64{x1}},
+		},
+		{
+			formula:  "x1 + x4 - x4",
+			expected: &ColSet{names: []string{"x1"}, data: [][]float64{x1}},
+		},
+		{
+			formula:   "x1",
+			autoIcept: true,
+			expected:  &ColSet{names: []string{"icept", "x1"}, data: [][]float64{icept, x1}},
+		},
+		{
+			formula:   "x1 - 1",
+			autoIcept: true,
+			expected:  &ColSet{names: []string{"x1"}, data: [][]float64{x1}},
+		},
+		{
+			formula:   "0 + x1",
+			autoIcept: true,
+			expected:  &ColSet{names: []string{"x1"}, data: [][]float64{x1}},
+		},
+	} {
+		fp, err := New(pr.formula, simpleData(), &Config{AutoIntercept: pr.autoIcept})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cols, err := fp.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !colSetEq(pr.expected, cols) {
+			fmt.Printf("Mismatch:\nip=%d\n", ip)
+			fmt.Printf("Expected: %v\n", pr.expected)
+			fmt.Printf("Observed: %v\n", cols)
+			t.Fail()
+		}
+	}
+}
+
+func TestDot(t *testing.T) {
+
+	x1 := []float64{0, 1, 2, 3, 4}
+	x2a := []float64{1, 1, 1, 0, 0}
+	x2b := []float64{0, 0, 0, 1, 1}
+	x3b := []float64{0, 1, 0, 1, 0}
+	x4 := []float64{-1, 0, 1, 0, -1}
+
+	for ip, pr := range []struct {
+		formula  string
+		expected *ColSet
+	}{
+		{
+			formula: ".",
+			expected: &ColSet{
+				names: []string{"x1", "x2[0]", "x2[1]", "x3[b]", "x4"},
+				data:  [][]float64{x1, x2a, x2b, x3b, x4},
+			},
+		},
+		{
+			formula: ". - x2 + x1:x4",
+			expected: &ColSet{
+				names: []string{"x1", "x3[b]", "x4", "x1:x4"},
+				data:  [][]float64{x1, x3b, x4, {0, 0, 2, 0, -4}},
+			},
+		},
+	} {
+		fp, err := New(pr.formula, simpleData(), &Config{RefLevels: map[string]string{"x3": "a"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cols, err := fp.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !colSetEq(pr.expected, cols) {
+			fmt.Printf("Mismatch:\nip=%d\n", ip)
+			fmt.Printf("Expected: %v\n", pr.expected)
+			fmt.Printf("Observed: %v\n", cols)
+			t.Fail()
+		}
+	}
+}
+
+func TestDotResponse(t *testing.T) {
+
+	// The response is not among the variables included by '.'
+	config := &Config{RefLevels: map[string]string{"x3": "a"}}
+	fp, err := New("x4 + x1 ~ . - x2", simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []string{"x3[b]"}
+	if !reflect.DeepEqual(cols.Names(), exp) {
+		t.Errorf("Expected %v, found %v", exp, cols.Names())
+	}
+
+	fp, err = New("y ~ .", mustSource([]interface{}{[]float64{1, 2, 3}, []float64{4, 5, 6}}, []string{"y", "x"}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err = fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cols.Names(), []string{"x"}) {
+		t.Errorf("Expected [x], found %v", cols.Names())
+	}
+	if !reflect.DeepEqual(fp.Response().Names(), []string{"y"}) {
+		t.Errorf("Expected the response [y], found %v", fp.Response().Names())
+	}
+}
+
+func TestMultiFunc(t *testing.T) {
+
+	mfuncs := map[string]MultiFunc{
+		"sum": func(c *Call) (*ColSet, error) {
+			y := make([]float64, len(c.Args[0]))
+			for _, x := range c.Args {
+				for i, v := range x {
+					y[i] += v
+				}
+			}
+			return &ColSet{names: []string{c.Name}, data: [][]float64{y}}, nil
+		},
+		"ratio": func(c *Call) (*ColSet, error) {
+			if len(c.Args) != 2 {
+				return nil, fmt.Errorf("expected 2 arguments, got %d", len(c.Args))
+			}
+			y := make([]float64, len(c.Args[0]))
+			for i := range y {
+				y[i] = c.Args[0][i] / c.Args[1][i]
+			}
+			return &ColSet{names: []string{c.Name}, data: [][]float64{y}}, nil
+		},
+	}
+	config := &Config{Funcs: makeFuncs(), MultiFuncs: mfuncs, RefLevels: map[string]string{"x3": "a"}}
+
+	fp, err := New("sum(x1,x4,x1) + sum(x4, x1):x3 + square(x4)", simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &ColSet{
+		names: []string{"sum(x1, x4, x1)", "sum(x4, x1):x3[b]", "square(x4)"},
+		data: [][]float64{
+			{-1, 2, 5, 6, 7},
+			{0, 1, 0, 3, 0},
+			{1, 0, 1, 0, 1},
+		},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+
+	for _, fml := range []string{"square(x1, x4)", "ratio(x1)", "x1, x4", "ratio(x1,)", "ratio(x1 x4)", "cube(x1, x4)"} {
+		fp, err := New(fml, simpleData(), config)
+		if err != nil {
+			continue
+		}
+		if _, err := fp.Parse(); err == nil {
+			t.Errorf("%s should fail", fml)
+		}
+	}
+}
+
+func TestParams(t *testing.T) {
+
+	mfuncs := map[string]MultiFunc{
+		"poly": func(c *Call) (*ColSet, error) {
+			deg, ok := c.Params[0].(float64)
+			if len(c.Params) != 1 || !ok {
+				return nil, fmt.Errorf("poly requires a degree")
+			}
+			cs := new(ColSet)
+			for k := 1; k <= int(deg); k++ {
+				y := make([]float64, len(c.Args[0]))
+				for i, v := range c.Args[0] {
+					y[i] = math.Pow(v, float64(k))
+				}
+				cs.names = append(cs.names, fmt.Sprintf("%s[%d]", c.Name, k))
+				cs.data = append(cs.data, y)
+			}
+			return cs, nil
+		},
+		"cut": func(c *Call) (*ColSet, error) {
+			y := make([]float64, len(c.Args[0]))
+			for i, v := range c.Args[0] {
+				if v > c.Params[0].(float64) {
+					y[i] = 1
+				}
+			}
+			return &ColSet{names: []string{c.Params[1].(string)}, data: [][]float64{y}}, nil
+		},
+	}
+	config := &Config{MultiFuncs: mfuncs}
+
+	fp, err := New("poly(x1, 2) + cut(x4, -0.5, \"hi\") + cut(x1, 1, 'big')", simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &ColSet{
+		names: []string{"poly(x1, 2)[1]", "poly(x1, 2)[2]", "hi", "big"},
+		data: [][]float64{
+			{0, 1, 2, 3, 4},
+			{0, 1, 4, 9, 16},
+			{0, 1, 1, 1, 0},
+			{0, 0, 1, 1, 1},
+		},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+
+	v, err := lex("cut(x4, -0.5, \"hi\")")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != 1 || v[0].name != "cut(x4, -0.5, \"hi\")" || v[0].args[1].value != -0.5 || v[0].args[2].name != "hi" {
+		t.Errorf("Unexpected token %+v", v[0])
+	}
+
+	for _, fml := range []string{"x1 + 'a'", "(2 + x1)", "poly(3)", "poly(x1, 'a", "poly(x1, 2 3)"} {
+		if _, err := New(fml, simpleData(), config); err == nil {
+			t.Errorf("%s should fail", fml)
+		}
+	}
+}
+
+func TestNestedFuncs(t *testing.T) {
+
+	funcs := makeFuncs()
+	funcs["abs"] = func(na string, x []float64) *ColSet {
+		y := make([]float64, len(x))
+		for i, v := range x {
+			y[i] = math.Abs(v)
+		}
+		return &ColSet{names: []string{na}, data: [][]float64{y}}
+	}
+	mfuncs := map[string]MultiFunc{
+		"scale": func(c *Call) (*ColSet, error) {
+			y := make([]float64, len(c.Args[0]))
+			for i, v := range c.Args[0] {
+				y[i] = c.Params[0].(float64) * v
+			}
+			return &ColSet{names: []string{c.Name}, data: [][]float64{y}}, nil
+		},
+	}
+	config := &Config{Funcs: funcs, MultiFuncs: mfuncs}
+
+	fp, err := New("abs(x4) + square(abs(x4)) + scale(square(x4), -2) + pbase(abs(x4))", simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &ColSet{
+		names: []string{"abs(x4)", "square(abs(x4))", "scale(square(x4), -2)", "pbase(abs(x4))^2", "pbase(abs(x4))^3"},
+		data: [][]float64{
+			{1, 0, 1, 0, 1},
+			{1, 0, 1, 0, 1},
+			{-2, 0, -2, 0, -2},
+			{1, 0, 1, 0, 1},
+			{1, 0, 1, 0, 1},
+		},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+
+	for _, fml := range []string{"square(abs(x4)", "square(abs(x4) x1)", "square(cube(x1))"} {
+		fp, err := New(fml, simpleData(), config)
+		if err != nil {
+			continue
+		}
+		if _, err := fp.Parse(); err == nil {
+			t.Errorf("%s should fail", fml)
+		}
+	}
+}
+
+func TestFuncExpr(t *testing.T) {
+
+	mfuncs := map[string]MultiFunc{
+		"center": func(c *Call) (*ColSet, error) {
+			x := c.Args[0]
+			y := make([]float64, len(x))
+			m := floats.Sum(x) / float64(len(x))
+			for i, v := range x {
+				y[i] = v - m
+			}
+			return &ColSet{names: []string{c.Name}, data: [][]float64{y}}, nil
+		},
+	}
+	config := &Config{Funcs: makeFuncs(), MultiFuncs: mfuncs, RefLevels: map[string]string{"x3": "a"}}
+
+	fp, err := New("square(x1 + x4) + center(x1*x4) + square(pbase(x4))", simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &ColSet{
+		names: []string{"square(x1)", "square(x4)", "center(x1*x4)", "square(pbase(x4)^2)", "square(pbase(x4)^3)"},
+		data: [][]float64{
+			{0, 1, 4, 9, 16},
+			{1, 0, 1, 0, 1},
+			{0.4, 0.4, 2.4, 0.4, -3.6},
+			{1, 0, 1, 0, 1},
+			{1, 0, 1, 0, 1},
+		},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+
+	// All columns of a term share its label
+	if cols.term(0) != "square(x1 + x4)" || cols.term(1) != "square(x1 + x4)" {
+		t.Fail()
+	}
+
+	// Factors can be used in expressions
+	fp, err = New("square(x3 + x1)", simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err = fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cols.Names(), []string{"square(x3[b])", "square(x1)"}) {
+		t.Errorf("Unexpected names %v", cols.Names())
+	}
+
+	for _, fml := range []string{"square(x1 + )", "square((x1 + x4)", "center(x1 + x4, x1:x4 + x1 + x4)", "square(x1 + 2)"} {
+		fp, err := New(fml, simpleData(), config)
+		if err != nil {
+			continue
+		}
+		if _, err := fp.Parse(); err == nil {
+			t.Errorf("%s should fail", fml)
+		}
+	}
+}
+
+func TestStrFunc(t *testing.T) {
+
+	sfuncs := map[string]StrFunc{
+		"isb": func(na string, x []string) *ColSet {
+			y := make([]float64, len(x))
+			for i, v := range x {
+				if v == "b" {
+					y[i] = 1
+				}
+			}
+			return &ColSet{names: []string{na}, data: [][]float64{y}}
+		},
+		// Also in Funcs, which is used for numeric arguments
+		"square": func(na string, x []string) *ColSet {
+			y := make([]float64, len(x))
+			for i, v := range x {
+				y[i] = float64(len(v) * len(v))
+			}
+			return &ColSet{names: []string{na}, data: [][]float64{y}}
+		},
+	}
+	config := &Config{Funcs: makeFuncs(), StrFuncs: sfuncs}
+
+	fp, err := New("isb(x3) + square(x2) + square(x4) + isb(x3):x1", simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &ColSet{
+		names: []string{"isb(x3)", "square(x2)", "square(x4)", "isb(x3):x1"},
+		data: [][]float64{
+			{0, 1, 0, 1, 0},
+			{1, 1, 1, 1, 1},
+			{1, 0, 1, 0, 1},
+			{0, 1, 0, 3, 0},
+		},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+
+	for _, fml := range []string{"isb(x1)", "isb(x3, x2)", "pbase(x3)"} {
+		fp, err := New(fml, simpleData(), config)
+		if err != nil {
+			continue
+		}
+		if _, err := fp.Parse(); err == nil {
+			t.Errorf("%s should fail", fml)
+		}
+	}
+}
+
+func TestCat(t *testing.T) {
+
+	config := &Config{RefLevels: map[string]string{"x1": "2"}}
+	fp, err := New("C(x4, 0) + C(x4):x1 + C(x1)", simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &ColSet{
+		names: []string{"C(x4, 0)[-1]", "C(x4, 0)[1]", "C(x4)[-1]:x1", "C(x4)[0]:x1",
+			"C(x4)[1]:x1", "C(x1)[0]", "C(x1)[1]", "C(x1)[3]", "C(x1)[4]"},
+		data: [][]float64{
+			{1, 0, 0, 0, 1},
+			{0, 0, 1, 0, 0},
+			{0, 0, 0, 0, 4},
+			{0, 1, 0, 3, 0},
+			{0, 0, 2, 0, 0},
+			{1, 0, 0, 0, 0},
+			{0, 1, 0, 0, 0},
+			{0, 0, 0, 1, 0},
+			{0, 0, 0, 0, 1},
+		},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+
+	for _, fml := range []string{"C(x1, x4)", "C(1 + x1)", "C(x5)"} {
+		fp, err := New(fml, simpleData(), nil)
+		if err != nil {
+			continue
+		}
+		if _, err := fp.Parse(); err == nil {
+			t.Errorf("%s should fail", fml)
+		}
+	}
+}
+
+func TestRelevel(t *testing.T) {
+
+	fp, err := New(`relevel(x3, "b") + relevel(x2, "1"):x1`, simpleData(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &ColSet{
+		names: []string{`relevel(x3, "b")[a]`, `relevel(x2, "1")[0]:x1`},
+		data: [][]float64{
+			{1, 0, 1, 0, 1},
+			{0, 1, 2, 0, 0},
+		},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+
+	for _, fml := range []string{"relevel(x3)", `relevel(x3, "c")`} {
+		if _, err := New(fml, simpleData(), nil); err == nil {
+			t.Errorf("%s should fail", fml)
+		}
+	}
+}
+
+func TestFactorLevels(t *testing.T) {
+
+	config := &Config{RefLevels: map[string]string{"x3": "a"}}
+	fp, err := New(`x3 + relevel(x2, "1") + C(x1)`, simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refs := map[string]string{"x3": "a", `relevel(x2, "1")`: "1"}
+	if !reflect.DeepEqual(fp.RefLevels(), refs) {
+		t.Errorf("Unexpected reference levels %v", fp.RefLevels())
+	}
+
+	if lev := fp.FactorLevels("C(x1)"); !reflect.DeepEqual(lev, []string{"0", "1", "2", "3", "4"}) {
+		t.Errorf("Unexpected levels %v", lev)
+	}
+	if lev := fp.FactorLevels("x3"); !reflect.DeepEqual(lev, []string{"b"}) {
+		t.Errorf("Unexpected levels %v", lev)
+	}
+	if lev := fp.FactorLevels("x4"); lev != nil {
+		t.Errorf("x4 is not categorical")
+	}
+
+	if na, ok := fp.ColumnForLevel(`relevel(x2, "1")`, "0"); !ok || na != `relevel(x2, "1")[0]` {
+		t.Errorf("Unexpected column %s", na)
+	}
+	if _, ok := fp.ColumnForLevel("x3", "a"); ok {
+		t.Errorf("The reference level has no column")
+	}
+}
+
+func TestDeclaredLevels(t *testing.T) {
+
+	config := &Config{
+		RefLevels: map[string]string{"x3": "a"},
+		Levels:    map[string][]string{"x3": {"c"}},
+	}
+	fp, err := New("x3", simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &ColSet{
+		names: []string{"x3[c]", "x3[b]"},
+		data: [][]float64{
+			{0, 0, 0, 0, 0},
+			{0, 1, 0, 1, 0},
+		},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+}
+
+func TestUnknownLevels(t *testing.T) {
+
+	newData := mustSource([]interface{}{[]string{"a", "c", "b"}}, []string{"x3"})
+
+	for _, policy := range []UnknownPolicy{UnknownZero, UnknownError, UnknownOther} {
+		config := &Config{RefLevels: map[string]string{"x3": "a"}, UnknownLevels: policy}
+		fp, err := New("x3", simpleData(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		train, err := fp.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cols, err := fp.WithData(newData).Parse()
+
+		var exp *ColSet
+		switch policy {
+		case UnknownZero:
+			exp = &ColSet{names: []string{"x3[b]"}, data: [][]float64{{0, 0, 1}}}
+		case UnknownError:
+			if err == nil {
+				t.Errorf("unseen level should fail")
+			}
+			continue
+		case UnknownOther:
+			exp = &ColSet{names: []string{"x3[b]", "x3[_other_]"}, data: [][]float64{{0, 0, 1}, {0, 1, 0}}}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !colSetEq(exp, cols) {
+			t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+		}
+		if !reflect.DeepEqual(train.Names(), cols.Names()) {
+			t.Errorf("The training and new columns differ: %v, %v", train.Names(), cols.Names())
+		}
+	}
+}
+
+func TestSumContrast(t *testing.T) {
+
+	config := &Config{
+		RefLevels: map[string]string{"x3": "b"},
+		Contrasts: map[string]Contrast{"x3": SumContrast, `relevel(x2, "0")`: SumContrast},
+	}
+	fp, err := New(`x3 + relevel(x2, "0")`, simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &ColSet{
+		names: []string{"x3[a]", `relevel(x2, "0")[1]`},
+		data: [][]float64{
+			{1, -1, 1, -1, 1},
+			{-1, -1, -1, 1, 1},
+		},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+
+	// A reference level is required
+	config = &Config{Contrasts: map[string]Contrast{"x3": SumContrast}}
+	if _, err := New("x3", simpleData(), config); err == nil {
+		t.Errorf("sum contrast without a reference level should fail")
+	}
+}
+
+func TestOneHot(t *testing.T) {
+
+	config := &Config{
+		RefLevels:  map[string]string{"x3": "b", "x2": "0"},
+		OneHot:     true,
+		OneHotVars: map[string]bool{"x2": false},
+	}
+	fp, err := New("x3 + x2", simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &ColSet{
+		names: []string{"x3[a]", "x3[b]", "x2[1]"},
+		data: [][]float64{
+			{1, 0, 1, 0, 1},
+			{0, 1, 0, 1, 0},
+			{0, 0, 0, 1, 1},
+		},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+}
+
+func TestHelmertContrast(t *testing.T) {
+
+	data := []interface{}{[]string{"c", "a", "b", "c", "d", "a"}}
+	src, err := NewSource(data, []string{"x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{
+		RefLevels: map[string]string{"x": "c"},
+		Contrasts: map[string]Contrast{"x": HelmertContrast},
+	}
+	fp, err := New("x", src, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &ColSet{
+		names: []string{"x[H.a]", "x[H.b]", "x[H.d]"},
+		data: [][]float64{
+			{-1, 1, 0, -1, 0, 1},
+			{-1, -1, 2, -1, 0, -1},
+			{-1, -1, -1, -1, 3, -1},
+		},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+}
+
+func TestResponse(t *testing.T) {
+
+	config := &Config{AutoIntercept: true}
+	fp, err := NewMulti([]string{"x1 ~ x4 + x3", "x2"}, simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &ColSet{
+		names: []string{"icept", "x4", "x3[a]", "x3[b]", "x2[0]", "x2[1]"},
+		data: [][]float64{
+			{1, 1, 1, 1, 1},
+			{-1, 0, 1, 0, -1},
+			{1, 0, 1, 0, 1},
+			{0, 1, 0, 1, 0},
+			{1, 1, 1, 0, 0},
+			{0, 0, 0, 1, 1},
+		},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+
+	exp = &ColSet{
+		names: []string{"x1"},
+		data:  [][]float64{{0, 1, 2, 3, 4}},
+	}
+	if !colSetEq(exp, fp.Response()) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, fp.Response())
+	}
+
+	for _, fml := range []string{"~ x1", "x1 ~", "x1 ~ x4 ~ x2", "log(x1 ~ x4)"} {
+		fp, err := New(fml, simpleData(), &Config{Funcs: makeFuncs()})
+		if err != nil {
+			continue
+		}
+		if _, err := fp.Parse(); err == nil {
+			t.Errorf("%s should fail", fml)
+		}
+	}
+}
+
+func TestCatFunc(t *testing.T) {
+
+	cfuncs := map[string]CatFunc{
+		"sign": func(na string, x []float64) []string {
+			y := make([]string, len(x))
+			for i, v := range x {
+				switch {
+				case v < 0:
+					y[i] = "neg"
+				case v > 0:
+					y[i] = "pos"
+				default:
+					y[i] = "zero"
+				}
+			}
+			return y
+		},
+	}
+	config := &Config{CatFuncs: cfuncs, RefLevels: map[string]string{"sign(x4)": "zero"}}
+
+	fp, err := New("sign(x4) + sign(x1, \"pos\"):x3", simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &ColSet{
+		names: []string{"sign(x4)[neg]", "sign(x4)[pos]", "sign(x1, \"pos\")[zero]:x3[a]", "sign(x1, \"pos\")[zero]:x3[b]"},
+		data: [][]float64{
+			{1, 0, 0, 0, 1},
+			{0, 0, 1, 0, 0},
+			{1, 0, 0, 0, 0},
+			{0, 0, 0, 0, 0},
+		},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+
+	for _, fml := range []string{"sign(x3)", "sign(x1, x4)", "sign(x5)"} {
+		fp, err := New(fml, simpleData(), config)
+		if err != nil {
+			continue
+		}
+		if _, err := fp.Parse(); err == nil {
+			t.Errorf("%s should fail", fml)
+		}
+	}
+}
+
+func TestCbind(t *testing.T) {
+
+	fp, err := New("cbind(x1, square(x1), x4 + x3) ~ x2", simpleData(), &Config{Funcs: makeFuncs()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &ColSet{
+		names: []string{"x2[0]", "x2[1]"},
+		data: [][]float64{
+			{1, 1, 1, 0, 0},
+			{0, 0, 0, 1, 1},
+		},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+
+	exp = &ColSet{
+		names: []string{"x1", "square(x1)", "x4", "x3[a]", "x3[b]"},
+		data: [][]float64{
+			{0, 1, 2, 3, 4},
+			{0, 1, 4, 9, 16},
+			{-1, 0, 1, 0, -1},
+			{1, 0, 1, 0, 1},
+			{0, 1, 0, 1, 0},
+		},
+	}
+	if !colSetEq(exp, fp.Response()) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, fp.Response())
+	}
+
+	if _, err := New("cbind(x1, 2) ~ x2", simpleData(), nil); err == nil {
+		t.Errorf("cbind with a literal should fail")
+	}
+}
+
+func TestOffset(t *testing.T) {
+
+	fp, err := New("x1 ~ x4 + offset(x1) + offset(square(x4))", simpleData(), &Config{Funcs: makeFuncs()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &ColSet{
+		names: []string{"x4"},
+		data:  [][]float64{{-1, 0, 1, 0, -1}},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+
+	exp = &ColSet{
+		names: []string{"x1", "square(x4)"},
+		data: [][]float64{
+			{0, 1, 2, 3, 4},
+			{1, 0, 1, 0, 1},
+		},
+	}
+	if !colSetEq(exp, fp.Offsets()) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, fp.Offsets())
+	}
+
+	for _, fml := range []string{"offset(x1, x4)", "offset(x3)"} {
+		fp, err := New(fml, simpleData(), nil)
+		if err != nil {
+			continue
+		}
+		if _, err := fp.Parse(); err == nil {
+			t.Errorf("%s should fail", fml)
+		}
+	}
+}
+
+func TestWeights(t *testing.T) {
+
+	fp, err := NewMulti([]string{"x1 + weights(x4) + offset(x1)", "x4"}, simpleData(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &ColSet{
+		names: []string{"x1", "x4"},
+		data: [][]float64{
+			{0, 1, 2, 3, 4},
+			{-1, 0, 1, 0, -1},
+		},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+	if !reflect.DeepEqual(fp.Weights(), []float64{-1, 0, 1, 0, -1}) {
+		t.Errorf("Unexpected weights %v", fp.Weights())
+	}
+	if fp.Offsets() == nil || len(fp.Offsets().Names()) != 1 {
+		t.Errorf("Unexpected offsets")
+	}
+
+	for _, fmls := range [][]string{{"weights(x1) + weights(x4)"}, {"x1 + weights(x1)", "weights(x4)"}, {"weights(x3)"}} {
+		fp, err := NewMulti(fmls, simpleData(), nil)
+		if err != nil {
+			continue
+		}
+		if _, err := fp.Parse(); err == nil {
+			t.Errorf("%v should fail", fmls)
+		}
+	}
+}
+
+func TestWeightScaling(t *testing.T) {
+
+	r2, r3 := math.Sqrt(2), math.Sqrt(3)
+	for _, tc := range []struct {
+		scaling WeightScaling
+		factor  float64
+	}{
+		{AbsoluteWeights, 1},
+		{RelativeWeights, 1 / r2},
+	} {
+		config := &Config{WeightScaling: tc.scaling}
+		fp, err := New("x1 ~ x4 + weights(x1)", simpleData(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Parsing twice checks that the data are not scaled in
+		// place
+		for k := 0; k < 2; k++ {
+			cols, err := fp.Parse()
+			if err != nil {
+				t.Fatal(err)
+			}
+			exp := &ColSet{
+				names: []string{"x4"},
+				data:  [][]float64{{0, 0, r2, 0, -2}},
+			}
+			floats.Scale(tc.factor, exp.data[0])
+			if !colSetEq(exp, cols) {
+				t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+			}
+			exp = &ColSet{
+				names: []string{"x1"},
+				data:  [][]float64{{0, 1, 2 * r2, 3 * r3, 8}},
+			}
+			floats.Scale(tc.factor, exp.data[0])
+			if !colSetEq(exp, fp.Response()) {
+				t.Errorf("Expected: %v\nObserved: %v\n", exp, fp.Response())
+			}
+		}
+		if !reflect.DeepEqual(fp.Weights(), []float64{0, 1, 2, 3, 4}) {
+			t.Errorf("Unexpected weights %v", fp.Weights())
+		}
+	}
+
+	// Negative weights, and scaling without weights
+	config := &Config{WeightScaling: AbsoluteWeights}
+	for _, fml := range []string{"x1 + weights(x4)", "x1"} {
+		fp, err := New(fml, simpleData(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fp.Parse(); err == nil {
+			t.Errorf("%s should fail", fml)
+		}
+	}
+}
+
+func TestRelativeWeights(t *testing.T) {
+
+	// The mean weight of the training data is 2
+	train := mustSource([]interface{}{[]float64{1, 2, 3}, []float64{1, 1, 1}}, []string{"w", "x"})
+	valid := mustSource([]interface{}{[]float64{8, 8}, []float64{1, 1}}, []string{"w", "x"})
+
+	config := &Config{WeightScaling: RelativeWeights}
+	fp, err := New("x + weights(w)", train, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// New data are scaled by the mean weight of the training data
+	cols, err := fp.WithData(valid).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !floats.EqualApprox(cols.Data()[0], []float64{2, 2}, 1e-12) {
+		t.Errorf("Unexpected scaled column %v", cols.Data()[0])
+	}
+
+	// A stream needs the mean weight from fitted codes, and
+	// scales each chunk by it
+	chunks := NewChunkSource(train, valid)
+	if _, err := NewStream([]string{"x + weights(w)"}, chunks, config); err == nil {
+		t.Errorf("Expected an error for a stream without fitted codes")
+	}
+	s, err := NewStream([]string{"x + weights(w)"}, chunks, &Config{WeightScaling: RelativeWeights, Codes: fp.Codes()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []float64
+	for {
+		cs, err := s.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, cs.Data()[0]...)
+	}
+	exp := []float64{math.Sqrt(0.5), 1, math.Sqrt(1.5), 2, 2}
+	if !floats.EqualApprox(got, exp, 1e-12) {
+		t.Errorf("Expected %v, found %v", exp, got)
+	}
+}
+
+func TestBackticks(t *testing.T) {
+
+	names := []string{"blood pressure (mmHg)", "group-id"}
+	data := []interface{}{
+		[]float64{120, 135, 110},
+		[]string{"a", "b", "a"},
+	}
+	src := mustSource(data, names)
+
+	fp, err := New("`blood pressure (mmHg)` + `group-id` + square(`blood pressure (mmHg)`)", src, &Config{Funcs: makeFuncs()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &ColSet{
+		names: []string{"blood pressure (mmHg)", "group-id[a]", "group-id[b]", "square(`blood pressure (mmHg)`)"},
+		data: [][]float64{
+			{120, 135, 110},
+			{1, 0, 1},
+			{0, 1, 0},
+			{14400, 18225, 12100},
+		},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+
+	for _, fml := range []string{"`blood pressure", "`` + x1"} {
+		if _, err := New(fml, src, nil); err == nil {
+			t.Errorf("%s should fail", fml)
+		}
+	}
+}
+
+func TestMacros(t *testing.T) {
+
+	macros := map[string]string{
+		"demog": "x1 + x3",
+		"all":   "demog + square(x4)",
+		"loop1": "x1 + loop2",
+		"loop2": "loop1",
+	}
+	config := &Config{Funcs: makeFuncs(), Macros: macros, RefLevels: map[string]string{"x3": "a"}}
+
+	fp, err := New("all + demog:x4", simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &ColSet{
+		names: []string{"x1", "x3[b]", "square(x4)", "x1:x4", "x3[b]:x4"},
+		data: [][]float64{
+			{0, 1, 2, 3, 4},
+			{0, 1, 0, 1, 0},
+			{1, 0, 1, 0, 1},
+			{0, 0, 2, 0, -4},
+			{0, 0, 0, 0, 0},
+		},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+
+	if _, err := New("loop1", simpleData(), config); err == nil {
+		t.Errorf("Recursive macros should fail")
+	}
+}
+
+func TestComments(t *testing.T) {
+
+	fml := `
+		# Main effects (numeric)
+		x1 +
+		x4	# a comment with an unmatched (
+		+ x1:x4 # interaction
+
+	`
+	fp, err := New(fml+"\r\n", simpleData(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &ColSet{
+		names: []string{"x1", "x4", "x1:x4"},
+		data: [][]float64{
+			{0, 1, 2, 3, 4},
+			{-1, 0, 1, 0, -1},
+			{0, 0, 2, 0, -4},
+		},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+}
+
+func TestNormalizeText(t *testing.T) {
+
+	// A formula with a byte order mark, smart quotes, a minus sign
+	// and a non-breaking space
+	fml := "\ufeffx1 + cut(x4, \u201cb\u201d)\u2212 x1 +\u00a0x3:\u2018x\u2019"
+	config := &Config{
+		MultiFuncs: map[string]MultiFunc{
+			"cut": func(c *Call) (*ColSet, error) {
+				if c.Params[0] != "b" {
+					return nil, fmt.Errorf("unexpected parameter %v", c.Params[0])
+				}
+				return &ColSet{names: []string{c.Name}, data: c.Args}, nil
+			},
+		},
+	}
+
+	// The string 'x' is not allowed here
+	if _, err := New(fml, simpleData(), config); err == nil || !strings.Contains(err.Error(), "string") {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	fp, err := New(fml[0:len(fml)-len(":\u2018x\u2019")], simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &ColSet{
+		names: []string{"cut(x4, \"b\")", "x3[a]", "x3[b]"},
+		data: [][]float64{
+			{-1, 0, 1, 0, -1},
+			{1, 0, 1, 0, 1},
+			{0, 1, 0, 1, 0},
+		},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+}
+
+func TestMarkerNames(t *testing.T) {
+
+	for _, rstyle := range []bool{false, true} {
+		config := &Config{RStyleOperators: rstyle}
+		fp, err := New("x1 + offset(x1) + weights(x1)", simpleData(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cols, err := fp.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		exp := &ColSet{
+			names: []string{"x1"},
+			data:  [][]float64{{0, 1, 2, 3, 4}},
+		}
+		if !colSetEq(exp, cols) {
+			t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+		}
+		if !colSetEq(exp, fp.Offsets()) {
+			t.Errorf("Expected offsets: %v\nObserved: %v\n", exp, fp.Offsets())
+		}
+		if !reflect.DeepEqual(fp.Weights(), []float64{0, 1, 2, 3, 4}) {
+			t.Errorf("Unexpected weights %v", fp.Weights())
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package formula
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+)
+
+// colSetGob is the exported form of a ColSet used for gob encoding.
+type colSetGob struct {
+	Names []string
+	Data  [][]float64
+	Terms []string
+}
+
+// GobEncode implements gob.GobEncoder, so that a ColSet can be sent
+// with a gob.Encoder, e.g. to stream the chunks produced by a Stream
+// over a network connection.  The provenance of the columns is not
+// encoded.
+func (cs *ColSet) GobEncode() ([]byte, error) {
+
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	err := enc.Encode(&colSetGob{Names: cs.names, Data: cs.data, Terms: cs.terms})
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// GobDecode implements gob.GobDecoder.
+func (cs *ColSet) GobDecode(b []byte) error {
+
+	var g colSetGob
+	dec := gob.NewDecoder(bytes.NewReader(b))
+	if err := dec.Decode(&g); err != nil {
+		return err
+	}
+
+	if len(g.Names) != len(g.Data) {
+		return fmt.Errorf("GobDecode: %d names for %d columns", len(g.Names), len(g.Data))
+	}
+	if g.Terms != nil && len(g.Terms) != len(g.Names) {
+		return fmt.Errorf("GobDecode: %d terms for %d columns", len(g.Terms), len(g.Names))
+	}
+
+	cs.names = g.Names
+	cs.data = g.Data
+	cs.terms = g.Terms
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package formula
+
+import (
+	"encoding/gob"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestGob(t *testing.T) {
+
+	chunk1 := mustSource([]interface{}{[]float64{1, 2}, []string{"a", "b"}}, []string{"x", "g"})
+	chunk2 := mustSource([]interface{}{[]float64{3}, []string{"a"}}, []string{"x", "g"})
+	s, err := NewStream([]string{"x + g"}, NewChunkSource(chunk1, chunk2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stream the chunks from a producer to a consumer
+	rdr, wtr := io.Pipe()
+	var sent []*ColSet
+	go func() {
+		enc := gob.NewEncoder(wtr)
+		for {
+			cs, err := s.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				wtr.CloseWithError(err)
+				return
+			}
+			sent = append(sent, cs)
+			if err := enc.Encode(cs); err != nil {
+				wtr.CloseWithError(err)
+				return
+			}
+		}
+		wtr.Close()
+	}()
+
+	var received []*ColSet
+	dec := gob.NewDecoder(rdr)
+	for {
+		cs := new(ColSet)
+		err := dec.Decode(cs)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, cs)
+	}
+
+	if len(received) != 2 {
+		t.Fatalf("received %d chunks, expected 2", len(received))
+	}
+	for k := range sent {
+		s, r := sent[k], received[k]
+		if !reflect.DeepEqual(s.names, r.names) || !reflect.DeepEqual(s.data, r.data) || !reflect.DeepEqual(s.terms, r.terms) {
+			t.Errorf("Sent %v, received %v", sent[k], received[k])
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package formula
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// GraphNode is a node in a dependency graph.
+type GraphNode struct {
+
+	// Kind is one of "variable" (a variable in the data, or a
+	// column not produced by a Parser), "intercept", "function"
+	// (the result of a function call), "arithmetic" (an I()
+	// expression), "term" or "column".
+	Kind string
+
+	// Name is the name of the variable, column or term, or the
+	// text of the function call or expression.
+	Name string
+}
+
+// Graph is a directed graph showing how the columns of a ColSet
+// depend on the variables in the data, through the functions and
+// terms of the formulas.  An edge from node a to node b indicates that
+// b is computed from a.  The coding of categorical variables and the
+// formation of interactions are not shown as separate nodes.
+type Graph struct {
+
+	// Nodes are the nodes of the graph.  Each node follows the
+	// nodes that it depends on.
+	Nodes []GraphNode
+
+	// Edges are the edges of the graph, given as pairs of
+	// positions in Nodes.
+	Edges [][2]int
+}
+
+// Graph returns the dependency graph of the columns of the ColSet.
+func (cs *ColSet) Graph() *Graph {
+
+	g := new(Graph)
+	nodeIx := make(map[GraphNode]int)
+	edgeIx := make(map[[2]int]bool)
+
+	node := func(kind, name string) int {
+		nd := GraphNode{Kind: kind, Name: name}
+		ix, ok := nodeIx[nd]
+		if !ok {
+			ix = len(g.Nodes)
+			nodeIx[nd] = ix
+			g.Nodes = append(g.Nodes, nd)
+		}
+		return ix
+	}
+
+	edge := func(from, to int) {
+		e := [2]int{from, to}
+		if !edgeIx[e] {
+			edgeIx[e] = true
+			g.Edges = append(g.Edges, e)
+		}
+	}
+
+	// Returns the nodes for the nearest origins at or above o
+	// that are shown in the graph, adding them to the graph.
+	var sources func(o *origin) []int
+	sources = func(o *origin) []int {
+		var kind string
+		switch o.op {
+		case "variable", "column":
+			kind = "variable"
+		case "intercept", "function", "arithmetic":
+			kind = o.op
+		default:
+			// Not shown, use the inputs
+			var ix []int
+			for _, in := range o.inputs {
+				ix = append(ix, sources(in)...)
+			}
+			return ix
+		}
+		var from []int
+		for _, in := range o.inputs {
+			from = append(from, sources(in)...)
+		}
+		name := o.name
+		if kind == "arithmetic" {
+			name = o.detail
+		}
+		to := node(kind, name)
+		for _, f := range from {
+			edge(f, to)
+		}
+		return []int{to}
+	}
+
+	for j, na := range cs.names {
+		src := sources(cs.origin(j))
+		term := node("term", cs.term(j))
+		for _, from := range src {
+			edge(from, term)
+		}
+		edge(term, node("column", na))
+	}
+
+	return g
+}
+
+// Dependents returns the nodes of the graph that depend, directly or
+// indirectly, on the node with the given kind and name, in the order
+// of Nodes.  For example, the columns that depend on a variable x7
+// are the nodes of kind "column" in Dependents("variable", "x7").
+func (g *Graph) Dependents(kind, name string) []GraphNode {
+
+	start := -1
+	for ix, nd := range g.Nodes {
+		if nd.Kind == kind && nd.Name == name {
+			start = ix
+			break
+		}
+	}
+	if start == -1 {
+		return nil
+	}
+
+	out := make(map[int][]int)
+	for _, e := range g.Edges {
+		out[e[0]] = append(out[e[0]], e[1])
+	}
+
+	reached := make([]bool, len(g.Nodes))
+	stack := []int{start}
+	for len(stack) > 0 {
+		ix := stack[len(stack)-1]
+		stack = stack[0 : len(stack)-1]
+		for _, to := range out[ix] {
+			if !reached[to] {
+				reached[to] = true
+				stack = append(stack, to)
+			}
+		}
+	}
+
+	var deps []GraphNode
+	for ix, nd := range g.Nodes {
+		if reached[ix] {
+			deps = append(deps, nd)
+		}
+	}
+
+	return deps
+}
+
+// dotShapes gives the shape used to draw each kind of node.
+var dotShapes = map[string]string{
+	"variable":   "ellipse",
+	"intercept":  "ellipse",
+	"function":   "box",
+	"arithmetic": "box",
+	"term":       "diamond",
+	"column":     "note",
+}
+
+// WriteDOT writes the graph to w in the DOT language used by
+// Graphviz.
+func (g *Graph) WriteDOT(w io.Writer) error {
+
+	wtr := bufio.NewWriter(w)
+	fmt.Fprintf(wtr, "digraph formula {\n")
+	for ix, nd := range g.Nodes {
+		fmt.Fprintf(wtr, "\tn%d [label=%s, shape=%s];\n", ix, strconv.Quote(nd.Name), dotShapes[nd.Kind])
+	}
+	for _, e := range g.Edges {
+		fmt.Fprintf(wtr, "\tn%d -> n%d;\n", e[0], e[1])
+	}
+	fmt.Fprintf(wtr, "}\n")
+
+	return wtr.Flush()
+}
@@ -0,0 +1,60 @@
+package formula
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGraph(t *testing.T) {
+
+	config := &Config{Funcs: makeFuncs(), RefLevels: map[string]string{"x3": "a"}}
+	fp, err := New("x2 + square(x1):x3", simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := cs.Graph()
+	expNodes := []GraphNode{
+		{Kind: "variable", Name: "x2"},
+		{Kind: "term", Name: "x2"},
+		{Kind: "column", Name: "x2[0]"},
+		{Kind: "column", Name: "x2[1]"},
+		{Kind: "variable", Name: "x1"},
+		{Kind: "function", Name: "square(x1)"},
+		{Kind: "variable", Name: "x3"},
+		{Kind: "term", Name: "square(x1):x3"},
+		{Kind: "column", Name: "square(x1):x3[b]"},
+	}
+	expEdges := [][2]int{{0, 1}, {1, 2}, {1, 3}, {4, 5}, {5, 7}, {6, 7}, {7, 8}}
+	if !reflect.DeepEqual(g.Nodes, expNodes) || !reflect.DeepEqual(g.Edges, expEdges) {
+		t.Errorf("Unexpected graph:\n%+v", g)
+	}
+
+	deps := g.Dependents("variable", "x1")
+	expDeps := []GraphNode{
+		{Kind: "function", Name: "square(x1)"},
+		{Kind: "term", Name: "square(x1):x3"},
+		{Kind: "column", Name: "square(x1):x3[b]"},
+	}
+	if !reflect.DeepEqual(deps, expDeps) {
+		t.Errorf("Unexpected dependents %v", deps)
+	}
+	if g.Dependents("variable", "x4") != nil {
+		t.Fail()
+	}
+
+	var buf bytes.Buffer
+	if err := g.WriteDOT(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dot := buf.String()
+	if !strings.HasPrefix(dot, "digraph formula {\n") || !strings.Contains(dot, "\tn5 [label=\"square(x1)\", shape=box];\n") || !strings.Contains(dot, "\tn4 -> n5;\n") {
+		t.Errorf("Unexpected DOT output:\n%s", dot)
+	}
+}
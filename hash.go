@@ -0,0 +1,86 @@
+package formula
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+)
+
+// The built-in function hash(x, n) codes a categorical variable with
+// many levels, e.g. zip codes, by n indicator columns, mapping each
+// level to one of the columns by a hash of its text (the "hashing
+// trick").  The number of columns does not depend on the number of
+// levels, and nothing is learned from the data, so levels that are
+// not in the training data are coded like any other level.  Distinct
+// levels can share a column.  The variable can be a string variable,
+// or a numeric variable whose values are formatted like the levels of
+// C(x).  The columns are named like hash(x, 256)[1], ...,
+// hash(x, 256)[256].  The name hash refers to a function in
+// Config.Funcs or Config.MultiFuncs if it is defined there.
+
+// isHash returns true if tok is a call to the built-in function hash.
+func (fp *Parser) isHash(tok *token) bool {
+
+	if tok.symbol != funct || tok.funcn != "hash" {
+		return false
+	}
+	_, single := fp.funcs[tok.funcn]
+	_, multi := fp.multiFuncs[tok.funcn]
+
+	return !single && !multi
+}
+
+// hashBucket returns the column, from 0 to n-1, of a level.
+func hashBucket(level string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(level))
+	return int(h.Sum32() % uint32(n))
+}
+
+// hashCode returns the columns of a call to hash.
+func (fp *Parser) hashCode(tok *token) (*ColSet, error) {
+
+	if len(tok.args) != 2 || tok.args[0].symbol != vname || tok.args[1].symbol != number {
+		return nil, fmt.Errorf("%s: hash takes a variable and a number of columns", tok.name)
+	}
+	v := tok.args[1].value
+	if v != math.Floor(v) || v < 1 || v > math.MaxInt32 {
+		return nil, fmt.Errorf("%s: the number of columns must be a positive integer", tok.name)
+	}
+	n := int(v)
+
+	na := tok.args[0].name
+	var levels []string
+	switch x := fp.rawColumn(na).(type) {
+	case nil:
+		return nil, &missingError{na}
+	case []string:
+		levels = x
+	case []float64:
+		levels = make([]string, len(x))
+		for i, u := range x {
+			levels[i] = formatLevel(u)
+		}
+	default:
+		return nil, fmt.Errorf("%s: unknown type %T for variable '%s'", tok.name, x, na)
+	}
+
+	dat := make([][]float64, n)
+	for j := range dat {
+		dat[j] = make([]float64, len(levels))
+	}
+	for i, level := range levels {
+		dat[hashBucket(level, n)][i] = 1
+	}
+
+	input := fp.varOrigin(na)
+	cs := &ColSet{data: dat}
+	for j := range dat {
+		cna := tok.name + "[" + strconv.Itoa(j+1) + "]"
+		cs.names = append(cs.names, cna)
+		cs.origins = append(cs.origins, &origin{op: "function", detail: tok.funcn, name: cna, inputs: []*origin{input}})
+	}
+
+	return cs, nil
+}
@@ -0,0 +1,60 @@
+package formula
+
+import (
+	"testing"
+)
+
+func TestHash(t *testing.T) {
+
+	zip := []string{"48104", "10001", "48104", "94110", "60601"}
+	src := mustSource([]interface{}{zip, []float64{3, 1, 3, 2, 1}}, []string{"zip", "z"})
+
+	fp, err := New("hash(zip, 8) + hash(z, 3)", src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cols.names) != 11 || cols.names[0] != "hash(zip, 8)[1]" || cols.names[10] != "hash(z, 3)[3]" {
+		t.Fatalf("Unexpected columns %v", cols.names)
+	}
+
+	// Each row has one indicator in each block, in the column
+	// given by the hash of its level
+	levels := [][]string{zip, {"3", "1", "3", "2", "1"}}
+	for k, blk := range [][2]int{{0, 8}, {8, 3}} {
+		for i, level := range levels[k] {
+			for j := 0; j < blk[1]; j++ {
+				var exp float64
+				if j == hashBucket(level, blk[1]) {
+					exp = 1
+				}
+				if v := cols.data[blk[0]+j][i]; v != exp {
+					t.Errorf("%s: row %d is %v, expected %v", cols.names[blk[0]+j], i, v, exp)
+				}
+			}
+		}
+	}
+
+	// New levels are coded without error
+	src2 := mustSource([]interface{}{[]string{"00501"}, []float64{7}}, []string{"zip", "z"})
+	cols, err = fp.WithData(src2).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := cols.data[hashBucket("00501", 8)][0]; v != 1 {
+		t.Errorf("Unexpected coding of a new level")
+	}
+
+	for _, fml := range []string{"hash(zip)", "hash(zip, 0)", "hash(zip, 2.5)"} {
+		fp, err := New(fml, src, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fp.Parse(); err == nil {
+			t.Errorf("%s: expected an error", fml)
+		}
+	}
+}
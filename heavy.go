@@ -0,0 +1,269 @@
+package formula
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// With Config.TopLevels set to K, the levels of each categorical
+// variable are selected in one pass over the data by the SpaceSaving
+// algorithm, which counts the levels using a fixed number of counters
+// (heavyFactor*K), instead of by an exact dictionary of all the
+// levels.  The K most frequent levels get columns, in order of
+// decreasing frequency, and the other levels are coded as levels that
+// were not seen, see Config.UnknownLevels.  Every level that occurs in
+// more than a fraction 1/(heavyFactor*K) of the rows is guaranteed to
+// be counted.
+
+// The number of counters per selected level
+const heavyFactor = 4
+
+// heavyCounter counts one level in a spaceSaving summary.  The count
+// overestimates the number of occurrences of the level by at most
+// err.
+type heavyCounter struct {
+	level string
+	count int
+	err   int
+	index int
+}
+
+// spaceSaving is a SpaceSaving summary of the levels of one variable,
+// with the counters in a min-heap by count.
+type spaceSaving struct {
+	size     int
+	counters []*heavyCounter
+	byLevel  map[string]*heavyCounter
+}
+
+func newSpaceSaving(size int) *spaceSaving {
+	return &spaceSaving{size: size, byLevel: make(map[string]*heavyCounter)}
+}
+
+func (s *spaceSaving) Len() int { return len(s.counters) }
+
+func (s *spaceSaving) Less(i, j int) bool { return s.counters[i].count < s.counters[j].count }
+
+func (s *spaceSaving) Swap(i, j int) {
+	s.counters[i], s.counters[j] = s.counters[j], s.counters[i]
+	s.counters[i].index = i
+	s.counters[j].index = j
+}
+
+func (s *spaceSaving) Push(x interface{}) {
+	c := x.(*heavyCounter)
+	c.index = len(s.counters)
+	s.counters = append(s.counters, c)
+}
+
+func (s *spaceSaving) Pop() interface{} {
+	n := len(s.counters)
+	c := s.counters[n-1]
+	s.counters = s.counters[:n-1]
+	return c
+}
+
+// add counts one occurrence of a level.  If the level is not counted
+// and all counters are in use, the counter with the smallest count is
+// given to the level.
+func (s *spaceSaving) add(level string) {
+
+	if c, ok := s.byLevel[level]; ok {
+		c.count++
+		heap.Fix(s, c.index)
+		return
+	}
+
+	if len(s.counters) < s.size {
+		c := &heavyCounter{level: level, count: 1}
+		s.byLevel[level] = c
+		heap.Push(s, c)
+		return
+	}
+
+	c := s.counters[0]
+	delete(s.byLevel, c.level)
+	c.level = level
+	c.err = c.count
+	c.count++
+	s.byLevel[level] = c
+	heap.Fix(s, 0)
+}
+
+// top returns at most k levels with the largest counts, in order of
+// decreasing count, with ties broken by level.
+func (s *spaceSaving) top(k int) []string {
+
+	cs := append([]*heavyCounter(nil), s.counters...)
+	sort.Slice(cs, func(i, j int) bool {
+		if cs[i].count != cs[j].count {
+			return cs[i].count > cs[j].count
+		}
+		return cs[i].level < cs[j].level
+	})
+
+	var levels []string
+	for _, c := range cs {
+		if len(levels) == k {
+			break
+		}
+		levels = append(levels, c.level)
+	}
+
+	return levels
+}
+
+// state returns the count and error of each counted level.
+func (s *spaceSaving) state() map[string][2]int {
+	m := make(map[string][2]int, len(s.counters))
+	for _, c := range s.counters {
+		m[c.level] = [2]int{c.count, c.err}
+	}
+	return m
+}
+
+// setState restores the counters returned by state.
+func (s *spaceSaving) setState(m map[string][2]int) {
+	for level, v := range m {
+		c := &heavyCounter{level: level, count: v[0], err: v[1]}
+		s.byLevel[level] = c
+		heap.Push(s, c)
+	}
+}
+
+// merge adds the counts of a summary of other data, as returned by
+// state, keeping the counters with the largest counts.  The counts and
+// errors of a level are added, so the merged count still
+// overestimates the number of occurrences by at most the merged
+// error, if the level was counted in both summaries.
+func (s *spaceSaving) merge(m map[string][2]int) {
+
+	merged := s.state()
+	for level, v := range m {
+		w := merged[level]
+		merged[level] = [2]int{w[0] + v[0], w[1] + v[1]}
+	}
+
+	levels := make([]string, 0, len(merged))
+	for level := range merged {
+		levels = append(levels, level)
+	}
+	sort.Slice(levels, func(i, j int) bool {
+		ci, cj := merged[levels[i]][0], merged[levels[j]][0]
+		if ci != cj {
+			return ci > cj
+		}
+		return levels[i] < levels[j]
+	})
+	if len(levels) > s.size {
+		levels = levels[0:s.size]
+	}
+
+	s.counters = nil
+	s.byLevel = make(map[string]*heavyCounter)
+	keep := make(map[string][2]int, len(levels))
+	for _, level := range levels {
+		keep[level] = merged[level]
+	}
+	s.setState(keep)
+}
+
+// addHeavy counts the levels in v of the categorical variable na.
+func (fp *Parser) addHeavy(na, ref string, v []string) {
+
+	s, ok := fp.heavy[na]
+	if !ok {
+		s = newSpaceSaving(heavyFactor * fp.topLevels)
+		fp.heavy[na] = s
+	}
+
+	for _, x := range v {
+		if x == ref {
+			fp.refSeen[na] = true
+		}
+		s.add(x)
+	}
+}
+
+// selectTopLevels codes the most frequent levels of each categorical
+// variable, after the levels have been counted.
+func (fp *Parser) selectTopLevels() {
+
+	if fp.topLevels <= 0 {
+		return
+	}
+
+	var names []string
+	for na := range fp.heavy {
+		names = append(names, na)
+	}
+	sort.Strings(names)
+
+	heavy := fp.heavy
+	fp.heavy = nil
+	for _, na := range names {
+		// The reference level has no column
+		ref := fp.refLevel(na)
+		var levels []string
+		for _, x := range heavy[na].top(fp.topLevels + 1) {
+			if (x != ref || fp.isOneHot(na)) && len(levels) < fp.topLevels {
+				levels = append(levels, x)
+			}
+		}
+		fp.updateLevels(na, ref, levels)
+	}
+	fp.heavy = heavy
+}
+
+// reselectTopLevels codes the most frequent levels of each
+// categorical variable according to the combined counts of the levels
+// in a and b, which were counted in different datasets.  The codes
+// of the variables that were counted are replaced.
+func (fp *Parser) reselectTopLevels(a, b map[string]map[string][2]int) {
+
+	if fp.topLevels <= 0 {
+		return
+	}
+
+	fp.heavy = make(map[string]*spaceSaving)
+	for _, m := range []map[string]map[string][2]int{a, b} {
+		for na, counts := range m {
+			s, ok := fp.heavy[na]
+			if !ok {
+				s = newSpaceSaving(heavyFactor * fp.topLevels)
+				fp.heavy[na] = s
+			}
+			s.merge(counts)
+		}
+	}
+
+	// Only the declared levels are kept, as in resetCodes
+	heavy := fp.heavy
+	fp.heavy = nil
+	fp.levelCounts = make(map[string]map[string]int)
+	for na := range heavy {
+		delete(fp.codes, na)
+		delete(fp.facNames, na)
+		if levels := fp.declaredLevels(na); len(levels) > 0 {
+			fp.updateLevels(na, fp.refLevel(na), levels)
+		}
+	}
+	fp.heavy = heavy
+
+	fp.selectTopLevels()
+}
+
+// heavyState returns the counters of the levels of each variable.
+func (fp *Parser) heavyState() map[string]map[string][2]int {
+
+	if len(fp.heavy) == 0 {
+		return nil
+	}
+
+	m := make(map[string]map[string][2]int)
+	for na, s := range fp.heavy {
+		m[na] = s.state()
+	}
+
+	return m
+}
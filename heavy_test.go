@@ -0,0 +1,107 @@
+package formula
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestSpaceSaving(t *testing.T) {
+
+	// Levels a, b and c are frequent, and there are many rare
+	// levels
+	s := newSpaceSaving(12)
+	for i := 0; i < 1000; i++ {
+		s.add("a")
+		if i%2 == 0 {
+			s.add("b")
+		}
+		if i%4 == 0 {
+			s.add("c")
+		}
+		s.add(fmt.Sprintf("r%d", i))
+	}
+
+	if top := s.top(3); !reflect.DeepEqual(top, []string{"a", "b", "c"}) {
+		t.Errorf("Unexpected top levels %v", top)
+	}
+	if len(s.counters) != 12 {
+		t.Errorf("Expected 12 counters, found %d", len(s.counters))
+	}
+}
+
+func TestTopLevels(t *testing.T) {
+
+	x := []string{"a", "b", "c", "b", "d", "b", "c", "a", "c", "b"}
+	src := mustSource([]interface{}{x}, []string{"x"})
+
+	config := &Config{
+		RefLevels:     map[string]string{"x": "a"},
+		TopLevels:     2,
+		UnknownLevels: UnknownOther,
+	}
+	fp, err := New("x", src, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &ColSet{
+		names: []string{"x[b]", "x[c]", "x[_other_]"},
+		data: [][]float64{
+			{0, 1, 0, 1, 0, 1, 0, 0, 0, 1},
+			{0, 0, 1, 0, 0, 0, 1, 0, 1, 0},
+			{0, 0, 0, 0, 1, 0, 0, 0, 0, 0},
+		},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+
+	// A stream resumed from a checkpoint selects the same levels
+	chunks := NewChunkSource(mustSource([]interface{}{x[0:5]}, []string{"x"}), mustSource([]interface{}{x[5:]}, []string{"x"}))
+	s, err := NewStream([]string{"x"}, chunks, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved []byte
+	s.OnCheckpoint = func(cp *Checkpoint) error {
+		if cp.Chunk == 1 && !cp.Fitted {
+			saved, err = json.Marshal(cp)
+			return err
+		}
+		return nil
+	}
+	if err := s.Fit(); err != nil {
+		t.Fatal(err)
+	}
+
+	var cp Checkpoint
+	if err := json.Unmarshal(saved, &cp); err != nil {
+		t.Fatal(err)
+	}
+	s, err = ResumeStream([]string{"x"}, chunks, config, &cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parts []*ColSet
+	for {
+		cs, err := s.Next()
+		if err != nil {
+			break
+		}
+		parts = append(parts, cs)
+	}
+	if len(parts) != 2 || !reflect.DeepEqual(parts[0].Names(), exp.names) {
+		t.Errorf("Unexpected stream output %v", parts)
+	}
+
+	config.MinLevelCount = 2
+	if _, err := New("x", src, config); err == nil {
+		t.Errorf("Expected an error for TopLevels with MinLevelCount")
+	}
+}
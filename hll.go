@@ -0,0 +1,143 @@
+package formula
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// The number of bits of the hash that select a register of a
+// HyperLogLog sketch, giving a relative error of about 1.6%
+const hllPrecision = 12
+
+// hyperLogLog is a HyperLogLog sketch, which estimates the number of
+// distinct values added to it using a fixed amount of memory.
+type hyperLogLog struct {
+	reg []uint8
+}
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{reg: make([]uint8, 1<<hllPrecision)}
+}
+
+// add adds a value to the sketch.
+func (h *hyperLogLog) add(x string) {
+
+	f := fnv.New64a()
+	f.Write([]byte(x))
+	v := f.Sum64()
+
+	// Mix the bits (the splitmix64 finalizer), as FNV hashes of
+	// similar strings have similar high bits
+	v ^= v >> 30
+	v *= 0xbf58476d1ce4e5b9
+	v ^= v >> 27
+	v *= 0x94d049bb133111eb
+	v ^= v >> 31
+
+	j := v >> (64 - hllPrecision)
+	rho := uint8(bits.LeadingZeros64(v<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	if rho > h.reg[j] {
+		h.reg[j] = rho
+	}
+}
+
+// estimate returns the estimated number of distinct values added to
+// the sketch.
+func (h *hyperLogLog) estimate() float64 {
+
+	m := float64(len(h.reg))
+	var sum float64
+	var zeros int
+	for _, r := range h.reg {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	alpha := 0.7213 / (1 + 1.079/m)
+	e := alpha * m * m / sum
+
+	// Linear counting for small cardinalities
+	if e <= 2.5*m && zeros > 0 {
+		return m * math.Log(m/float64(zeros))
+	}
+
+	return e
+}
+
+// EstimateLevels makes a pass over the chunks of the stream that
+// estimates the number of distinct levels of each categorical
+// variable and call to C or a CatFunc, using a HyperLogLog sketch
+// whose size does not depend on the number of levels.  The estimates
+// have a relative error of a few percent.  The progress of the stream
+// is not changed.
+func (s *Stream) EstimateLevels() (map[string]float64, error) {
+
+	sketches := make(map[string]*hyperLogLog)
+	add := func(na string, levels []string) {
+		h, ok := sketches[na]
+		if !ok {
+			h = newHyperLogLog()
+			sketches[na] = h
+		}
+		for _, x := range levels {
+			h.add(x)
+		}
+	}
+
+	fp := s.fp
+	for k := 0; ; k++ {
+		chunk, err := s.Chunks.Chunk(k)
+		if err != nil {
+			return nil, err
+		}
+		if chunk == nil {
+			break
+		}
+		for _, na := range chunk.Names() {
+			if x, ok := fp.get(chunk, na).([]string); ok {
+				add(na, x)
+			}
+		}
+		for _, tok := range fp.catCalls() {
+			if levels, err := fp.catLevels(chunk, tok); err == nil && levels != nil {
+				add(tok.name, levels)
+			}
+		}
+	}
+
+	est := make(map[string]float64)
+	for na, h := range sketches {
+		est[na] = math.Round(h.estimate())
+	}
+
+	return est, nil
+}
+
+// checkLevels returns an error if the estimated number of levels of a
+// categorical variable exceeds s.MaxLevels.
+func (s *Stream) checkLevels() error {
+
+	est, err := s.EstimateLevels()
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for na := range est {
+		names = append(names, na)
+	}
+	sort.Strings(names)
+
+	for _, na := range names {
+		if est[na] > float64(s.MaxLevels) {
+			return fmt.Errorf("'%s' has about %.0f levels, more than the maximum of %d", na, est[na], s.MaxLevels)
+		}
+	}
+
+	return nil
+}
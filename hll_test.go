@@ -0,0 +1,61 @@
+package formula
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestHyperLogLog(t *testing.T) {
+
+	for _, n := range []int{10, 1000, 100000} {
+		h := newHyperLogLog()
+		for i := 0; i < n; i++ {
+			// Each value is added twice
+			h.add(fmt.Sprintf("level%d", i))
+			h.add(fmt.Sprintf("level%d", i))
+		}
+		if e := h.estimate(); math.Abs(e-float64(n)) > 0.05*float64(n) {
+			t.Errorf("Estimated %f distinct values, expected %d", e, n)
+		}
+	}
+}
+
+func TestStreamMaxLevels(t *testing.T) {
+
+	var chunks []DataSource
+	for k := 0; k < 4; k++ {
+		x := make([]string, 500)
+		z := make([]float64, 500)
+		for i := range x {
+			x[i] = fmt.Sprintf("id%d", 500*k+i)
+			z[i] = float64(i % 7)
+		}
+		chunks = append(chunks, mustSource([]interface{}{x, z}, []string{"x", "z"}))
+	}
+
+	s, err := NewStream([]string{"x + C(z)"}, NewChunkSource(chunks...), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	est, err := s.EstimateLevels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(est["x"]-2000) > 100 || est["C(z)"] != 7 {
+		t.Errorf("Unexpected estimates %v", est)
+	}
+
+	s.MaxLevels = 1000
+	if err := s.Fit(); err == nil {
+		t.Errorf("Expected an error for too many levels")
+	}
+	if len(s.fp.codes["x"]) > 0 {
+		t.Errorf("Codes were learned before the error")
+	}
+
+	s.MaxLevels = 5000
+	if err := s.Fit(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,236 @@
+package formula
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// InteractionCoding determines how the interactions of categorical
+// variables are coded.
+type InteractionCoding int
+
+const (
+	// ProductCoding codes an interaction by the products of the
+	// columns of its terms, so that the interaction of two
+	// treatment-coded factors has a column for each pair of
+	// non-reference levels.  This is the default.
+	ProductCoding InteractionCoding = iota
+
+	// CellCoding codes the interaction of treatment-coded
+	// categorical variables, e.g. x2:x3, by an indicator for each
+	// combination (cell) of their levels, including the reference
+	// levels, named like x2[a]:x3[b].  The cell in which every
+	// variable is at its reference level has no column, so the
+	// columns together with an intercept are a full-rank coding of
+	// the main effects and the interaction, and the interaction
+	// should be used without the main effects.  With one-hot coded
+	// variables, every cell has a column (cell means coding).
+	// Cells that do not occur in the data have columns of zeros.
+	// Rows with a level that was not seen when the codes were
+	// determined are coded according to Config.UnknownLevels, as
+	// zeros in every cell, an error, or a cell of the _other_
+	// level, and rows with a missing level (see MissingPolicy) are
+	// missing (NaN) in every cell.  Interactions involving other
+	// columns are coded by products.
+	CellCoding
+)
+
+// factorBlock describes a block of columns coding a categorical
+// variable, or the cells of an interaction of categorical variables.
+type factorBlock struct {
+
+	// The term of the block, e.g. x2 or x2:x3
+	term string
+
+	// The levels, e.g. b or b:c, and the names used for them in
+	// cell column names, e.g. x2[b] or x2[b]:x3[c].  If hasRef is
+	// true, the first level is the reference level, which has no
+	// column.
+	levels []string
+	names  []string
+	hasRef bool
+
+	// The position of the level of each row in levels, or -1 if
+	// the row has no level and is coded by zeros, or -2 if the row
+	// is missing
+	code []int
+
+	// The variables coded by the block
+	inputs []*origin
+}
+
+// implicitRef returns the reference level of a term of categorical
+// variables, e.g. x2 or x2:x3, if that level has no column.
+func (fp *Parser) implicitRef(term string) (string, bool) {
+
+	var refs []string
+	for _, na := range strings.Split(term, ":") {
+		ref := fp.refLevel(na)
+		if ref == "" || fp.isOneHot(na) {
+			return "", false
+		}
+		refs = append(refs, ref)
+	}
+
+	return strings.Join(refs, ":"), true
+}
+
+// refName returns the name of the reference level of a term in cell
+// column names, e.g. x2[a]:x3[a].
+func (fp *Parser) refName(term string) string {
+
+	var names []string
+	for _, na := range strings.Split(term, ":") {
+		names = append(names, fmt.Sprintf("%s[%s]", na, fp.refLevel(na)))
+	}
+
+	return strings.Join(names, ":")
+}
+
+// factor returns the block of cs at the given positions as a
+// factorBlock, or false if the block does not code a treatment-coded
+// categorical variable or the cells of an interaction of such
+// variables.
+func (fp *Parser) factor(cs *ColSet, blk []int) (*factorBlock, bool) {
+
+	if cs.origins == nil {
+		return nil, false
+	}
+
+	term := cs.term(blk[0])
+	op := cs.origin(blk[0]).op
+	switch {
+	case op == "indicator" && fp.contrast(term) == TreatmentContrast:
+	case op == "cell":
+	default:
+		return nil, false
+	}
+
+	f := &factorBlock{term: term}
+	if ref, ok := fp.implicitRef(term); ok {
+		f.levels = append(f.levels, ref)
+		f.names = append(f.names, fp.refName(term))
+		f.hasRef = true
+	}
+
+	for _, j := range blk {
+		o := cs.origin(j)
+		if o.op != op {
+			return nil, false
+		}
+		f.levels = append(f.levels, o.detail)
+		f.names = append(f.names, cs.names[j])
+	}
+
+	o := cs.origin(blk[0])
+	if op == "cell" {
+		f.inputs = o.inputs
+	} else {
+		f.inputs = o.inputs[:1]
+	}
+
+	var n int
+	if len(blk) > 0 {
+		n = len(cs.data[blk[0]])
+	}
+	unseen := fp.unseen[term]
+	f.code = make([]int, n)
+	for i := range f.code {
+		f.code[i] = -1
+		if f.hasRef && !(unseen != nil && unseen[i]) {
+			f.code[i] = 0
+		}
+	}
+	for k, j := range blk {
+		if f.hasRef {
+			k++
+		}
+		for i, v := range cs.data[j] {
+			switch {
+			case math.IsNaN(v):
+				f.code[i] = -2
+			case v != 0 && f.code[i] != -2:
+				f.code[i] = k
+			}
+		}
+	}
+
+	return f, true
+}
+
+// cells returns the indicators of the cells of the interaction of two
+// categorical variables or interactions.  The rows in which either
+// variable has no level are recorded as unseen, so that they are not
+// taken to be in the reference cell by a further interaction.
+func (fp *Parser) cells(f1, f2 *factorBlock) *ColSet {
+
+	term := f1.term + ":" + f2.term
+	inputs := append(append([]*origin(nil), f1.inputs...), f2.inputs...)
+
+	var unseen []bool
+	for i := range f1.code {
+		if f1.code[i] == -1 || f2.code[i] == -1 {
+			if unseen == nil {
+				unseen = make([]bool, len(f1.code))
+			}
+			unseen[i] = true
+		}
+	}
+	if unseen != nil && fp.unseen != nil {
+		fp.unseen[term] = unseen
+	}
+
+	cs := new(ColSet)
+	for k1 := range f1.levels {
+		for k2 := range f2.levels {
+			if f1.hasRef && f2.hasRef && k1 == 0 && k2 == 0 {
+				// The reference cell
+				continue
+			}
+			x := make([]float64, len(f1.code))
+			for i := range x {
+				switch {
+				case f1.code[i] == -2 || f2.code[i] == -2:
+					x[i] = math.NaN()
+				case f1.code[i] == k1 && f2.code[i] == k2:
+					x[i] = 1
+				}
+			}
+			na := f1.names[k1] + ":" + f2.names[k2]
+			o := &origin{op: "cell", detail: f1.levels[k1] + ":" + f2.levels[k2], name: na, inputs: inputs}
+			cs.names = append(cs.names, na)
+			cs.data = append(cs.data, x)
+			cs.terms = append(cs.terms, term)
+			cs.origins = append(cs.origins, o)
+		}
+	}
+
+	return cs
+}
+
+// interact returns the interaction of ds1 and ds2, which is the
+// product of their columns unless Config.InteractionCoding is
+// CellCoding, in which case pairs of categorical blocks are coded by
+// their cells.
+func (fp *Parser) interact(ds1, ds2 *ColSet) *ColSet {
+
+	if fp.interactionCoding != CellCoding {
+		return product(ds1, ds2)
+	}
+
+	rslt := new(ColSet)
+	for _, b1 := range ds1.blocks() {
+		f1, ok1 := fp.factor(ds1, b1)
+		for _, b2 := range ds2.blocks() {
+			f2, ok2 := fp.factor(ds2, b2)
+			if ok1 && ok2 {
+				rslt = union(rslt, fp.cells(f1, f2))
+			} else {
+				rslt = union(rslt, product(ds1.sub(b1), ds2.sub(b2)))
+			}
+		}
+	}
+
+	return rslt
+}
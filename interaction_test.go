@@ -0,0 +1,190 @@
+package formula
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestCellCoding(t *testing.T) {
+
+	data := []interface{}{
+		[]string{"a", "a", "b", "b", "c", "c"},
+		[]string{"u", "v", "u", "v", "u", "v"},
+		[]float64{1, 2, 3, 4, 5, 6},
+	}
+	src, err := NewSource(data, []string{"f", "g", "z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fml := range []string{"1 + f:g", "1 + f*g"} {
+		config := &Config{
+			RefLevels:         map[string]string{"f": "a", "g": "u"},
+			InteractionCoding: CellCoding,
+		}
+		fp, err := New(fml, src, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cols, err := fp.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		exp := &ColSet{
+			names: []string{"icept", "f[a]:g[v]", "f[b]:g[u]", "f[b]:g[v]", "f[c]:g[u]", "f[c]:g[v]"},
+			data: [][]float64{
+				{1, 1, 1, 1, 1, 1},
+				{0, 1, 0, 0, 0, 0},
+				{0, 0, 1, 0, 0, 0},
+				{0, 0, 0, 1, 0, 0},
+				{0, 0, 0, 0, 1, 0},
+				{0, 0, 0, 0, 0, 1},
+			},
+		}
+		if !colSetEq(exp, cols) {
+			t.Errorf("%s\nExpected: %v\nObserved: %v\n", fml, exp, cols)
+		}
+	}
+
+	// Cell means coding, and interactions with numeric variables
+	config := &Config{
+		RefLevels:         map[string]string{"f": "a"},
+		OneHotVars:        map[string]bool{"f": true, "g": true},
+		InteractionCoding: CellCoding,
+	}
+	fp, err := New("f:g + f:z", src, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []string{"f[a]:g[u]", "f[a]:g[v]", "f[b]:g[u]", "f[b]:g[v]", "f[c]:g[u]", "f[c]:g[v]",
+		"f[a]:z", "f[b]:z", "f[c]:z"}
+	if !reflect.DeepEqual(exp, cols.Names()) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols.Names())
+	}
+	for j := 0; j < 6; j++ {
+		for i, v := range cols.data[j] {
+			if (i == j) != (v == 1) {
+				t.Errorf("%s: unexpected value %v in row %d", cols.names[j], v, i)
+			}
+		}
+	}
+
+	prov := cols.Provenance()[1]
+	last := prov[len(prov)-1]
+	if last.Op != "cell" || last.Detail != "a:v" || !reflect.DeepEqual(last.Inputs, []string{"f", "g"}) {
+		t.Errorf("Unexpected provenance %v", prov)
+	}
+}
+
+func TestCellCodingUnknown(t *testing.T) {
+
+	train := mustSource([]interface{}{
+		[]string{"a", "a", "b", "b"},
+		[]string{"u", "v", "u", "v"},
+	}, []string{"f", "g"})
+	test := mustSource([]interface{}{
+		[]string{"a", "c", "b", "c"},
+		[]string{"u", "u", "v", "v"},
+	}, []string{"f", "g"})
+
+	for _, policy := range []UnknownPolicy{UnknownZero, UnknownError, UnknownOther} {
+		config := &Config{
+			RefLevels:         map[string]string{"f": "a", "g": "u"},
+			InteractionCoding: CellCoding,
+			UnknownLevels:     policy,
+		}
+		fp, err := New("f:g", train, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fp.Parse(); err != nil {
+			t.Fatal(err)
+		}
+		cols, err := fp.WithData(test).Parse()
+		if policy == UnknownError {
+			if err == nil {
+				t.Errorf("Expected an error for an unseen level")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The unseen level c is not coded as the reference level
+		exp := &ColSet{
+			names: []string{"f[a]:g[v]", "f[b]:g[u]", "f[b]:g[v]"},
+			data: [][]float64{
+				{0, 0, 0, 0},
+				{0, 0, 0, 0},
+				{0, 0, 1, 0},
+			},
+		}
+		if policy == UnknownOther {
+			// Both variables have an _other_ level
+			exp = &ColSet{
+				names: []string{"f[a]:g[v]", "f[a]:g[_other_]", "f[b]:g[u]", "f[b]:g[v]", "f[b]:g[_other_]",
+					"f[_other_]:g[u]", "f[_other_]:g[v]", "f[_other_]:g[_other_]"},
+				data: [][]float64{
+					{0, 0, 0, 0},
+					{0, 0, 0, 0},
+					{0, 0, 0, 0},
+					{0, 0, 1, 0},
+					{0, 0, 0, 0},
+					{0, 1, 0, 0},
+					{0, 0, 0, 1},
+					{0, 0, 0, 0},
+				},
+			}
+		}
+		if !colSetEq(exp, cols) {
+			t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+		}
+	}
+}
+
+func TestCellCodingMissing(t *testing.T) {
+
+	src := mustSource([]interface{}{
+		[]string{"a", "NA", "b", "b", "a"},
+		[]string{"v", "v", "u", "v", "u"},
+		[]string{"p", "q", "p", "q", "q"},
+	}, []string{"f", "g", "h"})
+	config := &Config{
+		RefLevels:         map[string]string{"f": "a", "g": "u", "h": "p"},
+		InteractionCoding: CellCoding,
+		MissingLevels:     []string{"NA"},
+		MissingPolicy:     MissingDrop,
+	}
+
+	for _, fml := range []string{"f:g", "f:g:h"} {
+		fp, err := New(fml, src, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cols, err := fp.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The missing level is missing in every cell, and is not
+		// coded as the last level
+		for j, x := range cols.Data() {
+			for i, v := range x {
+				if math.IsNaN(v) != (i == 1) {
+					t.Errorf("%s: unexpected value %v in row %d of %s", fml, v, i, cols.Names()[j])
+				}
+			}
+		}
+		if n := len(cols.DropNA().Data()[0]); n != 4 {
+			t.Errorf("%s: expected 4 rows, observed %d", fml, n)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package formula
+
+import (
+	"fmt"
+)
+
+// A term of a formula can be given a label, e.g. trt_eff = x1:x2 in
+// "x3 + trt_eff = x1:x2".  The columns of the term are named after
+// the label instead of the term, e.g. trt_eff if the term produces
+// one column, and trt_eff[1], trt_eff[2], ... otherwise.  A label
+// applies to the term following it up to the next + or -, so a sum
+// must be parenthesized, e.g. demog = (age + sex).  Labels can not be
+// used in function calls.
+
+// lexLabels replaces each labeled term, i.e. a variable name followed
+// by = and a term, with a single labeled token holding the RPN of the
+// term.
+func lexLabels(input []*token) ([]*token, error) {
+
+	var output []*token
+	for i := 0; i < len(input); i++ {
+		tok := input[i]
+		if tok.symbol == equals {
+			return nil, syntaxError("", tok.pos, "unexpected '='")
+		}
+		if tok.symbol != vname || i+1 >= len(input) || input[i+1].symbol != equals {
+			output = append(output, tok)
+			continue
+		}
+
+		// The term ends at the next + or - that is not nested in
+		// parentheses, or at a right parenthesis closing an
+		// enclosing expression
+		j, depth := i+2, 0
+		for ; j < len(input); j++ {
+			s := input[j].symbol
+			if depth == 0 && (s == plus || s == minus || s == tilde || s == rightp) {
+				break
+			}
+			switch s {
+			case leftp:
+				depth++
+			case rightp:
+				depth--
+			case equals:
+				return nil, syntaxError("", input[j].pos, "labels can not be nested")
+			}
+		}
+		term := input[i+2 : j]
+		if len(term) == 0 {
+			return nil, syntaxError("", input[i+1].pos, "missing term after label '%s'", tok.name)
+		}
+
+		rpn, err := parse(term)
+		if err != nil {
+			return nil, err
+		}
+		name := argText(tok) + " = " + renderTokens(term)
+		output = append(output, &token{symbol: labeled, name: name, funcn: tok.name, expr: rpn, pos: tok.pos})
+		i = j - 1
+	}
+
+	return output, nil
+}
+
+// doLabel evaluates a labeled term, and names its columns after the
+// label.
+func (fp *Parser) doLabel(tok *token) (*ColSet, error) {
+
+	if cs, ok := fp.cached(tok.name); ok {
+		return cs, nil
+	}
+
+	saved := fp.workData
+	fp.workData = make(map[string]*ColSet)
+	cs, err := fp.doFormula(tok.expr)
+	fp.workData = saved
+	if err != nil {
+		return nil, err
+	}
+
+	rslt := &ColSet{data: cs.data}
+	for j := range cs.names {
+		na := tok.funcn
+		if len(cs.names) > 1 {
+			na = fmt.Sprintf("%s[%d]", tok.funcn, j+1)
+		}
+		rslt.names = append(rslt.names, na)
+		o := &origin{op: "rename", detail: tok.funcn, name: na, inputs: []*origin{cs.origin(j)}}
+		rslt.origins = append(rslt.origins, o)
+	}
+	rslt = rslt.withTerm(tok.funcn)
+	fp.store(tok.name, rslt)
+
+	return rslt, nil
+}
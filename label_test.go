@@ -0,0 +1,52 @@
+package formula
+
+import (
+	"testing"
+)
+
+func TestLabels(t *testing.T) {
+
+	fp, err := New("x4 + trt_eff = x1:x3 + z = (x1 + x2)", simpleData(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &ColSet{
+		names: []string{"x4", "trt_eff[1]", "trt_eff[2]", "z[1]", "z[2]", "z[3]"},
+		data: [][]float64{
+			{-1, 0, 1, 0, -1},
+			{0, 0, 2, 0, 4},
+			{0, 1, 0, 3, 0},
+			{0, 1, 2, 3, 4},
+			{1, 1, 1, 0, 0},
+			{0, 0, 0, 1, 1},
+		},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+
+	// A single column is named by the label, and the label binds
+	// more loosely than the other operators
+	fp, err = New("(eff = log(x1):x4)*x4 + x1", simpleData(), &Config{Funcs: map[string]Func{"log": func(na string, x []float64) *ColSet { return NewColSet([]string{na}, [][]float64{x}) }}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err = fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cols.Names()) != 2 || cols.Names()[0] != "eff:x4" || cols.Names()[1] != "x1" {
+		t.Errorf("Unexpected names %v", cols.Names())
+	}
+
+	for _, fml := range []string{"x1 + = x2", "x1 + a = ", "log(a = x1)", "a = b = x1", "x1 = x2 = x3"} {
+		if _, err := New(fml, simpleData(), nil); err == nil {
+			t.Errorf("%s should fail", fml)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package formula
+
+import (
+	"fmt"
+	"math"
+)
+
+// The built-in functions offset and weights mark their arguments as
+// having a special role in a model, rather than being covariates.  An
+// offset, e.g. offset(logExposure), is a covariate whose coefficient
+// is fixed at 1 in a generalized linear model, and weights(w) holds
+// the case weights.  The columns of these calls are not included in
+// the design matrix returned by Parse, and are instead available from
+// Parser.Offsets and Parser.Weights.
+
+// isMarker returns true if tok is a call to the built-in function
+// offset or weights.
+func isMarker(tok *token) bool {
+	return tok.symbol == funct && (tok.funcn == "offset" || tok.funcn == "weights")
+}
+
+// marker returns the columns of a call to offset or weights, which
+// have the names of the columns of its argument.
+func (fp *Parser) marker(tok *token) (*ColSet, error) {
+
+	if len(tok.args) != 1 {
+		return nil, fmt.Errorf("%s: %s takes one argument", tok.name, tok.funcn)
+	}
+
+	cs, err := fp.argument(tok.args[0])
+	if err != nil {
+		return nil, err
+	}
+	if cs == nil {
+		return nil, fmt.Errorf("%s: the argument of %s must be a variable or an expression", tok.name, tok.funcn)
+	}
+
+	rslt := &ColSet{names: cs.names, data: cs.data}
+	for j, na := range cs.names {
+		o := &origin{op: "function", detail: tok.funcn, name: na, inputs: []*origin{cs.origin(j)}}
+		rslt.origins = append(rslt.origins, o)
+	}
+
+	return rslt, nil
+}
+
+// splitMarked returns the columns of cs that do not belong to the
+// calls to the function funcn in rpn, followed by those that do.
+func splitMarked(cs *ColSet, rpn []*token, funcn string) (*ColSet, *ColSet) {
+
+	terms := make(map[string]bool)
+	for _, tok := range rpn {
+		if isMarker(tok) && tok.funcn == funcn {
+			terms[tok.name] = true
+		}
+	}
+	if len(terms) == 0 {
+		return cs, nil
+	}
+
+	var ix, jx []int
+	for j := range cs.names {
+		if terms[cs.term(j)] {
+			jx = append(jx, j)
+		} else {
+			ix = append(ix, j)
+		}
+	}
+
+	return cs.sub(ix), cs.sub(jx)
+}
+
+// Offsets returns the columns of the calls to offset in the formulas,
+// in formula order.  Offsets returns nil if the formulas have no
+// offsets, or if Parse has not been called.
+func (fp *Parser) Offsets() *ColSet {
+	return fp.offsets
+}
+
+// Weights returns the case weights given by a call to weights in the
+// formulas.  Weights returns nil if the formulas have no weights, or
+// if Parse has not been called.
+func (fp *Parser) Weights() []float64 {
+	return fp.weights
+}
+
+// WeightScaling determines whether the design matrix and the
+// responses are multiplied by the square roots of the case weights
+// given by a call to weights, so that a weighted least squares fit
+// is an ordinary least squares fit of the scaled columns.
+type WeightScaling int
+
+const (
+	// NoWeightScaling leaves the columns unscaled.  This is the
+	// default.
+	NoWeightScaling WeightScaling = iota
+
+	// AbsoluteWeights multiplies each row by the square root of
+	// its weight.
+	AbsoluteWeights
+
+	// RelativeWeights multiplies each row by the square root of
+	// its weight divided by the mean weight of the data that the
+	// codes were learned from, so that the scaling factors do not
+	// depend on the units of the weights, and are the same for
+	// new data, e.g. given to WithData.  Streams only support
+	// RelativeWeights with codes in Config.Codes.
+	RelativeWeights
+)
+
+// fitMeanWeight learns the mean weight of the parser's data, if the
+// weights are scaled by RelativeWeights.
+func (fp *Parser) fitMeanWeight() error {
+
+	if fp.weightScaling != RelativeWeights {
+		return nil
+	}
+
+	p := fp.WithData(fp.RawData)
+	p.weightScaling = NoWeightScaling
+	if _, err := p.Parse(); err != nil {
+		return err
+	}
+	if p.weights == nil {
+		return fmt.Errorf("Weight scaling requires a call to weights in the formulas")
+	}
+
+	var sum float64
+	var n int
+	for _, w := range p.weights {
+		if !math.IsNaN(w) {
+			sum += w
+			n++
+		}
+	}
+	if n == 0 || sum <= 0 {
+		return fmt.Errorf("The weights have no positive mean")
+	}
+	fp.meanWeight = sum / float64(n)
+
+	return nil
+}
+
+// scaleByWeights multiplies the rows of the design matrix and the
+// responses by the square roots of the weights, according to the
+// weight scaling policy.  The offsets and the weights are not
+// scaled.
+func (fp *Parser) scaleByWeights() error {
+
+	if fp.weightScaling == NoWeightScaling {
+		return nil
+	}
+	if fp.weights == nil {
+		return fmt.Errorf("Weight scaling requires a call to weights in the formulas")
+	}
+
+	f := make([]float64, len(fp.weights))
+	for i, w := range fp.weights {
+		if w < 0 {
+			return fmt.Errorf("The weight %v in row %d is negative", w, i)
+		}
+		if fp.weightScaling == RelativeWeights {
+			w /= fp.meanWeight
+		}
+		f[i] = math.Sqrt(w)
+	}
+
+	// The columns may be shared with the data or with other
+	// columns, so they are scaled into new slices
+	scale := func(cs *ColSet) {
+		for j, x := range cs.data {
+			y := make([]float64, len(x))
+			for i := range x {
+				y[i] = f[i] * x[i]
+			}
+			cs.data[j] = y
+		}
+	}
+	scale(fp.data)
+	if fp.response != nil {
+		scale(fp.response)
+	}
+
+	return nil
+}
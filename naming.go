@@ -0,0 +1,106 @@
+package formula
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// ColumnMeta describes a column produced by a function in a formula.
+// A function that returns its columns with NewColSetMeta leaves the
+// naming of the columns to the parser, which constructs the names
+// from Config.NameTemplate.
+type ColumnMeta struct {
+
+	// Base is the text of the function call, e.g. "pbase(x1)",
+	// which is passed to the function as its name argument.
+	Base string
+
+	// Component identifies the column among the columns produced
+	// by the call, e.g. "2" for the square in a polynomial basis.
+	// It is empty if the call produces a single column.
+	Component string
+
+	// Params holds other parameters of the column, e.g. the knot
+	// of a spline basis function, keyed by name.
+	Params map[string]string
+}
+
+// DefaultNameTemplate is the template used to name the columns
+// described by a ColumnMeta when Config.NameTemplate is empty, which
+// gives names such as "pbase(x1)[2]".
+const DefaultNameTemplate = "{{.Base}}{{if .Component}}[{{.Component}}]{{end}}"
+
+var defaultNameTemplate = template.Must(template.New("name").Parse(DefaultNameTemplate))
+
+// NewColSetMeta returns a ColSet holding columns described by meta.
+// The columns are named with DefaultNameTemplate, and renamed with
+// Config.NameTemplate when the ColSet is returned by a function in a
+// formula.
+func NewColSetMeta(meta []ColumnMeta, data [][]float64) *ColSet {
+
+	names, err := metaNames(defaultNameTemplate, meta)
+	if err != nil {
+		panic(err)
+	}
+
+	return &ColSet{
+		names: names,
+		data:  data,
+		meta:  meta,
+	}
+}
+
+// metaNames returns the names of the columns described by meta,
+// constructed from the template.
+func metaNames(tmpl *template.Template, meta []ColumnMeta) ([]string, error) {
+
+	names := make([]string, len(meta))
+	var buf strings.Builder
+	for j, m := range meta {
+		buf.Reset()
+		if err := tmpl.Execute(&buf, m); err != nil {
+			return nil, err
+		}
+		names[j] = buf.String()
+	}
+
+	return names, nil
+}
+
+// parseNameTemplate parses Config.NameTemplate, returning an error if
+// it is not a valid template.
+func (fp *Parser) parseNameTemplate() error {
+
+	fp.nameTmpl = defaultNameTemplate
+	if fp.nameTemplate == "" {
+		return nil
+	}
+
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(fp.nameTemplate)
+	if err != nil {
+		return err
+	}
+	fp.nameTmpl = tmpl
+
+	return nil
+}
+
+// funcNames returns the names of the columns returned by a function,
+// constructed from the name template for columns with metadata.
+func (fp *Parser) funcNames(cs *ColSet) ([]string, error) {
+
+	if cs.meta == nil {
+		return cs.names, nil
+	}
+	if len(cs.meta) != len(cs.data) {
+		return nil, fmt.Errorf("the column metadata does not match the columns")
+	}
+
+	tmpl := fp.nameTmpl
+	if tmpl == nil {
+		tmpl = defaultNameTemplate
+	}
+
+	return metaNames(tmpl, cs.meta)
+}
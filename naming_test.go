@@ -0,0 +1,70 @@
+package formula
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestNameTemplate(t *testing.T) {
+
+	// The first two powers of a variable
+	pbase := func(na string, x []float64) *ColSet {
+		var meta []ColumnMeta
+		var data [][]float64
+		for k := 1; k <= 2; k++ {
+			y := make([]float64, len(x))
+			for i := range x {
+				y[i] = x[i]
+				if k == 2 {
+					y[i] *= x[i]
+				}
+			}
+			meta = append(meta, ColumnMeta{Base: na, Component: fmt.Sprint(k), Params: map[string]string{"degree": fmt.Sprint(k)}})
+			data = append(data, y)
+		}
+		return NewColSetMeta(meta, data)
+	}
+
+	for _, tc := range []struct {
+		tmpl  string
+		names string
+	}{
+		{"", "[pbase(x1)[1] pbase(x1)[2] x4]"},
+		{"{{.Base}}^{{.Component}}", "[pbase(x1)^1 pbase(x1)^2 x4]"},
+		{"{{.Base}}_deg{{.Params.degree}}", "[pbase(x1)_deg1 pbase(x1)_deg2 x4]"},
+	} {
+		config := &Config{Funcs: map[string]Func{"pbase": pbase}, NameTemplate: tc.tmpl}
+		fp, err := New("pbase(x1) + x4", simpleData(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cols, err := fp.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(cols.Names()) != tc.names {
+			t.Errorf("Expected %s, observed %v", tc.names, cols.Names())
+		}
+		x, err := cols.Get(cols.Names()[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(x) != "[0 1 4 9 16]" {
+			t.Errorf("Unexpected data %v", x)
+		}
+	}
+
+	// Invalid templates
+	config := &Config{Funcs: map[string]Func{"pbase": pbase}, NameTemplate: "{{.Base"}
+	if _, err := New("pbase(x1)", simpleData(), config); err == nil {
+		t.Errorf("Expected an error for an invalid template")
+	}
+	config.NameTemplate = "{{.Params.knot}}"
+	fp, err := New("pbase(x1)", simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.Parse(); err == nil {
+		t.Errorf("Expected an error for a missing parameter")
+	}
+}
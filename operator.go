@@ -0,0 +1,144 @@
+package formula
+
+import (
+	"fmt"
+	"io"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// Operator represents the design matrix produced by applying formulas
+// to a chunked dataset as a linear operator.  Products of the matrix
+// and its transpose with a vector are computed one chunk at a time,
+// so the matrix is never held in memory.  This allows iterative
+// solvers such as conjugate gradients or LSQR to be used with designs
+// that are too large to materialize.
+type Operator struct {
+	formulas []string
+	chunks   ChunkSource
+	config   *Config
+
+	// The state of the stream after the codes are fit
+	fitted *Checkpoint
+
+	rows int
+	cols int
+}
+
+// NewOperator returns an Operator for the design matrix produced by
+// applying the formulas to the chunks.  The data are read twice, once
+// to determine the categorical codes and once to determine the
+// dimensions of the design matrix.
+func NewOperator(formulas []string, chunks ChunkSource, config *Config) (*Operator, error) {
+
+	s, err := NewStream(formulas, chunks, config)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Fit(); err != nil {
+		return nil, err
+	}
+
+	op := &Operator{
+		formulas: formulas,
+		chunks:   chunks,
+		config:   config,
+		fitted:   s.Checkpoint(),
+		cols:     -1,
+	}
+
+	err = op.each(func(_ int, cs *ColSet) error {
+		if op.cols == -1 {
+			op.cols = len(cs.data)
+		} else if len(cs.data) != op.cols {
+			return fmt.Errorf("NewOperator: chunk has %d columns, expected %d", len(cs.data), op.cols)
+		}
+		op.rows += numRowsColSet(cs)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if op.cols == -1 {
+		op.cols = 0
+	}
+
+	return op, nil
+}
+
+// Dims returns the number of rows and columns of the design matrix.
+func (op *Operator) Dims() (r, c int) {
+	return op.rows, op.cols
+}
+
+// each calls f with the design matrix of each chunk in turn, along
+// with the index of the first row of the chunk in the full design
+// matrix.
+func (op *Operator) each(f func(int, *ColSet) error) error {
+
+	s, err := ResumeStream(op.formulas, op.chunks, op.config, op.fitted)
+	if err != nil {
+		return err
+	}
+
+	var row int
+	for {
+		cs, err := s.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := f(row, cs); err != nil {
+			return err
+		}
+		row += numRowsColSet(cs)
+	}
+}
+
+// MulVecTo computes X·x if trans is false, or Xᵀ·x if trans is true,
+// where X is the design matrix, and stores the result in dst.  If dst
+// is empty it is resized, otherwise it must have the correct length.
+func (op *Operator) MulVecTo(dst *mat.VecDense, trans bool, x mat.Vector) error {
+
+	n, m := op.cols, op.rows
+	if trans {
+		n, m = m, n
+	}
+	if x.Len() != n {
+		return fmt.Errorf("MulVecTo: vector has length %d, expected %d", x.Len(), n)
+	}
+	if m == 0 {
+		return nil
+	}
+	if dst.IsEmpty() {
+		*dst = *mat.NewVecDense(m, nil)
+	} else if dst.Len() != m {
+		return fmt.Errorf("MulVecTo: destination has length %d, expected %d", dst.Len(), m)
+	}
+	dst.Zero()
+
+	return op.each(func(row int, cs *ColSet) error {
+		if len(cs.data) != op.cols || numRowsColSet(cs) > op.rows-row {
+			return fmt.Errorf("MulVecTo: the data have changed since the operator was created")
+		}
+		for j, v := range cs.data {
+			for i, z := range v {
+				if trans {
+					dst.SetVec(j, dst.AtVec(j)+z*x.AtVec(row+i))
+				} else {
+					dst.SetVec(row+i, dst.AtVec(row+i)+z*x.AtVec(j))
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// numRowsColSet returns the number of rows in a ColSet.
+func numRowsColSet(cs *ColSet) int {
+	if len(cs.data) == 0 {
+		return 0
+	}
+	return len(cs.data[0])
+}
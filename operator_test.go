@@ -0,0 +1,65 @@
+package formula
+
+import (
+	"testing"
+
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+func TestOperator(t *testing.T) {
+
+	formulas := []string{"x1 + x2 + x3*x4"}
+	config := &Config{RefLevels: map[string]string{"x3": "a"}}
+
+	fp, err := NewMulti(formulas, simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	xd := full.ToDense()
+
+	op, err := NewOperator(formulas, chunkedData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, c := op.Dims()
+	if r != 5 || c != 4 {
+		t.Fatalf("Dims are %d x %d, expected 5 x 4", r, c)
+	}
+
+	v := mat.NewVecDense(4, []float64{1, -2, 0.5, 3})
+	var exp, obs mat.VecDense
+	exp.MulVec(xd, v)
+	if err := op.MulVecTo(&obs, false, v); err != nil {
+		t.Fatal(err)
+	}
+	if !floats.EqualApprox(exp.RawVector().Data, obs.RawVector().Data, 1e-12) {
+		t.Errorf("Expected %v, observed %v", exp.RawVector().Data, obs.RawVector().Data)
+	}
+
+	u := mat.NewVecDense(5, []float64{1, 2, 3, -1, 0.5})
+	var expT, obsT mat.VecDense
+	expT.MulVec(xd.T(), u)
+	if err := op.MulVecTo(&obsT, true, u); err != nil {
+		t.Fatal(err)
+	}
+	if !floats.EqualApprox(expT.RawVector().Data, obsT.RawVector().Data, 1e-12) {
+		t.Errorf("Expected %v, observed %v", expT.RawVector().Data, obsT.RawVector().Data)
+	}
+
+	// The destination is reused
+	if err := op.MulVecTo(&obsT, true, u); err != nil {
+		t.Fatal(err)
+	}
+	if !floats.EqualApprox(expT.RawVector().Data, obsT.RawVector().Data, 1e-12) {
+		t.Fail()
+	}
+
+	if err := op.MulVecTo(&obs, false, u); err == nil {
+		t.Fail()
+	}
+}
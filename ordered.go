@@ -0,0 +1,124 @@
+package formula
+
+import (
+	"fmt"
+	"math"
+)
+
+// contrast returns the contrast used to code the categorical variable
+// or call with the given name.
+func (fp *Parser) contrast(na string) Contrast {
+
+	if c, ok := fp.contrasts[na]; ok {
+		return c
+	}
+	if _, ok := fp.ordered[na]; ok {
+		return PolyContrast
+	}
+
+	return TreatmentContrast
+}
+
+// declaredLevels returns the levels of the categorical variable na
+// that are coded before the levels found in the data, which are those
+// in Config.Levels followed by those in Config.Ordered, so that an
+// ordered variable is coded in its declared order with any contrast.
+// Ordered variables with polynomial contrasts are not coded by their
+// levels.
+func (fp *Parser) declaredLevels(na string) []string {
+
+	levels := fp.levels[na]
+	if fp.contrast(na) == PolyContrast {
+		return levels
+	}
+	for _, x := range fp.ordered[na] {
+		if find(levels, x) == -1 {
+			levels = append(levels, x)
+		}
+	}
+
+	return levels
+}
+
+// codePoly returns the polynomial contrast columns of the ordered
+// categorical variable na with values s.
+func (fp *Parser) codePoly(na string, s []string) *ColSet {
+
+	levels := fp.ordered[na]
+	pos := make(map[string]int)
+	for k, x := range levels {
+		pos[x] = k
+	}
+	poly := polyContrasts(len(levels))
+
+	cs := new(ColSet)
+	v := &origin{op: "variable", name: na}
+	for d, p := range poly {
+		x := make([]float64, len(s))
+		for i, y := range s {
+			if k, ok := pos[y]; ok {
+				x[i] = p[k]
+			}
+		}
+		label := polyLabel(d + 1)
+		cna := fmt.Sprintf("%s[%s]", na, label)
+		cs.names = append(cs.names, cna)
+		cs.data = append(cs.data, x)
+		cs.origins = append(cs.origins, &origin{op: "contrast", detail: label, name: cna, inputs: []*origin{v}})
+	}
+
+	return cs
+}
+
+// polyContrasts returns the orthonormal polynomials of degrees 1, ...,
+// k-1 evaluated at 1, ..., k, which are orthogonal to the constant
+// and have positive leading coefficients.
+func polyContrasts(k int) [][]float64 {
+
+	// Gram-Schmidt orthogonalization of the powers of the
+	// centered positions
+	basis := [][]float64{make([]float64, k)}
+	for i := range basis[0] {
+		basis[0][i] = 1 / math.Sqrt(float64(k))
+	}
+	for d := 1; d < k; d++ {
+		x := make([]float64, k)
+		for i := range x {
+			x[i] = math.Pow(float64(i)-float64(k-1)/2, float64(d))
+		}
+		for _, b := range basis {
+			var ip float64
+			for i := range x {
+				ip += x[i] * b[i]
+			}
+			for i := range x {
+				x[i] -= ip * b[i]
+			}
+		}
+		var nrm float64
+		for _, y := range x {
+			nrm += y * y
+		}
+		nrm = math.Sqrt(nrm)
+		for i := range x {
+			x[i] /= nrm
+		}
+		basis = append(basis, x)
+	}
+
+	return basis[1:]
+}
+
+// polyLabel returns the label of the polynomial contrast of degree d.
+func polyLabel(d int) string {
+	switch d {
+	case 1:
+		return ".L"
+	case 2:
+		return ".Q"
+	case 3:
+		return ".C"
+	default:
+		return fmt.Sprintf("^%d", d)
+	}
+}
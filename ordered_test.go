@@ -0,0 +1,106 @@
+package formula
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPolyContrasts(t *testing.T) {
+
+	// The contrasts of R's contr.poly(4)
+	s5 := math.Sqrt(5)
+	exp := [][]float64{
+		{-3 / (2 * s5), -1 / (2 * s5), 1 / (2 * s5), 3 / (2 * s5)},
+		{0.5, -0.5, -0.5, 0.5},
+		{-1 / (2 * s5), 3 / (2 * s5), -3 / (2 * s5), 1 / (2 * s5)},
+	}
+	poly := polyContrasts(4)
+	for d := range exp {
+		for i := range exp[d] {
+			if math.Abs(poly[d][i]-exp[d][i]) > 1e-12 {
+				t.Errorf("degree %d: expected %v, found %v", d+1, exp[d], poly[d])
+				break
+			}
+		}
+	}
+}
+
+func TestOrdered(t *testing.T) {
+
+	names := []string{"dose"}
+	data := []interface{}{[]string{"low", "high", "mid", "none", "low"}}
+	config := &Config{
+		Ordered: map[string][]string{"dose": {"low", "mid", "high"}},
+	}
+	fp, err := New("dose", mustSource(data, names), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := 1 / math.Sqrt(2)
+	q := 1 / math.Sqrt(6)
+	exp := &ColSet{
+		names: []string{"dose[.L]", "dose[.Q]"},
+		data: [][]float64{
+			{-r, r, 0, 0, -r},
+			{q, q, -2 * q, 0, q},
+		},
+	}
+	if ok, diff := exp.EqualTol(cols, 1e-12); !ok {
+		t.Errorf("%v", diff)
+	}
+
+	config.Ordered["dose"] = []string{"low", "low"}
+	if _, err := New("dose", mustSource(data, names), config); err == nil {
+		t.Errorf("repeated ordered levels should fail")
+	}
+}
+
+func TestOrderedContrasts(t *testing.T) {
+
+	// The data are not in the declared order, nor in sorted order
+	names := []string{"dose"}
+	data := []interface{}{[]string{"high", "mid", "low", "mid"}}
+
+	for _, c := range []Contrast{TreatmentContrast, SumContrast, HelmertContrast} {
+		for _, policy := range []RefPolicy{RefExplicit, RefFirst} {
+			config := &Config{
+				Ordered:   map[string][]string{"dose": {"low", "mid", "high"}},
+				Contrasts: map[string]Contrast{"dose": c},
+				RefPolicy: policy,
+
+				// The ordered levels are not pooled
+				MinLevelCount: 2,
+			}
+			if policy == RefExplicit {
+				config.RefLevels = map[string]string{"dose": "low"}
+			}
+			fp, err := New("dose", mustSource(data, names), config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cols, err := fp.Parse()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			exp := &ColSet{names: []string{"dose[mid]", "dose[high]"}}
+			switch c {
+			case TreatmentContrast:
+				exp.data = [][]float64{{0, 1, 0, 1}, {1, 0, 0, 0}}
+			case SumContrast:
+				exp.data = [][]float64{{0, 1, -1, 1}, {1, 0, -1, 0}}
+			case HelmertContrast:
+				exp.names = []string{"dose[H.mid]", "dose[H.high]"}
+				exp.data = [][]float64{{0, 1, -1, 1}, {2, -1, -1, -1}}
+			}
+			if !colSetEq(exp, cols) {
+				t.Errorf("%d, %d:\nExpected: %v\nObserved: %v\n", c, policy, exp, cols)
+			}
+		}
+	}
+}
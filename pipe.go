@@ -0,0 +1,115 @@
+package formula
+
+// The pipe operator |> passes the term on its left as the first
+// argument of the function on its right, so that x |> log |> center
+// is equivalent to center(log(x)), and x |> cut(0.5, "high") is
+// equivalent to cut(x, 0.5, "high").  The left operand is a variable,
+// a function call or a parenthesized expression, i.e. the pipe binds
+// more tightly than any other operator.
+
+// lexPipes rewrites each use of the pipe operator as a function call.
+func lexPipes(input []*token) ([]*token, error) {
+
+	var output []*token
+	for i := 0; i < len(input); i++ {
+		tok := input[i]
+		if tok.symbol != pipe {
+			output = append(output, tok)
+			continue
+		}
+
+		// The left operand
+		start := operandStart(output)
+		if start == -1 {
+			return nil, syntaxError("", tok.pos, "missing operand before '|>'")
+		}
+		left := append([]*token(nil), output[start:]...)
+		output = output[0:start]
+		if left[0].symbol == leftp {
+			// A parenthesized expression is the argument
+			left = left[1 : len(left)-1]
+		}
+
+		// The function, possibly with further arguments
+		if i+1 >= len(input) || input[i+1].symbol != vname {
+			return nil, syntaxError("", tok.pos, "'|>' must be followed by a function name")
+		}
+		fn := input[i+1]
+		i++
+		var args []*token
+		if i+1 < len(input) && input[i+1].symbol == leftp {
+			end := closingParen(input, i+1)
+			if end == -1 {
+				return nil, syntaxError("", input[i+1].pos, "unbalanced parentheses")
+			}
+			args = input[i+2 : end]
+			i = end
+		}
+
+		output = append(output, fn, &token{symbol: leftp, pos: tok.pos})
+		output = append(output, left...)
+		if len(args) > 0 {
+			output = append(output, &token{symbol: comma, pos: tok.pos})
+			output = append(output, args...)
+		}
+		output = append(output, &token{symbol: rightp, pos: tok.pos})
+	}
+
+	return output, nil
+}
+
+// operandStart returns the position of the first token of the operand
+// at the end of tokens, which is a single token, a parenthesized
+// expression, or a function call.  -1 is returned if tokens does not
+// end with an operand.
+func operandStart(tokens []*token) int {
+
+	n := len(tokens)
+	if n == 0 {
+		return -1
+	}
+
+	switch tokens[n-1].symbol {
+	case vname, number, icept, noicept, dot:
+		return n - 1
+	case rightp:
+		depth := 0
+		for j := n - 1; j >= 0; j-- {
+			switch tokens[j].symbol {
+			case rightp:
+				depth++
+			case leftp:
+				depth--
+			}
+			if depth == 0 {
+				if j > 0 && tokens[j-1].symbol == vname {
+					// A function call
+					return j - 1
+				}
+				return j
+			}
+		}
+	}
+
+	return -1
+}
+
+// closingParen returns the position of the right parenthesis matching
+// the left parenthesis at position i, or -1 if there is none.
+func closingParen(tokens []*token, i int) int {
+
+	depth := 0
+	for j := i; j < len(tokens); j++ {
+		switch tokens[j].symbol {
+		case leftp:
+			depth++
+		case rightp:
+			depth--
+		}
+		if depth == 0 {
+			return j
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,64 @@
+package formula
+
+import (
+	"testing"
+)
+
+func TestPipe(t *testing.T) {
+
+	config := &Config{
+		Funcs: map[string]Func{
+			"neg": func(na string, x []float64) *ColSet {
+				y := make([]float64, len(x))
+				for i := range x {
+					y[i] = -x[i]
+				}
+				return NewColSet([]string{na}, [][]float64{y})
+			},
+		},
+		MultiFuncs: map[string]MultiFunc{
+			"shift": func(c *Call) (*ColSet, error) {
+				y := make([]float64, len(c.Args[0]))
+				for i, v := range c.Args[0] {
+					y[i] = v + c.Params[0].(float64)
+				}
+				return NewColSet([]string{c.Name}, [][]float64{y}), nil
+			},
+		},
+	}
+
+	for _, tc := range []struct {
+		fml   string
+		equiv string
+	}{
+		{"x1 |> neg |> shift(2)", "shift(neg(x1), 2)"},
+		{"x4 + (x1 + x4) |> neg:x3", "x4 + neg(x1 + x4):x3"},
+		{"shift(x1, 1) |> neg + I(x1 + 1)|>neg", "neg(shift(x1, 1)) + neg(I(x1 + 1))"},
+	} {
+		fp, err := New(tc.fml, simpleData(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cols, err := fp.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fp, err = New(tc.equiv, simpleData(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exp, err := fp.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, diff := exp.EqualTol(cols, 0); !ok {
+			t.Errorf("%s: %s", tc.fml, diff)
+		}
+	}
+
+	for _, fml := range []string{"|> neg", "x1 + |> neg", "x1 |> (neg)", "x1 |>"} {
+		if _, err := New(fml, simpleData(), config); err == nil {
+			t.Errorf("%s should fail", fml)
+		}
+	}
+}
@@ -0,0 +1,399 @@
+package formula
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+)
+
+// A Pipeline chains fitted feature engineering steps: steps that
+// transform the raw data, e.g. an imputer, the formulas that produce
+// the design matrix, and steps that transform the design matrix, e.g.
+// a scaler.  Fit learns the parameters of all the steps from training
+// data, and Transform applies them to new data.  The learned
+// parameters can be written with Save and restored with Load into a
+// Pipeline constructed in the same way, e.g. in a scoring service.
+type Pipeline struct {
+
+	// Pre are the steps applied to the raw data, in order.
+	Pre []DataStep
+
+	// Formula produces the design matrix.
+	Formula *FormulaStep
+
+	// Post are the steps applied to the design matrix, in order.
+	Post []ColSetStep
+}
+
+// DataStep is a step of a Pipeline that transforms the raw data.  Its
+// learned parameters are saved as JSON, so they must be exported
+// fields or be handled by MarshalJSON and UnmarshalJSON methods.
+type DataStep interface {
+
+	// Fit learns the parameters of the step from the data.
+	Fit(DataSource) error
+
+	// Transform applies the fitted step to the data.
+	Transform(DataSource) (DataSource, error)
+}
+
+// ColSetStep is a step of a Pipeline that transforms the design
+// matrix.  Its learned parameters are saved as JSON, as for a
+// DataStep.
+type ColSetStep interface {
+
+	// Fit learns the parameters of the step from the design
+	// matrix.
+	Fit(*ColSet) error
+
+	// Transform applies the fitted step to the design matrix.
+	Transform(*ColSet) (*ColSet, error)
+}
+
+// Fit learns the parameters of the steps of the pipeline from the
+// data, and returns the transformed design matrix of the data.
+func (p *Pipeline) Fit(src DataSource) (*ColSet, error) {
+
+	if p.Formula == nil {
+		return nil, fmt.Errorf("Pipeline: no formula step")
+	}
+
+	for k, step := range p.Pre {
+		if err := step.Fit(src); err != nil {
+			return nil, fmt.Errorf("Pipeline: step %d: %v", k, err)
+		}
+		var err error
+		src, err = step.Transform(src)
+		if err != nil {
+			return nil, fmt.Errorf("Pipeline: step %d: %v", k, err)
+		}
+	}
+
+	if err := p.Formula.Fit(src); err != nil {
+		return nil, fmt.Errorf("Pipeline: %v", err)
+	}
+	cs, err := p.Formula.Transform(src)
+	if err != nil {
+		return nil, fmt.Errorf("Pipeline: %v", err)
+	}
+
+	for k, step := range p.Post {
+		if err := step.Fit(cs); err != nil {
+			return nil, fmt.Errorf("Pipeline: step %d: %v", len(p.Pre)+1+k, err)
+		}
+		cs, err = step.Transform(cs)
+		if err != nil {
+			return nil, fmt.Errorf("Pipeline: step %d: %v", len(p.Pre)+1+k, err)
+		}
+	}
+
+	return cs, nil
+}
+
+// Transform applies the fitted steps of the pipeline to the data, and
+// returns the design matrix.
+func (p *Pipeline) Transform(src DataSource) (*ColSet, error) {
+
+	if p.Formula == nil {
+		return nil, fmt.Errorf("Pipeline: no formula step")
+	}
+
+	for k, step := range p.Pre {
+		var err error
+		src, err = step.Transform(src)
+		if err != nil {
+			return nil, fmt.Errorf("Pipeline: step %d: %v", k, err)
+		}
+	}
+
+	cs, err := p.Formula.Transform(src)
+	if err != nil {
+		return nil, fmt.Errorf("Pipeline: %v", err)
+	}
+
+	for k, step := range p.Post {
+		cs, err = step.Transform(cs)
+		if err != nil {
+			return nil, fmt.Errorf("Pipeline: step %d: %v", len(p.Pre)+1+k, err)
+		}
+	}
+
+	return cs, nil
+}
+
+// pipelineState is the saved form of the learned parameters of a
+// Pipeline.
+type pipelineState struct {
+	Pre     []json.RawMessage
+	Formula json.RawMessage
+	Post    []json.RawMessage
+}
+
+// Save writes the learned parameters of the steps of the pipeline to w
+// as JSON.
+func (p *Pipeline) Save(w io.Writer) error {
+
+	var st pipelineState
+	for _, step := range p.Pre {
+		b, err := json.Marshal(step)
+		if err != nil {
+			return err
+		}
+		st.Pre = append(st.Pre, b)
+	}
+	b, err := json.Marshal(p.Formula)
+	if err != nil {
+		return err
+	}
+	st.Formula = b
+	for _, step := range p.Post {
+		b, err := json.Marshal(step)
+		if err != nil {
+			return err
+		}
+		st.Post = append(st.Post, b)
+	}
+
+	return json.NewEncoder(w).Encode(&st)
+}
+
+// Load reads parameters written by Save into the steps of the
+// pipeline, which must be the same steps as those of the saved
+// pipeline, so that Transform can be called without calling Fit.
+func (p *Pipeline) Load(r io.Reader) error {
+
+	var st pipelineState
+	if err := json.NewDecoder(r).Decode(&st); err != nil {
+		return err
+	}
+	if len(st.Pre) != len(p.Pre) || len(st.Post) != len(p.Post) || p.Formula == nil {
+		return fmt.Errorf("Pipeline: the saved steps do not match the steps of the pipeline")
+	}
+
+	for k, step := range p.Pre {
+		if err := json.Unmarshal(st.Pre[k], step); err != nil {
+			return fmt.Errorf("Pipeline: step %d: %v", k, err)
+		}
+	}
+	if err := json.Unmarshal(st.Formula, p.Formula); err != nil {
+		return fmt.Errorf("Pipeline: %v", err)
+	}
+	for k, step := range p.Post {
+		if err := json.Unmarshal(st.Post[k], step); err != nil {
+			return fmt.Errorf("Pipeline: step %d: %v", len(p.Pre)+1+k, err)
+		}
+	}
+
+	return nil
+}
+
+// FormulaStep is the step of a Pipeline that applies formulas to the
+// data.  Fit learns the categorical codes and the other parameters of
+// the parser from the data, see WithData.
+type FormulaStep struct {
+	Formulas []string
+	Config   *Config
+
+	// The parser fitted to the training data
+	fp *Parser
+}
+
+// Fit learns the parameters of the parser from the data.  Functions
+// producing blocks that are rescaled by Config.BlockScaling are
+// evaluated on the data.
+func (f *FormulaStep) Fit(src DataSource) error {
+
+	fp, err := NewMulti(f.Formulas, src, f.Config)
+	if err != nil {
+		return err
+	}
+	if fp.blockScaling != NoBlockScaling {
+		if _, err := fp.Parse(); err != nil {
+			return err
+		}
+	}
+	f.fp = fp
+
+	return nil
+}
+
+// Transform returns the design matrix for the data.
+func (f *FormulaStep) Transform(src DataSource) (*ColSet, error) {
+
+	if f.fp == nil {
+		return nil, fmt.Errorf("the formula step has not been fit")
+	}
+
+	return f.fp.WithData(src).Parse()
+}
+
+// Parser returns the parser fitted by Fit or restored by Load, or nil.
+func (f *FormulaStep) Parser() *Parser {
+	return f.fp
+}
+
+// MarshalJSON implements json.Marshaler, encoding the parameters that
+// the parser learned from the data.
+func (f *FormulaStep) MarshalJSON() ([]byte, error) {
+
+	if f.fp == nil {
+		return nil, fmt.Errorf("the formula step has not been fit")
+	}
+
+	return json.Marshal(f.fp.Codes())
+}
+
+// UnmarshalJSON implements json.Unmarshaler, restoring a parser for
+// the formulas and configuration of the step with the parameters
+// encoded by MarshalJSON.
+func (f *FormulaStep) UnmarshalJSON(b []byte) error {
+
+	var c Codes
+	if err := json.Unmarshal(b, &c); err != nil {
+		return err
+	}
+
+	fp := &Parser{Formulas: f.Formulas}
+	fp.configure(f.Config)
+	if err := fp.compile(); err != nil {
+		return err
+	}
+	if err := fp.validate(); err != nil {
+		return err
+	}
+	fp.setFitted(&c)
+	f.fp = fp
+
+	return nil
+}
+
+// MeanImputer is a DataStep that replaces the missing values (NaN) of
+// numeric variables by their means in the training data.
+type MeanImputer struct {
+
+	// Vars are the variables to impute, or all the numeric
+	// variables if empty.
+	Vars []string
+
+	// Means are the learned means.
+	Means map[string]float64
+}
+
+// Fit learns the means of the variables.
+func (m *MeanImputer) Fit(src DataSource) error {
+
+	names := m.Vars
+	if len(names) == 0 {
+		names = src.Names()
+	}
+
+	m.Means = make(map[string]float64)
+	for _, na := range names {
+		switch x := src.Get(na).(type) {
+		case []float64:
+			// Variables with no observed values are not
+			// imputed
+			if mean, _ := meanSD(x); !math.IsNaN(mean) {
+				m.Means[na] = mean
+			}
+		case nil:
+			return fmt.Errorf("MeanImputer: variable '%s' not found", na)
+		default:
+			if len(m.Vars) > 0 {
+				return fmt.Errorf("MeanImputer: variable '%s' is not numeric", na)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Transform returns the data with the missing values of the variables
+// replaced by their means.  The other variables are not copied.
+func (m *MeanImputer) Transform(src DataSource) (DataSource, error) {
+	return &imputedSource{DataSource: src, means: m.Means}, nil
+}
+
+// imputedSource is a DataSource whose numeric variables have their
+// missing values replaced.
+type imputedSource struct {
+	DataSource
+	means map[string]float64
+}
+
+// Get returns the data for one variable.
+func (s *imputedSource) Get(na string) interface{} {
+
+	v := s.DataSource.Get(na)
+	mean, ok := s.means[na]
+	x, isNum := v.([]float64)
+	if !ok || !isNum {
+		return v
+	}
+
+	y := make([]float64, len(x))
+	for i, u := range x {
+		if math.IsNaN(u) {
+			u = mean
+		}
+		y[i] = u
+	}
+
+	return y
+}
+
+// Version returns the version of a variable of the underlying source,
+// if it reports versions.
+func (s *imputedSource) Version(na string) string {
+	return sourceVersion(s.DataSource, na)
+}
+
+// Standardizer is a ColSetStep that centers and scales the columns of
+// the design matrix by their means and standard deviations in the
+// training data.  Columns that are constant in the training data, e.g.
+// an intercept, are not changed.
+type Standardizer struct {
+
+	// Offsets and Scales are the learned means and standard
+	// deviations of the columns.
+	Offsets map[string]float64
+	Scales  map[string]float64
+}
+
+// Fit learns the means and standard deviations of the columns.
+func (s *Standardizer) Fit(cs *ColSet) error {
+
+	s.Offsets = make(map[string]float64)
+	s.Scales = make(map[string]float64)
+	for j, na := range cs.names {
+		mean, sd := meanSD(cs.data[j])
+		if !(sd > 0) {
+			mean, sd = 0, 1
+		}
+		s.Offsets[na] = mean
+		s.Scales[na] = sd
+	}
+
+	return nil
+}
+
+// Transform returns the standardized design matrix.
+func (s *Standardizer) Transform(cs *ColSet) (*ColSet, error) {
+
+	rslt := &ColSet{names: cs.names, terms: cs.terms, origins: cs.origins, meta: cs.meta, rows: cs.rows, ids: cs.ids}
+	for j, na := range cs.names {
+		scale, ok := s.Scales[na]
+		if !ok {
+			return nil, fmt.Errorf("Standardizer: column '%s' was not present when fitting", na)
+		}
+		offset := s.Offsets[na]
+		y := make([]float64, len(cs.data[j]))
+		for i, v := range cs.data[j] {
+			y[i] = (v - offset) / scale
+		}
+		rslt.data = append(rslt.data, y)
+	}
+
+	return rslt, nil
+}
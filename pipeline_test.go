@@ -0,0 +1,77 @@
+package formula
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestPipeline(t *testing.T) {
+
+	names := []string{"x1", "x3"}
+	train := mustSource([]interface{}{
+		[]float64{1, math.NaN(), 3, 5},
+		[]string{"a", "b", "a", "b"},
+	}, names)
+	test := mustSource([]interface{}{
+		[]float64{math.NaN(), 5},
+		[]string{"b", "a"},
+	}, names)
+
+	newPipeline := func() *Pipeline {
+		config := &Config{RefLevels: map[string]string{"x3": "a"}}
+		return &Pipeline{
+			Pre:     []DataStep{new(MeanImputer)},
+			Formula: &FormulaStep{Formulas: []string{"1 + x1 + x3"}, Config: config},
+			Post:    []ColSetStep{new(Standardizer)},
+		}
+	}
+
+	p := newPipeline()
+	cs, err := p.Fit(train)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The mean of x1 is 3, and its standard deviation is sqrt(2)
+	// after imputation
+	s2 := math.Sqrt(2)
+	exp := &ColSet{
+		names: []string{"icept", "x1", "x3[b]"},
+		data: [][]float64{
+			{1, 1, 1, 1},
+			{-s2, 0, 0, s2},
+			{-1, 1, -1, 1},
+		},
+	}
+	if ok, diff := exp.EqualTol(cs, 1e-12); !ok {
+		t.Errorf("%v", diff)
+	}
+
+	cs1, err := p.Transform(test)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A pipeline restored from the saved parameters transforms
+	// the data in the same way
+	var buf bytes.Buffer
+	if err := p.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	q := newPipeline()
+	if err := q.Load(&buf); err != nil {
+		t.Fatal(err)
+	}
+	cs2, err := q.Transform(test)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, diff := cs1.EqualTol(cs2, 0); !ok {
+		t.Errorf("%v", diff)
+	}
+
+	if _, err := newPipeline().Transform(test); err == nil {
+		t.Errorf("Transform before Fit should fail")
+	}
+}
@@ -0,0 +1,97 @@
+package formula
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// poolLevels replaces the levels of the categorical variables that
+// occur fewer than Config.MinLevelCount times, or in less than the
+// fraction Recipe.MinLevelFraction of the values of a string variable,
+// by OtherLevel, after the levels have been determined from the data.
+func (fp *Parser) poolLevels() {
+
+	if !fp.countsLevels() {
+		return
+	}
+
+	var names []string
+	for na := range fp.levelCounts {
+		names = append(names, na)
+	}
+	sort.Strings(names)
+
+	for _, na := range names {
+		if fp.contrast(na) == PolyContrast {
+			continue
+		}
+		declared := make(map[string]bool)
+		for _, x := range fp.declaredLevels(na) {
+			declared[x] = true
+		}
+		ref := fp.refLevel(na)
+		counts := fp.levelCounts[na]
+		min := float64(fp.minLevelCount)
+		if fp.levelFraction(na) {
+			var n int
+			for _, c := range counts {
+				n += c
+			}
+			min = math.Max(min, fp.recipe.MinLevelFraction*float64(n))
+		}
+
+		var rare []string
+		for _, x := range levelsByCode(fp.codes[na]) {
+			if x != ref && x != OtherLevel && !declared[x] && float64(counts[x]) < min {
+				rare = append(rare, x)
+			}
+		}
+		if len(rare) > 0 {
+			fp.setPooled(na, rare)
+		}
+	}
+}
+
+// setPooled codes the given levels of the categorical variable na by
+// OtherLevel, which follows the remaining levels.
+func (fp *Parser) setPooled(na string, rare []string) {
+
+	pooled := make(map[string]bool)
+	for _, x := range rare {
+		pooled[x] = true
+	}
+	fp.pooled[na] = pooled
+
+	codes := make(map[string]int)
+	var fn []string
+	for _, x := range levelsByCode(fp.codes[na]) {
+		if !pooled[x] && x != OtherLevel {
+			codes[x] = len(codes)
+			fn = append(fn, fmt.Sprintf("%s[%s]", na, x))
+		}
+	}
+	codes[OtherLevel] = len(codes)
+	fn = append(fn, fmt.Sprintf("%s[%s]", na, OtherLevel))
+	fp.codes[na] = codes
+	fp.facNames[na] = fn
+}
+
+// pooledLevels returns the pooled levels of each variable in sorted
+// order.
+func (fp *Parser) pooledLevels() map[string][]string {
+
+	if len(fp.pooled) == 0 {
+		return nil
+	}
+
+	m := make(map[string][]string)
+	for na, pooled := range fp.pooled {
+		for x := range pooled {
+			m[na] = append(m[na], x)
+		}
+		sort.Strings(m[na])
+	}
+
+	return m
+}
@@ -0,0 +1,79 @@
+package formula
+
+import (
+	"testing"
+)
+
+func TestPoolLevels(t *testing.T) {
+
+	names := []string{"x"}
+	data := []interface{}{[]string{"a", "b", "c", "a", "b", "d", "a"}}
+	config := &Config{
+		RefLevels:     map[string]string{"x": "a"},
+		MinLevelCount: 2,
+		UnknownLevels: UnknownOther,
+	}
+	fp, err := New("x", mustSource(data, names), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &ColSet{
+		names: []string{"x[b]", "x[_other_]"},
+		data: [][]float64{
+			{0, 1, 0, 0, 1, 0, 0},
+			{0, 0, 1, 0, 0, 1, 0},
+		},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+
+	// Unseen levels are also pooled
+	src := mustSource([]interface{}{[]string{"e", "c", "b"}}, names)
+	cols, err = fp.WithData(src).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp = &ColSet{
+		names: []string{"x[b]", "x[_other_]"},
+		data:  [][]float64{{0, 0, 1}, {1, 1, 0}},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+}
+
+func TestPoolLevelsStream(t *testing.T) {
+
+	formulas := []string{"x3 + x1"}
+	config := &Config{MinLevelCount: 3}
+
+	fp, err := NewMulti(formulas, simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := full.Names(); len(names) != 3 || names[1] != "x3[_other_]" {
+		t.Errorf("Unexpected names %v", names)
+	}
+
+	s, err := NewStream(formulas, chunkedData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err := CollectChunks(s, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !colSetEq(full, cs) {
+		t.Errorf("Expected: %v\nObserved: %v\n", full, cs)
+	}
+}
@@ -0,0 +1,179 @@
+package formula
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// indicatorColumns returns the positions of the columns of cs that
+// are in names, or if names is empty, of the indicator columns of the
+// categorical variables and their cells, see CellCoding.
+func indicatorColumns(cs *ColSet, names []string) ([]int, error) {
+
+	var ix []int
+	if len(names) > 0 {
+		for _, na := range names {
+			j := find(cs.names, na)
+			if j == -1 {
+				return nil, fmt.Errorf("column '%s' not found", na)
+			}
+			ix = append(ix, j)
+		}
+		return ix, nil
+	}
+
+	for j := range cs.names {
+		if op := cs.origin(j).op; op == "indicator" || op == "cell" {
+			ix = append(ix, j)
+		}
+	}
+
+	return ix, nil
+}
+
+// LaplaceNoise is a ColSetStep that adds Laplace noise with scale
+// Sensitivity/Epsilon to each value of the indicator columns of the
+// design matrix, so that each row of these columns is released with
+// epsilon-differential privacy (in the local model) when a row changes
+// the indicators by at most Sensitivity in total, e.g. 2 for the
+// indicators of one treatment-coded variable.  Nothing is learned by
+// Fit, so noise is added to the training design as well as to new
+// data.
+type LaplaceNoise struct {
+
+	// Epsilon is the privacy budget, which must be positive.
+	Epsilon float64
+
+	// Sensitivity is the largest total change of the indicators of
+	// a row, 1 if zero.
+	Sensitivity float64
+
+	// Columns are the names of the columns to perturb, or the
+	// indicator columns if empty.
+	Columns []string
+
+	// Rng is the source of the noise, a generator seeded with the
+	// time if nil.
+	Rng *rand.Rand `json:"-"`
+}
+
+// Fit checks the parameters of the step.
+func (l *LaplaceNoise) Fit(cs *ColSet) error {
+	_, err := l.columns(cs)
+	return err
+}
+
+// columns checks the parameters of the step, and returns the
+// positions of the columns to perturb.
+func (l *LaplaceNoise) columns(cs *ColSet) ([]int, error) {
+
+	if !(l.Epsilon > 0) {
+		return nil, fmt.Errorf("LaplaceNoise: Epsilon must be positive")
+	}
+	if l.Sensitivity < 0 {
+		return nil, fmt.Errorf("LaplaceNoise: Sensitivity must not be negative")
+	}
+	ix, err := indicatorColumns(cs, l.Columns)
+	if err != nil {
+		return nil, fmt.Errorf("LaplaceNoise: %v", err)
+	}
+
+	return ix, nil
+}
+
+// Transform returns the design matrix with noise added to the
+// indicator columns.  The other columns are not copied.
+func (l *LaplaceNoise) Transform(cs *ColSet) (*ColSet, error) {
+
+	ix, err := l.columns(cs)
+	if err != nil {
+		return nil, err
+	}
+
+	sens := l.Sensitivity
+	if sens == 0 {
+		sens = 1
+	}
+	scale := sens / l.Epsilon
+
+	rng := l.Rng
+	if rng == nil {
+		rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	rslt := &ColSet{names: cs.names, terms: cs.terms, origins: cs.origins, meta: cs.meta, rows: cs.rows, ids: cs.ids}
+	rslt.data = append([][]float64(nil), cs.data...)
+	for _, j := range ix {
+		y := make([]float64, len(cs.data[j]))
+		for i, v := range cs.data[j] {
+			// The difference of two exponential variables
+			// is a Laplace variable
+			y[i] = v + scale*(rng.ExpFloat64()-rng.ExpFloat64())
+		}
+		rslt.data[j] = y
+	}
+
+	return rslt, nil
+}
+
+// KAnonymizer is a ColSetStep that suppresses the indicator columns of
+// the design matrix that are nonzero in fewer than K rows of the
+// training data, so that no released indicator identifies a group of
+// fewer than K individuals.  The same columns are removed from the
+// designs of new data.
+type KAnonymizer struct {
+
+	// K is the smallest number of rows that an indicator column
+	// can be nonzero in.
+	K int
+
+	// Columns are the names of the columns that can be
+	// suppressed, or the indicator columns if empty.
+	Columns []string
+
+	// Suppressed are the learned names of the suppressed columns.
+	Suppressed []string
+}
+
+// Fit learns the columns to suppress.
+func (k *KAnonymizer) Fit(cs *ColSet) error {
+
+	ix, err := indicatorColumns(cs, k.Columns)
+	if err != nil {
+		return fmt.Errorf("KAnonymizer: %v", err)
+	}
+
+	k.Suppressed = nil
+	for _, j := range ix {
+		var n int
+		for _, v := range cs.data[j] {
+			if v != 0 && !math.IsNaN(v) {
+				n++
+			}
+		}
+		if n < k.K {
+			k.Suppressed = append(k.Suppressed, cs.names[j])
+		}
+	}
+
+	return nil
+}
+
+// Transform returns the design matrix without the suppressed columns.
+func (k *KAnonymizer) Transform(cs *ColSet) (*ColSet, error) {
+
+	var ix []int
+	for j, na := range cs.names {
+		if find(k.Suppressed, na) == -1 {
+			ix = append(ix, j)
+		}
+	}
+
+	rslt := cs.sub(ix)
+	rslt.rows = cs.rows
+	rslt.ids = cs.ids
+
+	return rslt, nil
+}
@@ -0,0 +1,102 @@
+package formula
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestLaplaceNoise(t *testing.T) {
+
+	n := 10000
+	x := make([]string, n)
+	z := make([]float64, n)
+	for i := range x {
+		x[i] = []string{"a", "b", "c"}[i%3]
+		z[i] = float64(i)
+	}
+	src := mustSource([]interface{}{x, z}, []string{"x", "z"})
+
+	config := &Config{RefLevels: map[string]string{"x": "a"}}
+	noise := &LaplaceNoise{Epsilon: 2, Rng: rand.New(rand.NewSource(1))}
+	p := &Pipeline{
+		Formula: &FormulaStep{Formulas: []string{"x + z"}, Config: config},
+		Post:    []ColSetStep{noise},
+	}
+	cs, err := p.Fit(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The numeric column is not perturbed
+	if !reflect.DeepEqual(cs.data[2], z) {
+		t.Errorf("The column z was changed")
+	}
+
+	// The noise has mean 0 and variance 2*(1/2)^2
+	for j := 0; j < 2; j++ {
+		var sum, ss float64
+		for i, v := range cs.data[j] {
+			var u float64
+			if x[i] == []string{"b", "c"}[j] {
+				u = 1
+			}
+			sum += v - u
+			ss += (v - u) * (v - u)
+		}
+		mean := sum / float64(n)
+		vr := ss/float64(n) - mean*mean
+		if math.Abs(mean) > 0.05 || math.Abs(vr-0.5) > 0.05 {
+			t.Errorf("%s: unexpected noise mean %f and variance %f", cs.names[j], mean, vr)
+		}
+	}
+
+	noise.Epsilon = 0
+	if _, err := p.Transform(src); err == nil {
+		t.Errorf("Expected an error for Epsilon = 0")
+	}
+}
+
+func TestKAnonymizer(t *testing.T) {
+
+	names := []string{"x", "y"}
+	train := mustSource([]interface{}{
+		[]string{"a", "b", "b", "c", "a", "b"},
+		[]float64{1, 2, 3, 4, 5, 6},
+	}, names)
+	test := mustSource([]interface{}{
+		[]string{"c", "b"},
+		[]float64{7, 8},
+	}, names)
+
+	config := &Config{OneHot: true}
+	k := &KAnonymizer{K: 2}
+	p := &Pipeline{
+		Formula: &FormulaStep{Formulas: []string{"x + y"}, Config: config},
+		Post:    []ColSetStep{k},
+	}
+	cs, err := p.Fit(train)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(k.Suppressed, []string{"x[c]"}) {
+		t.Errorf("Unexpected suppressed columns %v", k.Suppressed)
+	}
+
+	exp := &ColSet{
+		names: []string{"x[a]", "x[b]", "y"},
+		data: [][]float64{
+			{0, 0},
+			{0, 1},
+			{7, 8},
+		},
+	}
+	cs, err = p.Transform(test)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !colSetEq(exp, cs) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cs)
+	}
+}
@@ -0,0 +1,85 @@
+package formula
+
+// Step is one operation in the derivation of a column of a ColSet.
+type Step struct {
+
+	// Op is the operation, one of "variable" (a numeric variable
+	// in the data), "indicator" (an indicator of one level of a
+	// categorical variable), "contrast" (a polynomial contrast of
+	// an ordered categorical variable), "statistic" (a statistic
+	// of the levels of a categorical variable, see StatEncoder),
+	// "coder" (a column produced by a Coder), "intercept",
+	// "function" (a Func or MultiFunc), "arithmetic" (an I()
+	// expression), "interaction" (a product of columns),
+	// "cell" (an indicator of a combination of levels of
+	// categorical variables, see CellCoding), "rename" (a column
+	// renamed to avoid a duplicate name, or named after the label
+	// of its term), or "column" (a column of a ColSet that was
+	// not produced by a Parser).
+	Op string
+
+	// Output is the name of the column produced by the step.
+	Output string
+
+	// Inputs are the names of the columns used by the step.
+	Inputs []string
+
+	// Detail is the level for an indicator, the levels of a cell,
+	// e.g. "a:b", the name of a statistic, the label of a
+	// polynomial contrast, e.g. ".L", the name of the function for
+	// a function, and the expression for arithmetic.
+	Detail string
+}
+
+// origin records how a column of a ColSet was derived.
+type origin struct {
+	op     string
+	detail string
+	name   string
+	inputs []*origin
+}
+
+// origin returns the origin of column j.
+func (cs *ColSet) origin(j int) *origin {
+	if cs.origins == nil || cs.origins[j] == nil {
+		return &origin{op: "column", name: cs.names[j]}
+	}
+	return cs.origins[j]
+}
+
+// varOrigin returns the origin of a numeric variable, which is either
+// in the data or produced by a function.
+func (fp *Parser) varOrigin(na string) *origin {
+	if o, ok := fp.derivedOrigins[na]; ok {
+		return o
+	}
+	return &origin{op: "variable", name: na}
+}
+
+// Provenance returns the sequence of operations that produced each
+// column of the ColSet, in column order.  The steps for a column are
+// ordered so that each step follows the steps producing its inputs,
+// and the last step produces the column itself.
+func (cs *ColSet) Provenance() [][]Step {
+
+	prov := make([][]Step, len(cs.names))
+	for j := range cs.names {
+		seen := make(map[*origin]bool)
+		var visit func(*origin)
+		visit = func(o *origin) {
+			if seen[o] {
+				return
+			}
+			seen[o] = true
+			step := Step{Op: o.op, Output: o.name, Detail: o.detail}
+			for _, in := range o.inputs {
+				visit(in)
+				step.Inputs = append(step.Inputs, in.name)
+			}
+			prov[j] = append(prov[j], step)
+		}
+		visit(cs.origin(j))
+	}
+
+	return prov
+}
@@ -0,0 +1,54 @@
+package formula
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProvenance(t *testing.T) {
+
+	config := &Config{Funcs: makeFuncs(), RefLevels: map[string]string{"x3": "a"}}
+	fp, err := NewMulti([]string{"1 + square(x1):x3", "I(x1 + x4)"}, simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prov := cs.Provenance()
+	exp := [][]Step{
+		{
+			{Op: "intercept", Output: "icept"},
+		},
+		{
+			{Op: "variable", Output: "x1"},
+			{Op: "function", Output: "square(x1)", Inputs: []string{"x1"}, Detail: "square"},
+			{Op: "variable", Output: "x3"},
+			{Op: "indicator", Output: "x3[b]", Inputs: []string{"x3"}, Detail: "b"},
+			{Op: "interaction", Output: "square(x1):x3[b]", Inputs: []string{"square(x1)", "x3[b]"}},
+		},
+		{
+			{Op: "variable", Output: "x1"},
+			{Op: "variable", Output: "x4"},
+			{Op: "arithmetic", Output: "I(x1+x4)", Inputs: []string{"x1", "x4"}, Detail: "I(x1+x4)"},
+		},
+	}
+	if !reflect.DeepEqual(prov, exp) {
+		t.Errorf("Expected:\n%+v\nObserved:\n%+v", exp, prov)
+	}
+
+	// Renamed duplicates and columns not produced by a parser
+	c := NewColSet([]string{"a"}, [][]float64{{1, 2}})
+	if err := c.ExtendPolicy(NewColSet([]string{"a"}, [][]float64{{3, 4}}), DupRename); err != nil {
+		t.Fatal(err)
+	}
+	exp = [][]Step{
+		{{Op: "column", Output: "a"}},
+		{{Op: "column", Output: "a"}, {Op: "rename", Output: "a_2", Inputs: []string{"a"}}},
+	}
+	if prov := c.Provenance(); !reflect.DeepEqual(prov, exp) {
+		t.Errorf("Expected:\n%+v\nObserved:\n%+v", exp, prov)
+	}
+}
@@ -0,0 +1,403 @@
+package formula
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// The built-in functions ecdf(x), winsor(x, p) and cut(x, k) transform
+// a numeric variable by its quantiles, which are learned from the data
+// along with the categorical codes, so that new data are transformed
+// in the same way.  ecdf(x) is the fraction of the values of x that
+// are at most x (the empirical distribution function), winsor(x, p)
+// moves the values of x below the p'th quantile or above the (1-p)'th
+// quantile to that quantile, for 0 < p < 0.5, and cut(x, k) codes x by
+// indicators of the k bins between its k-quantiles, omitting the first
+// bin, named like cut(x, 4)[2], ..., cut(x, 4)[4].  Missing values give
+// missing values.  The names ecdf, winsor and cut refer to functions
+// in Config.Funcs or Config.MultiFuncs if they are defined there.
+//
+// The quantiles are estimated in one pass over the data by a KLL
+// sketch, which holds a sample of the values whose size does not
+// depend on the number of values, so that streams can be fit without
+// sorting the data.  The quantiles are exact if the data have fewer
+// than quantileSize values, and otherwise have a rank error of about
+// 1%.  The sketches of different datasets can be merged, see
+// MergeCodes.
+
+// The capacity of the largest compactor of a sketch
+const quantileSize = 200
+
+// quantileSketch is a KLL sketch of the values of one variable.  The
+// values in Compactors[h] each stand for 2^h values of the data.  The
+// fields are exported so that the sketch can be serialized.
+type quantileSketch struct {
+	Compactors [][]float64
+	N          int
+
+	// Which half of a compactor is kept by the next compaction
+	Flip bool
+}
+
+// capacity returns the capacity of compactor h.
+func (q *quantileSketch) capacity(h int) int {
+	depth := len(q.Compactors) - h - 1
+	c := int(math.Ceil(quantileSize * math.Pow(2.0/3, float64(depth))))
+	if c < 2 {
+		c = 2
+	}
+	return c
+}
+
+// size returns the number of values held by the sketch.
+func (q *quantileSketch) size() int {
+	var n int
+	for _, c := range q.Compactors {
+		n += len(c)
+	}
+	return n
+}
+
+// add adds a value to the sketch.
+func (q *quantileSketch) add(x float64) {
+
+	if len(q.Compactors) == 0 {
+		q.Compactors = [][]float64{nil}
+	}
+	q.Compactors[0] = append(q.Compactors[0], x)
+	q.N++
+	q.compress()
+}
+
+// compress compacts the lowest full compactor until the sketch is
+// within its capacity.  A compaction sorts the values of a compactor
+// and promotes every other value to the next compactor.
+func (q *quantileSketch) compress() {
+
+	for {
+		var total int
+		for h := range q.Compactors {
+			total += q.capacity(h)
+		}
+		if q.size() <= total {
+			return
+		}
+
+		for h, c := range q.Compactors {
+			if len(c) < q.capacity(h) {
+				continue
+			}
+			if h+1 == len(q.Compactors) {
+				q.Compactors = append(q.Compactors, nil)
+			}
+			sort.Float64s(c)
+
+			// An odd value out stays in the compactor
+			var rest []float64
+			if len(c)%2 == 1 {
+				rest = []float64{c[len(c)-1]}
+				c = c[:len(c)-1]
+			}
+			j := 0
+			if q.Flip {
+				j = 1
+			}
+			q.Flip = !q.Flip
+			for ; j < len(c); j += 2 {
+				q.Compactors[h+1] = append(q.Compactors[h+1], c[j])
+			}
+			q.Compactors[h] = rest
+			break
+		}
+	}
+}
+
+// merge adds the values of another sketch to the sketch.
+func (q *quantileSketch) merge(o *quantileSketch) {
+
+	for len(q.Compactors) < len(o.Compactors) {
+		q.Compactors = append(q.Compactors, nil)
+	}
+	for h, c := range o.Compactors {
+		q.Compactors[h] = append(q.Compactors[h], c...)
+	}
+	q.N += o.N
+	q.compress()
+}
+
+// copy returns a copy of the sketch.
+func (q *quantileSketch) copy() *quantileSketch {
+	c := &quantileSketch{N: q.N, Flip: q.Flip}
+	for _, x := range q.Compactors {
+		c.Compactors = append(c.Compactors, append([]float64(nil), x...))
+	}
+	return c
+}
+
+// weighted returns the values of the sketch in increasing order, and
+// their cumulative weights.
+func (q *quantileSketch) weighted() ([]float64, []float64) {
+
+	type item struct {
+		x float64
+		w float64
+	}
+	var items []item
+	for h, c := range q.Compactors {
+		w := math.Ldexp(1, h)
+		for _, x := range c {
+			items = append(items, item{x, w})
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].x < items[j].x })
+
+	x := make([]float64, len(items))
+	cw := make([]float64, len(items))
+	var s float64
+	for i, it := range items {
+		s += it.w
+		x[i] = it.x
+		cw[i] = s
+	}
+
+	return x, cw
+}
+
+// quantile returns the p'th quantile of the values, the smallest value
+// whose cumulative fraction is at least p.
+func (q *quantileSketch) quantile(p float64) float64 {
+
+	x, cw := q.weighted()
+	if len(x) == 0 {
+		return math.NaN()
+	}
+	t := p * cw[len(cw)-1]
+	i := sort.Search(len(cw), func(i int) bool { return cw[i] >= t })
+	if i == len(x) {
+		i--
+	}
+
+	return x[i]
+}
+
+// cdf returns the fraction of the values that are at most each value
+// of y.
+func (q *quantileSketch) cdf(y []float64) []float64 {
+
+	x, cw := q.weighted()
+	z := make([]float64, len(y))
+	for i, v := range y {
+		if math.IsNaN(v) {
+			z[i] = math.NaN()
+			continue
+		}
+		j := sort.Search(len(x), func(j int) bool { return x[j] > v })
+		if j > 0 {
+			z[i] = cw[j-1] / cw[len(cw)-1]
+		}
+	}
+
+	return z
+}
+
+// isQuantile returns true if tok is a call to the built-in function
+// ecdf, winsor or cut.
+func (fp *Parser) isQuantile(tok *token) bool {
+
+	if tok.symbol != funct {
+		return false
+	}
+	switch tok.funcn {
+	case "ecdf", "winsor", "cut":
+	default:
+		return false
+	}
+	_, single := fp.funcs[tok.funcn]
+	_, multi := fp.multiFuncs[tok.funcn]
+
+	return !single && !multi
+}
+
+// quantileVars returns the variables whose quantiles are used by the
+// formulas, which are the arguments of ecdf, winsor and cut, and of bs
+// and te if Config.QuantileKnots is set.
+func (fp *Parser) quantileVars() map[string]bool {
+
+	vars := make(map[string]bool)
+	var walk func([]*token)
+	walk = func(tokens []*token) {
+		for _, tok := range tokens {
+			switch {
+			case fp.isQuantile(tok) || (fp.quantileKnots && fp.isSmooth(tok)):
+				for _, arg := range tok.args {
+					if arg.symbol == vname {
+						vars[arg.name] = true
+					}
+				}
+			case tok.symbol == funct:
+				walk(tok.args)
+			case tok.symbol == subexpr || tok.symbol == labeled:
+				walk(tok.expr)
+			}
+		}
+	}
+
+	for _, rpn := range fp.rpn {
+		walk(rpn)
+	}
+
+	return vars
+}
+
+// updateQuantiles adds the values of the numeric variable na to its
+// sketch.
+func (fp *Parser) updateQuantiles(na string, v []float64) {
+
+	q, ok := fp.quantiles[na]
+	if !ok {
+		q = new(quantileSketch)
+		fp.quantiles[na] = q
+	}
+	for _, x := range v {
+		if !math.IsNaN(x) {
+			q.add(x)
+		}
+	}
+}
+
+// sketch returns the sketch of the variable na.
+func (fp *Parser) sketch(na string) (*quantileSketch, error) {
+
+	q, ok := fp.quantiles[na]
+	if !ok || q.N == 0 {
+		return nil, fmt.Errorf("the variable '%s' has no quantiles", na)
+	}
+
+	return q, nil
+}
+
+// quantileKnotsOf returns the k-4 interior knots of a cubic B-spline
+// basis of the variable na, at its quantiles.
+func (fp *Parser) quantileKnotsOf(na string, lo, hi float64, k int) ([]float64, error) {
+
+	q, err := fp.sketch(na)
+	if err != nil {
+		return nil, err
+	}
+
+	inner := make([]float64, k-splineDegree-1)
+	last := lo
+	for i := range inner {
+		inner[i] = q.quantile(float64(i+1) / float64(len(inner)+1))
+		if inner[i] <= last || inner[i] >= hi {
+			return nil, fmt.Errorf("the quantiles of '%s' are not distinct", na)
+		}
+		last = inner[i]
+	}
+
+	return inner, nil
+}
+
+// quantileCode returns the columns of a call to ecdf, winsor or cut.
+func (fp *Parser) quantileCode(tok *token) (*ColSet, error) {
+
+	nargs := 2
+	if tok.funcn == "ecdf" {
+		nargs = 1
+	}
+	if len(tok.args) != nargs || tok.args[0].symbol != vname || (nargs == 2 && tok.args[1].symbol != number) {
+		if nargs == 1 {
+			return nil, fmt.Errorf("%s: ecdf takes a variable", tok.name)
+		}
+		return nil, fmt.Errorf("%s: %s takes a variable and a number", tok.name, tok.funcn)
+	}
+
+	na := tok.args[0].name
+	x, err := fp.numeric(na)
+	if err != nil {
+		return nil, err
+	}
+	q, err := fp.sketch(na)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", tok.name, err)
+	}
+	input := fp.varOrigin(na)
+	org := func(cna string) *origin {
+		return &origin{op: "function", detail: tok.funcn, name: cna, inputs: []*origin{input}}
+	}
+
+	switch tok.funcn {
+	case "ecdf":
+		return &ColSet{names: []string{tok.name}, data: [][]float64{q.cdf(x)}, origins: []*origin{org(tok.name)}}, nil
+	case "winsor":
+		p := tok.args[1].value
+		if !(p > 0 && p < 0.5) {
+			return nil, fmt.Errorf("%s: the fraction must be between 0 and 0.5", tok.name)
+		}
+		lo, hi := q.quantile(p), q.quantile(1-p)
+		z := make([]float64, len(x))
+		for i, v := range x {
+			z[i] = v
+			if v < lo {
+				z[i] = lo
+			} else if v > hi {
+				z[i] = hi
+			}
+		}
+		return &ColSet{names: []string{tok.name}, data: [][]float64{z}, origins: []*origin{org(tok.name)}}, nil
+	}
+
+	// cut
+	v := tok.args[1].value
+	if v != math.Floor(v) || v < 2 || v > math.MaxInt32 {
+		return nil, fmt.Errorf("%s: the number of bins must be an integer of at least 2", tok.name)
+	}
+	k := int(v)
+	cuts := make([]float64, k-1)
+	for j := range cuts {
+		cuts[j] = q.quantile(float64(j+1) / float64(k))
+	}
+
+	dat := make([][]float64, k-1)
+	for j := range dat {
+		dat[j] = make([]float64, len(x))
+	}
+	for i, u := range x {
+		if math.IsNaN(u) {
+			for j := range dat {
+				dat[j][i] = math.NaN()
+			}
+			continue
+		}
+		b := sort.Search(len(cuts), func(j int) bool { return u <= cuts[j] })
+		if b > 0 {
+			dat[b-1][i] = 1
+		}
+	}
+
+	cs := &ColSet{data: dat}
+	for j := range dat {
+		cna := tok.name + "[" + strconv.Itoa(j+2) + "]"
+		cs.names = append(cs.names, cna)
+		cs.origins = append(cs.origins, org(cna))
+	}
+
+	return cs, nil
+}
+
+// quantileState returns copies of the sketches of the variables.
+func (fp *Parser) quantileState() map[string]*quantileSketch {
+
+	if len(fp.quantiles) == 0 {
+		return nil
+	}
+
+	m := make(map[string]*quantileSketch)
+	for na, q := range fp.quantiles {
+		m[na] = q.copy()
+	}
+
+	return m
+}
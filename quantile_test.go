@@ -0,0 +1,141 @@
+package formula
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestQuantileSketch(t *testing.T) {
+
+	// The values 0, ..., n-1 in a scrambled order, in two sketches
+	n := 100000
+	q1, q2 := new(quantileSketch), new(quantileSketch)
+	for i := 0; i < n; i++ {
+		x := float64((i * 7919) % n)
+		if i%3 == 0 {
+			q1.add(x)
+		} else {
+			q2.add(x)
+		}
+	}
+	q1.merge(q2)
+
+	if q1.N != n {
+		t.Errorf("Expected %d values, found %d", n, q1.N)
+	}
+	if q1.size() > 4*quantileSize {
+		t.Errorf("The sketch holds %d values", q1.size())
+	}
+	for _, p := range []float64{0.01, 0.1, 0.5, 0.9, 0.99} {
+		if e := math.Abs(q1.quantile(p)/float64(n) - p); e > 0.02 {
+			t.Errorf("The %v quantile has rank error %v", p, e)
+		}
+		if e := math.Abs(q1.cdf([]float64{p * float64(n)})[0] - p); e > 0.02 {
+			t.Errorf("The ecdf at the %v quantile has error %v", p, e)
+		}
+	}
+}
+
+func TestQuantileFuncs(t *testing.T) {
+
+	x := []float64{3, 1, 4, 10, 5, 9, 2, 6, 8, 7}
+	src := mustSource([]interface{}{x}, []string{"x"})
+
+	fp, err := New("ecdf(x) + winsor(x, 0.2) + cut(x, 2)", src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &ColSet{
+		names: []string{"ecdf(x)", "winsor(x, 0.2)", "cut(x, 2)[2]"},
+		data: [][]float64{
+			{0.3, 0.1, 0.4, 1, 0.5, 0.9, 0.2, 0.6, 0.8, 0.7},
+			{3, 2, 4, 8, 5, 8, 2, 6, 8, 7},
+			{0, 0, 0, 1, 0, 1, 0, 1, 1, 1},
+		},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+
+	for _, f := range []string{"winsor(x, 0.7)", "cut(x, 1)", "ecdf(x, 2)"} {
+		fp, err := New(f, src, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fp.Parse(); err == nil {
+			t.Errorf("%s: expected an error", f)
+		}
+	}
+}
+
+func TestStreamQuantiles(t *testing.T) {
+
+	x := make([]float64, 1000)
+	for i := range x {
+		x[i] = float64((i * 37) % 1000)
+	}
+	var chunks []DataSource
+	for i := 0; i < len(x); i += 100 {
+		chunks = append(chunks, mustSource([]interface{}{x[i : i+100]}, []string{"x"}))
+	}
+
+	formulas := []string{"ecdf(x) + bs(x)"}
+	config := &Config{QuantileKnots: true}
+	s, err := NewStream(formulas, NewChunkSource(chunks...), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Fit(); err != nil {
+		t.Fatal(err)
+	}
+	cols, err := s.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range cols.Data()[0] {
+		if e := math.Abs(v - (x[i]+1)/1000); e > 0.02 {
+			t.Errorf("ecdf(x) for %v is %v", x[i], v)
+			break
+		}
+	}
+
+	// The sketch is saved in the codes
+	b, err := json.Marshal(s.Checkpoint())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cp Checkpoint
+	if err := json.Unmarshal(b, &cp); err != nil {
+		t.Fatal(err)
+	}
+	if cp.Quantiles["x"] == nil || cp.Quantiles["x"].N != len(x) {
+		t.Errorf("The checkpoint does not hold the sketch of x")
+	}
+
+	// The knots are at the quantiles, so the middle basis function
+	// peaks near the median
+	fp, err := New("bs(x)", mustSource([]interface{}{x}, []string{"x"}), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, err := fp.quantileKnotsOf("x", 0, 999, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inner) != 1 || math.Abs(inner[0]-499) > 1 {
+		t.Errorf("Expected a knot at the median, found %v", inner)
+	}
+	if len(kb.Names()) != 5 {
+		t.Errorf("Expected 5 basis functions, found %d", len(kb.Names()))
+	}
+}
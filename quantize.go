@@ -0,0 +1,267 @@
+package formula
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Quantization is the reduced precision used to write a design matrix
+// by WriteQuantized, for inference on devices with little memory.
+type Quantization int
+
+const (
+	// QuantizeFloat16 writes each value as an IEEE 754 half
+	// precision number in two bytes, with about three significant
+	// digits.  Missing values are NaN.
+	QuantizeFloat16 Quantization = iota
+
+	// QuantizeInt8 writes each value as a signed byte q from -127
+	// to 127, which stands for Offsets[j] + (q+127)*Scales[j] in
+	// column j, so that the range of each column is divided into
+	// 254 equal steps.  Missing values are written as -128.
+	// Infinite values, and ranges too wide to be represented, are
+	// an error.
+	QuantizeInt8
+)
+
+// The int8 code of a missing value
+const int8NA = -128
+
+// Manifest describes a design matrix written by WriteQuantized, and
+// holds the parameters needed to read it back with ReadQuantized.  A
+// Manifest can be serialized as JSON and stored with the data.
+type Manifest struct {
+
+	// Names are the names of the columns, in the order in which
+	// they are written.
+	Names []string
+
+	// Rows is the number of values in each column.
+	Rows int
+
+	// Quantization is the precision of the values.
+	Quantization Quantization
+
+	// Scales and Offsets hold the quantization parameters of each
+	// column with QuantizeInt8.
+	Scales  []float64 `json:",omitempty"`
+	Offsets []float64 `json:",omitempty"`
+}
+
+// WriteQuantized writes the ColSet to w with reduced precision, one
+// column after another, with values in little-endian byte order, and
+// returns a Manifest describing the data.  Values written with
+// QuantizeInt8 are within half a step of the original values, and
+// indicator columns are written exactly.
+func (cs *ColSet) WriteQuantized(w io.Writer, q Quantization) (*Manifest, error) {
+
+	if q != QuantizeFloat16 && q != QuantizeInt8 {
+		return nil, fmt.Errorf("WriteQuantized: unknown quantization %d", q)
+	}
+
+	m := &Manifest{Names: append([]string(nil), cs.names...), Quantization: q}
+	for j, v := range cs.data {
+		if j == 0 {
+			m.Rows = len(v)
+		} else if len(v) != m.Rows {
+			return nil, fmt.Errorf("WriteQuantized: column '%s' has length %d, expected %d", cs.names[j], len(v), m.Rows)
+		}
+	}
+
+	// The parameters are checked before any data are written
+	if q == QuantizeInt8 {
+		for j, v := range cs.data {
+			scale, offset, err := int8Params(v)
+			if err != nil {
+				return nil, fmt.Errorf("WriteQuantized: column '%s': %v", cs.names[j], err)
+			}
+			m.Scales = append(m.Scales, scale)
+			m.Offsets = append(m.Offsets, offset)
+		}
+	}
+
+	wtr := bufio.NewWriter(w)
+	buf := make([]byte, 2)
+	for j, v := range cs.data {
+		switch q {
+		case QuantizeFloat16:
+			for _, x := range v {
+				binary.LittleEndian.PutUint16(buf, float16Bits(x))
+				if _, err := wtr.Write(buf); err != nil {
+					return nil, err
+				}
+			}
+		case QuantizeInt8:
+			scale, offset := m.Scales[j], m.Offsets[j]
+			for _, x := range v {
+				c := int8(int8NA)
+				if !math.IsNaN(x) {
+					c = -127
+					if scale > 0 {
+						c = int8(math.Round((x-offset)/scale) - 127)
+					}
+				}
+				if err := wtr.WriteByte(byte(c)); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	if err := wtr.Flush(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// ReadQuantized reads a design matrix written by WriteQuantized, which
+// is described by m.
+func ReadQuantized(r io.Reader, m *Manifest) (*ColSet, error) {
+
+	switch {
+	case m.Quantization != QuantizeFloat16 && m.Quantization != QuantizeInt8:
+		return nil, fmt.Errorf("ReadQuantized: unknown quantization %d", m.Quantization)
+	case m.Quantization == QuantizeInt8 && (len(m.Scales) != len(m.Names) || len(m.Offsets) != len(m.Names)):
+		return nil, fmt.Errorf("ReadQuantized: the manifest has %d scales and %d offsets for %d columns",
+			len(m.Scales), len(m.Offsets), len(m.Names))
+	}
+
+	size := 2
+	if m.Quantization == QuantizeInt8 {
+		size = 1
+	}
+
+	rdr := bufio.NewReader(r)
+	buf := make([]byte, size*m.Rows)
+	cs := &ColSet{names: append([]string(nil), m.Names...)}
+	for j, na := range m.Names {
+		if _, err := io.ReadFull(rdr, buf); err != nil {
+			return nil, fmt.Errorf("ReadQuantized: column '%s': %v", na, err)
+		}
+		v := make([]float64, m.Rows)
+		for i := range v {
+			if m.Quantization == QuantizeFloat16 {
+				v[i] = float16Value(binary.LittleEndian.Uint16(buf[2*i:]))
+				continue
+			}
+			c := int8(buf[i])
+			if c == int8NA {
+				v[i] = math.NaN()
+			} else {
+				v[i] = m.Offsets[j] + float64(int(c)+127)*m.Scales[j]
+			}
+		}
+		cs.data = append(cs.data, v)
+	}
+
+	return cs, nil
+}
+
+// int8Params returns the scale and offset of the int8 codes of the
+// values in v, which map the range of v to 254 steps.  The scale is
+// zero if v has no range.  An error is returned if v has an infinite
+// value, or if its range overflows, as the codes would not be defined
+// and the parameters could not be stored as JSON.
+func int8Params(v []float64) (float64, float64, error) {
+
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for i, x := range v {
+		switch {
+		case math.IsInf(x, 0):
+			return 0, 0, fmt.Errorf("the value %v in row %d is infinite", x, i+1)
+		case !math.IsNaN(x):
+			lo = math.Min(lo, x)
+			hi = math.Max(hi, x)
+		}
+	}
+	if lo > hi {
+		return 0, 0, nil
+	}
+	if math.IsInf(hi-lo, 0) {
+		return 0, 0, fmt.Errorf("the range from %v to %v is too wide", lo, hi)
+	}
+
+	return (hi - lo) / 254, lo, nil
+}
+
+// float16Bits returns the IEEE 754 half precision number nearest to x,
+// with ties to even.  Values too large in magnitude become infinite.
+func float16Bits(x float64) uint16 {
+
+	b := math.Float64bits(x)
+	sign := uint16(b>>48) & 0x8000
+	exp := int(b>>52) & 0x7ff
+	mant := b & (1<<52 - 1)
+
+	switch {
+	case exp == 0x7ff && mant != 0:
+		return sign | 0x7e00
+	case exp == 0x7ff:
+		return sign | 0x7c00
+	case exp == 0:
+		// Subnormal float64 values are far below the float16
+		// range
+		return sign
+	}
+
+	// round shifts m right by s bits, rounding to nearest with ties
+	// to even.
+	round := func(m uint64, s uint) uint64 {
+		q := m >> s
+		rem := m & (1<<s - 1)
+		half := uint64(1) << (s - 1)
+		if rem > half || (rem == half && q&1 == 1) {
+			q++
+		}
+		return q
+	}
+
+	e := exp - 1023 + 15
+	if e <= 0 {
+		// A subnormal float16, whose value is a multiple of
+		// 2^-24.  A carry gives the smallest normal number.
+		s := uint(42 + 1 - e)
+		if s > 63 {
+			return sign
+		}
+		return sign | uint16(round(mant|1<<52, s))
+	}
+
+	// A carry out of the mantissa increments the exponent
+	v := uint64(e)<<10 + round(mant, 42)
+	if v >= 0x7c00 {
+		return sign | 0x7c00
+	}
+
+	return sign | uint16(v)
+}
+
+// float16Value returns the value of an IEEE 754 half precision
+// number.
+func float16Value(h uint16) float64 {
+
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+
+	var x float64
+	switch exp {
+	case 0:
+		x = math.Ldexp(mant, -24)
+	case 0x1f:
+		if mant != 0 {
+			return math.NaN()
+		}
+		x = math.Inf(1)
+	default:
+		x = math.Ldexp(1024+mant, exp-25)
+	}
+	if h&0x8000 != 0 {
+		x = -x
+	}
+
+	return x
+}
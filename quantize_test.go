@@ -0,0 +1,123 @@
+package formula
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestFloat16(t *testing.T) {
+
+	for _, x := range []float64{0, 1, -2, 0.5, 65504, 1.0 / 1024, math.Ldexp(1, -24), math.Ldexp(3, -24)} {
+		if y := float16Value(float16Bits(x)); y != x {
+			t.Errorf("%v is read back as %v", x, y)
+		}
+	}
+
+	// Rounding to nearest, with ties to even
+	for _, c := range [][2]float64{
+		{1 + math.Ldexp(1, -11), 1},
+		{1 + 3*math.Ldexp(1, -11), 1 + math.Ldexp(1, -9)},
+		{1e6, math.Inf(1)},
+		{-1e6, math.Inf(-1)},
+		{math.Ldexp(1, -26), 0},
+		{math.Ldexp(3, -25), math.Ldexp(1, -23)},
+	} {
+		if y := float16Value(float16Bits(c[0])); y != c[1] {
+			t.Errorf("%v is read back as %v, expected %v", c[0], y, c[1])
+		}
+	}
+
+	if !math.IsNaN(float16Value(float16Bits(math.NaN()))) {
+		t.Errorf("NaN is not read back as NaN")
+	}
+}
+
+func TestWriteQuantized(t *testing.T) {
+
+	cs := &ColSet{
+		names: []string{"x[b]", "y", "z"},
+		data: [][]float64{
+			{0, 1, 1, 0},
+			{-1.5, 3.14159, math.NaN(), 100},
+			{2, 2, 2, 2},
+		},
+	}
+
+	for _, q := range []Quantization{QuantizeFloat16, QuantizeInt8} {
+		var buf bytes.Buffer
+		m, err := cs.WriteQuantized(&buf, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := 2
+		if q == QuantizeInt8 {
+			size = 1
+		}
+		if buf.Len() != size*12 {
+			t.Errorf("Expected %d bytes, found %d", size*12, buf.Len())
+		}
+
+		// The manifest is stored as JSON
+		b, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m2 Manifest
+		if err := json.Unmarshal(b, &m2); err != nil {
+			t.Fatal(err)
+		}
+
+		rs, err := ReadQuantized(&buf, &m2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rs.Names()) != 3 || rs.Names()[1] != "y" {
+			t.Errorf("Unexpected names %v", rs.Names())
+		}
+		for j, v := range cs.data {
+			tol := 0.0
+			if j == 1 {
+				tol = 0.1
+				if q == QuantizeInt8 {
+					tol = m.Scales[1] / 2
+				}
+			}
+			for i, x := range v {
+				y := rs.data[j][i]
+				if math.IsNaN(x) != math.IsNaN(y) || math.Abs(x-y) > tol {
+					t.Errorf("%d: %v is read back as %v", q, x, y)
+				}
+			}
+		}
+	}
+
+	if _, err := cs.WriteQuantized(new(bytes.Buffer), Quantization(5)); err == nil {
+		t.Errorf("Expected an error for an unknown quantization")
+	}
+	for _, x := range [][]float64{{0, math.Inf(1), 1}, {math.Inf(-1), 0, 1}, {-math.MaxFloat64, 0, math.MaxFloat64}} {
+		cs := &ColSet{names: []string{"x"}, data: [][]float64{x}}
+		var buf bytes.Buffer
+		if _, err := cs.WriteQuantized(&buf, QuantizeInt8); err == nil {
+			t.Errorf("Expected an error for %v", x)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("Expected no data to be written for %v", x)
+		}
+
+		// Infinite values are represented in float16
+		m, err := cs.WriteQuantized(&buf, QuantizeFloat16)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := json.Marshal(m); err != nil {
+			t.Errorf("The manifest can not be stored as JSON: %v", err)
+		}
+	}
+
+	m := &Manifest{Names: []string{"x"}, Rows: 4, Quantization: QuantizeInt8}
+	if _, err := ReadQuantized(bytes.NewReader(make([]byte, 4)), m); err == nil {
+		t.Errorf("Expected an error for a manifest without scales")
+	}
+}
@@ -0,0 +1,291 @@
+package formula
+
+import (
+	"fmt"
+	"math"
+)
+
+// Recipe gives default transformations of the variables of each type,
+// e.g. standardizing all numeric variables, or pooling the rare levels
+// of all string variables.  A transformation is applied to each
+// variable of the data that appears as a term of a formula, or of a
+// labeled term, outside of function calls, including the variables
+// included by '.'.  A formula overrides the default by transforming
+// the variable explicitly, e.g. log(x), or I(x) for the untransformed
+// values.  The left-hand sides of formulas are not transformed.
+//
+// The parameters of Standardize and MinLevelFraction are learned from
+// the data along with the categorical codes, and are stored in the
+// Codes, so that new data are transformed in the same way.
+type Recipe struct {
+
+	// Numeric is the name of a function in Config.Funcs or
+	// Config.MultiFuncs that is applied to the numeric variables.
+	Numeric string
+
+	// String is the name of a function in Config.StrFuncs that is
+	// applied to the string variables.
+	String string
+
+	// Standardize replaces the numeric variables by standardize(x),
+	// see below.  Numeric can not also be set.
+	Standardize bool
+
+	// MinLevelFraction pools the levels of the string variables
+	// that occur in less than this fraction of the values of the
+	// variable, e.g. 0.01, as with Config.MinLevelCount.
+	MinLevelFraction float64
+}
+
+// The built-in function standardize(x) subtracts the mean of the
+// numeric variable x from its values and divides them by its standard
+// deviation, which are learned from the data along with the
+// categorical codes.  A variable with no variation is only centered.
+// The name standardize refers to a function in Config.Funcs or
+// Config.MultiFuncs if one is defined there.
+
+// validateRecipe returns the problems with the recipe, whose functions
+// must be defined.
+func (fp *Parser) validateRecipe() []string {
+
+	if fp.recipe == nil {
+		return nil
+	}
+
+	var problems []string
+	if fp.recipe.Standardize && fp.recipe.Numeric != "" {
+		problems = append(problems, "the recipe can not both standardize and transform the numeric variables")
+	}
+	if f := fp.recipe.MinLevelFraction; !(f >= 0 && f < 1) {
+		problems = append(problems, fmt.Sprintf("the fraction of rare levels %v is not between 0 and 1", f))
+	}
+	if na := fp.recipe.Numeric; na != "" {
+		_, single := fp.funcs[na]
+		_, multi := fp.multiFuncs[na]
+		if !single && !multi {
+			problems = append(problems, fmt.Sprintf("recipe function '%s' for numeric variables is not defined", na))
+		}
+	}
+	if na := fp.recipe.String; na != "" {
+		if _, ok := fp.strFuncs[na]; !ok {
+			problems = append(problems, fmt.Sprintf("recipe function '%s' for string variables is not defined", na))
+		}
+	}
+
+	return problems
+}
+
+// applyRecipe returns the RPN of each formula, in which the variables
+// are replaced by calls to the functions of the recipe according to
+// their type in the data.
+func (fp *Parser) applyRecipe() [][]*token {
+
+	if fp.recipe == nil || (fp.recipe.Numeric == "" && fp.recipe.String == "" && !fp.recipe.Standardize) {
+		return fp.rpn
+	}
+
+	rpns := make([][]*token, len(fp.rpn))
+	for i, rpn := range fp.rpn {
+		if fp.lhs[i] {
+			rpns[i] = rpn
+		} else {
+			rpns[i] = fp.recipeTokens(rpn, fp.responseVars(fp.rpn, i))
+		}
+	}
+
+	return rpns
+}
+
+// recipeTokens returns a copy of rpn, with the variables replaced by
+// calls to the functions of the recipe.  A '.' is replaced by the sum
+// of the variables that it includes, other than those in skip, so
+// that these are transformed as well.
+func (fp *Parser) recipeTokens(rpn []*token, skip map[string]bool) []*token {
+
+	var out []*token
+	for _, tok := range rpn {
+		switch tok.symbol {
+		case labeled:
+			t := *tok
+			t.expr = fp.recipeTokens(tok.expr, skip)
+			out = append(out, &t)
+		case vname:
+			out = append(out, fp.recipeToken(tok))
+		case dot:
+			var n int
+			for _, na := range fp.RawData.Names() {
+				if na == fp.rowID || skip[na] {
+					continue
+				}
+				out = append(out, fp.recipeToken(&token{symbol: vname, name: na, pos: tok.pos}))
+				if n > 0 {
+					out = append(out, &token{symbol: plus, name: "+", pos: tok.pos})
+				}
+				n++
+			}
+			if n == 0 {
+				out = append(out, tok)
+			}
+		default:
+			out = append(out, tok)
+		}
+	}
+
+	return out
+}
+
+// recipeToken returns a call to the function of the recipe for the
+// type of the variable in tok, or tok if there is no such function.
+func (fp *Parser) recipeToken(tok *token) *token {
+
+	var fn string
+	switch fp.rawColumn(tok.name).(type) {
+	case []float64:
+		fn = fp.recipe.Numeric
+		if fp.recipe.Standardize {
+			fn = "standardize"
+		}
+	case []string:
+		fn = fp.recipe.String
+	}
+	if fn == "" {
+		return tok
+	}
+	name := fn + "(" + argText(tok) + ")"
+
+	return &token{symbol: funct, name: name, funcn: fn, args: []*token{tok}, pos: tok.pos}
+}
+
+// isStandardize returns true if tok is a call to the built-in function
+// standardize.
+func (fp *Parser) isStandardize(tok *token) bool {
+
+	if tok.symbol != funct || tok.funcn != "standardize" {
+		return false
+	}
+	_, single := fp.funcs[tok.funcn]
+	_, multi := fp.multiFuncs[tok.funcn]
+
+	return !single && !multi
+}
+
+// momentVars returns the variables whose means and standard
+// deviations are used, which are the arguments of standardize, or all
+// the numeric variables if the recipe standardizes them.
+func (fp *Parser) momentVars() (map[string]bool, bool) {
+
+	if fp.recipe != nil && fp.recipe.Standardize {
+		return nil, true
+	}
+
+	vars := make(map[string]bool)
+	var walk func([]*token)
+	walk = func(tokens []*token) {
+		for _, tok := range tokens {
+			switch {
+			case fp.isStandardize(tok):
+				for _, arg := range tok.args {
+					if arg.symbol == vname {
+						vars[arg.name] = true
+					}
+				}
+			case tok.symbol == funct:
+				walk(tok.args)
+			case tok.symbol == subexpr || tok.symbol == labeled:
+				walk(tok.expr)
+			}
+		}
+	}
+	for _, rpn := range fp.rpn {
+		walk(rpn)
+	}
+
+	return vars, false
+}
+
+// updateMoments adds the values of the numeric variable na to its
+// count, mean and sum of squared deviations from the mean.
+func (fp *Parser) updateMoments(na string, v []float64) {
+
+	m := fp.moments[na]
+	for _, x := range v {
+		if math.IsNaN(x) {
+			continue
+		}
+		m[0]++
+		d := x - m[1]
+		m[1] += d / m[0]
+		m[2] += d * (x - m[1])
+	}
+	fp.moments[na] = m
+}
+
+// mergeMoments returns the count, mean and sum of squared deviations
+// of the union of two sets of values, given those of each set.
+func mergeMoments(a, b [3]float64) [3]float64 {
+
+	n := a[0] + b[0]
+	if n == 0 {
+		return a
+	}
+	d := b[1] - a[1]
+
+	return [3]float64{n, a[1] + d*b[0]/n, a[2] + b[2] + d*d*a[0]*b[0]/n}
+}
+
+// standardize returns the column of a call to standardize.
+func (fp *Parser) standardize(tok *token) (*ColSet, error) {
+
+	if len(tok.args) != 1 || tok.args[0].symbol != vname {
+		return nil, fmt.Errorf("%s: standardize takes a variable", tok.name)
+	}
+
+	na := tok.args[0].name
+	x, err := fp.numeric(na)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := fp.moments[na]
+	if !ok || m[0] == 0 {
+		return nil, fmt.Errorf("%s: the variable '%s' has no mean", tok.name, na)
+	}
+	sd := 1.0
+	if m[0] > 1 && m[2] > 0 {
+		sd = math.Sqrt(m[2] / (m[0] - 1))
+	}
+
+	z := make([]float64, len(x))
+	for i, v := range x {
+		z[i] = (v - m[1]) / sd
+	}
+	o := &origin{op: "function", detail: tok.funcn, name: tok.name, inputs: []*origin{fp.varOrigin(na)}}
+
+	return &ColSet{names: []string{tok.name}, data: [][]float64{z}, origins: []*origin{o}}, nil
+}
+
+// momentState returns a copy of the moments of the variables.
+func (fp *Parser) momentState() map[string][3]float64 {
+
+	if len(fp.moments) == 0 {
+		return nil
+	}
+
+	m := make(map[string][3]float64)
+	for na, v := range fp.moments {
+		m[na] = v
+	}
+
+	return m
+}
+
+// levelFraction returns true if the rare levels of the categorical
+// variable na are pooled by the fraction of the recipe.
+func (fp *Parser) levelFraction(na string) bool {
+	return fp.recipe != nil && fp.recipe.MinLevelFraction > 0 && find(fp.vars, na) != -1
+}
+
+// countsLevels returns true if the levels of the categorical
+// variables are counted, for pooling the rare levels.
+func (fp *Parser) countsLevels() bool {
+	return fp.minLevelCount > 0 || (fp.recipe != nil && fp.recipe.MinLevelFraction > 0)
+}
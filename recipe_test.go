@@ -0,0 +1,182 @@
+package formula
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRecipe(t *testing.T) {
+
+	sfuncs := map[string]StrFunc{
+		"isb": func(na string, x []string) *ColSet {
+			y := make([]float64, len(x))
+			for i, v := range x {
+				if v == "b" {
+					y[i] = 1
+				}
+			}
+			return &ColSet{names: []string{na}, data: [][]float64{y}}
+		},
+	}
+	config := &Config{
+		Funcs:    makeFuncs(),
+		StrFuncs: sfuncs,
+		Recipe:   &Recipe{Numeric: "square", String: "isb"},
+	}
+
+	fp, err := New("x1 ~ x3 + x4 + I(x4) + z = x4:x1", simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &ColSet{
+		names: []string{"isb(x3)", "square(x4)", "I(x4)", "z"},
+		data: [][]float64{
+			{0, 1, 0, 1, 0},
+			{1, 0, 1, 0, 1},
+			{-1, 0, 1, 0, -1},
+			{0, 0, 4, 0, 16},
+		},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+
+	resp := &ColSet{names: []string{"x1"}, data: [][]float64{{0, 1, 2, 3, 4}}}
+	if !colSetEq(resp, fp.Response()) {
+		t.Errorf("Expected: %v\nObserved: %v\n", resp, fp.Response())
+	}
+
+	config.Recipe = &Recipe{Numeric: "cube"}
+	if _, err := New("x1 + x4", simpleData(), config); err == nil {
+		t.Errorf("undefined recipe function should fail")
+	}
+}
+
+func TestRecipeDot(t *testing.T) {
+
+	sfuncs := map[string]StrFunc{
+		"isb": func(na string, x []string) *ColSet {
+			y := make([]float64, len(x))
+			for i, v := range x {
+				if v == "b" {
+					y[i] = 1
+				}
+			}
+			return &ColSet{names: []string{na}, data: [][]float64{y}}
+		},
+	}
+	config := &Config{
+		Funcs:    makeFuncs(),
+		StrFuncs: sfuncs,
+		Recipe:   &Recipe{Numeric: "square", String: "isb"},
+	}
+
+	// The variables included by '.' are transformed, except for
+	// the response
+	fp, err := New("x1 ~ . - x2", simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &ColSet{
+		names: []string{"isb(x3)", "square(x4)"},
+		data: [][]float64{
+			{0, 1, 0, 1, 0},
+			{1, 0, 1, 0, 1},
+		},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+}
+
+func TestRecipeFitted(t *testing.T) {
+
+	train := mustSource([]interface{}{
+		[]float64{1, 2, 3, 4, 5},
+		[]string{"a", "a", "a", "a", "b"},
+	}, []string{"x", "s"})
+	test := mustSource([]interface{}{
+		[]float64{3, 8},
+		[]string{"b", "c"},
+	}, []string{"x", "s"})
+
+	config := &Config{
+		RefLevels: map[string]string{"s": "a"},
+		Recipe:    &Recipe{Standardize: true, MinLevelFraction: 0.3},
+	}
+	fp, err := New(".", train, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd := math.Sqrt(2.5)
+	exp := &ColSet{
+		names: []string{"standardize(x)", "s[_other_]"},
+		data: [][]float64{
+			{-2 / sd, -1 / sd, 0, 1 / sd, 2 / sd},
+			{0, 0, 0, 0, 1},
+		},
+	}
+	if ok, diff := exp.EqualTol(cols, 1e-12); !ok {
+		t.Errorf("%v", diff)
+	}
+
+	// New data are transformed with the mean, standard deviation
+	// and pooled levels of the training data, also when the codes
+	// are saved and restored
+	config2 := &Config{
+		RefLevels: map[string]string{"s": "a"},
+		Recipe:    &Recipe{Standardize: true, MinLevelFraction: 0.3},
+		Codes:     fp.Codes(),
+	}
+	fp2, err := New(".", test, config2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []*Parser{fp.WithData(test), fp2} {
+		cols, err := p.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		exp := &ColSet{
+			names: []string{"standardize(x)", "s[_other_]"},
+			data: [][]float64{
+				{0, 5 / sd},
+				{1, 0},
+			},
+		}
+		if ok, diff := exp.EqualTol(cols, 1e-12); !ok {
+			t.Errorf("%v", diff)
+		}
+	}
+
+	// The moments of shards are merged
+	a, b := new(Parser), new(Parser)
+	a.moments = map[string][3]float64{}
+	b.moments = map[string][3]float64{}
+	a.updateMoments("x", []float64{1, 2})
+	b.updateMoments("x", []float64{3, 4, 5, math.NaN()})
+	m := mergeMoments(a.moments["x"], b.moments["x"])
+	if m[0] != 5 || math.Abs(m[1]-3) > 1e-12 || math.Abs(m[2]-10) > 1e-12 {
+		t.Errorf("Unexpected moments %v", m)
+	}
+
+	for _, r := range []*Recipe{{Standardize: true, Numeric: "square"}, {MinLevelFraction: 1.5}} {
+		if _, err := New(".", train, &Config{Funcs: makeFuncs(), Recipe: r}); err == nil {
+			t.Errorf("%v should fail", r)
+		}
+	}
+}
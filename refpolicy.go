@@ -0,0 +1,168 @@
+package formula
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// RefPolicy determines the reference levels of the categorical
+// variables that have no reference level in Config.RefLevels or in
+// the formula.
+type RefPolicy int
+
+const (
+	// RefExplicit only uses the given reference levels, so that
+	// the other variables have an indicator for every level, in
+	// order of first appearance.  This is the default.
+	RefExplicit RefPolicy = iota
+
+	// RefFirst makes the first level in sorted order the
+	// reference level, as in R and in pandas.get_dummies with
+	// drop_first.
+	RefFirst
+
+	// RefLast makes the last level in sorted order the reference
+	// level, as in SAS.
+	RefLast
+)
+
+// With RefFirst or RefLast, the indicators of all the variables that
+// receive a reference level are in sorted order.  The levels are
+// sorted numerically if they are all numbers, e.g. the levels of
+// C(x), and as strings otherwise.  The levels of ordered variables
+// keep the order of Config.Ordered.
+
+// applyRefPolicy chooses the reference levels of the categorical
+// variables that do not have one, after their levels have been
+// determined from the data.
+func (fp *Parser) applyRefPolicy() {
+
+	if fp.refPolicy == RefExplicit {
+		return
+	}
+
+	var names []string
+	for na := range fp.codes {
+		if fp.refLevel(na) == "" && !fp.isOneHot(na) && fp.contrast(na) != PolyContrast && len(fp.codes[na]) > 0 {
+			names = append(names, na)
+		}
+	}
+	sort.Strings(names)
+
+	for _, na := range names {
+		// The level of pooled levels is not a reference level,
+		// and stays last
+		var levels []string
+		_, pooled := fp.codes[na][OtherLevel]
+		for _, x := range levelsByCode(fp.codes[na]) {
+			if x != OtherLevel {
+				levels = append(levels, x)
+			}
+		}
+		if len(levels) == 0 {
+			continue
+		}
+		if _, ok := fp.ordered[na]; !ok {
+			levels = sortLevels(levels)
+		}
+		ref := levels[0]
+		if fp.refPolicy == RefLast {
+			ref = levels[len(levels)-1]
+		}
+		if pooled {
+			levels = append(levels, OtherLevel)
+		}
+		fp.setAutoRef(na, ref, levels)
+	}
+}
+
+// sortLevelCodes recodes the levels of each categorical variable in
+// sorted order if Config.SortLevels is set, after the levels have
+// been determined from the data.  The declared levels, including the
+// levels of ordered variables, keep their codes.
+func (fp *Parser) sortLevelCodes() {
+
+	if !fp.sortCodes {
+		return
+	}
+
+	for na, codes := range fp.codes {
+		declared := make(map[string]bool)
+		for _, x := range fp.declaredLevels(na) {
+			declared[x] = true
+		}
+
+		var first, rest []string
+		for _, x := range levelsByCode(codes) {
+			if declared[x] {
+				first = append(first, x)
+			} else {
+				rest = append(rest, x)
+			}
+		}
+
+		sorted := make(map[string]int)
+		var fn []string
+		for _, x := range append(first, sortLevels(rest)...) {
+			sorted[x] = len(sorted)
+			fn = append(fn, fmt.Sprintf("%s[%s]", na, x))
+		}
+		fp.codes[na] = sorted
+		fp.facNames[na] = fn
+	}
+}
+
+// setAutoRef makes ref the reference level of the categorical variable
+// na, coding the other levels in the given order.
+func (fp *Parser) setAutoRef(na, ref string, levels []string) {
+
+	refs := make(map[string]string)
+	for k, v := range fp.refLevels {
+		refs[k] = v
+	}
+	refs[na] = ref
+	fp.refLevels = refs
+
+	if fp.autoRefs == nil {
+		fp.autoRefs = make(map[string]string)
+	}
+	fp.autoRefs[na] = ref
+	fp.refSeen[na] = true
+
+	codes := make(map[string]int)
+	var fn []string
+	for _, x := range levels {
+		if x != ref {
+			codes[x] = len(codes)
+			fn = append(fn, fmt.Sprintf("%s[%s]", na, x))
+		}
+	}
+	fp.codes[na] = codes
+	fp.facNames[na] = fn
+}
+
+// sortLevels returns the levels in sorted order, numerically if they
+// are all numbers.
+func sortLevels(levels []string) []string {
+
+	levels = append([]string(nil), levels...)
+	numeric := true
+	x := make(map[string]float64)
+	for _, v := range levels {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			numeric = false
+			break
+		}
+		x[v] = f
+	}
+
+	if numeric {
+		sort.SliceStable(levels, func(i, j int) bool { return x[levels[i]] < x[levels[j]] })
+	} else {
+		sort.Strings(levels)
+	}
+
+	return levels
+}
@@ -0,0 +1,102 @@
+package formula
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRefPolicy(t *testing.T) {
+
+	names := []string{"x", "z"}
+	data := []interface{}{
+		[]string{"b", "c", "a", "b"},
+		[]float64{10, 2, 2, 1},
+	}
+
+	for _, tc := range []struct {
+		policy RefPolicy
+		names  []string
+	}{
+		{RefExplicit, []string{"x[b]", "x[c]", "x[a]", "C(z)[10]", "C(z)[2]", "C(z)[1]"}},
+		{RefFirst, []string{"x[b]", "x[c]", "C(z)[2]", "C(z)[10]"}},
+		{RefLast, []string{"x[a]", "x[b]", "C(z)[1]", "C(z)[2]"}},
+	} {
+		config := &Config{RefPolicy: tc.policy}
+		fp, err := New("x + C(z)", mustSource(data, names), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cols, err := fp.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(cols.Names(), tc.names) {
+			t.Errorf("policy %d: expected %v, found %v", tc.policy, tc.names, cols.Names())
+		}
+	}
+
+	// Explicit reference levels take precedence
+	config := &Config{RefPolicy: RefFirst, RefLevels: map[string]string{"x": "c"}}
+	fp, err := New("x", mustSource(data, names), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := &ColSet{
+		names: []string{"x[b]", "x[a]"},
+		data:  [][]float64{{1, 0, 0, 1}, {0, 0, 1, 0}},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+}
+
+func TestSortLevels(t *testing.T) {
+
+	names := []string{"x", "z"}
+	data := []interface{}{
+		[]string{"b", "c", "a", "d"},
+		[]float64{10, 2, 2, 1},
+	}
+	shuffled := []interface{}{
+		[]string{"d", "a", "c", "b"},
+		[]float64{1, 2, 2, 10},
+	}
+
+	config := &Config{
+		SortLevels: true,
+		RefLevels:  map[string]string{"x": "a"},
+		Levels:     map[string][]string{"x": {"d"}},
+	}
+	exp := []string{"x[d]", "x[b]", "x[c]", "C(z)[1]", "C(z)[2]", "C(z)[10]"}
+	for _, d := range [][]interface{}{data, shuffled} {
+		fp, err := New("x + C(z)", mustSource(d, names), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cols, err := fp.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(cols.Names(), exp) {
+			t.Errorf("Expected %v, found %v", exp, cols.Names())
+		}
+	}
+
+	// The codes learned by a stream are also sorted
+	chunks := NewChunkSource(mustSource(shuffled, names))
+	s, err := NewStream([]string{"x + C(z)"}, chunks, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := s.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cols.Names(), exp) {
+		t.Errorf("Stream: expected %v, found %v", exp, cols.Names())
+	}
+}
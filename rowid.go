@@ -0,0 +1,115 @@
+package formula
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// numRows returns the number of rows in the data.
+func (fp *Parser) numRows() int {
+
+	names := fp.RawData.Names()
+	if len(names) == 0 {
+		return 0
+	}
+
+	v := reflect.ValueOf(fp.rawColumn(names[0]))
+	if v.Kind() != reflect.Slice {
+		panic("unknown type")
+	}
+
+	return v.Len()
+}
+
+// NumObs returns the number of observations (rows) in the data of the
+// most recent call to Parse, or zero if Parse has not been called.
+func (fp *Parser) NumObs() int {
+	return fp.nobs
+}
+
+// setRowIDs records the number of rows in the data, and attaches the
+// values of the row identifier variable to the design and the
+// responses.
+func (fp *Parser) setRowIDs() error {
+
+	fp.nobs = fp.numRows()
+
+	if fp.rowID == "" {
+		return nil
+	}
+
+	ids := fp.RawData.Get(fp.rowID)
+	if ids == nil {
+		return fmt.Errorf("row identifier variable '%s' not found", fp.rowID)
+	}
+	if n := reflect.ValueOf(ids).Len(); n != fp.nobs {
+		return fmt.Errorf("row identifier variable '%s' has %d values, expected %d", fp.rowID, n, fp.nobs)
+	}
+	fp.data.ids = ids
+	if fp.response != nil {
+		fp.response.ids = ids
+	}
+
+	return nil
+}
+
+// Rows returns the positions in the data of the rows of the ColSet,
+// which differ from 0, 1, ... if rows have been removed, e.g. by
+// DropNA.
+func (cs *ColSet) Rows() []int {
+
+	if cs.rows != nil {
+		return cs.rows
+	}
+
+	var n int
+	if len(cs.data) > 0 {
+		n = len(cs.data[0])
+	}
+	rows := make([]int, n)
+	for i := range rows {
+		rows[i] = i
+	}
+
+	return rows
+}
+
+// RowIDs returns the values of the row identifier variable, see
+// Config.RowID, for the rows of the ColSet.  The result has the type
+// of the variable in the data, e.g. []string, and is nil if no row
+// identifier was configured.
+func (cs *ColSet) RowIDs() interface{} {
+	return cs.ids
+}
+
+// subRows returns the positions in the data of the rows of cs at
+// positions ii.
+func (cs *ColSet) subRows(ii []int) []int {
+
+	rows := make([]int, len(ii))
+	for j, i := range ii {
+		if cs.rows != nil {
+			i = cs.rows[i]
+		}
+		rows[j] = i
+	}
+
+	return rows
+}
+
+// subIDs returns the row identifiers at positions ii, or nil if ids
+// is nil.
+func subIDs(ids interface{}, ii []int) interface{} {
+
+	if ids == nil {
+		return nil
+	}
+
+	v := reflect.ValueOf(ids)
+	sub := reflect.MakeSlice(v.Type(), len(ii), len(ii))
+	for j, i := range ii {
+		sub.Index(j).Set(v.Index(i))
+	}
+
+	return sub.Interface()
+}
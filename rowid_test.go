@@ -0,0 +1,51 @@
+package formula
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestRowIDs(t *testing.T) {
+
+	names := []string{"id", "y", "x"}
+	data := []interface{}{
+		[]string{"r1", "r2", "r3", "r4"},
+		[]float64{1, 2, 3, 4},
+		[]float64{0, math.NaN(), 2, 3},
+	}
+	fp, err := New("y ~ .", mustSource(data, names), &Config{RowID: "id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fp.NumObs() != 0 {
+		t.Errorf("NumObs should be zero before Parse")
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fp.NumObs() != 4 {
+		t.Errorf("Expected 4 observations, found %d", fp.NumObs())
+	}
+
+	// The row identifier and the response are not in the design
+	if !reflect.DeepEqual(cols.Names(), []string{"x"}) {
+		t.Errorf("Unexpected names %v", cols.Names())
+	}
+
+	sub := cols.DropNA().DropNA()
+	if !reflect.DeepEqual(sub.Rows(), []int{0, 2, 3}) {
+		t.Errorf("Unexpected rows %v", sub.Rows())
+	}
+	if !reflect.DeepEqual(sub.RowIDs(), []string{"r1", "r3", "r4"}) {
+		t.Errorf("Unexpected row ids %v", sub.RowIDs())
+	}
+	if !reflect.DeepEqual(fp.Response().RowIDs(), data[0]) {
+		t.Errorf("Unexpected response row ids %v", fp.Response().RowIDs())
+	}
+
+	if _, err := New("y ~ x", mustSource(data, names), &Config{RowID: "key"}); err == nil {
+		t.Errorf("unknown row identifier should fail")
+	}
+}
@@ -0,0 +1,185 @@
+package formula
+
+import (
+	"fmt"
+	"math"
+)
+
+// TermScore holds the screening statistics of one term of a design
+// matrix.
+type TermScore struct {
+
+	// Term is the label of the term, e.g. "x2" for the indicator
+	// columns of a factor x2.
+	Term string
+
+	// Columns are the names of the columns belonging to the term.
+	Columns []string
+
+	// Variance is the largest sample variance of the columns of
+	// the term.
+	Variance float64
+
+	// Correlation is the largest absolute correlation between a
+	// column of the term and the response, or NaN if no response
+	// was provided.
+	Correlation float64
+}
+
+// moments holds running moments of a column and the response, over
+// the rows where neither is missing.
+type moments struct {
+	n, mx, my, cxx, cyy, cxy float64
+}
+
+func (m *moments) add(x, y float64) {
+	m.n++
+	dx := x - m.mx
+	m.mx += dx / m.n
+	m.cxx += dx * (x - m.mx)
+	dy := y - m.my
+	m.my += dy / m.n
+	m.cyy += dy * (y - m.my)
+	m.cxy += dx * (y - m.my)
+}
+
+// Screener computes statistics that can be used to discard columns of
+// a design matrix that are nearly constant, or that are nearly
+// uncorrelated with a response, before fitting a model.  The design
+// matrix can be provided in chunks, e.g. from a Stream, so that the
+// screening can be done without materializing the full design.
+type Screener struct {
+	names   []string
+	terms   []string
+	mom     []moments
+	hasResp bool
+}
+
+// NewScreener returns a Screener with no data.
+func NewScreener() *Screener {
+	return new(Screener)
+}
+
+// Add includes the rows of cs in the screening statistics, with the
+// corresponding values of the response in y.  If y is nil, only the
+// variances are computed.  All chunks must have the same columns, and
+// either all or none must have a response.  Missing (NaN) values are
+// skipped.
+func (s *Screener) Add(cs *ColSet, y []float64) error {
+
+	if s.mom == nil {
+		s.names = append([]string(nil), cs.names...)
+		s.terms = make([]string, len(cs.names))
+		for j := range cs.names {
+			s.terms[j] = cs.term(j)
+		}
+		s.mom = make([]moments, len(cs.names))
+		s.hasResp = y != nil
+	} else {
+		if len(cs.names) != len(s.names) {
+			return fmt.Errorf("Screener: chunk has %d columns, expected %d", len(cs.names), len(s.names))
+		}
+		for j, na := range cs.names {
+			if na != s.names[j] {
+				return fmt.Errorf("Screener: chunk has column '%s' in position %d, expected '%s'", na, j, s.names[j])
+			}
+		}
+		if s.hasResp != (y != nil) {
+			return fmt.Errorf("Screener: a response must be given for all chunks or none")
+		}
+	}
+
+	for j, x := range cs.data {
+		if y != nil && len(y) != len(x) {
+			return fmt.Errorf("Screener: response has length %d, column '%s' has length %d", len(y), cs.names[j], len(x))
+		}
+		m := &s.mom[j]
+		for i, v := range x {
+			var u float64
+			if y != nil {
+				u = y[i]
+			}
+			if math.IsNaN(v) || math.IsNaN(u) {
+				continue
+			}
+			m.add(v, u)
+		}
+	}
+
+	return nil
+}
+
+// Scores returns the screening statistics of each term, in order of
+// the first column of each term.
+func (s *Screener) Scores() []TermScore {
+
+	var scores []TermScore
+	ix := make(map[string]int)
+	for j, t := range s.terms {
+		k, ok := ix[t]
+		if !ok {
+			k = len(scores)
+			ix[t] = k
+			scores = append(scores, TermScore{Term: t, Variance: math.NaN(), Correlation: math.NaN()})
+		}
+		sc := &scores[k]
+		sc.Columns = append(sc.Columns, s.names[j])
+
+		m := s.mom[j]
+		if m.n < 2 {
+			continue
+		}
+		v := m.cxx / (m.n - 1)
+		if math.IsNaN(sc.Variance) || v > sc.Variance {
+			sc.Variance = v
+		}
+		if s.hasResp && m.cxx > 0 && m.cyy > 0 {
+			r := math.Abs(m.cxy / math.Sqrt(m.cxx*m.cyy))
+			if math.IsNaN(sc.Correlation) || r > sc.Correlation {
+				sc.Correlation = r
+			}
+		}
+	}
+
+	return scores
+}
+
+// Select returns the terms having a column with variance greater than
+// minVar, and, if a response was provided, a column whose absolute
+// correlation with the response is at least minCor.  The terms are in
+// the order of their first columns.
+func (s *Screener) Select(minVar, minCor float64) []string {
+
+	var terms []string
+	for _, sc := range s.Scores() {
+		if !(sc.Variance > minVar) {
+			continue
+		}
+		if s.hasResp && !(sc.Correlation >= minCor) {
+			continue
+		}
+		terms = append(terms, sc.Term)
+	}
+
+	return terms
+}
+
+// SelectTerms returns a ColSet containing the columns of cs that
+// belong to the given terms, in their original order.  The data are
+// not copied.
+func (cs *ColSet) SelectTerms(terms []string) *ColSet {
+
+	keep := make(map[string]bool)
+	for _, t := range terms {
+		keep[t] = true
+	}
+
+	var ix []int
+	for j := range cs.names {
+		if keep[cs.term(j)] {
+			ix = append(ix, j)
+		}
+	}
+
+	return cs.sub(ix)
+}
@@ -0,0 +1,78 @@
+package formula
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestScreener(t *testing.T) {
+
+	formulas := []string{"x1 + x2 + x3 + x4 + x1:x4"}
+	config := &Config{RefLevels: map[string]string{"x3": "a"}}
+	y := []float64{0, 1.1, 1.9, 3.2, 4}
+
+	// Screening a chunked design gives the same result as
+	// screening the full design.
+	fp, err := NewMulti(formulas, simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s1 := NewScreener()
+	if err := s1.Add(full, y); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := NewStream(formulas, chunkedData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2 := NewScreener()
+	for _, yc := range [][]float64{y[0:3], y[3:5]} {
+		cs, err := st.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s2.Add(cs, yc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sc1, sc2 := s1.Scores(), s2.Scores()
+	if len(sc1) != 5 || len(sc2) != 5 {
+		t.Fatalf("Expected 5 terms, found %d and %d", len(sc1), len(sc2))
+	}
+	for k := range sc1 {
+		if sc1[k].Term != sc2[k].Term || !reflect.DeepEqual(sc1[k].Columns, sc2[k].Columns) {
+			t.Fail()
+		}
+		if math.Abs(sc1[k].Variance-sc2[k].Variance) > 1e-12 || math.Abs(sc1[k].Correlation-sc2[k].Correlation) > 1e-12 {
+			t.Fail()
+		}
+	}
+
+	// The variance of x1 is 2.5, and x2 has two columns
+	if math.Abs(sc1[0].Variance-2.5) > 1e-12 || !reflect.DeepEqual(sc1[1].Columns, []string{"x2[0]", "x2[1]"}) {
+		t.Fail()
+	}
+
+	terms := s1.Select(0.1, 0.8)
+	if !reflect.DeepEqual(terms, []string{"x1", "x2"}) {
+		t.Errorf("Selected %v", terms)
+	}
+	sub := full.SelectTerms(terms)
+	if !reflect.DeepEqual(sub.Names(), []string{"x1", "x2[0]", "x2[1]"}) {
+		t.Fail()
+	}
+
+	if err := s1.Add(full, nil); err == nil {
+		t.Fail()
+	}
+	if err := s1.Add(sub, y); err == nil {
+		t.Fail()
+	}
+}
@@ -0,0 +1,63 @@
+package formula
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// Simulate returns a DataSource with n rows of synthetic data that
+// conforms to the schema learned by the parser.  The variables are
+// those seen when the parser was fit, in the same order.  Values of a
+// numeric variable are drawn uniformly from the range of the variable
+// in the fitted data (variables with no observed values are NaN).
+// Values of a string variable are drawn uniformly from its levels,
+// including the reference level if one is set.  If rng is nil, a
+// generator with a fixed seed is used.
+func (fp *Parser) Simulate(n int, rng *rand.Rand) (DataSource, error) {
+
+	if fp.codes == nil {
+		return nil, fmt.Errorf("Simulate: parser has not been fit")
+	}
+
+	if rng == nil {
+		rng = rand.New(rand.NewSource(1))
+	}
+
+	data := make([]interface{}, len(fp.vars))
+	for j, na := range fp.vars {
+		if codes, ok := fp.codes[na]; ok {
+			levels := levelsByCode(codes)
+			if ref, ok := fp.refLevels[na]; ok {
+				levels = append(levels, ref)
+			}
+			if len(levels) == 0 {
+				return nil, fmt.Errorf("Simulate: variable '%s' has no levels", na)
+			}
+			x := make([]string, n)
+			for i := range x {
+				x[i] = levels[rng.Intn(len(levels))]
+			}
+			data[j] = x
+			continue
+		}
+
+		x := make([]float64, n)
+		r, ok := fp.ranges[na]
+		for i := range x {
+			if ok {
+				x[i] = r[0] + (r[1]-r[0])*rng.Float64()
+			} else {
+				x[i] = math.NaN()
+			}
+		}
+		data[j] = x
+	}
+
+	src, err := NewSource(data, append([]string(nil), fp.vars...))
+	if err != nil {
+		return nil, err
+	}
+
+	return src, nil
+}
@@ -0,0 +1,53 @@
+package formula
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSimulate(t *testing.T) {
+
+	config := &Config{RefLevels: map[string]string{"x3": "a"}}
+	fp, err := New("x1 + x2 + x3*x4", simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := fp.Simulate(200, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(src.Names(), []string{"x1", "x2", "x3", "x4"}) {
+		t.Fail()
+	}
+
+	for _, v := range src.Get("x1").([]float64) {
+		if v < 0 || v > 4 {
+			t.Fail()
+		}
+	}
+	for _, v := range src.Get("x4").([]float64) {
+		if v < -1 || v > 1 {
+			t.Fail()
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, v := range src.Get("x3").([]string) {
+		seen[v] = true
+	}
+	if !reflect.DeepEqual(seen, map[string]bool{"a": true, "b": true}) {
+		t.Fail()
+	}
+
+	// The simulated data can be scored with the fitted codes
+	fp.RawData = src
+	cs, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cs.Names(), []string{"x1", "x2[0]", "x2[1]", "x3[b]:x4"}) {
+		t.Fail()
+	}
+}
@@ -0,0 +1,194 @@
+package formula
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// The built-in function bs(x) produces a cubic B-spline basis for the
+// numeric variable x, and te(x1, x2, ...) produces the tensor product
+// of the B-spline bases of its arguments, for fitting smooth
+// surfaces.  An optional last argument gives the number of basis
+// functions for each variable, which is at least 4 and defaults to 5,
+// e.g. te(x1, x2, 6).  The knots are equally spaced over the range of
+// each variable, or with Config.QuantileKnots are at quantiles of the
+// variable, which are learned from the data along with the
+// categorical codes, so that the basis is the same for new data.
+// Values outside of the range are treated as the nearest end of the
+// range.  The columns are named like bs(x)[2] and te(x1, x2)[2.3],
+// and the columns of a basis sum to one, so the basis is collinear
+// with an intercept.  The names bs and te refer to functions in
+// Config.Funcs or Config.MultiFuncs if they are defined there.
+
+// The degree of the splines
+const splineDegree = 3
+
+// The default number of basis functions of each variable
+const defaultBasisSize = 5
+
+// isSmooth returns true if tok is a call to the built-in function bs
+// or te.
+func (fp *Parser) isSmooth(tok *token) bool {
+
+	if tok.symbol != funct || (tok.funcn != "bs" && tok.funcn != "te") {
+		return false
+	}
+	_, single := fp.funcs[tok.funcn]
+	_, multi := fp.multiFuncs[tok.funcn]
+
+	return !single && !multi
+}
+
+// smooth returns the columns of a call to bs or te.
+func (fp *Parser) smooth(tok *token) (*ColSet, error) {
+
+	// The variables, and the number of basis functions
+	vars := tok.args
+	k := defaultBasisSize
+	if n := len(vars); n > 1 && vars[n-1].symbol == number {
+		v := vars[n-1].value
+		if v != math.Floor(v) || v < splineDegree+1 {
+			return nil, fmt.Errorf("%s: the number of basis functions must be an integer of at least %d", tok.name, splineDegree+1)
+		}
+		k = int(v)
+		vars = vars[0 : n-1]
+	}
+	if tok.funcn == "bs" && len(vars) != 1 {
+		return nil, fmt.Errorf("%s: bs takes a variable and an optional number of basis functions", tok.name)
+	}
+
+	var margins [][][]float64
+	var inputs []*origin
+	for _, arg := range vars {
+		if arg.symbol != vname {
+			return nil, fmt.Errorf("%s: the arguments of %s must be variables", tok.name, tok.funcn)
+		}
+		x, err := fp.numeric(arg.name)
+		if err != nil {
+			return nil, err
+		}
+		r, ok := fp.ranges[arg.name]
+		if !ok || r[0] == r[1] {
+			return nil, fmt.Errorf("%s: the variable '%s' has no range of values", tok.name, arg.name)
+		}
+		if !fp.quantileKnots {
+			margins = append(margins, bsplineBasis(x, r[0], r[1], k))
+		} else {
+			inner, err := fp.quantileKnotsOf(arg.name, r[0], r[1], k)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", tok.name, err)
+			}
+			margins = append(margins, knotBasis(x, r[0], r[1], inner))
+		}
+		inputs = append(inputs, fp.varOrigin(arg.name))
+	}
+
+	// The tensor product, the index of the first margin varies
+	// slowest
+	cols := margins[0]
+	labels := make([]string, k)
+	for i := range labels {
+		labels[i] = strconv.Itoa(i + 1)
+	}
+	for _, m := range margins[1:] {
+		var pcols [][]float64
+		var plabels []string
+		for a, x := range cols {
+			for b, y := range m {
+				z := make([]float64, len(x))
+				for i := range z {
+					z[i] = x[i] * y[i]
+				}
+				pcols = append(pcols, z)
+				plabels = append(plabels, labels[a]+"."+strconv.Itoa(b+1))
+			}
+		}
+		cols, labels = pcols, plabels
+	}
+
+	cs := &ColSet{data: cols}
+	for _, lb := range labels {
+		na := tok.name + "[" + lb + "]"
+		cs.names = append(cs.names, na)
+		cs.origins = append(cs.origins, &origin{op: "function", detail: tok.funcn, name: na, inputs: inputs})
+	}
+
+	return cs, nil
+}
+
+// bsplineBasis returns the k cubic B-spline basis functions with
+// equally spaced knots on [lo, hi], evaluated at x.
+func bsplineBasis(x []float64, lo, hi float64, k int) [][]float64 {
+
+	inner := make([]float64, k-splineDegree-1)
+	for i := range inner {
+		inner[i] = lo + (hi-lo)*float64(i+1)/float64(len(inner)+1)
+	}
+
+	return knotBasis(x, lo, hi, inner)
+}
+
+// knotBasis returns the cubic B-spline basis functions on [lo, hi]
+// with the given increasing interior knots, evaluated at x.  Values
+// outside of [lo, hi] are moved to the nearest end, and missing
+// values give missing values in all the basis functions.
+func knotBasis(x []float64, lo, hi float64, inner []float64) [][]float64 {
+
+	// The knots, with the boundary knots repeated
+	p := splineDegree
+	k := len(inner) + p + 1
+	knots := make([]float64, 0, k+p+1)
+	for i := 0; i <= p; i++ {
+		knots = append(knots, lo)
+	}
+	knots = append(knots, inner...)
+	for i := 0; i <= p; i++ {
+		knots = append(knots, hi)
+	}
+
+	basis := make([][]float64, k)
+	for j := range basis {
+		basis[j] = make([]float64, len(x))
+	}
+
+	left := make([]float64, p+1)
+	right := make([]float64, p+1)
+	n := make([]float64, p+1)
+	for i, v := range x {
+		if math.IsNaN(v) {
+			for j := range basis {
+				basis[j][i] = math.NaN()
+			}
+			continue
+		}
+		v = math.Max(lo, math.Min(hi, v))
+
+		// The knot span containing v, the last span contains
+		// the upper end of the range
+		s := p
+		for s < k-1 && v >= knots[s+1] {
+			s++
+		}
+
+		// The non-zero basis functions at v, which are those
+		// with indices s-p, ..., s (Piegl and Tiller, A2.2)
+		n[0] = 1
+		for j := 1; j <= p; j++ {
+			left[j] = v - knots[s+1-j]
+			right[j] = knots[s+j] - v
+			saved := 0.0
+			for r := 0; r < j; r++ {
+				t := n[r] / (right[r+1] + left[j-r])
+				n[r] = saved + right[r+1]*t
+				saved = left[j-r] * t
+			}
+			n[j] = saved
+		}
+		for j := 0; j <= p; j++ {
+			basis[s-p+j][i] = n[j]
+		}
+	}
+
+	return basis
+}
@@ -0,0 +1,84 @@
+package formula
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSmooth(t *testing.T) {
+
+	fp, err := New("bs(x1) + te(x1, x4, 4)", simpleData(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := cols.Names()
+	if len(names) != 5+16 || names[0] != "bs(x1)[1]" || names[5] != "te(x1, x4, 4)[1.1]" || names[20] != "te(x1, x4, 4)[4.4]" {
+		t.Fatalf("Unexpected names %v", names)
+	}
+
+	// Each basis sums to one, the first function is one at the
+	// lower end of the range and the last is one at the upper
+	// end
+	for _, ix := range [][2]int{{0, 5}, {5, 21}} {
+		for i := 0; i < 5; i++ {
+			var s float64
+			for j := ix[0]; j < ix[1]; j++ {
+				s += cols.Data()[j][i]
+			}
+			if math.Abs(s-1) > 1e-12 {
+				t.Errorf("Basis does not sum to one in row %d", i)
+			}
+		}
+	}
+	if cols.Data()[0][0] != 1 || cols.Data()[4][4] != 1 {
+		t.Errorf("Unexpected basis %v", cols.Data()[0:5])
+	}
+
+	// With one interior knot at 2, the middle function is largest
+	// there
+	exp := []float64{0, 0.25, 0.5, 0.25, 0}
+	for i, v := range cols.Data()[2] {
+		if math.Abs(v-exp[i]) > 1e-12 {
+			t.Errorf("Expected %v, observed %v", exp, cols.Data()[2])
+			break
+		}
+	}
+
+	// The tensor product columns are products of the marginal
+	// bases
+	b1 := bsplineBasis([]float64{0, 1, 2, 3, 4}, 0, 4, 4)
+	b4 := bsplineBasis([]float64{-1, 0, 1, 0, -1}, -1, 1, 4)
+	for _, c := range [][3]int{{5, 0, 0}, {11, 1, 2}, {20, 3, 3}} {
+		for i, v := range cols.Data()[c[0]] {
+			if math.Abs(v-b1[c[1]][i]*b4[c[2]][i]) > 1e-12 {
+				t.Errorf("Unexpected tensor product column %s", names[c[0]])
+				break
+			}
+		}
+	}
+
+	// New data outside of the learned range are moved to the ends
+	// of the range
+	src := mustSource([]interface{}{[]float64{-5, 10}, []float64{0, 0}}, []string{"x1", "x4"})
+	cols, err = fp.WithData(src).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cols.Data()[0][0] != 1 || cols.Data()[4][1] != 1 {
+		t.Errorf("Unexpected basis for new data")
+	}
+
+	for _, fml := range []string{"bs(x1, 3)", "bs(x1, 4.5)", "bs(x1, x4)", "te(x1, x3)", "bs(I(x1 + 1))"} {
+		fp, err := New(fml, simpleData(), nil)
+		if err != nil {
+			continue
+		}
+		if _, err := fp.Parse(); err == nil {
+			t.Errorf("%s should fail", fml)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package formula
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+)
+
+// FeatureSpec describes the inputs and outputs of a parsed formula in
+// a form that maps onto TensorFlow feature columns and ONNX
+// preprocessing operators.  Numeric inputs correspond to numeric
+// columns, string inputs to categorical columns with a vocabulary
+// list, and the normalization constants of each output column to a
+// scaler (subtract Offset, divide by Scale).
+type FeatureSpec struct {
+
+	// Inputs are the raw variables referenced by the formulas, in
+	// order of first appearance.
+	Inputs []InputSpec `json:"inputs"`
+
+	// Columns are the columns of the design matrix, in order.
+	Columns []ColumnSpec `json:"columns"`
+}
+
+// InputSpec describes one raw input variable.
+type InputSpec struct {
+	Name string `json:"name"`
+
+	// Dtype is "float64", "string", or "date" for a string
+	// variable holding dates (see Config.DateLayouts).
+	Dtype string `json:"dtype"`
+
+	// Vocabulary contains the coded levels of a string variable,
+	// in the order of their indicator columns.
+	Vocabulary []string `json:"vocabulary,omitempty"`
+
+	// RefLevel is the level of a string variable that does not
+	// receive an indicator column, if any.
+	RefLevel string `json:"ref_level,omitempty"`
+}
+
+// ColumnSpec describes one column of the design matrix.
+type ColumnSpec struct {
+	Name   string  `json:"name"`
+	Dtype  string  `json:"dtype"`
+	Offset float64 `json:"offset"`
+	Scale  float64 `json:"scale"`
+}
+
+// levelsByCode returns the levels in a code map, ordered by their
+// integer codes.
+func levelsByCode(codes map[string]int) []string {
+	levels := make([]string, len(codes))
+	for lev, c := range codes {
+		levels[c] = lev
+	}
+	return levels
+}
+
+// varNames returns the names of the raw variables referenced by the
+// formulas, in order of first appearance.
+func (fp *Parser) varNames() []string {
+
+	var names []string
+	seen := make(map[string]bool)
+	add := func(na string) {
+		if !seen[na] && fp.RawData.Get(na) != nil {
+			seen[na] = true
+			names = append(names, na)
+		}
+	}
+
+	var walk func([]*token)
+	walk = func(rpn []*token) {
+		for _, tok := range rpn {
+			switch tok.symbol {
+			case vname:
+				add(tok.name)
+			case funct:
+				var addArgs func(*token)
+				addArgs = func(tok *token) {
+					for _, arg := range tok.args {
+						switch arg.symbol {
+						case vname:
+							add(arg.name)
+						case funct:
+							addArgs(arg)
+						case subexpr:
+							for _, t := range arg.expr {
+								if t.symbol == vname {
+									add(t.name)
+								} else if t.symbol == funct {
+									addArgs(t)
+								}
+							}
+						}
+					}
+				}
+				addArgs(tok)
+			case labeled:
+				walk(tok.expr)
+			case dot:
+				for _, na := range fp.RawData.Names() {
+					add(na)
+				}
+			}
+		}
+	}
+	for _, rpn := range fp.rpn {
+		walk(rpn)
+	}
+
+	return names
+}
+
+// FeatureSpec returns a specification of the features used by, and
+// produced by, the parser.  Parse must have been called before
+// calling FeatureSpec.  The Offset and Scale of each column are its
+// sample mean and standard deviation, ignoring missing values.
+func (fp *Parser) FeatureSpec() (*FeatureSpec, error) {
+
+	if fp.data == nil {
+		return nil, fmt.Errorf("FeatureSpec: Parse has not been called")
+	}
+
+	spec := new(FeatureSpec)
+
+	for _, na := range fp.varNames() {
+		switch dt := fp.dtype(fp.RawData, na); dt {
+		case "float64", "date":
+			spec.Inputs = append(spec.Inputs, InputSpec{Name: na, Dtype: dt})
+		case "string":
+			spec.Inputs = append(spec.Inputs, InputSpec{
+				Name:       na,
+				Dtype:      "string",
+				Vocabulary: levelsByCode(fp.codes[na]),
+				RefLevel:   fp.refLevels[na],
+			})
+		}
+	}
+
+	for j, na := range fp.data.names {
+		mean, sd := meanSD(fp.data.data[j])
+		spec.Columns = append(spec.Columns, ColumnSpec{Name: na, Dtype: "float64", Offset: mean, Scale: sd})
+	}
+
+	return spec, nil
+}
+
+// WriteFeatureSpec writes the feature specification of the parser to
+// w as indented JSON.
+func (fp *Parser) WriteFeatureSpec(w io.Writer) error {
+
+	spec, err := fp.FeatureSpec()
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(spec)
+}
+
+// meanSD returns the mean and standard deviation of the non-missing
+// values in x.
+func meanSD(x []float64) (float64, float64) {
+
+	var n, sum, ss float64
+	for _, v := range x {
+		if !math.IsNaN(v) {
+			n++
+			sum += v
+		}
+	}
+	if n == 0 {
+		return math.NaN(), math.NaN()
+	}
+	mean := sum / n
+
+	for _, v := range x {
+		if !math.IsNaN(v) {
+			ss += (v - mean) * (v - mean)
+		}
+	}
+
+	return mean, math.Sqrt(ss / n)
+}
@@ -0,0 +1,61 @@
+package formula
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestFeatureSpec(t *testing.T) {
+
+	rawData := simpleData()
+	config := &Config{RefLevels: map[string]string{"x3": "a"}, Funcs: makeFuncs()}
+	fp, err := New("x1 + x3 + square(x4)", rawData, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fp.FeatureSpec(); err == nil {
+		t.Fatal("FeatureSpec should fail before Parse")
+	}
+
+	if _, err := fp.Parse(); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := fp.WriteFeatureSpec(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var spec FeatureSpec
+	if err := json.Unmarshal(buf.Bytes(), &spec); err != nil {
+		t.Fatal(err)
+	}
+
+	expIn := []InputSpec{
+		{Name: "x1", Dtype: "float64"},
+		{Name: "x3", Dtype: "string", Vocabulary: []string{"b"}, RefLevel: "a"},
+		{Name: "x4", Dtype: "float64"},
+	}
+	if !reflect.DeepEqual(spec.Inputs, expIn) {
+		t.Fatalf("Expected %v, observed %v", expIn, spec.Inputs)
+	}
+
+	expCol := []ColumnSpec{
+		{Name: "x1", Dtype: "float64", Offset: 2, Scale: 1.414214},
+		{Name: "x3[b]", Dtype: "float64", Offset: 0.4, Scale: 0.489898},
+		{Name: "square(x4)", Dtype: "float64", Offset: 0.6, Scale: 0.489898},
+	}
+	if len(spec.Columns) != len(expCol) {
+		t.Fatalf("Expected %v, observed %v", expCol, spec.Columns)
+	}
+	for j, c := range spec.Columns {
+		e := expCol[j]
+		if c.Name != e.Name || c.Dtype != e.Dtype || math.Abs(c.Offset-e.Offset) > 1e-5 || math.Abs(c.Scale-e.Scale) > 1e-5 {
+			t.Fatalf("Expected %v, observed %v", e, c)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package formula
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// TimeWindows specifies how a time-indexed dataset is split into
+// training and validation windows.  Each cutoff defines one split,
+// in which the validation window starts at the cutoff and the
+// training window ends just before it.  A single cutoff gives a fixed
+// split, and a sequence of cutoffs gives rolling splits.
+type TimeWindows struct {
+
+	// Cutoffs are the start times of the validation windows.
+	Cutoffs []float64
+
+	// Window is the length of each training window.  If zero,
+	// each training window contains all the rows before its
+	// cutoff.
+	Window float64
+
+	// Horizon is the length of each validation window.  If zero,
+	// each validation window contains all the rows from its
+	// cutoff on.
+	Horizon float64
+}
+
+// TimeSplit holds the training and validation windows of a
+// time-indexed dataset.
+type TimeSplit struct {
+
+	// Cutoff is the first time in the validation window.
+	Cutoff float64
+
+	// Train holds the rows with times in [Cutoff - Window,
+	// Cutoff).
+	Train DataSource
+
+	// Valid holds the rows with times in [Cutoff, Cutoff +
+	// Horizon).
+	Valid DataSource
+}
+
+// SplitByTime splits the rows of src into training and validation
+// windows according to the values of the numeric or integer variable
+// timevar.
+// Rows with a missing time are not in any window.  An error is
+// returned if a training or validation window is empty.  The data
+// are copied.
+func SplitByTime(src DataSource, timevar string, w *TimeWindows) ([]*TimeSplit, error) {
+
+	// Integer times, e.g. years, are numeric
+	tm, ok := new(Parser).convertData(timevar, src.Get(timevar)).([]float64)
+	if !ok {
+		return nil, fmt.Errorf("SplitByTime: '%s' is not a numeric variable", timevar)
+	}
+
+	var splits []*TimeSplit
+	for _, cutoff := range w.Cutoffs {
+		var train, valid []int
+		for i, t := range tm {
+			switch {
+			case math.IsNaN(t):
+			case t < cutoff && (w.Window == 0 || t >= cutoff-w.Window):
+				train = append(train, i)
+			case t >= cutoff && (w.Horizon == 0 || t < cutoff+w.Horizon):
+				valid = append(valid, i)
+			}
+		}
+		if len(train) == 0 {
+			return nil, fmt.Errorf("SplitByTime: no training rows before cutoff %v", cutoff)
+		}
+		if len(valid) == 0 {
+			return nil, fmt.Errorf("SplitByTime: no validation rows after cutoff %v", cutoff)
+		}
+
+		ts := &TimeSplit{Cutoff: cutoff}
+		var err error
+		if ts.Train, err = selectRows(src, train); err != nil {
+			return nil, fmt.Errorf("SplitByTime: %v", err)
+		}
+		if ts.Valid, err = selectRows(src, valid); err != nil {
+			return nil, fmt.Errorf("SplitByTime: %v", err)
+		}
+		splits = append(splits, ts)
+	}
+
+	return splits, nil
+}
+
+// Parsers returns parsers for the training and validation windows of
+// the split.  The categorical codes of both parsers are learned from
+// the training window only, so that no information from the
+// validation window leaks into the coding.
+func (ts *TimeSplit) Parsers(formulas []string, config *Config) (*Parser, *Parser, error) {
+
+	train, err := NewMulti(formulas, ts.Train, config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return train, train.WithData(ts.Valid), nil
+}
+
+// Fold holds the training and validation sets of one fold of a
+// grouped cross-validation.  All the rows of a group are in the same
+// set, so that correlated observations, e.g. repeated measurements of
+// a subject, never straddle the two sets.
+type Fold struct {
+
+	// Groups are the groups in the validation set.
+	Groups []string
+
+	// Train holds the rows of the groups that are not in the
+	// validation set.
+	Train DataSource
+
+	// Valid holds the rows of the groups in Groups.
+	Valid DataSource
+}
+
+// GroupKFold splits the rows of src into k folds for
+// cross-validation, such that each group, identified by the value of
+// groupvar, is in the validation set of exactly one fold.  Larger
+// groups are assigned first, each to the fold with the fewest rows,
+// so that the folds have similar numbers of rows.  The group variable
+// can be a string or numeric variable, and rows with a missing
+// (NaN) group are not in any fold.  An error is returned if there
+// are fewer than k groups.  The data are copied.
+func GroupKFold(src DataSource, groupvar string, k int) ([]*Fold, error) {
+
+	groups, rows, err := groupRows(src, groupvar)
+	if err != nil {
+		return nil, fmt.Errorf("GroupKFold: %v", err)
+	}
+	if k < 2 || k > len(groups) {
+		return nil, fmt.Errorf("GroupKFold: can not make %d folds from %d groups", k, len(groups))
+	}
+
+	// The groups in order of decreasing size, ties in order of
+	// first appearance
+	order := append([]string(nil), groups...)
+	sort.SliceStable(order, func(i, j int) bool { return len(rows[order[i]]) > len(rows[order[j]]) })
+
+	assign := make([][]string, k)
+	size := make([]int, k)
+	for _, g := range order {
+		f := 0
+		for j := range size {
+			if size[j] < size[f] {
+				f = j
+			}
+		}
+		assign[f] = append(assign[f], g)
+		size[f] += len(rows[g])
+	}
+
+	// Restore the order of first appearance within each fold
+	pos := make(map[string]int)
+	for i, g := range groups {
+		pos[g] = i
+	}
+	for _, a := range assign {
+		sort.Slice(a, func(i, j int) bool { return pos[a[i]] < pos[a[j]] })
+	}
+
+	folds, err := makeFolds(src, rows, assign)
+	if err != nil {
+		return nil, fmt.Errorf("GroupKFold: %v", err)
+	}
+
+	return folds, nil
+}
+
+// LeaveOneGroupOut splits the rows of src into one fold per group,
+// identified by the value of groupvar, in which the validation set
+// holds the rows of the group and the training set holds the rows of
+// the other groups.  The folds are in order of the first appearance
+// of their groups.  Rows with a missing (NaN) group are not in any
+// fold.  The data are copied.
+func LeaveOneGroupOut(src DataSource, groupvar string) ([]*Fold, error) {
+
+	groups, rows, err := groupRows(src, groupvar)
+	if err != nil {
+		return nil, fmt.Errorf("LeaveOneGroupOut: %v", err)
+	}
+	if len(groups) < 2 {
+		return nil, fmt.Errorf("LeaveOneGroupOut: there must be at least two groups")
+	}
+
+	assign := make([][]string, len(groups))
+	for i, g := range groups {
+		assign[i] = []string{g}
+	}
+
+	folds, err := makeFolds(src, rows, assign)
+	if err != nil {
+		return nil, fmt.Errorf("LeaveOneGroupOut: %v", err)
+	}
+
+	return folds, nil
+}
+
+// Parsers returns parsers for the training and validation sets of
+// the fold.  The categorical codes of both parsers are learned from
+// the training set only.
+func (f *Fold) Parsers(formulas []string, config *Config) (*Parser, *Parser, error) {
+
+	train, err := NewMulti(formulas, f.Train, config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return train, train.WithData(f.Valid), nil
+}
+
+// groupRows returns the distinct values of the group variable in
+// order of first appearance, and the rows holding each value.
+func groupRows(src DataSource, groupvar string) ([]string, map[string][]int, error) {
+
+	var groups []string
+	rows := make(map[string][]int)
+	add := func(i int, g string) {
+		if _, ok := rows[g]; !ok {
+			groups = append(groups, g)
+		}
+		rows[g] = append(rows[g], i)
+	}
+
+	switch x := src.Get(groupvar).(type) {
+	case []string:
+		for i, g := range x {
+			add(i, g)
+		}
+	case []float64:
+		for i, v := range x {
+			if !math.IsNaN(v) {
+				add(i, formatLevel(v))
+			}
+		}
+	case []int:
+		for i, v := range x {
+			add(i, strconv.Itoa(v))
+		}
+	case []int64:
+		for i, v := range x {
+			add(i, strconv.FormatInt(v, 10))
+		}
+	case []bool:
+		for i, v := range x {
+			add(i, strconv.FormatBool(v))
+		}
+	default:
+		return nil, nil, fmt.Errorf("'%s' is not a string, numeric, integer or boolean variable", groupvar)
+	}
+
+	return groups, rows, nil
+}
+
+// makeFolds returns the folds whose validation sets hold the rows of
+// the groups assigned to them.
+func makeFolds(src DataSource, rows map[string][]int, assign [][]string) ([]*Fold, error) {
+
+	// The fold of each row, -1 if the row is in no fold
+	fold := make([]int, numRows(src))
+	for i := range fold {
+		fold[i] = -1
+	}
+	for f, a := range assign {
+		for _, g := range a {
+			for _, i := range rows[g] {
+				fold[i] = f
+			}
+		}
+	}
+
+	var folds []*Fold
+	for f, a := range assign {
+		var train, valid []int
+		for i, j := range fold {
+			switch {
+			case j == f:
+				valid = append(valid, i)
+			case j != -1:
+				train = append(train, i)
+			}
+		}
+
+		fd := &Fold{Groups: a}
+		var err error
+		if fd.Train, err = selectRows(src, train); err != nil {
+			return nil, err
+		}
+		if fd.Valid, err = selectRows(src, valid); err != nil {
+			return nil, err
+		}
+		folds = append(folds, fd)
+	}
+
+	return folds, nil
+}
+
+// selectRows returns a DataSource containing the given rows of src.
+func selectRows(src DataSource, ix []int) (DataSource, error) {
+
+	names := src.Names()
+	data := make([]interface{}, len(names))
+	for j, na := range names {
+		switch x := src.Get(na).(type) {
+		case []float64:
+			y := make([]float64, len(ix))
+			for k, i := range ix {
+				y[k] = x[i]
+			}
+			data[j] = y
+		case []string:
+			y := make([]string, len(ix))
+			for k, i := range ix {
+				y[k] = x[i]
+			}
+			data[j] = y
+		case []int:
+			y := make([]int, len(ix))
+			for k, i := range ix {
+				y[k] = x[i]
+			}
+			data[j] = y
+		case []int64:
+			y := make([]int64, len(ix))
+			for k, i := range ix {
+				y[k] = x[i]
+			}
+			data[j] = y
+		case []bool:
+			y := make([]bool, len(ix))
+			for k, i := range ix {
+				y[k] = x[i]
+			}
+			data[j] = y
+		default:
+			return nil, fmt.Errorf("variable '%s' has unsupported type %T", na, x)
+		}
+	}
+
+	return NewSource(data, append([]string(nil), names...))
+}
@@ -0,0 +1,186 @@
+package formula
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestSplitByTime(t *testing.T) {
+
+	src := mustSource([]interface{}{
+		[]float64{1, 2, 3, 4, 5, 6, math.NaN()},
+		[]string{"a", "a", "b", "a", "c", "b", "c"},
+		[]float64{1, 2, 3, 4, 5, 6, 7},
+	}, []string{"t", "g", "x"})
+
+	splits, err := SplitByTime(src, "t", &TimeWindows{Cutoffs: []float64{3, 5}, Window: 2, Horizon: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(splits) != 2 {
+		t.Fatalf("Expected 2 splits, got %d", len(splits))
+	}
+	if !reflect.DeepEqual(splits[0].Train.Get("x"), []float64{1, 2}) || !reflect.DeepEqual(splits[0].Valid.Get("x"), []float64{3}) {
+		t.Errorf("Unexpected first split")
+	}
+	if !reflect.DeepEqual(splits[1].Train.Get("g"), []string{"b", "a"}) || !reflect.DeepEqual(splits[1].Valid.Get("g"), []string{"c"}) {
+		t.Errorf("Unexpected second split")
+	}
+
+	// Expanding training window, validation to the end
+	splits, err = SplitByTime(src, "t", &TimeWindows{Cutoffs: []float64{4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(splits[0].Train.Get("x"), []float64{1, 2, 3}) || !reflect.DeepEqual(splits[0].Valid.Get("x"), []float64{4, 5, 6}) {
+		t.Errorf("Unexpected split")
+	}
+
+	// The codes are learned from the training window, the level c
+	// only appears in the validation window
+	train, valid, err := splits[0].Parsers([]string{"g + x"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := train.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	cols, err := valid.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := &ColSet{
+		names: []string{"g[a]", "g[b]", "x"},
+		data: [][]float64{
+			{1, 0, 0},
+			{0, 0, 1},
+			{4, 5, 6},
+		},
+	}
+	if !colSetEq(exp, cols) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cols)
+	}
+
+	for _, w := range []*TimeWindows{{Cutoffs: []float64{1}}, {Cutoffs: []float64{7}}} {
+		if _, err := SplitByTime(src, "t", w); err == nil {
+			t.Errorf("%v should fail", w.Cutoffs)
+		}
+	}
+	if _, err := SplitByTime(src, "g", &TimeWindows{Cutoffs: []float64{3}}); err == nil {
+		t.Errorf("A string time variable should fail")
+	}
+}
+
+func TestGroupKFold(t *testing.T) {
+
+	src := mustSource([]interface{}{
+		[]float64{1, 1, 2, 3, 3, 3, 4, math.NaN(), 2},
+		[]string{"a", "b", "a", "b", "a", "b", "c", "a", "c"},
+		[]float64{1, 2, 3, 4, 5, 6, 7, 8, 9},
+	}, []string{"id", "g", "x"})
+
+	folds, err := GroupKFold(src, "id", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Group 3 has three rows and goes to the first fold, then
+	// groups 1 and 2 to the second fold, and group 4 to the first
+	if len(folds) != 2 {
+		t.Fatalf("Expected 2 folds, got %d", len(folds))
+	}
+	if !reflect.DeepEqual(folds[0].Groups, []string{"3", "4"}) || !reflect.DeepEqual(folds[1].Groups, []string{"1", "2"}) {
+		t.Errorf("Unexpected groups %v %v", folds[0].Groups, folds[1].Groups)
+	}
+	if !reflect.DeepEqual(folds[0].Valid.Get("x"), []float64{4, 5, 6, 7}) || !reflect.DeepEqual(folds[0].Train.Get("x"), []float64{1, 2, 3, 9}) {
+		t.Errorf("Unexpected first fold")
+	}
+	if !reflect.DeepEqual(folds[1].Valid.Get("x"), []float64{1, 2, 3, 9}) || !reflect.DeepEqual(folds[1].Train.Get("x"), []float64{4, 5, 6, 7}) {
+		t.Errorf("Unexpected second fold")
+	}
+
+	if _, err := GroupKFold(src, "id", 5); err == nil {
+		t.Errorf("Expected an error for too many folds")
+	}
+
+	// Leave one group out, with a string group variable
+	folds, err = LeaveOneGroupOut(src, "g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(folds) != 3 || !reflect.DeepEqual(folds[2].Groups, []string{"c"}) {
+		t.Fatalf("Unexpected folds")
+	}
+	if !reflect.DeepEqual(folds[2].Valid.Get("x"), []float64{7, 9}) || !reflect.DeepEqual(folds[2].Train.Get("x"), []float64{1, 2, 3, 4, 5, 6, 8}) {
+		t.Errorf("Unexpected third fold")
+	}
+
+	// The codes are learned from the training set, the level c
+	// only appears in the validation set
+	train, valid, err := folds[2].Parsers([]string{"g + x"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := train.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	cols, err := valid.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cols.Names(), []string{"g[a]", "g[b]", "x"}) || !reflect.DeepEqual(cols.Data()[0], []float64{0, 0}) {
+		t.Errorf("Unexpected validation design %v %v", cols.Names(), cols.Data())
+	}
+}
+
+func TestSplitIntBool(t *testing.T) {
+
+	src := mustSource([]interface{}{
+		[]int{2001, 2002, 2003, 2003, 2004},
+		[]int64{7, 8, 7, 9, 8},
+		[]bool{true, false, true, true, false},
+		[]float64{1, 2, 3, 4, 5},
+	}, []string{"year", "id", "flag", "x"})
+
+	// An integer time variable, and the selected rows of the
+	// integer and boolean variables
+	splits, err := SplitByTime(src, "year", &TimeWindows{Cutoffs: []float64{2003}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp := splits[0]
+	if !reflect.DeepEqual(sp.Train.Get("year"), []int{2001, 2002}) || !reflect.DeepEqual(sp.Valid.Get("id"), []int64{7, 9, 8}) ||
+		!reflect.DeepEqual(sp.Valid.Get("flag"), []bool{true, true, false}) {
+		t.Errorf("Unexpected split %v %v", sp.Train, sp.Valid)
+	}
+
+	// Integer and boolean group variables
+	folds, err := GroupKFold(src, "id", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(folds[0].Groups, []string{"7", "9"}) || !reflect.DeepEqual(folds[0].Valid.Get("x"), []float64{1, 3, 4}) {
+		t.Errorf("Unexpected first fold %v", folds[0].Groups)
+	}
+	if !reflect.DeepEqual(folds[1].Train.Get("year"), []int{2001, 2003, 2003}) {
+		t.Errorf("Unexpected training years %v", folds[1].Train.Get("year"))
+	}
+
+	folds, err = LeaveOneGroupOut(src, "flag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(folds) != 2 || !reflect.DeepEqual(folds[0].Groups, []string{"true"}) ||
+		!reflect.DeepEqual(folds[0].Train.Get("flag"), []bool{false, false}) {
+		t.Errorf("Unexpected folds %v", folds)
+	}
+
+	folds, err = LeaveOneGroupOut(src, "year")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(folds) != 4 || !reflect.DeepEqual(folds[2].Valid.Get("id"), []int64{7, 9}) {
+		t.Errorf("Unexpected folds by year")
+	}
+}
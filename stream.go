@@ -0,0 +1,461 @@
+package formula
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// ChunkSource provides a dataset as a sequence of chunks, each of
+// which is a DataSource holding consecutive rows of the full dataset.
+// All chunks must have the same variables.
+type ChunkSource interface {
+
+	// Chunk returns the chunk with the given (0-based) index, or
+	// nil if there is no such chunk.
+	Chunk(int) (DataSource, error)
+}
+
+type chunkSlice []DataSource
+
+// Chunk returns the i'th chunk.
+func (c chunkSlice) Chunk(i int) (DataSource, error) {
+	if i >= len(c) {
+		return nil, nil
+	}
+	return c[i], nil
+}
+
+// NewChunkSource returns a ChunkSource that produces the given
+// chunks in order.
+func NewChunkSource(chunks ...DataSource) ChunkSource {
+	return chunkSlice(chunks)
+}
+
+// Checkpoint records the progress of a Stream, so that an
+// interrupted job can be resumed.  A Checkpoint can be serialized as
+// JSON.
+type Checkpoint struct {
+
+	// Fitted is true if the pass over the data that determines
+	// the categorical codes is complete.
+	Fitted bool
+
+	// Chunk is the index of the next chunk to be processed in the
+	// current pass.
+	Chunk int
+
+	// NumObs is the number of rows processed in the current pass.
+	NumObs int
+
+	// Codes and FacNames are the categorical codes and indicator
+	// names accumulated so far.
+	Codes    map[string]map[string]int
+	FacNames map[string][]string
+
+	// Ranges holds the minimum and maximum values of the numeric
+	// variables seen so far.
+	Ranges map[string][2]float64
+
+	// Variables are the names of the variables seen so far, in
+	// order of first appearance.
+	Variables []string
+
+	// RefSeen holds the categorical variables whose reference
+	// levels have been seen so far.
+	RefSeen map[string]bool
+
+	// AutoRefs holds the reference levels chosen by
+	// Config.RefPolicy at the end of the first pass.
+	AutoRefs map[string]string
+
+	// LevelCounts holds the number of times that each level was
+	// seen so far, if Config.MinLevelCount is set, and Pooled
+	// holds the levels pooled at the end of the first pass.
+	LevelCounts map[string]map[string]int
+	Pooled      map[string][]string
+
+	// Versions holds the versions of the variables seen so far,
+	// see VersionedSource.
+	Versions map[string]string
+
+	// TopCounts holds the count and the maximum overcount of each
+	// counted level of each variable, if Config.TopLevels is set.
+	TopCounts map[string]map[string][2]int
+
+	// Quantiles holds the sketches of the quantiles of the numeric
+	// variables seen so far, see Codes.
+	Quantiles map[string]*quantileSketch
+
+	// Moments holds the count, mean and sum of squared deviations
+	// of the numeric variables seen so far, see Recipe.
+	Moments map[string][3]float64
+
+	// DateLayouts holds the layouts of the date variables fixed
+	// so far, see Config.DateLayouts.
+	DateLayouts map[string]string
+}
+
+// Stream produces a design matrix chunk by chunk from a dataset that
+// is too large to process at once.  The data are visited twice: a
+// first pass (Fit) determines the coding of the categorical
+// variables, and a second pass (Next) produces the design matrix.
+// Progress in both passes can be saved with Checkpoint and restored
+// with ResumeStream.
+type Stream struct {
+
+	// Chunks provides the data.
+	Chunks ChunkSource
+
+	// If not nil, OnCheckpoint is called with the current
+	// checkpoint after each chunk is processed during Fit.
+	OnCheckpoint func(*Checkpoint) error
+
+	// If positive, Fit starts with a pass over the chunks that
+	// estimates the number of levels of each categorical
+	// variable, see EstimateLevels, and returns an error before
+	// learning any codes if a variable has more than MaxLevels
+	// levels.
+	MaxLevels int
+
+	// Used to code and parse each chunk
+	fp *Parser
+
+	fitted bool
+	chunk  int
+	nobs   int
+}
+
+// NewStream returns a Stream that applies the given formulas to the
+// chunks of a dataset.
+func NewStream(formulas []string, chunks ChunkSource, config *Config) (*Stream, error) {
+
+	fp := &Parser{Formulas: formulas}
+	fp.configure(config)
+	if err := fp.compile(); err != nil {
+		return nil, err
+	}
+	if err := fp.validate(); err != nil {
+		return nil, err
+	}
+	if fp.blockScaling != NoBlockScaling {
+		return nil, fmt.Errorf("block scaling is not supported by streams")
+	}
+	if fp.weightScaling == RelativeWeights && (fp.fitted == nil || fp.fitted.MeanWeight <= 0) {
+		return nil, fmt.Errorf("relative weight scaling is only supported by streams with fitted codes")
+	}
+	fp.resetCodes()
+
+	// Codes learned by another parser make the first pass
+	// unnecessary
+	if fp.fitted != nil {
+		fp.setFitted(fp.fitted)
+		if err := fp.checkRefLevels(); err != nil {
+			return nil, err
+		}
+		return &Stream{Chunks: chunks, fp: fp, fitted: true}, nil
+	}
+
+	return &Stream{Chunks: chunks, fp: fp}, nil
+}
+
+// ResumeStream returns a Stream that continues the work of a previous
+// Stream from the given checkpoint.  The formulas, chunks and
+// configuration must be the same as those of the original Stream.
+func ResumeStream(formulas []string, chunks ChunkSource, config *Config, cp *Checkpoint) (*Stream, error) {
+
+	s, err := NewStream(formulas, chunks, config)
+	if err != nil {
+		return nil, err
+	}
+
+	s.fitted = cp.Fitted
+	s.chunk = cp.Chunk
+	s.nobs = cp.NumObs
+	for na, codes := range cp.Codes {
+		s.fp.codes[na] = copyCodes(codes)
+	}
+	for na, fn := range cp.FacNames {
+		s.fp.facNames[na] = append([]string(nil), fn...)
+	}
+	for na, r := range cp.Ranges {
+		s.fp.ranges[na] = r
+	}
+	s.fp.vars = append([]string(nil), cp.Variables...)
+	for na, seen := range cp.RefSeen {
+		s.fp.refSeen[na] = seen
+	}
+	for na, counts := range cp.LevelCounts {
+		s.fp.levelCounts[na] = copyCodes(counts)
+	}
+	for na, rare := range cp.Pooled {
+		s.fp.setPooled(na, rare)
+	}
+	for na, ref := range cp.AutoRefs {
+		s.fp.setAutoRef(na, ref, levelsByCode(s.fp.codes[na]))
+	}
+	for na, v := range cp.Versions {
+		s.fp.versions[na] = v
+	}
+	for na, q := range cp.Quantiles {
+		s.fp.quantiles[na] = q.copy()
+	}
+	for na, m := range cp.Moments {
+		s.fp.moments[na] = m
+	}
+	for na, layout := range cp.DateLayouts {
+		s.fp.layouts[na] = layout
+	}
+	for na, m := range cp.TopCounts {
+		if s.fp.heavy != nil && !s.fitted {
+			ss := newSpaceSaving(heavyFactor * s.fp.topLevels)
+			ss.setState(m)
+			s.fp.heavy[na] = ss
+		}
+	}
+
+	return s, nil
+}
+
+// Checkpoint returns a snapshot of the current progress of the
+// stream.
+func (s *Stream) Checkpoint() *Checkpoint {
+
+	cp := &Checkpoint{
+		Fitted:    s.fitted,
+		Chunk:     s.chunk,
+		NumObs:    s.nobs,
+		Codes:     make(map[string]map[string]int),
+		FacNames:  make(map[string][]string),
+		Ranges:    make(map[string][2]float64),
+		Variables: append([]string(nil), s.fp.vars...),
+		RefSeen:   make(map[string]bool),
+	}
+	for na, codes := range s.fp.codes {
+		cp.Codes[na] = copyCodes(codes)
+	}
+	for na, fn := range s.fp.facNames {
+		cp.FacNames[na] = append([]string(nil), fn...)
+	}
+	for na, r := range s.fp.ranges {
+		cp.Ranges[na] = r
+	}
+	for na, seen := range s.fp.refSeen {
+		cp.RefSeen[na] = seen
+	}
+	for na, counts := range s.fp.levelCounts {
+		if cp.LevelCounts == nil {
+			cp.LevelCounts = make(map[string]map[string]int)
+		}
+		cp.LevelCounts[na] = copyCodes(counts)
+	}
+	cp.Pooled = s.fp.pooledLevels()
+	if len(s.fp.versions) > 0 {
+		cp.Versions = s.fp.Versions()
+	}
+	if !s.fitted {
+		cp.TopCounts = s.fp.heavyState()
+	}
+	cp.Quantiles = s.fp.quantileState()
+	cp.Moments = s.fp.momentState()
+	for na, layout := range s.fp.layouts {
+		if cp.DateLayouts == nil {
+			cp.DateLayouts = make(map[string]string)
+		}
+		cp.DateLayouts[na] = layout
+	}
+	for na, ref := range s.fp.autoRefs {
+		if cp.AutoRefs == nil {
+			cp.AutoRefs = make(map[string]string)
+		}
+		cp.AutoRefs[na] = ref
+	}
+
+	return cp
+}
+
+func copyCodes(codes map[string]int) map[string]int {
+	c := make(map[string]int, len(codes))
+	for k, v := range codes {
+		c[k] = v
+	}
+	return c
+}
+
+// Fit makes a pass over the remaining chunks to determine the codes of
+// the categorical variables.  It does nothing if the stream has
+// already been fit.
+func (s *Stream) Fit() error {
+
+	if !s.fitted && s.chunk == 0 && s.MaxLevels > 0 {
+		if err := s.checkLevels(); err != nil {
+			return err
+		}
+	}
+
+	for !s.fitted {
+		chunk, err := s.Chunks.Chunk(s.chunk)
+		if err != nil {
+			return err
+		}
+
+		if chunk == nil {
+			s.fp.selectTopLevels()
+			s.fp.sortLevelCodes()
+			s.fp.poolLevels()
+			s.fp.applyRefPolicy()
+			if err := s.fp.checkRefLevels(); err != nil {
+				return err
+			}
+
+			// Start the second pass
+			s.fitted = true
+			s.chunk = 0
+			s.nobs = 0
+		} else {
+			s.fp.updateCodes(chunk)
+			s.chunk++
+			s.nobs += numRows(chunk)
+		}
+
+		if s.OnCheckpoint != nil {
+			if err := s.OnCheckpoint(s.Checkpoint()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Next returns the design matrix for the next chunk of data, or
+// io.EOF if all chunks have been processed.  Fit is called first if
+// the stream has not been fit.
+func (s *Stream) Next() (*ColSet, error) {
+
+	if err := s.Fit(); err != nil {
+		return nil, err
+	}
+
+	chunk, err := s.Chunks.Chunk(s.chunk)
+	if err != nil {
+		return nil, err
+	}
+	if chunk == nil {
+		return nil, io.EOF
+	}
+
+	s.fp.RawData = chunk
+	cs, err := s.fp.Parse()
+	if err != nil {
+		return nil, fmt.Errorf("chunk %d: %v", s.chunk, err)
+	}
+	s.chunk++
+	s.nobs += numRows(chunk)
+
+	return cs, nil
+}
+
+// ChunkIterator produces a design matrix in chunks of rows, e.g. a
+// Stream.  Next returns io.EOF after the last chunk.
+type ChunkIterator interface {
+	Next() (*ColSet, error)
+}
+
+// CollectChunks concatenates the chunks produced by iter into a single
+// ColSet.  All chunks must have the same columns, in the same order.
+// If maxBytes is positive, an error is returned as soon as the data of
+// the collected chunks would occupy more than maxBytes bytes.  The
+// row identifiers, see Config.RowID, are concatenated as well.
+func CollectChunks(iter ChunkIterator, maxBytes int64) (*ColSet, error) {
+
+	var rslt *ColSet
+	var size int64
+	for k := 0; ; k++ {
+		cs, err := iter.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if rslt == nil {
+			rslt = &ColSet{
+				names:   append([]string(nil), cs.names...),
+				data:    make([][]float64, len(cs.data)),
+				ids:     subIDs(cs.ids, nil),
+				terms:   append([]string(nil), cs.terms...),
+				origins: append([]*origin(nil), cs.origins...),
+				meta:    append([]ColumnMeta(nil), cs.meta...),
+			}
+		}
+		if err := checkChunk(rslt, cs); err != nil {
+			return nil, fmt.Errorf("chunk %d: %v", k, err)
+		}
+
+		var nrow int
+		if len(cs.data) > 0 {
+			nrow = len(cs.data[0])
+		}
+		size += 8 * int64(nrow) * int64(len(cs.data))
+		if maxBytes > 0 && size > maxBytes {
+			return nil, fmt.Errorf("chunk %d: the collected data exceed %d bytes", k, maxBytes)
+		}
+
+		for j, x := range cs.data {
+			rslt.data[j] = append(rslt.data[j], x...)
+		}
+		if rslt.ids != nil {
+			rslt.ids = reflect.AppendSlice(reflect.ValueOf(rslt.ids), reflect.ValueOf(cs.ids)).Interface()
+		}
+	}
+
+	if rslt == nil {
+		return nil, fmt.Errorf("CollectChunks: there are no chunks")
+	}
+
+	return rslt, nil
+}
+
+// checkChunk returns an error if the chunk cs does not have the
+// columns and row identifiers of the collected chunks.
+func checkChunk(rslt, cs *ColSet) error {
+
+	if len(cs.names) != len(rslt.names) {
+		return fmt.Errorf("%d columns, expected %d", len(cs.names), len(rslt.names))
+	}
+	for j, na := range cs.names {
+		if na != rslt.names[j] {
+			return fmt.Errorf("column %d is '%s', expected '%s'", j, na, rslt.names[j])
+		}
+	}
+	if (cs.ids == nil) != (rslt.ids == nil) || (cs.ids != nil && reflect.TypeOf(cs.ids) != reflect.TypeOf(rslt.ids)) {
+		return fmt.Errorf("the row identifiers do not match those of the first chunk")
+	}
+
+	return nil
+}
+
+// numRows returns the number of rows in a DataSource.
+func numRows(src DataSource) int {
+
+	names := src.Names()
+	if len(names) == 0 {
+		return 0
+	}
+
+	switch x := src.Get(names[0]).(type) {
+	case []float64:
+		return len(x)
+	case []string:
+		return len(x)
+	case []int:
+		return len(x)
+	case []int64:
+		return len(x)
+	case []bool:
+		return len(x)
+	default:
+		return 0
+	}
+}
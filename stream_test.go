@@ -0,0 +1,326 @@
+package formula
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func chunkedData() ChunkSource {
+
+	names := []string{"x1", "x2", "x3", "x4"}
+	chunk1 := mustSource([]interface{}{
+		[]float64{0, 1, 2},
+		[]string{"0", "0", "0"},
+		[]string{"a", "b", "a"},
+		[]float64{-1, 0, 1},
+	}, names)
+	chunk2 := mustSource([]interface{}{
+		[]float64{3, 4},
+		[]string{"1", "1"},
+		[]string{"b", "a"},
+		[]float64{0, -1},
+	}, names)
+
+	return NewChunkSource(chunk1, chunk2)
+}
+
+func TestStream(t *testing.T) {
+
+	formulas := []string{"x1 + x2 + x3*x4"}
+	config := &Config{RefLevels: map[string]string{"x3": "a"}}
+
+	fp, err := NewMulti(formulas, simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Interrupt the first pass after one chunk, keeping only the
+	// serialized checkpoint.
+	s, err := NewStream(formulas, chunkedData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved []byte
+	s.OnCheckpoint = func(cp *Checkpoint) error {
+		saved, err = json.Marshal(cp)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("interrupted")
+	}
+	if err := s.Fit(); err == nil {
+		t.Fatal("expected interruption")
+	}
+
+	var cp Checkpoint
+	if err := json.Unmarshal(saved, &cp); err != nil {
+		t.Fatal(err)
+	}
+	if cp.Fitted || cp.Chunk != 1 || cp.NumObs != 3 {
+		t.Fatalf("unexpected checkpoint %+v", cp)
+	}
+
+	s, err = ResumeStream(formulas, chunkedData(), config, &cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var chunks []*ColSet
+	for {
+		cs, err := s.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, cs)
+
+		// Resume the second pass after every chunk.
+		s, err = ResumeStream(formulas, chunkedData(), config, s.Checkpoint())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(chunks) != 2 {
+		t.Fatalf("expected 2 chunks, got %d", len(chunks))
+	}
+
+	for j, na := range full.names {
+		if chunks[0].names[j] != na || chunks[1].names[j] != na {
+			t.Fatalf("column names do not match")
+		}
+		var x []float64
+		x = append(x, chunks[0].data[j]...)
+		x = append(x, chunks[1].data[j]...)
+		if !colSetEq(&ColSet{names: []string{na}, data: [][]float64{x}},
+			&ColSet{names: []string{na}, data: [][]float64{full.data[j]}}) {
+			t.Fatalf("column '%s' does not match", na)
+		}
+	}
+}
+
+func TestStreamRefLevel(t *testing.T) {
+
+	// The reference level of x2 is misspelled
+	config := &Config{RefLevels: map[string]string{"x3": "b", "x2": "O"}}
+	s, err := NewStream([]string{"x2 + x3"}, chunkedData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Fit(); err == nil {
+		t.Errorf("A reference level that does not occur should fail")
+	}
+
+	// The reference levels of x2 and C(x1, 4) are only seen in
+	// the second chunk, which is processed after resuming
+	config.RefLevels["x2"] = "1"
+	s, err = NewStream([]string{"x2 + C(x1, 4)"}, chunkedData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cps []*Checkpoint
+	s.OnCheckpoint = func(cp *Checkpoint) error {
+		cps = append(cps, cp)
+		return nil
+	}
+	if err := s.Fit(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = ResumeStream([]string{"x2 + C(x1, 4)"}, chunkedData(), config, cps[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Fit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := New("C(x1, 9)", simpleData(), nil); err == nil {
+		t.Errorf("A reference level that does not occur should fail")
+	}
+}
+
+// colSetIter produces the given ColSets as chunks.
+type colSetIter []*ColSet
+
+func (it *colSetIter) Next() (*ColSet, error) {
+	if len(*it) == 0 {
+		return nil, io.EOF
+	}
+	cs := (*it)[0]
+	*it = (*it)[1:]
+	return cs, nil
+}
+
+func TestCollectChunks(t *testing.T) {
+
+	formulas := []string{"x1 + x2 + x3*x4"}
+	config := &Config{RefLevels: map[string]string{"x3": "a"}}
+
+	fp, err := NewMulti(formulas, simpleData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := fp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewStream(formulas, chunkedData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err := CollectChunks(s, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !colSetEq(full, cs) {
+		t.Errorf("Expected: %v\nObserved: %v\n", full, cs)
+	}
+
+	// The first chunk has 3 rows and 6 columns
+	s, err = NewStream(formulas, chunkedData(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CollectChunks(s, 8*3*6); err == nil {
+		t.Errorf("memory budget should be exceeded")
+	}
+
+	it := &colSetIter{
+		NewColSet([]string{"a", "b"}, [][]float64{{1}, {2}}),
+		NewColSet([]string{"a", "c"}, [][]float64{{1}, {2}}),
+	}
+	if _, err := CollectChunks(it, 0); err == nil {
+		t.Errorf("inconsistent columns should fail")
+	}
+}
+
+func TestStreamStandardize(t *testing.T) {
+
+	formulas := []string{"x1 + x4"}
+	config := &Config{Recipe: &Recipe{Standardize: true}}
+
+	run := func(interrupt bool) []*ColSet {
+		s, err := NewStream(formulas, chunkedData(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if interrupt {
+			// Interrupt the first pass after one chunk, and
+			// resume from the serialized checkpoint.
+			var saved []byte
+			s.OnCheckpoint = func(cp *Checkpoint) error {
+				saved, err = json.Marshal(cp)
+				if err != nil {
+					return err
+				}
+				return fmt.Errorf("interrupted")
+			}
+			if err := s.Fit(); err == nil {
+				t.Fatal("expected interruption")
+			}
+			var cp Checkpoint
+			if err := json.Unmarshal(saved, &cp); err != nil {
+				t.Fatal(err)
+			}
+			s, err = ResumeStream(formulas, chunkedData(), config, &cp)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var chunks []*ColSet
+		for {
+			cs, err := s.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			chunks = append(chunks, cs)
+		}
+		return chunks
+	}
+
+	full := run(false)
+	resumed := run(true)
+	if len(full) != 2 || len(resumed) != 2 {
+		t.Fatalf("expected 2 chunks, got %d and %d", len(full), len(resumed))
+	}
+	for i := range full {
+		if !colSetEq(full[i], resumed[i]) {
+			t.Errorf("chunk %d does not match:\n%v\n%v", i, full[i].data, resumed[i].data)
+		}
+	}
+
+	// x1 has mean 2 over both chunks
+	if full[0].data[0][2] != 0 {
+		t.Errorf("x1 is not standardized: %v", full[0].data[0])
+	}
+}
+
+func TestStreamDateLayout(t *testing.T) {
+
+	// The layout is fixed by the first chunk, in which 01/13/2020
+	// can only be a month followed by a day
+	chunks := func() ChunkSource {
+		return NewChunkSource(
+			mustSource([]interface{}{[]string{"01/13/2020"}}, []string{"d"}),
+			mustSource([]interface{}{[]string{"01/02/2020"}}, []string{"d"}),
+		)
+	}
+	formulas := []string{"d"}
+	config := &Config{DateLayouts: []string{"02/01/2006", "01/02/2006"}}
+
+	s, err := NewStream(formulas, chunks(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved []byte
+	s.OnCheckpoint = func(cp *Checkpoint) error {
+		saved, err = json.Marshal(cp)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("interrupted")
+	}
+	if err := s.Fit(); err == nil {
+		t.Fatal("expected interruption")
+	}
+	var cp Checkpoint
+	if err := json.Unmarshal(saved, &cp); err != nil {
+		t.Fatal(err)
+	}
+	if cp.DateLayouts["d"] != "01/02/2006" {
+		t.Fatalf("unexpected layouts %v", cp.DateLayouts)
+	}
+
+	s, err = ResumeStream(formulas, chunks(), config, &cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var x []float64
+	for {
+		cs, err := s.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		x = append(x, cs.Data()[0]...)
+	}
+
+	// January 13 and January 2
+	jan1 := float64(1577836800)
+	day := float64(24 * 60 * 60)
+	if len(x) != 2 || x[0] != jan1+12*day || x[1] != jan1+day {
+		t.Errorf("unexpected dates %v", x)
+	}
+}
@@ -0,0 +1,77 @@
+package formula
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SyntaxError is returned when a formula can not be lexed or parsed.
+// The error message gives the position of the problem along with the
+// line of the formula containing it, marked with a caret, e.g.
+//
+//	"x1 + * x2": unexpected '*' at position 5
+//		x1 + * x2
+//		     ^
+type SyntaxError struct {
+
+	// The formula, after smart quotes and similar characters have
+	// been converted
+	Formula string
+
+	// Pos is the byte offset of the problem in Formula
+	Pos int
+
+	// Msg describes the problem
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+
+	if e.Formula == "" {
+		return fmt.Sprintf("%s at position %d", e.Msg, e.Pos)
+	}
+
+	pos := e.Pos
+	if pos > len(e.Formula) {
+		pos = len(e.Formula)
+	}
+
+	// The line containing the position
+	start := strings.LastIndex(e.Formula[0:pos], "\n") + 1
+	end := strings.Index(e.Formula[pos:], "\n")
+	if end == -1 {
+		end = len(e.Formula)
+	} else {
+		end += pos
+	}
+
+	// Tabs are kept so that the caret lines up with the line
+	var pad []rune
+	for _, r := range e.Formula[start:pos] {
+		if r != '\t' {
+			r = ' '
+		}
+		pad = append(pad, r)
+	}
+
+	return fmt.Sprintf("%q: %s at position %d\n\t%s\n\t%s^", e.Formula, e.Msg, e.Pos,
+		e.Formula[start:end], string(pad))
+}
+
+// syntaxError returns a SyntaxError at the given position of the
+// formula.  The formula is filled in by compileFormula if it is
+// empty.
+func syntaxError(fml string, pos int, format string, args ...interface{}) *SyntaxError {
+	return &SyntaxError{Formula: fml, Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// tokText returns the text of a token for use in error messages.
+func tokText(tok *token) string {
+	switch tok.symbol {
+	case comma:
+		return ","
+	case tilde:
+		return "~"
+	}
+	return strings.TrimSpace(renderTokens([]*token{tok}))
+}
@@ -0,0 +1,49 @@
+package formula
+
+import (
+	"testing"
+)
+
+func TestSyntaxError(t *testing.T) {
+
+	for _, tc := range []struct {
+		fml string
+		pos int
+		msg string
+	}{
+		{"x1 + * x2", 5, "unexpected '*'"},
+		{"x1 + x2 x3", 8, "missing operator before 'x3'"},
+		{"x1 + log(x2", 8, "unbalanced parentheses"},
+		{"x1 + (x2 + )", 11, "unexpected ')'"},
+		{"x1 +\n  x2 $ x3", 10, "unknown symbol '$'"},
+		{"x1 + f(x2, )", 11, "missing argument of function 'f'"},
+		{"x1 + \"a\"", 5, "string \"a\" is not allowed here"},
+		{"x1 + I(x2 + * 3)", 12, "unexpected '*' in I()"},
+		{"y ~ x1 ~ x2", 2, "'~' must separate a response from the terms"},
+		{"x1 + x2 +", 8, "missing operand after '+'"},
+		{"x1 + `x2", 5, "unterminated variable name"},
+	} {
+		_, err := New(tc.fml, simpleData(), nil)
+		se, ok := err.(*SyntaxError)
+		if !ok {
+			t.Errorf("%q: expected a syntax error, got %v", tc.fml, err)
+			continue
+		}
+		if se.Pos != tc.pos || se.Msg != tc.msg || se.Formula != tc.fml {
+			t.Errorf("%q: unexpected error %q at position %d", tc.fml, se.Msg, se.Pos)
+		}
+	}
+
+	_, err := New("x1 + * x2", simpleData(), nil)
+	exp := "\"x1 + * x2\": unexpected '*' at position 5\n\tx1 + * x2\n\t     ^"
+	if err.Error() != exp {
+		t.Errorf("Expected:\n%s\nObserved:\n%s", exp, err)
+	}
+
+	// The caret is placed on the line containing the problem
+	_, err = New("x1 +\n\tx2 + * x3", simpleData(), nil)
+	exp = "\"x1 +\\n\\tx2 + * x3\": unexpected '*' at position 11\n\t\tx2 + * x3\n\t\t     ^"
+	if err.Error() != exp {
+		t.Errorf("Expected:\n%s\nObserved:\n%s", exp, err)
+	}
+}
@@ -0,0 +1,203 @@
+package formula
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ConfigError is returned when a Parser or Stream is created with a
+// Config that has problems.  All problems that are found are
+// reported together.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "Invalid Config: " + strings.Join(e.Problems, "; ")
+}
+
+// validate checks the configuration of the parser, after the
+// formulas are compiled and before any data are coded.  The reference
+// levels are only checked if the parser has data.
+func (fp *Parser) validate() error {
+
+	var problems []string
+
+	// Functions that are nil
+	isNil := make(map[string]bool)
+	for na, f := range fp.funcs {
+		isNil[na] = isNil[na] || f == nil
+	}
+	for na, f := range fp.multiFuncs {
+		isNil[na] = isNil[na] || f == nil
+	}
+	for na, f := range fp.strFuncs {
+		isNil[na] = isNil[na] || f == nil
+	}
+	for na, f := range fp.catFuncs {
+		isNil[na] = isNil[na] || f == nil
+	}
+	var names []string
+	for na, ok := range isNil {
+		if ok {
+			names = append(names, na)
+		}
+	}
+	sort.Strings(names)
+	for _, na := range names {
+		problems = append(problems, fmt.Sprintf("function '%s' is nil", na))
+	}
+
+	var syms []string
+	for sym := range fp.binaryOps {
+		syms = append(syms, sym)
+	}
+	sort.Strings(syms)
+	for _, sym := range syms {
+		if err := checkOpSymbol(sym); err != nil {
+			problems = append(problems, err.Error())
+		} else if fp.binaryOps[sym].Func == nil {
+			problems = append(problems, fmt.Sprintf("operator '%s' is nil", sym))
+		}
+	}
+
+	if err := fp.parseNameTemplate(); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid name template: %v", err))
+	}
+
+	if fp.dupPolicy < DupSkip || fp.dupPolicy > DupRename {
+		problems = append(problems, fmt.Sprintf("unknown duplicates policy %d", fp.dupPolicy))
+	}
+
+	if fp.blockScaling < NoBlockScaling || fp.blockScaling > BlockUnitRange {
+		problems = append(problems, fmt.Sprintf("unknown block scaling %d", fp.blockScaling))
+	}
+
+	if fp.unknownLevels < UnknownZero || fp.unknownLevels > UnknownOther {
+		problems = append(problems, fmt.Sprintf("unknown policy for unseen levels %d", fp.unknownLevels))
+	}
+
+	if fp.refPolicy < RefExplicit || fp.refPolicy > RefLast {
+		problems = append(problems, fmt.Sprintf("unknown reference level policy %d", fp.refPolicy))
+	}
+
+	if fp.weightScaling < NoWeightScaling || fp.weightScaling > RelativeWeights {
+		problems = append(problems, fmt.Sprintf("unknown weight scaling %d", fp.weightScaling))
+	}
+
+	if fp.missingPolicy < MissingAsLevel || fp.missingPolicy > MissingError {
+		problems = append(problems, fmt.Sprintf("unknown missing value policy %d", fp.missingPolicy))
+	}
+
+	if fp.topLevels < 0 {
+		problems = append(problems, fmt.Sprintf("negative number of top levels %d", fp.topLevels))
+	} else if fp.topLevels > 0 && fp.minLevelCount > 0 {
+		problems = append(problems, "TopLevels and MinLevelCount can not both be set")
+	}
+
+	problems = append(problems, fp.validateContrasts()...)
+	problems = append(problems, fp.validateRecipe()...)
+	problems = append(problems, fp.validateEncoders()...)
+	problems = append(problems, fp.validateCoders()...)
+
+	if fp.RawData != nil {
+		problems = append(problems, fp.validateRefLevels()...)
+		if fp.rowID != "" && fp.RawData.Get(fp.rowID) == nil {
+			problems = append(problems, fmt.Sprintf("row identifier variable '%s' not found", fp.rowID))
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+
+	return nil
+}
+
+// validateContrasts returns the problems with the contrasts, which
+// must be known, and must have a reference level if they are sum or
+// Helmert contrasts, or ordered levels if they are polynomial
+// contrasts.  The ordered levels must be distinct.
+func (fp *Parser) validateContrasts() []string {
+
+	var names []string
+	for na := range fp.contrasts {
+		names = append(names, na)
+	}
+	for na := range fp.ordered {
+		if _, ok := fp.contrasts[na]; !ok {
+			names = append(names, na)
+		}
+	}
+	sort.Strings(names)
+
+	var problems []string
+	for _, na := range names {
+		if levels, ok := fp.ordered[na]; ok {
+			seen := make(map[string]bool)
+			for _, x := range levels {
+				if seen[x] {
+					problems = append(problems, fmt.Sprintf("level '%s' of ordered variable '%s' is repeated", x, na))
+				}
+				seen[x] = true
+			}
+		}
+		switch c := fp.contrast(na); c {
+		case TreatmentContrast:
+		case SumContrast, HelmertContrast:
+			if fp.refLevel(na) == "" && fp.refPolicy == RefExplicit {
+				problems = append(problems, fmt.Sprintf("contrast for '%s' requires a reference level", na))
+			}
+		case PolyContrast:
+			if len(fp.ordered[na]) < 2 {
+				problems = append(problems, fmt.Sprintf("polynomial contrast for '%s' requires at least two ordered levels", na))
+			}
+		default:
+			problems = append(problems, fmt.Sprintf("unknown contrast %d for '%s'", c, na))
+		}
+	}
+
+	return problems
+}
+
+// validateRefLevels returns the problems with the reference levels,
+// which must belong to variables in the data or to calls to C or a
+// CatFunc, and must be levels of string variables.
+func (fp *Parser) validateRefLevels() []string {
+
+	cats := make(map[string]bool)
+	for _, tok := range fp.catCalls() {
+		cats[tok.name] = true
+		cats[tok.args[0].name] = true
+	}
+
+	var names []string
+	for na := range fp.refLevels {
+		names = append(names, na)
+	}
+	sort.Strings(names)
+
+	var problems []string
+	for _, na := range names {
+		ref := fp.refLevels[na]
+		switch x := fp.get(fp.RawData, na).(type) {
+		case nil:
+			if !cats[na] {
+				problems = append(problems, fmt.Sprintf("reference level for unknown variable '%s'", na))
+			}
+		case []string:
+			// The codes given in Config.Codes were not
+			// learned from these data
+			if fp.fitted == nil && find(x, ref) == -1 {
+				problems = append(problems, fmt.Sprintf("reference level '%s' does not occur in variable '%s'", ref, na))
+			}
+		default:
+			if !cats[na] {
+				problems = append(problems, fmt.Sprintf("reference level for numeric variable '%s'", na))
+			}
+		}
+	}
+
+	return problems
+}
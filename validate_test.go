@@ -0,0 +1,46 @@
+package formula
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+
+	config := &Config{
+		RefLevels: map[string]string{"x3": "c", "x5": "a", "x1": "0", "C(x4)": "0"},
+		Funcs:     map[string]Func{"square": nil},
+		CatFuncs:  map[string]CatFunc{"bin": nil},
+	}
+	_, err := New("x1 + C(x4)", simpleData(), config)
+	cerr, ok := err.(*ConfigError)
+	if !ok {
+		t.Fatalf("Expected a ConfigError, got %v", err)
+	}
+	exp := []string{
+		"function 'bin' is nil",
+		"function 'square' is nil",
+		"reference level for numeric variable 'x1'",
+		"reference level 'c' does not occur in variable 'x3'",
+		"reference level for unknown variable 'x5'",
+	}
+	if !reflect.DeepEqual(cerr.Problems, exp) {
+		t.Errorf("Expected: %v\nObserved: %v\n", exp, cerr.Problems)
+	}
+
+	// The data are not checked by a Stream
+	config.Funcs = nil
+	config.CatFuncs = nil
+	if _, err := NewStream([]string{"x1"}, chunkedData(), config); err != nil {
+		t.Error(err)
+	}
+	config.Duplicates = DupPolicy(7)
+	if _, err := NewStream([]string{"x1"}, chunkedData(), config); err == nil {
+		t.Errorf("An unknown duplicates policy should fail")
+	}
+
+	config = &Config{RefLevels: map[string]string{"x3": "b", "x4": "0", "C(x1)": "2"}}
+	if _, err := New("x3 + C(x4) + C(x1)", simpleData(), config); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,109 @@
+package formula
+
+import (
+	"fmt"
+	"sort"
+)
+
+// VersionedSource is a DataSource that reports a version of each of
+// its variables, e.g. a schema version or an ETag of the definition
+// of a column in an upstream system.  A version identifies how the
+// values of a variable are produced, not the values themselves, so
+// training and scoring data have the same versions unless the
+// variable was redefined.
+//
+// A parser records the versions of the variables in the data that its
+// codes were learned from.  Parse returns an error if a variable in
+// the data has a version that differs from the recorded version,
+// which usually indicates a silent change upstream, e.g. a unit or a
+// coding that changed.  Variables without a version, i.e. for which
+// Version returns "", are not checked.
+type VersionedSource interface {
+	DataSource
+
+	// Version returns the version of a variable, or "" if it is
+	// unknown.
+	Version(string) string
+}
+
+// versionedSource attaches versions to a DataSource.
+type versionedSource struct {
+	DataSource
+	versions map[string]string
+}
+
+// Version returns the version of a variable.
+func (s *versionedSource) Version(na string) string {
+	return s.versions[na]
+}
+
+// WithVersions returns a VersionedSource with the data of src and the
+// given versions of its variables, keyed by variable name.
+func WithVersions(src DataSource, versions map[string]string) VersionedSource {
+	return &versionedSource{DataSource: src, versions: versions}
+}
+
+// sourceVersion returns the version of a variable in src, or "" if src
+// does not report versions.
+func sourceVersion(src DataSource, na string) string {
+	if vs, ok := src.(VersionedSource); ok {
+		return vs.Version(na)
+	}
+	return ""
+}
+
+// updateVersions records the versions of the variables in src that
+// have not been seen before.
+func (fp *Parser) updateVersions(src DataSource) {
+
+	if _, ok := src.(VersionedSource); !ok {
+		return
+	}
+
+	for _, na := range src.Names() {
+		if _, ok := fp.versions[na]; ok {
+			continue
+		}
+		if v := sourceVersion(src, na); v != "" {
+			fp.versions[na] = v
+		}
+	}
+}
+
+// checkVersions returns an error if a variable of the data has a
+// version that differs from the version recorded when the codes were
+// learned.
+func (fp *Parser) checkVersions() error {
+
+	if _, ok := fp.RawData.(VersionedSource); !ok || len(fp.versions) == 0 {
+		return nil
+	}
+
+	var names []string
+	for na := range fp.versions {
+		names = append(names, na)
+	}
+	sort.Strings(names)
+
+	for _, na := range names {
+		v := sourceVersion(fp.RawData, na)
+		if v != "" && v != fp.versions[na] {
+			return fmt.Errorf("variable '%s' has version '%s', but the codes were learned from version '%s'", na, v, fp.versions[na])
+		}
+	}
+
+	return nil
+}
+
+// Versions returns the versions of the variables in the data that the
+// codes were learned from, keyed by variable name, see
+// VersionedSource.
+func (fp *Parser) Versions() map[string]string {
+
+	versions := make(map[string]string, len(fp.versions))
+	for na, v := range fp.versions {
+		versions[na] = v
+	}
+
+	return versions
+}
@@ -0,0 +1,62 @@
+package formula
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestVersions(t *testing.T) {
+
+	names := []string{"x1", "x3"}
+	data := []interface{}{
+		[]float64{1, 2, 3},
+		[]string{"a", "b", "a"},
+	}
+	src := WithVersions(mustSource(data, names), map[string]string{"x1": "v1", "x3": "v7"})
+
+	fp, err := New("x1 + x3", src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	if exp := map[string]string{"x1": "v1", "x3": "v7"}; !reflect.DeepEqual(fp.Versions(), exp) {
+		t.Errorf("Expected versions %v, observed %v", exp, fp.Versions())
+	}
+
+	// Data without versions, or with the same versions, are
+	// accepted
+	for _, versions := range []map[string]string{nil, {"x3": "v7"}} {
+		if _, err := fp.WithData(WithVersions(mustSource(data, names), versions)).Parse(); err != nil {
+			t.Errorf("%v: %v", versions, err)
+		}
+	}
+	if _, err := fp.WithData(mustSource(data, names)).Parse(); err != nil {
+		t.Error(err)
+	}
+
+	// A changed version is rejected
+	src2 := WithVersions(mustSource(data, names), map[string]string{"x1": "v1", "x3": "v8"})
+	if _, err := fp.WithData(src2).Parse(); err == nil {
+		t.Errorf("Expected an error for a changed version")
+	}
+
+	// The versions are saved with a pipeline
+	p := &Pipeline{Formula: &FormulaStep{Formulas: []string{"x1 + x3"}}}
+	if _, err := p.Fit(src); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := p.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	p2 := &Pipeline{Formula: &FormulaStep{Formulas: []string{"x1 + x3"}}}
+	if err := p2.Load(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p2.Transform(src2); err == nil {
+		t.Errorf("Expected an error for a changed version after loading")
+	}
+}